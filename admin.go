@@ -0,0 +1,652 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DiscordOAuthAuthorizeUrl = "https://discord.com/api/oauth2/authorize"
+	DiscordOAuthTokenUrl     = "https://discord.com/api/oauth2/token"
+	DiscordApiUrl            = "https://discord.com/api"
+
+	sessionCookie    = "session"
+	sessionTTL       = time.Hour * 12
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = time.Minute * 10
+
+	// Longest command prefix we let a guild pick
+	maxPrefixLength = 3
+)
+
+// AdminSession is a logged in Discord user. What they can manage is checked against Discord on every request, so
+// losing a role takes effect straight away.
+type AdminSession struct {
+	Id        string `json:"-"`
+	UserId    string `json:"user_id"`
+	Username  string `json:"username"`
+	CsrfToken string `json:"csrf_token"`
+}
+
+type discordUser struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// adminTemplates are added to the dashboard's set so they share its layout
+var adminTemplates = template.Must(dashboardTemplates.Parse(`
+{{define "admin"}}{{template "header" .}}
+<form method="post" action="/admin/logout">Logged in as {{.Session.Username}}. <input type="hidden" name="csrf" value="{{.Session.CsrfToken}}"><button>Log out</button></form>
+<table>
+<tr><th>Guilds you manage</th></tr>
+{{range .Guilds}}<tr><td><a href="/admin/guilds/{{.Id}}">{{.Name}}</a></td></tr>
+{{else}}<tr><td class="muted">You don't manage any guilds the bot is in</td></tr>
+{{end}}</table>
+{{template "footer" .}}{{end}}
+
+{{define "admin_guild"}}{{template "header" .}}
+{{if .Message}}<p><strong>{{.Message}}</strong></p>{{end}}
+<h2>Settings</h2>
+<form method="post" action="/admin/guilds/{{.Guild.ID}}/settings">
+<input type="hidden" name="csrf" value="{{.Session.CsrfToken}}">
+<p><label>Broadcast channel <select name="broadcast_channel">
+<option value="">Not set</option>
+{{range .Channels}}<option value="{{.ID}}"{{if eq .ID $.BroadcastChannel}} selected{{end}}>#{{.Name}}</option>{{end}}
+</select></label></p>
+<p><label>Command prefix <input name="prefix" value="{{.Settings.CommandPrefix}}" size="3" maxlength="3"></label></p>
+<p><label>Home system <input name="home" value="{{.Home}}" placeholder="Not set"></label></p>
+<p><label>Routes <select name="route_preference">
+{{range .RoutePreferences}}<option value="{{.}}"{{if eq . $.RoutePreference}} selected{{end}}>{{.}}</option>{{end}}
+</select></label></p>
+<p>Factions, none for all:
+{{range .Factions}}<label><input type="checkbox" name="factions" value="{{.Id}}"{{if .Selected}} checked{{end}}> {{.Name}}</label> {{end}}</p>
+<p>Admin roles:
+{{range .Roles}}<label><input type="checkbox" name="admin_roles" value="{{.Id}}"{{if .Selected}} checked{{end}}> {{.Name}}</label> {{end}}</p>
+<p>FC roles, admins can always run fleets:
+{{range .FcRoles}}<label><input type="checkbox" name="fc_roles" value="{{.Id}}"{{if .Selected}} checked{{end}}> {{.Name}}</label> {{end}}</p>
+<button>Save settings</button>
+</form>
+<h2>Instructions</h2>
+{{range .Instructions}}<form method="post" action="/admin/guilds/{{$.Guild.ID}}/instructions">
+<input type="hidden" name="csrf" value="{{$.Session.CsrfToken}}">
+<input type="hidden" name="name" value="{{.Name}}">
+<h3>{{.Name}}</h3>
+<textarea name="text" rows="8" cols="100">{{.Text}}</textarea><br>
+<button>Save {{.Name}}</button> <button formaction="/admin/guilds/{{$.Guild.ID}}/instructions/delete">Delete {{.Name}}</button>
+</form>
+{{end}}
+<form method="post" action="/admin/guilds/{{.Guild.ID}}/instructions">
+<input type="hidden" name="csrf" value="{{.Session.CsrfToken}}">
+<h3>New instructions</h3>
+<p><label>Name <input name="name"></label></p>
+<textarea name="text" rows="8" cols="100"></textarea><br>
+<button>Add instructions</button>
+</form>
+{{template "footer" .}}{{end}}
+`))
+
+type adminOption struct {
+	Id       string
+	Name     string
+	Selected bool
+}
+
+type adminInstructions struct {
+	Name string
+	Text string
+}
+
+func oauthStateKey(state string) string {
+	return fmt.Sprintf("bot:oauth:state:%v", state)
+}
+
+func sessionKey(id string) string {
+	return fmt.Sprintf("bot:session:%v", id)
+}
+
+func discordOAuthEnabled() bool {
+	return len(os.Getenv("DISCORD_CLIENT_ID")) > 0 && len(os.Getenv("DISCORD_CLIENT_SECRET")) > 0 && len(os.Getenv("HOSTED_URL")) > 0
+}
+
+func discordRedirectUrl() string {
+	return strings.TrimSuffix(os.Getenv("HOSTED_URL"), "/") + "/discord/auth"
+}
+
+// ValidPrefix keeps prefixes short and free of spaces so commands still split the same way
+func ValidPrefix(prefix string) bool {
+	if len(prefix) <= 0 || len(prefix) > maxPrefixLength {
+		return false
+	}
+
+	for _, r := range prefix {
+		if unicode.IsSpace(r) || unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (server *Server) GetSession(id string) *AdminSession {
+	cmd := server.Redis.Get(sessionKey(id))
+
+	if len(id) <= 0 || cmd.Err() != nil {
+		return nil
+	}
+
+	var session AdminSession
+	if err := json.Unmarshal([]byte(cmd.Val()), &session); err != nil {
+		return nil
+	}
+
+	session.Id = id
+	return &session
+}
+
+func (server *Server) SaveSession(session *AdminSession) error {
+	bytes, err := json.Marshal(session)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Redis.Set(sessionKey(session.Id), string(bytes), sessionTTL).Err()
+}
+
+// CanManage is true for the guild owner, anyone Discord lets manage the server, and the bot's own admins
+func (server *Server) CanManage(session *AdminSession, guildId string) bool {
+	if !server.Guilds.Has(guildId) {
+		return false
+	}
+
+	return server.CanManageGuild(guildId, session.UserId) || server.IsGuildAdmin(guildId, session.UserId)
+}
+
+// setOAuthStateCookie ties the login to this browser, an empty state clears it
+func setOAuthStateCookie(c *gin.Context, state string) {
+	maxAge := int(oauthStateTTL / time.Second)
+	if len(state) <= 0 {
+		maxAge = -1
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/discord",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// discordApiGet calls the Discord api as the logged in user
+func discordApiGet(path, accessToken string, v interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, DiscordApiUrl+path, nil)
+
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Discord answered %v with %v", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// exchangeDiscordCode swaps the OAuth code for an access token
+func exchangeDiscordCode(code string) (string, error) {
+	form := url.Values{}
+	form.Set("client_id", os.Getenv("DISCORD_CLIENT_ID"))
+	form.Set("client_secret", os.Getenv("DISCORD_CLIENT_SECRET"))
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", discordRedirectUrl())
+
+	resp, err := http.PostForm(DiscordOAuthTokenUrl, form)
+
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Discord token request failed. Status: %v", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+
+	if len(token.AccessToken) <= 0 {
+		return "", errors.New("Discord didn't send an access token")
+	}
+
+	return token.AccessToken, nil
+}
+
+// adminLogin sends the user to Discord to log in
+func (server *Server) adminLogin(c *gin.Context) {
+	if !discordOAuthEnabled() {
+		c.String(http.StatusNotFound, "Discord login isn't set up on this bot")
+		return
+	}
+
+	state, err := randomToken(24)
+
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unable to start login")
+		return
+	}
+
+	server.Redis.Set(oauthStateKey(state), "1", oauthStateTTL)
+	setOAuthStateCookie(c, state)
+
+	query := url.Values{}
+	query.Set("client_id", os.Getenv("DISCORD_CLIENT_ID"))
+	query.Set("redirect_uri", discordRedirectUrl())
+	query.Set("response_type", "code")
+	query.Set("scope", "identify")
+	query.Set("state", state)
+
+	c.Redirect(http.StatusFound, DiscordOAuthAuthorizeUrl+"?"+query.Encode())
+}
+
+// discordAuth is where Discord sends people back to, both after adding the bot and after logging in to the panel
+func (server *Server) discordAuth(c *gin.Context) {
+	state := c.Query("state")
+
+	if len(state) <= 0 {
+		c.String(http.StatusOK, "Added to discord. Enjoy...")
+		return
+	}
+
+	// The state has to come back to the browser that started the login, so nobody can log someone else in as them
+	cookie, _ := c.Cookie(oauthStateCookie)
+	setOAuthStateCookie(c, "")
+
+	if subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+		RequestLog(c).Warn("Discord login finished in a browser that didn't start it", nil)
+		c.String(http.StatusBadRequest, "This login was started in a different browser, please try again")
+		return
+	}
+
+	// States only work once
+	if server.Redis.Del(oauthStateKey(state)).Val() <= 0 {
+		c.String(http.StatusBadRequest, "This login has expired, please try again")
+		return
+	}
+
+	accessToken, err := exchangeDiscordCode(c.Query("code"))
+
+	if err != nil {
+		RequestLog(c).Warn("Unable to exchange Discord code", LogFields{"error": err})
+		c.String(http.StatusBadGateway, "Unable to log in with Discord, please try again")
+		return
+	}
+
+	var user discordUser
+
+	if err = discordApiGet("/users/@me", accessToken, &user); err != nil {
+		RequestLog(c).Warn("Unable to look up Discord user", LogFields{"error": err})
+		c.String(http.StatusBadGateway, "Unable to log in with Discord, please try again")
+		return
+	}
+
+	id, err := randomToken(32)
+	csrf, csrfErr := randomToken(32)
+
+	if err != nil || csrfErr != nil {
+		c.String(http.StatusInternalServerError, "Unable to log in, please try again")
+		return
+	}
+
+	session := &AdminSession{
+		Id:        id,
+		UserId:    user.Id,
+		Username:  user.Username,
+		CsrfToken: csrf,
+	}
+
+	if err = server.SaveSession(session); err != nil {
+		RequestLog(c).Error("Unable to save session", LogFields{"user": user.Id, "error": err})
+		c.String(http.StatusInternalServerError, "Unable to log in, please try again")
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionTTL / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	c.Redirect(http.StatusFound, "/admin")
+}
+
+// requireSession sends anyone without a session to log in, and checks the CSRF token on anything that changes state
+func (server *Server) requireSession(c *gin.Context) {
+	id, _ := c.Cookie(sessionCookie)
+	session := server.GetSession(id)
+
+	if session == nil {
+		if c.Request.Method == http.MethodGet {
+			c.Redirect(http.StatusFound, "/admin/login")
+		} else {
+			c.String(http.StatusUnauthorized, "Please log in again")
+		}
+		c.Abort()
+		return
+	}
+
+	if c.Request.Method != http.MethodGet && subtle.ConstantTimeCompare([]byte(c.PostForm("csrf")), []byte(session.CsrfToken)) != 1 {
+		c.String(http.StatusForbidden, "This form has expired, please reload the page")
+		c.Abort()
+		return
+	}
+
+	c.Set("session", session)
+	c.Next()
+}
+
+func adminSession(c *gin.Context) *AdminSession {
+	return c.MustGet("session").(*AdminSession)
+}
+
+// managedGuild loads the guild in the url, stopping the request if the user can't manage it
+func (server *Server) managedGuild(c *gin.Context) (*discordgo.Guild, bool) {
+	guild, ok := server.Guilds.Guild(c.Param("id"))
+
+	if !ok || !server.CanManage(adminSession(c), guild.ID) {
+		c.String(http.StatusForbidden, "You can't manage that guild")
+		return nil, false
+	}
+
+	return guild, true
+}
+
+func (server *Server) adminIndex(c *gin.Context) {
+	session := adminSession(c)
+	guilds := make([]*DashboardGuild, 0)
+
+	for _, guildId := range server.Guilds.IDs() {
+		if server.CanManage(session, guildId) {
+			guilds = append(guilds, &DashboardGuild{Id: guildId, Name: server.Guilds.Name(guildId)})
+		}
+	}
+
+	sort.Slice(guilds, func(i, j int) bool {
+		return guilds[i].Name < guilds[j].Name
+	})
+
+	renderDashboard(c, "admin", gin.H{
+		"Title":   "Admin",
+		"Session": session,
+		"Guilds":  guilds,
+	})
+}
+
+func (server *Server) adminGuild(c *gin.Context) {
+	guild, ok := server.managedGuild(c)
+
+	if !ok {
+		return
+	}
+
+	server.renderAdminGuild(c, guild, c.Query("message"))
+}
+
+func (server *Server) renderAdminGuild(c *gin.Context, guild *discordgo.Guild, message string) {
+	settings := server.GetGuildSettings(guild.ID)
+	broadcast, _ := GetBroadcastChannelForGuild(server.Redis, guild.ID)
+
+	channels := make([]*discordgo.Channel, 0)
+	for _, channel := range guild.Channels {
+		if channel.Type == discordgo.ChannelTypeGuildText {
+			channels = append(channels, channel)
+		}
+	}
+
+	factions := make([]*adminOption, 0, len(knownFactions))
+	for id, name := range knownFactions {
+		factions = append(factions, &adminOption{Id: strconv.Itoa(id), Name: name, Selected: settings.WantsFaction(id) && len(settings.Factions) > 0})
+	}
+
+	sort.Slice(factions, func(i, j int) bool {
+		return factions[i].Name < factions[j].Name
+	})
+
+	roles := make([]*adminOption, 0, len(guild.Roles))
+	fcRoles := make([]*adminOption, 0, len(guild.Roles))
+	for _, role := range guild.Roles {
+		if role.ID == guild.ID {
+			// @everyone
+			continue
+		}
+
+		roles = append(roles, &adminOption{Id: role.ID, Name: role.Name, Selected: Exists(settings.AdminRoles, role.ID)})
+		fcRoles = append(fcRoles, &adminOption{Id: role.ID, Name: role.Name, Selected: Exists(settings.FcRoles, role.ID)})
+	}
+
+	instructions := make([]*adminInstructions, 0)
+	for _, name := range server.GetInstructionNames(guild.ID) {
+		text, _ := server.GetInstructionsText(guild.ID, name)
+		instructions = append(instructions, &adminInstructions{Name: name, Text: text})
+	}
+
+	renderDashboard(c, "admin_guild", gin.H{
+		"Title":            guild.Name,
+		"Message":          message,
+		"Session":          adminSession(c),
+		"Guild":            guild,
+		"Settings":         settings,
+		"Channels":         channels,
+		"BroadcastChannel": broadcast,
+		"Home":             server.homeField(settings),
+		"RoutePreference":  string(settings.RouteOptions().preference()),
+		"RoutePreferences": []string{string(RouteShortest), string(RouteSecure), string(RouteInsecure), string(RouteSecureOnly)},
+		"Factions":         factions,
+		"Roles":            roles,
+		"FcRoles":          fcRoles,
+		"Instructions":     instructions,
+	})
+}
+
+// homeField is what goes in the home system box, empty when there isn't one
+func (server *Server) homeField(settings *GuildSettings) string {
+	if settings.HomeSystemId <= 0 {
+		return ""
+	}
+
+	return server.systemNames([]int{settings.HomeSystemId})
+}
+
+// adminRedirect goes back to the guild page with a message, so reloading doesn't post the form again
+func adminRedirect(c *gin.Context, guildId, message string) {
+	c.Redirect(http.StatusSeeOther, fmt.Sprintf("/admin/guilds/%v?message=%v", guildId, url.QueryEscape(message)))
+}
+
+// guildRoles keeps the ids that are actually roles in the guild
+func guildRoles(guild *discordgo.Guild, ids []string) []string {
+	roles := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		for _, role := range guild.Roles {
+			if role.ID == id {
+				roles = append(roles, id)
+			}
+		}
+	}
+
+	return roles
+}
+
+func (server *Server) adminSaveSettings(c *gin.Context) {
+	guild, ok := server.managedGuild(c)
+
+	if !ok {
+		return
+	}
+
+	settings := server.GetGuildSettings(guild.ID)
+
+	prefix := strings.TrimSpace(c.PostForm("prefix"))
+	if !ValidPrefix(prefix) {
+		adminRedirect(c, guild.ID, fmt.Sprintf("Prefixes are 1 to %d symbols", maxPrefixLength))
+		return
+	}
+	settings.Prefix = prefix
+
+	preference, err := ParseRoutePreference(c.PostForm("route_preference"))
+	if err != nil {
+		adminRedirect(c, guild.ID, err.Error())
+		return
+	}
+	settings.RoutePreference = string(preference)
+
+	// An empty field clears the home, an unchanged one is left alone even if the name can't be looked up now
+	if home := strings.TrimSpace(c.PostForm("home")); len(home) <= 0 {
+		settings.HomeSystemId = 0
+	} else if !strings.EqualFold(home, server.homeField(settings)) {
+		system := server.FindSystemByName(home)
+
+		if system == nil {
+			adminRedirect(c, guild.ID, fmt.Sprintf("Couldn't find a system called %v", home))
+			return
+		}
+
+		settings.HomeSystemId = system.SystemId
+	}
+
+	settings.Factions = make([]int, 0)
+	for _, value := range c.PostFormArray("factions") {
+		if id, err := strconv.Atoi(value); err == nil {
+			if _, known := knownFactions[id]; known {
+				settings.Factions = append(settings.Factions, id)
+			}
+		}
+	}
+
+	settings.AdminRoles = guildRoles(guild, c.PostFormArray("admin_roles"))
+	settings.FcRoles = guildRoles(guild, c.PostFormArray("fc_roles"))
+
+	if channelId := c.PostForm("broadcast_channel"); len(channelId) > 0 {
+		if owner, err := server.Guilds.GuildIdForChannel(channelId); err != nil || owner != guild.ID {
+			adminRedirect(c, guild.ID, "That channel isn't in this guild")
+			return
+		}
+
+		SetBroadcastChannelForGuild(server.Redis, guild.ID, channelId)
+	} else {
+		DeleteBroadcastChannelForGuild(server.Redis, guild.ID)
+	}
+
+	if err = server.SaveGuildSettings(guild.ID, settings); err != nil {
+		RequestLog(c).Error("Unable to save settings from the admin panel", LogFields{"guild": guild.ID, "error": err})
+		adminRedirect(c, guild.ID, "Unable to save settings")
+		return
+	}
+
+	RequestLog(c).Info("Settings changed from the admin panel", LogFields{"guild": guild.ID, "user": adminSession(c).UserId})
+	adminRedirect(c, guild.ID, "Settings saved")
+}
+
+func (server *Server) adminSaveInstructions(c *gin.Context) {
+	guild, ok := server.managedGuild(c)
+
+	if !ok {
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(c.PostForm("name")))
+	text := strings.TrimSpace(strings.Replace(c.PostForm("text"), "\r\n", "\n", -1))
+
+	if !instructionsName.MatchString(name) || len(text) <= 0 {
+		adminRedirect(c, guild.ID, "Instructions need a name of lower case letters, numbers, - and _ and some text")
+		return
+	}
+
+	if current, ok := server.GetInstructionsText(guild.ID, name); ok && current == text {
+		adminRedirect(c, guild.ID, fmt.Sprintf("Instructions %v haven't changed", name))
+		return
+	}
+
+	number, err := server.SaveInstructions(guild.ID, name, text, adminSession(c).UserId)
+
+	if err != nil {
+		adminRedirect(c, guild.ID, fmt.Sprintf("Unable to save instructions. Error: %v", err))
+		return
+	}
+
+	adminRedirect(c, guild.ID, fmt.Sprintf("Instructions %v saved (v%d)", name, number))
+}
+
+func (server *Server) adminDeleteInstructions(c *gin.Context) {
+	guild, ok := server.managedGuild(c)
+
+	if !ok {
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSpace(c.PostForm("name")))
+	server.DeleteInstructions(guild.ID, name)
+	adminRedirect(c, guild.ID, fmt.Sprintf("Instructions %v deleted", name))
+}
+
+func (server *Server) adminLogout(c *gin.Context) {
+	server.Redis.Del(sessionKey(adminSession(c).Id))
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	c.Redirect(http.StatusSeeOther, "/dashboard")
+}
+
+// SetupAdminRoutes puts the panel under /admin, everything but the login needs a session
+func (server *Server) SetupAdminRoutes(router *gin.Engine) {
+	router.GET("/admin/login", server.adminLogin)
+
+	admin := router.Group("/admin", server.requireSession)
+	admin.GET("", server.adminIndex)
+	admin.GET("/guilds/:id", server.adminGuild)
+	admin.POST("/guilds/:id/settings", server.adminSaveSettings)
+	admin.POST("/guilds/:id/instructions", server.adminSaveInstructions)
+	admin.POST("/guilds/:id/instructions/delete", server.adminDeleteInstructions)
+	admin.POST("/logout", server.adminLogout)
+}
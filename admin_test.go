@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestDiscordAuthNeedsStateCookie(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/discord/auth", server.discordAuth)
+
+	server.Redis.Set(oauthStateKey("state"), "1", oauthStateTTL)
+
+	for _, cookie := range []string{"", "other"} {
+		request := httptest.NewRequest("GET", "/discord/auth?state=state&code=code", nil)
+		if len(cookie) > 0 {
+			request.AddCookie(&http.Cookie{Name: oauthStateCookie, Value: cookie})
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("cookie %q: status = %v, want 400", cookie, recorder.Code)
+		}
+	}
+
+	// A login from another browser mustn't use up the state for the one that started it
+	if server.Redis.Exists(oauthStateKey("state")).Val() != 1 {
+		t.Error("state was used up by a browser that didn't start the login")
+	}
+}
+
+func TestHomeField(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	if home := server.homeField(&GuildSettings{}); home != "" {
+		t.Errorf("unset home = %q, want empty", home)
+	}
+
+	if home := server.homeName(&GuildSettings{}); home != "Not set" {
+		t.Errorf("unset home name = %q", home)
+	}
+}
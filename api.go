@@ -0,0 +1,479 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultApiRateLimit = 60
+
+	apiKeysKey = "bot:api_keys"
+
+	defaultApiPageLength = 50
+	maxApiPageLength     = 100
+
+	// How long a stream ticket can wait before it's used
+	streamTicketTTL = time.Minute
+)
+
+// ApiKey is who a key was handed out to. Only the sha256 of the key itself is stored.
+type ApiKey struct {
+	Name      string    `json:"name"`
+	GuildId   string    `json:"guild_id"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ApiSystem struct {
+	Id       int     `json:"id"`
+	Name     string  `json:"name"`
+	Security float32 `json:"security"`
+}
+
+type ApiIncursion struct {
+	ConstellationId   int          `json:"constellation_id"`
+	ConstellationName string       `json:"constellation_name"`
+	RegionName        string       `json:"region_name"`
+	StagingSystem     *ApiSystem   `json:"staging_system"`
+	InfestedSystems   []*ApiSystem `json:"infested_systems"`
+	FactionId         int          `json:"faction_id"`
+	FactionName       string       `json:"faction_name"`
+	Type              string       `json:"type"`
+	State             string       `json:"state"`
+	Influence         float32      `json:"influence"`
+	HasBoss           bool         `json:"has_boss"`
+	// -1 when there is no route with the preference asked for
+	Jumps int `json:"jumps"`
+}
+
+// ApiPage wraps lists that can be paged through
+type ApiPage struct {
+	Data    interface{} `json:"data"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"per_page"`
+	Total   int         `json:"total"`
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiRateKey(hash string, window int64) string {
+	return fmt.Sprintf("bot:api:rate:%v:%v", hash, window)
+}
+
+// streamTicketKey holds the hash of the key a ticket was handed out for
+func streamTicketKey(ticket string) string {
+	return fmt.Sprintf("bot:api:ticket:%v", ticket)
+}
+
+func apiError(c *gin.Context, status int, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": message})
+}
+
+// requireApiKey checks the key and counts the request against it, one fixed window per minute. Keys only come in
+// headers, browsers can't set those on EventSource or WebSocket connections so they use a stream ticket instead.
+func (server *Server) requireApiKey(c *gin.Context) {
+	key := c.GetHeader("X-API-Key")
+
+	if len(key) <= 0 {
+		key = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	}
+
+	hash := ""
+	if len(key) > 0 {
+		hash = hashApiKey(key)
+	} else if ticket := c.Query("ticket"); len(ticket) > 0 {
+		// Tickets work once and not for long, so it doesn't matter if one ends up in a log
+		hash, _ = takeKey(server.Redis, streamTicketKey(ticket))
+
+		if len(hash) <= 0 {
+			apiError(c, http.StatusUnauthorized, "Unknown or used ticket")
+			return
+		}
+
+		c.Set("api_ticket", true)
+	}
+
+	if len(hash) <= 0 {
+		apiError(c, http.StatusUnauthorized, "Missing API key, send it in the X-API-Key header")
+		return
+	}
+
+	if !server.Redis.HExists(apiKeysKey, hash).Val() {
+		apiError(c, http.StatusUnauthorized, "Unknown API key")
+		return
+	}
+
+	now := time.Now().Unix()
+	window := now / 60
+	rateKey := apiRateKey(hash, window)
+
+	count, err := server.Redis.Incr(rateKey).Result()
+
+	if err != nil {
+		apiError(c, http.StatusServiceUnavailable, "Unable to check rate limit")
+		return
+	}
+
+	if count == 1 {
+		server.Redis.Expire(rateKey, time.Minute*2)
+	}
+
+	limit := int64(server.Config.ApiRateLimit)
+	remaining := limit - count
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	c.Header("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+	c.Header("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+
+	if count > limit {
+		c.Header("Retry-After", strconv.FormatInt((window+1)*60-now, 10))
+		apiError(c, http.StatusTooManyRequests, "Rate limit exceeded")
+		return
+	}
+
+	c.Set("api_key", hash)
+	c.Next()
+}
+
+// apiStreamTicket is POST /api/v1/events/tickets, a ticket a browser can open one event stream with
+func (server *Server) apiStreamTicket(c *gin.Context) {
+	// Otherwise one leaked ticket could be swapped for new ones forever
+	if c.GetBool("api_ticket") {
+		apiError(c, http.StatusUnauthorized, "Tickets have to be asked for with the API key")
+		return
+	}
+
+	ticket, err := randomToken(24)
+
+	if err == nil {
+		err = server.Redis.Set(streamTicketKey(ticket), c.GetString("api_key"), streamTicketTTL).Err()
+	}
+
+	if err != nil {
+		apiError(c, http.StatusServiceUnavailable, "Unable to create a ticket")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"ticket": ticket, "expires_in": int(streamTicketTTL / time.Second)})
+}
+
+// apiPaging reads page and per_page, keeping per_page within limits
+func apiPaging(c *gin.Context) (int, int) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	perPage, err := strconv.Atoi(c.DefaultQuery("per_page", strconv.Itoa(defaultApiPageLength)))
+	if err != nil || perPage < 1 {
+		perPage = defaultApiPageLength
+	}
+
+	if perPage > maxApiPageLength {
+		perPage = maxApiPageLength
+	}
+
+	return page, perPage
+}
+
+// findSystem takes a system id or name
+func (server *Server) findSystem(value string) *EsiSystem {
+	if id, err := strconv.Atoi(value); err == nil {
+		return server.GetSystem(id)
+	}
+
+	return server.FindSystemByName(value)
+}
+
+// findConstellationId takes a constellation id or name
+func (server *Server) findConstellationId(value string) (int, bool) {
+	if id, err := strconv.Atoi(value); err == nil {
+		return id, true
+	}
+
+	if constellation := server.Universe.ConstellationByName(value); constellation != nil {
+		return constellation.Id, true
+	}
+
+	bytes := postEndpointResult("/latest/universe/ids", []string{value})
+
+	if bytes == nil {
+		return 0, false
+	}
+
+	var ids struct {
+		Constellations []*EsiName `json:"constellations"`
+	}
+
+	if err := json.Unmarshal(bytes, &ids); err != nil || len(ids.Constellations) <= 0 {
+		return 0, false
+	}
+
+	return ids.Constellations[0].Id, true
+}
+
+func (server *Server) apiSystem(id int) *ApiSystem {
+	system := &ApiSystem{Id: id}
+
+	if esi := server.GetSystem(id); esi != nil {
+		system.Name = esi.Name
+		system.Security = esi.SecurityStatus
+	}
+
+	return system
+}
+
+// apiIncursions is /api/v1/incursions?origin=<system>&preference=<route preference>
+func (server *Server) apiIncursions(c *gin.Context) {
+	options := server.Config.DefaultRouteOptions()
+	origin := server.Config.DefaultStagingSystemId
+
+	if value := c.Query("origin"); len(value) > 0 {
+		system := server.findSystem(value)
+
+		if system == nil {
+			apiError(c, http.StatusBadRequest, fmt.Sprintf("Unknown origin system %q", value))
+			return
+		}
+
+		origin = system.SystemId
+	}
+
+	if value := c.Query("preference"); len(value) > 0 {
+		preference, err := ParseRoutePreference(value)
+
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		options.Preference = preference
+	}
+
+	incursions, _ := server.GetIncursions()
+	result := make([]*ApiIncursion, 0, len(incursions))
+
+	for _, incursion := range incursions {
+		api := &ApiIncursion{
+			ConstellationId:   incursion.ConstellationId,
+			ConstellationName: incursion.ConsellationName,
+			StagingSystem:     server.apiSystem(incursion.StagingSolarSystemId),
+			InfestedSystems:   make([]*ApiSystem, 0, len(incursion.InfestedSolarSystems)),
+			FactionId:         incursion.FactionId,
+			FactionName:       incursion.FactionName,
+			Type:              incursion.Type,
+			State:             incursion.State,
+			Influence:         incursion.Influence,
+			HasBoss:           incursion.HasBoss,
+			Jumps:             JumpCount(server.GetRouteWithOptions(origin, incursion.StagingSolarSystemId, options)),
+		}
+
+		if constellation := server.GetConstellationForIncursion(incursion); constellation != nil {
+			api.RegionName = constellation.RegionName
+		}
+
+		for _, id := range incursion.InfestedSolarSystems {
+			api.InfestedSystems = append(api.InfestedSystems, server.apiSystem(id))
+		}
+
+		result = append(result, api)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"origin":     server.apiSystem(origin),
+		"preference": options.preference(),
+		"data":       result,
+	})
+}
+
+// apiIncursionHistory is every event we have for the constellation, newest first
+func (server *Server) apiIncursionHistory(c *gin.Context) {
+	id, ok := server.findConstellationId(c.Param("constellation"))
+
+	if !ok {
+		apiError(c, http.StatusNotFound, fmt.Sprintf("Unknown constellation %q", c.Param("constellation")))
+		return
+	}
+
+	events := make([]*IncursionEvent, 0)
+	for _, event := range server.GetEvents(0, maxEvents) {
+		if event.ConstellationId == id {
+			events = append(events, event)
+		}
+	}
+
+	page, perPage := apiPaging(c)
+	start := (page - 1) * perPage
+	end := start + perPage
+
+	if start > len(events) {
+		start = len(events)
+	}
+
+	if end > len(events) {
+		end = len(events)
+	}
+
+	c.JSON(http.StatusOK, &ApiPage{
+		Data:    events[start:end],
+		Page:    page,
+		PerPage: perPage,
+		Total:   len(events),
+	})
+}
+
+func (server *Server) apiEvents(c *gin.Context) {
+	page, perPage := apiPaging(c)
+
+	c.JSON(http.StatusOK, &ApiPage{
+		Data:    server.GetEvents((page-1)*perPage, perPage),
+		Page:    page,
+		PerPage: perPage,
+		Total:   server.CountEvents(),
+	})
+}
+
+func (server *Server) SetupApiRoutes(router *gin.Engine) {
+	api := router.Group("/api/v1", server.requireApiKey)
+	api.GET("/incursions", server.apiIncursions)
+	api.GET("/incursions/:constellation/history", server.apiIncursionHistory)
+	api.GET("/events", server.apiEvents)
+	api.POST("/events/tickets", server.apiStreamTicket)
+	api.GET("/events/stream", server.limitStreams, server.streamEventsSSE)
+	api.GET("/events/ws", server.limitStreams, server.streamEventsWebsocket)
+}
+
+// GetApiKeys is every key handed out for the guild, by hash
+func (server *Server) GetApiKeys(guildId string) map[string]*ApiKey {
+	keys := make(map[string]*ApiKey)
+
+	for hash, raw := range server.Redis.HGetAll(apiKeysKey).Val() {
+		var key ApiKey
+
+		if err := json.Unmarshal([]byte(raw), &key); err != nil {
+			Log.Warn("Unable to parse API key", LogFields{"guild": guildId, "error": err})
+			continue
+		}
+
+		if key.GuildId == guildId {
+			keys[hash] = &key
+		}
+	}
+
+	return keys
+}
+
+// HandleApiKey is !apikey create <name> | list | revoke <name>. New keys are DM'd since they can't be shown again.
+func (server *Server) HandleApiKey(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	args := commandArgs(message)
+
+	if len(args) <= 0 {
+		server.SendMessage(message.ChannelID, "Usage: !apikey create <name> | list | revoke <name>")
+		return
+	}
+
+	keys := server.GetApiKeys(guildId)
+
+	switch strings.ToLower(args[0]) {
+	case "create":
+		if len(args) < 2 {
+			server.SendMessage(message.ChannelID, "Usage: !apikey create <name>")
+			return
+		}
+
+		name := strings.Join(args[1:], " ")
+
+		for _, key := range keys {
+			if strings.EqualFold(key.Name, name) {
+				server.SendMessage(message.ChannelID, fmt.Sprintf("There is already a key called %v", name))
+				return
+			}
+		}
+
+		secret, err := randomToken(32)
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, "Unable to create a key")
+			return
+		}
+
+		bytes, err := json.Marshal(&ApiKey{
+			Name:      name,
+			GuildId:   guildId,
+			CreatedBy: message.Author.ID,
+			CreatedAt: time.Now().UTC(),
+		})
+
+		if err == nil {
+			err = server.Redis.HSet(apiKeysKey, hashApiKey(secret), string(bytes)).Err()
+		}
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to save the key. Error: %v", err))
+			return
+		}
+
+		err = server.SendDirectMessage(message.Author, fmt.Sprintf("API key %v: `%v`\nSend it in the X-API-Key header. It won't be shown again, revoke it with !apikey revoke %v if it leaks.", name, secret, name))
+
+		// Nobody has the secret, so the key is no use to anyone
+		if err != nil {
+			server.Redis.HDel(apiKeysKey, hashApiKey(secret))
+			server.SendMessage(message.ChannelID, "I couldn't DM you the key so it wasn't created. Allow DMs from server members and try again")
+			return
+		}
+
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Created API key %v, check your DMs", name))
+	case "list":
+		if len(keys) <= 0 {
+			server.SendMessage(message.ChannelID, "No API keys have been created")
+			return
+		}
+
+		lines := make([]string, 0, len(keys))
+		for _, key := range keys {
+			lines = append(lines, fmt.Sprintf("%v - created by %v on %v", key.Name, server.PilotName(key.CreatedBy), key.CreatedAt.Format(eveTimeLayout)))
+		}
+
+		server.SendMessage(message.ChannelID, strings.Join(lines, "\n"))
+	case "revoke":
+		if len(args) < 2 {
+			server.SendMessage(message.ChannelID, "Usage: !apikey revoke <name>")
+			return
+		}
+
+		name := strings.Join(args[1:], " ")
+
+		for hash, key := range keys {
+			if strings.EqualFold(key.Name, name) {
+				server.Redis.HDel(apiKeysKey, hash)
+				server.SendMessage(message.ChannelID, fmt.Sprintf("Revoked API key %v", key.Name))
+				return
+			}
+		}
+
+		server.SendMessage(message.ChannelID, fmt.Sprintf("No API key called %v", name))
+	default:
+		server.SendMessage(message.ChannelID, "Usage: !apikey create <name> | list | revoke <name>")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Cache is a two tier cache, memory first and Redis second, for a single namespace of keys.
+// Values are stored as json in both tiers so every caller decodes its own copy and
+// nobody ends up sharing (and mutating) the same pointer from different goroutines.
+type Cache struct {
+	Namespace string
+	TTL       time.Duration
+
+	redis   *redis.Client
+	lock    sync.RWMutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewCache creates a cache whose Redis keys are prefixed with namespace. A TTL of 0 never expires.
+func NewCache(redis *redis.Client, namespace string, ttl time.Duration) *Cache {
+	return &Cache{
+		Namespace: namespace,
+		TTL:       ttl,
+		redis:     redis,
+		entries:   make(map[string]cacheEntry),
+	}
+}
+
+func (entry cacheEntry) expired(now time.Time) bool {
+	return !entry.expires.IsZero() && now.After(entry.expires)
+}
+
+func (cache *Cache) redisKey(key string) string {
+	return fmt.Sprintf("%v:%v", cache.Namespace, key)
+}
+
+func (cache *Cache) expiry() time.Time {
+	if cache.TTL <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(cache.TTL)
+}
+
+// Get decodes the cached value for key into value and returns whether it was found in either tier
+func (cache *Cache) Get(key interface{}, value interface{}) bool {
+	k := fmt.Sprint(key)
+
+	cache.lock.RLock()
+	entry, ok := cache.entries[k]
+	cache.lock.RUnlock()
+
+	if ok && !entry.expired(time.Now()) {
+		cacheLookups.Inc(cache.Namespace, "memory")
+		return json.Unmarshal(entry.value, value) == nil
+	}
+
+	if cache.redis == nil {
+		cacheLookups.Inc(cache.Namespace, "miss")
+		return false
+	}
+
+	cmd := cache.redis.Get(cache.redisKey(k))
+
+	if cmd.Err() != nil {
+		cacheLookups.Inc(cache.Namespace, "miss")
+		return false
+	}
+
+	raw := []byte(cmd.Val())
+
+	if err := json.Unmarshal(raw, value); err != nil {
+		Log.Warn("Unable to decode cached value", LogFields{"key": cache.redisKey(k), "error": err})
+		cacheLookups.Inc(cache.Namespace, "miss")
+		return false
+	}
+
+	cacheLookups.Inc(cache.Namespace, "redis")
+
+	// Promote to memory so we don't go back to Redis for a while
+	cache.lock.Lock()
+	cache.entries[k] = cacheEntry{value: raw, expires: cache.expiry()}
+	cache.lock.Unlock()
+
+	return true
+}
+
+// Set stores value in both tiers. It's ok if Redis fails, we'll just have to look it up again after a restart.
+func (cache *Cache) Set(key interface{}, value interface{}) {
+	k := fmt.Sprint(key)
+
+	raw, err := json.Marshal(value)
+
+	if err != nil {
+		Log.Error("Unable to encode value", LogFields{"key": cache.redisKey(k), "error": err})
+		return
+	}
+
+	cache.lock.Lock()
+	cache.entries[k] = cacheEntry{value: raw, expires: cache.expiry()}
+	cache.lock.Unlock()
+
+	if cache.redis != nil {
+		cache.redis.Set(cache.redisKey(k), string(raw), cache.TTL)
+	}
+}
+
+// Delete removes key from both tiers
+func (cache *Cache) Delete(key interface{}) {
+	k := fmt.Sprint(key)
+
+	cache.lock.Lock()
+	delete(cache.entries, k)
+	cache.lock.Unlock()
+
+	if cache.redis != nil {
+		cache.redis.Del(cache.redisKey(k))
+	}
+}
+
+// Prune drops expired entries from memory. Redis takes care of itself.
+func (cache *Cache) Prune() {
+	now := time.Now()
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for k, entry := range cache.entries {
+		if entry.expired(now) {
+			delete(cache.entries, k)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type cachedThing struct {
+	Name string
+}
+
+func TestCacheMemoryOnly(t *testing.T) {
+	cache := NewCache(nil, "test", 0)
+
+	var thing cachedThing
+	if cache.Get(1, &thing) {
+		t.Fatal("Get found a key that was never set")
+	}
+
+	cache.Set(1, cachedThing{Name: "Jita"})
+
+	if !cache.Get(1, &thing) || thing.Name != "Jita" {
+		t.Fatalf("Get = %+v, want Jita", thing)
+	}
+
+	cache.Delete(1)
+
+	if cache.Get(1, &thing) {
+		t.Error("Get found a deleted key")
+	}
+}
+
+func TestCacheCopiesValues(t *testing.T) {
+	cache := NewCache(nil, "test", 0)
+	cache.Set(1, &cachedThing{Name: "Jita"})
+
+	var first, second cachedThing
+	cache.Get(1, &first)
+	first.Name = "Amarr"
+	cache.Get(1, &second)
+
+	if second.Name != "Jita" {
+		t.Errorf("changing one caller's copy changed the cache, got %v", second.Name)
+	}
+}
+
+func TestCacheTTLExpiry(t *testing.T) {
+	client, stop := newTestRedis(t)
+	defer stop()
+
+	cache := NewCache(client, "test", time.Millisecond*50)
+	cache.Set(1, cachedThing{Name: "Jita"})
+
+	var thing cachedThing
+	if !cache.Get(1, &thing) {
+		t.Fatal("Get missed a fresh key")
+	}
+
+	time.Sleep(time.Millisecond * 120)
+
+	if cache.Get(1, &thing) {
+		t.Error("Get found a key past its TTL")
+	}
+
+	if client.Exists("test:1").Val() != 0 {
+		t.Error("Redis kept a key past its TTL")
+	}
+}
+
+func TestCachePruneDropsExpiredEntries(t *testing.T) {
+	cache := NewCache(nil, "test", time.Millisecond*10)
+	cache.Set(1, cachedThing{Name: "Jita"})
+
+	time.Sleep(time.Millisecond * 30)
+	cache.Prune()
+
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	if len(cache.entries) != 0 {
+		t.Errorf("Prune left %d expired entries", len(cache.entries))
+	}
+}
+
+func TestCacheNamespaceIsolation(t *testing.T) {
+	client, stop := newTestRedis(t)
+	defer stop()
+
+	systems := NewCache(client, SystemCacheNamespace, 0)
+	names := NewCache(client, NameCacheNamespace, 0)
+
+	systems.Set(30000142, cachedThing{Name: "Jita"})
+
+	var thing cachedThing
+	if names.Get(30000142, &thing) {
+		t.Error("a key set in one namespace was found in another")
+	}
+
+	if client.Get(SystemCacheNamespace+":30000142").Err() != nil {
+		t.Error("Redis key wasn't prefixed with the namespace")
+	}
+
+	// A fresh cache for the same namespace only has Redis to go on
+	if !NewCache(client, SystemCacheNamespace, 0).Get(30000142, &thing) || thing.Name != "Jita" {
+		t.Errorf("same namespace didn't find the key in Redis, got %+v", thing)
+	}
+}
+
+func TestCacheRedisPromotion(t *testing.T) {
+	client, stop := newTestRedis(t)
+	defer stop()
+
+	NewCache(client, "test", 0).Set(1, cachedThing{Name: "Jita"})
+
+	// Like after a restart, memory is empty but Redis still has it
+	cache := NewCache(client, "test", 0)
+
+	var thing cachedThing
+	if !cache.Get(1, &thing) || thing.Name != "Jita" {
+		t.Fatalf("Get = %+v, want Jita from Redis", thing)
+	}
+
+	cache.lock.RLock()
+	_, promoted := cache.entries["1"]
+	cache.lock.RUnlock()
+
+	if !promoted {
+		t.Fatal("value read from Redis wasn't promoted to memory")
+	}
+
+	// With Redis gone, the memory tier still answers
+	client.Del("test:1")
+
+	if !cache.Get(1, &thing) || thing.Name != "Jita" {
+		t.Errorf("promoted value wasn't served from memory, got %+v", thing)
+	}
+}
+
+func TestCacheConcurrentAccess(t *testing.T) {
+	client, stop := newTestRedis(t)
+	defer stop()
+
+	cache := NewCache(client, "test", time.Millisecond*20)
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wait.Add(1)
+
+		go func(worker int) {
+			defer wait.Done()
+
+			for i := 0; i < 50; i++ {
+				key := i % 5
+				cache.Set(key, cachedThing{Name: fmt.Sprintf("%d-%d", worker, i)})
+
+				var thing cachedThing
+				cache.Get(key, &thing)
+
+				if i%10 == 0 {
+					cache.Delete(key)
+					cache.Prune()
+				}
+			}
+		}(worker)
+	}
+
+	wait.Wait()
+}
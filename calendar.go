@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	icsTimeLayout = "20060102T150405Z"
+
+	// Lines longer than this are folded, RFC 5545 counts octets
+	icsLineLength = 75
+
+	// Fleets don't have an end time, this is long enough to block out the evening
+	fleetCalendarLength = time.Hour * 2
+)
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`)
+
+func calendarTokenKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:calendar_token", guildId)
+}
+
+// CalendarToken keeps the calendar url hard to guess, since fleets aren't something we want to hand out to everyone
+func (server *Server) CalendarToken(guildId string, reset bool) (string, error) {
+	if !reset {
+		if token, err := server.Redis.Get(calendarTokenKey(guildId)).Result(); err == nil && len(token) > 0 {
+			return token, nil
+		}
+	}
+
+	token, err := randomToken(24)
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, server.Redis.Set(calendarTokenKey(guildId), token, 0).Err()
+}
+
+func calendarUrl(guildId, token string) string {
+	return fmt.Sprintf("%v/calendar/%v.ics?token=%v", strings.TrimSuffix(os.Getenv("HOSTED_URL"), "/"), guildId, url.QueryEscape(token))
+}
+
+// calendarDomain goes on the end of every UID so they can't clash with another calendar's
+func calendarDomain() string {
+	if hosted, err := url.Parse(os.Getenv("HOSTED_URL")); err == nil && len(hosted.Hostname()) > 0 {
+		return hosted.Hostname()
+	}
+
+	return "incursion-discord-bot"
+}
+
+func icsTime(t time.Time) string {
+	return t.UTC().Format(icsTimeLayout)
+}
+
+// writeIcsLine escapes nothing, it only folds the line and ends it with the CRLF calendars insist on
+func writeIcsLine(buffer *bytes.Buffer, line string) {
+	limit := icsLineLength
+
+	for len(line) > limit {
+		cut := limit
+
+		// Don't split a character in half
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+
+		buffer.WriteString(line[:cut])
+		buffer.WriteString("\r\n ")
+		line = line[cut:]
+
+		// Continuation lines lose one to the leading space
+		limit = icsLineLength - 1
+	}
+
+	buffer.WriteString(line)
+	buffer.WriteString("\r\n")
+}
+
+func writeIcsText(buffer *bytes.Buffer, name, value string) {
+	writeIcsLine(buffer, name+":"+icsEscaper.Replace(value))
+}
+
+// BuildCalendar is an iCalendar file of the guild's fleets and the respawn windows. UIDs only depend on the
+// fleet or despawn they come from, so calendar clients update events instead of adding them again.
+func BuildCalendar(name string, fleets []*Fleet, windows []*RespawnWindow, pilotName func(string) string, now time.Time) []byte {
+	var buffer bytes.Buffer
+	domain := calendarDomain()
+	stamp := icsTime(now)
+
+	writeIcsLine(&buffer, "BEGIN:VCALENDAR")
+	writeIcsLine(&buffer, "VERSION:2.0")
+	writeIcsLine(&buffer, "PRODID:-//incursion-discord-bot//Fleets and respawns//EN")
+	writeIcsLine(&buffer, "CALSCALE:GREGORIAN")
+	writeIcsLine(&buffer, "METHOD:PUBLISH")
+	writeIcsText(&buffer, "X-WR-CALNAME", name)
+	writeIcsLine(&buffer, "X-WR-TIMEZONE:UTC")
+
+	for _, fleet := range fleets {
+		description := fmt.Sprintf("FC: %v\nDoctrine: %v\nSigned up: %d", pilotName(fleet.FcId), fleet.Doctrine, len(fleet.Signups))
+
+		writeIcsLine(&buffer, "BEGIN:VEVENT")
+		writeIcsLine(&buffer, fmt.Sprintf("UID:fleet-%v-%d@%v", fleet.GuildId, fleet.Id, domain))
+		writeIcsLine(&buffer, "DTSTAMP:"+stamp)
+		writeIcsLine(&buffer, "DTSTART:"+icsTime(fleet.StartsAt))
+		writeIcsLine(&buffer, "DTEND:"+icsTime(fleet.StartsAt.Add(fleetCalendarLength)))
+		writeIcsText(&buffer, "SUMMARY", fmt.Sprintf("Fleet #%d: %v", fleet.Id, fleet.Incursion))
+		writeIcsText(&buffer, "DESCRIPTION", description)
+		writeIcsLine(&buffer, "END:VEVENT")
+	}
+
+	for _, window := range windows {
+		description := fmt.Sprintf("The %v incursion in %v (%v) despawned at %v EVE time. Its replacement should spawn somewhere in this window.", window.FactionName, window.ConstellationName, window.RegionName, window.DespawnedAt.UTC().Format(eveTimeLayout))
+
+		writeIcsLine(&buffer, "BEGIN:VEVENT")
+		writeIcsLine(&buffer, fmt.Sprintf("UID:respawn-%d@%v", window.DespawnEventId, domain))
+		writeIcsLine(&buffer, "DTSTAMP:"+stamp)
+		writeIcsLine(&buffer, "DTSTART:"+icsTime(window.Opens))
+		writeIcsLine(&buffer, "DTEND:"+icsTime(window.Closes))
+		writeIcsText(&buffer, "SUMMARY", fmt.Sprintf("%v incursion respawn window", window.FactionName))
+		writeIcsText(&buffer, "DESCRIPTION", description)
+		// A day long window shouldn't show people as busy
+		writeIcsLine(&buffer, "TRANSP:TRANSPARENT")
+		writeIcsLine(&buffer, "END:VEVENT")
+	}
+
+	writeIcsLine(&buffer, "END:VCALENDAR")
+
+	return buffer.Bytes()
+}
+
+// guildCalendar is /calendar/<guild>.ics?token=<token>
+func (server *Server) guildCalendar(c *gin.Context) {
+	guildId := strings.TrimSuffix(c.Param("guild"), ".ics")
+	token := c.Query("token")
+
+	expected, err := server.Redis.Get(calendarTokenKey(guildId)).Result()
+
+	if err != nil || len(token) <= 0 || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+		c.String(http.StatusNotFound, "No such calendar")
+		return
+	}
+
+	name := "Incursion fleets"
+	if guildName := server.Guilds.Name(guildId); len(guildName) > 0 {
+		name = fmt.Sprintf("%v fleets", guildName)
+	}
+
+	calendar := BuildCalendar(name, server.GetFleets(guildId), server.GetRespawnWindows(), server.PilotName, time.Now())
+
+	c.Header("Content-Disposition", fmt.Sprintf("inline; filename=%v.ics", guildId))
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", calendar)
+}
+
+// HandleCalendar is !calendar, which DMs the calendar link, or !calendar reset for admins to revoke the old link
+func (server *Server) HandleCalendar(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args := commandArgs(message)
+	reset := len(args) > 0 && strings.ToLower(args[0]) == "reset"
+
+	var guildId string
+
+	if reset {
+		var ok bool
+		if guildId, ok = server.guildAdminCheck(logger, message); !ok {
+			return
+		}
+	} else {
+		var err error
+		if guildId, err = server.GetGuildIdForChannel(message.ChannelID); err != nil {
+			server.SendMessage(message.ChannelID, "Calendars only work from a server channel")
+			return
+		}
+	}
+
+	token, err := server.CalendarToken(guildId, reset)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to set up the calendar. Error: %v", err))
+		return
+	}
+
+	if err = server.SendDirectMessage(message.Author, fmt.Sprintf("Subscribe to this in your calendar app for fleets and respawn windows, please don't share it outside the corp:\n%v", calendarUrl(guildId, token))); err != nil {
+		server.SendMessage(message.ChannelID, "I couldn't DM you the calendar link. Allow DMs from server members and try again")
+		return
+	}
+
+	if reset {
+		server.SendMessage(message.ChannelID, "The old calendar link no longer works, check your DMs for the new one")
+	} else {
+		server.SendMessage(message.ChannelID, "Check your DMs for the calendar link")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestBuildCalendar(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	starts := time.Date(2026, 3, 2, 19, 30, 0, 0, time.UTC)
+
+	fleets := []*Fleet{{
+		Id:        7,
+		GuildId:   "guild",
+		FcId:      "fc",
+		Incursion: "Alpha; the one, with the \\ boss",
+		Doctrine:  "Shiny",
+		StartsAt:  starts,
+		Signups:   []*FleetSignup{{UserId: "a"}, {UserId: "b"}},
+	}}
+
+	windows := []*RespawnWindow{{
+		DespawnEventId:    42,
+		FactionName:       "Sansha's Nation",
+		ConstellationName: "Beta",
+		RegionName:        "Test Region",
+		DespawnedAt:       now.Add(-time.Hour * 20),
+		Opens:             now.Add(-time.Hour * 8),
+		Closes:            now.Add(time.Hour * 16),
+	}}
+
+	pilotName := func(userId string) string {
+		return "Pilot " + userId
+	}
+
+	calendar := string(BuildCalendar("Test Guild", fleets, windows, pilotName, now))
+
+	if !strings.HasPrefix(calendar, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(calendar, "END:VCALENDAR\r\n") {
+		t.Fatalf("calendar isn't wrapped in VCALENDAR:\n%v", calendar)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(calendar, "\r\n"), "\r\n")
+
+	for _, line := range lines {
+		if len(line) > icsLineLength {
+			t.Errorf("line is %d octets: %q", len(line), line)
+		}
+
+		if strings.Contains(line, "\n") {
+			t.Errorf("line has a bare newline: %q", line)
+		}
+	}
+
+	// Put folded lines back together to check what they say
+	unfolded := strings.Replace(calendar, "\r\n ", "", -1)
+
+	for _, want := range []string{
+		"X-WR-CALNAME:Test Guild\r\n",
+		"UID:fleet-guild-7@",
+		"DTSTAMP:20260301T120000Z\r\n",
+		"DTSTART:20260302T193000Z\r\n",
+		"DTEND:20260302T213000Z\r\n",
+		`SUMMARY:Fleet #7: Alpha\; the one\, with the \\ boss` + "\r\n",
+		`DESCRIPTION:FC: Pilot fc\nDoctrine: Shiny\nSigned up: 2` + "\r\n",
+		"UID:respawn-42@",
+		"DTSTART:20260301T040000Z\r\n",
+		"DTEND:20260302T040000Z\r\n",
+		"SUMMARY:Sansha's Nation incursion respawn window\r\n",
+		"TRANSP:TRANSPARENT\r\n",
+	} {
+		if !strings.Contains(unfolded, want) {
+			t.Errorf("calendar is missing %q", want)
+		}
+	}
+
+	if strings.Count(calendar, "BEGIN:VEVENT") != 2 || strings.Count(calendar, "END:VEVENT") != 2 {
+		t.Errorf("want 2 events:\n%v", calendar)
+	}
+
+	// Building it again later keeps the same UIDs, so clients update events instead of duplicating them
+	again := string(BuildCalendar("Test Guild", fleets, windows, pilotName, now.Add(time.Hour)))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "UID:") && !strings.Contains(again, line) {
+			t.Errorf("UID changed between builds: %q", line)
+		}
+	}
+}
+
+func TestWriteIcsLineKeepsCharactersWhole(t *testing.T) {
+	var buffer bytes.Buffer
+	line := "SUMMARY:" + strings.Repeat("é", 100)
+
+	writeIcsLine(&buffer, line)
+	folded := strings.TrimSuffix(buffer.String(), "\r\n")
+
+	for _, part := range strings.Split(folded, "\r\n") {
+		if len(part) > icsLineLength {
+			t.Errorf("line is %d octets", len(part))
+		}
+
+		if !utf8.ValidString(part) {
+			t.Errorf("line splits a character: %q", part)
+		}
+	}
+
+	if strings.Replace(folded, "\r\n ", "", -1) != line {
+		t.Error("unfolding didn't give back the line")
+	}
+}
@@ -1,185 +1,194 @@
-package main
-
-import (
-	"bytes"
-	"fmt"
-	"github.com/bwmarrin/discordgo"
-	"log"
-	"strings"
-)
-
-type DiscordCommand = func(*discordgo.Session, *discordgo.MessageCreate)
-
-type CommandCenter struct {
-	Commands map[string]DiscordCommand
-}
-
-// TODO: I dislike this global variable
-var commandCenter CommandCenter
-
-func (server *Server) RegisterCommands() {
-	commandCenter.Commands = make(map[string]DiscordCommand)
-	commandCenter.Commands["!incursions"] = server.HandleIncursion
-	commandCenter.Commands["!status"] = server.HandleTqStatus
-	commandCenter.Commands["!instructions"] = server.GetInstructions
-	commandCenter.Commands["!setinstructions"] = server.SetInstructions
-	commandCenter.Commands["!setadmin"] = server.SetAdmin
-	commandCenter.Commands["!removeadmin"] = server.RemoveAdmin
-	commandCenter.Commands["!setbroadcast"] = server.SetBroadcastChannel
-	commandCenter.Commands["!broadcast"] = server.TestBroadcast
-}
-
-func (commandCenter *CommandCenter) ProcessCommand(command string, session *discordgo.Session, message *discordgo.MessageCreate) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Error when processing command! %v\n", r)
-		}
-	}()
-
-	if commandCenter.Commands[command] != nil {
-		commandCenter.Commands[command](session, message)
-	}
-}
-
-func (server *Server) HandleIncursion(session *discordgo.Session, message *discordgo.MessageCreate) {
-	incursions, _ := server.GetIncursions()
-
-	buffer := bytes.NewBufferString("")
-	for _, inc := range incursions {
-		server.GetDefaultIncurionsMessage(inc, buffer)
-	}
-
-	if buffer.Len() <= 0 {
-		buffer.WriteString("No Null or Low Sec Incursions... Go Krab!")
-	}
-
-	_, err := session.ChannelMessageSend(message.ChannelID, buffer.String())
-
-	if err != nil {
-		log.Print(err)
-	}
-}
-
-func (server *Server) HandleTqStatus(session *discordgo.Session, message *discordgo.MessageCreate) {
-	log.Printf("Retrieving Tranquility Status")
-
-	tq := GetTqStatus()
-
-	if tq == nil {
-		session.ChannelMessageSend(message.ChannelID, "Tranquility is offline.")
-		return
-	}
-
-	session.ChannelMessageSend(message.ChannelID, fmt.Sprintf("Tranquility is online with %v players.", tq.Players))
-}
-
-func (server *Server) GetInstructions(session *discordgo.Session, message *discordgo.MessageCreate) {
-	guildId, err := GetGuildIdForChannel(message.ChannelID)
-
-	if err != nil {
-		log.Printf("Unable to get instructions. %v", err)
-		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintainer of this bot.", err))
-		return
-	}
-
-	cmd := server.Redis.Get(fmt.Sprintf("bot:%v:instructions", guildId))
-	if cmd.Err() != nil {
-		log.Printf("Unable to get instructions. Error: %v\n", cmd.Err())
-		server.SendDirectMessage(message.Author, "No instructions are set")
-		return
-	}
-
-	server.SendDirectMessage(message.Author, cmd.Val())
-}
-
-func (server *Server) SetInstructions(session *discordgo.Session, message *discordgo.MessageCreate) {
-
-	guildId, err := GetGuildIdForChannel(message.ChannelID)
-
-	if err != nil {
-		log.Printf("Unable to set instructions. %v", err)
-		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintiner of this bot.", err))
-		return
-	}
-
-	admins := server.GetAdminsForGuild(guildId)
-
-	if !Exists(admins, message.Author.ID) {
-		// Invalid admin
-		server.SendMessage(message.ChannelID, "Please don't try to set instructions if you aren't authorized")
-		return
-	}
-
-	instructions := strings.Replace(message.Content, "!setinstructions", "", -1)
-
-	cmd := server.Redis.Set(fmt.Sprintf("bot:%v:instructions", guildId), instructions, 0)
-
-	if cmd.Err() != nil {
-		log.Printf("Error setting instructions %v\n", cmd.Err())
-		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to set instructions. Error: %v", cmd.Err()))
-		return
-	}
-
-	server.SendMessage(message.ChannelID, fmt.Sprintf(`Instructions set to "%v"`, instructions))
-}
-
-func (server *Server) SetAdmin(session *discordgo.Session, message *discordgo.MessageCreate) {
-	adminId := strings.TrimSpace(strings.Replace(message.Content, "!setadmin", "", -1))
-
-	guildId, err := GetGuildIdForChannel(message.ChannelID)
-
-	if err != nil {
-		log.Printf("Unable to set admin!. %v\n", err)
-		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintainer of this bot.", err))
-		return
-	}
-
-	server.Redis.SAdd(fmt.Sprintf("incursions:%v:admins", guildId), adminId)
-
-	server.SendMessage(message.ChannelID, fmt.Sprintf("<@%v> added as admin", adminId))
-}
-
-func (server *Server) RemoveAdmin(session *discordgo.Session, message *discordgo.MessageCreate) {
-	adminId := strings.TrimSpace(strings.Replace(message.Content, "!removeadmin", "", -1))
-
-	guildId, err := GetGuildIdForChannel(message.ChannelID)
-
-	if err != nil {
-		log.Printf("Unable to remove admin!. %v\n", err)
-		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintainer of this bot.", err))
-		return
-	}
-
-	server.Redis.SRem(fmt.Sprintf("incursions:%v:admins", guildId), adminId)
-
-	server.SendMessage(message.ChannelID, fmt.Sprintf("<@%v> removed as admin", adminId))
-}
-
-func (server *Server) SetBroadcastChannel(session *discordgo.Session, message *discordgo.MessageCreate) {
-	channelId := strings.Replace(message.Content, "!setbroadcast", "", -1)
-	channelId = strings.TrimSpace(channelId)
-
-	wasSet := false
-
-	// Have to look through all channels we can see
-	for id, guild := range Guilds {
-		for _, channel := range guild.Channels {
-			if channel.ID == channelId {
-				wasSet = true
-				SetBroadcastChannelForGuild(server.Redis, id, channelId)
-			}
-		}
-	}
-
-	if wasSet {
-		server.SendMessage(message.ChannelID, fmt.Sprintf("Broadcast channel was set to %v", channelId))
-	} else {
-		server.SendMessage(message.ChannelID, "Could not find channel ID in any of my registered servers. Please try again")
-	}
-}
-
-func (server *Server) TestBroadcast(session *discordgo.Session, message *discordgo.MessageCreate) {
-	msg := strings.Replace(message.Content, "!broadcast", "", -1)
-
-	server.BroadcastMessage(msg)
-}
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+	"time"
+)
+
+// DiscordCommand handles one command. The logger carries the command's correlation id.
+type DiscordCommand = func(*Logger, *discordgo.Session, *discordgo.MessageCreate)
+
+type CommandCenter struct {
+	Commands map[string]DiscordCommand
+}
+
+// TODO: I dislike this global variable
+var commandCenter CommandCenter
+
+func (server *Server) RegisterCommands() {
+	commandCenter.Commands = make(map[string]DiscordCommand)
+	commandCenter.Commands["!incursions"] = server.HandleIncursion
+	commandCenter.Commands["!incursion"] = server.HandleIncursionDetails
+	commandCenter.Commands["!status"] = server.HandleTqStatus
+	commandCenter.Commands["!instructions"] = server.GetInstructions
+	commandCenter.Commands["!setinstructions"] = server.SetInstructions
+	commandCenter.Commands["!appendinstructions"] = server.AppendInstructions
+	commandCenter.Commands["!rollbackinstructions"] = server.RollbackInstructions
+	commandCenter.Commands["!deleteinstructions"] = server.RemoveInstructions
+	commandCenter.Commands["!setadmin"] = server.SetAdmin
+	commandCenter.Commands["!removeadmin"] = server.RemoveAdmin
+	commandCenter.Commands["!setbroadcast"] = server.SetBroadcastChannel
+	commandCenter.Commands["!broadcast"] = server.TestBroadcast
+	commandCenter.Commands["!sethome"] = server.SetHome
+	commandCenter.Commands["!setroute"] = server.SetRoutePreference
+	commandCenter.Commands["!avoid"] = server.AddAvoid
+	commandCenter.Commands["!unavoid"] = server.RemoveAvoid
+	commandCenter.Commands["!route"] = server.ShowRouteSettings
+	commandCenter.Commands["!setfactions"] = server.SetFactions
+	commandCenter.Commands["!fleet"] = server.HandleFleet
+	commandCenter.Commands["!x"] = server.HandleXUp
+	commandCenter.Commands["!waitlist"] = server.HandleWaitlist
+	commandCenter.Commands["!doctrine"] = server.HandleDoctrine
+	commandCenter.Commands["!checkfit"] = server.HandleCheckFit
+	commandCenter.Commands["!payouts"] = server.HandlePayouts
+	commandCenter.Commands["!link"] = server.HandleLink
+	commandCenter.Commands["!characters"] = server.HandleCharacters
+	commandCenter.Commands["!whereami"] = server.HandleWhereAmI
+	commandCenter.Commands["!rolesync"] = server.HandleRoleSync
+	commandCenter.Commands["!apikey"] = server.HandleApiKey
+	commandCenter.Commands["!calendar"] = server.HandleCalendar
+}
+
+// ProcessCommand runs the handler for command. Only the command name is logged, arguments can be anything people type.
+func (commandCenter *CommandCenter) ProcessCommand(command string, logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	handler := commandCenter.Commands[command]
+
+	if handler == nil {
+		return
+	}
+
+	logger = logger.With(LogFields{"cid": NewCorrelationId(), "command": command})
+	start := time.Now()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Command panicked", LogFields{"panic": fmt.Sprint(r), "duration": time.Since(start)})
+			return
+		}
+
+		logger.Info("Command handled", LogFields{"duration": time.Since(start)})
+	}()
+
+	handler(logger, session, message)
+}
+
+// commandArgs splits everything after the command itself on whitespace
+func commandArgs(message *discordgo.MessageCreate) []string {
+	fields := strings.Fields(message.Content)
+
+	if len(fields) <= 1 {
+		return make([]string, 0)
+	}
+
+	return fields[1:]
+}
+
+// HandleIncursion is !incursions, or !incursions me for routes from where the user's character is, sent privately
+func (server *Server) HandleIncursion(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	settings := server.GetGuildSettingsForChannel(message.ChannelID)
+	args := commandArgs(message)
+
+	located := len(args) > 0 && strings.ToLower(args[0]) == "me"
+
+	if located {
+		_, system, err := server.LocateUser(message.Author.ID)
+
+		if err != nil {
+			server.SendPrivateReply(session, message, err.Error())
+			return
+		}
+
+		settings = settingsFromSystem(settings, system)
+	}
+
+	incursions, _ := server.GetIncursions()
+
+	buffer := bytes.NewBufferString("")
+	for _, inc := range incursions {
+		server.GetDefaultIncurionsMessage(inc, settings, buffer)
+	}
+
+	if buffer.Len() <= 0 {
+		buffer.WriteString("No Null or Low Sec Incursions... Go Krab!")
+	}
+
+	// Routes from the user's character give away where it is
+	if located {
+		server.SendPrivateReply(session, message, buffer.String())
+		return
+	}
+
+	server.SendMessage(message.ChannelID, buffer.String())
+}
+
+func (server *Server) HandleTqStatus(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	logger.Debug("Retrieving Tranquility status", nil)
+
+	tq := GetTqStatus()
+
+	if tq == nil {
+		session.ChannelMessageSend(message.ChannelID, "Tranquility is offline.")
+		return
+	}
+
+	session.ChannelMessageSend(message.ChannelID, fmt.Sprintf("Tranquility is online with %v players.", tq.Players))
+}
+
+func (server *Server) SetAdmin(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	adminId := strings.TrimSpace(strings.Replace(message.Content, "!setadmin", "", -1))
+
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		logger.Error("Unable to set admin", LogFields{"guild": guildId, "error": err})
+		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintainer of this bot.", err))
+		return
+	}
+
+	server.Redis.SAdd(fmt.Sprintf("incursions:%v:admins", guildId), adminId)
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("<@%v> added as admin", adminId))
+}
+
+func (server *Server) RemoveAdmin(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	adminId := strings.TrimSpace(strings.Replace(message.Content, "!removeadmin", "", -1))
+
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		logger.Error("Unable to remove admin", LogFields{"guild": guildId, "error": err})
+		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintainer of this bot.", err))
+		return
+	}
+
+	server.Redis.SRem(fmt.Sprintf("incursions:%v:admins", guildId), adminId)
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("<@%v> removed as admin", adminId))
+}
+
+func (server *Server) SetBroadcastChannel(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	channelId := strings.Replace(message.Content, "!setbroadcast", "", -1)
+	channelId = strings.TrimSpace(channelId)
+
+	// Have to look through all channels we can see
+	id, err := server.Guilds.GuildIdForChannel(channelId)
+
+	if err == nil {
+		SetBroadcastChannelForGuild(server.Redis, id, channelId)
+	}
+
+	if err == nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Broadcast channel was set to %v", channelId))
+	} else {
+		server.SendMessage(message.ChannelID, "Could not find channel ID in any of my registered servers. Please try again")
+	}
+}
+
+func (server *Server) TestBroadcast(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	msg := strings.Replace(message.Content, "!broadcast", "", -1)
+
+	server.BroadcastMessage(logger, msg)
+}
@@ -1,41 +1,110 @@
-package main
-
-import (
-	"encoding/json"
-	"io/ioutil"
-	"fmt"
-)
-
-type Config struct {
-	DefaultStagingSystemId   int      `json:"default_staging_system_id"`
-	SecurityStatusThreshold  float32  `json:"security_status_threshold"`
-}
-
-func ParseConfig() *Config {
-	contents, err := ioutil.ReadFile("config.json")
-
-	if err != nil {
-		panic("Unable to read config file!")
-	}
-
-	var config Config
-	err = json.Unmarshal(contents, &config)
-
-	if err != nil {
-		panic("Malformed json in config.json!")
-	}
-
-	return &config
-}
-
-// GetAdminsForGuild is just a redis call, so this is super fast
-func (server *Server) GetAdminsForGuild(guildId string) []string {
-	admins := server.Redis.SMembers(fmt.Sprintf("incursions:%v:admins", guildId))
-
-	if admins.Err() == nil {
-		// TODO: We should do validation here
-		return admins.Val()
-	}
-
-	return make([]string, 0)
-}
\ No newline at end of file
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+type Config struct {
+	DefaultStagingSystemId  int     `json:"default_staging_system_id"`
+	SecurityStatusThreshold float32 `json:"security_status_threshold"`
+	DespawnConfirmations    int     `json:"despawn_confirmations"`
+	// Directory holding the Fuzzwork csv export of the SDE
+	SdePath string `json:"sde_path"`
+	// One of shortest, secure or secure-only
+	RoutePreference string `json:"route_preference"`
+	// EVE-Scout style list of wormhole hub connections, either a url or a file. Empty turns shortcuts off.
+	TheraFeed string `json:"thera_feed"`
+	// How long before a fleet starts to remind everyone signed up
+	FleetReminderMinutes int `json:"fleet_reminder_minutes"`
+	// Pilots drop off the waitlist after waiting this long
+	WaitlistTimeoutMinutes int `json:"waitlist_timeout_minutes"`
+	// ISK and LP per pilot for vanguard, assault and headquarters sites. Anything missing uses DefaultPayoutTable.
+	Payouts PayoutTable `json:"payouts"`
+	// EVE SSO endpoints and the scopes pilots are asked for when they link a character
+	SSO SsoConfig `json:"sso"`
+	// Requests each API key can make per minute
+	ApiRateLimit int `json:"api_rate_limit"`
+	// Sites other than our own whose pages can open the event websocket, like https://example.com
+	ApiAllowedOrigins []string `json:"api_allowed_origins"`
+	// Earliest and latest we expect a replacement incursion after a despawn
+	RespawnMinHours int `json:"respawn_min_hours"`
+	RespawnMaxHours int `json:"respawn_max_hours"`
+}
+
+func ParseConfig() *Config {
+	contents, err := ioutil.ReadFile("config.json")
+
+	if err != nil {
+		panic("Unable to read config file!")
+	}
+
+	var config Config
+	err = json.Unmarshal(contents, &config)
+
+	if err != nil {
+		panic("Malformed json in config.json!")
+	}
+
+	if len(config.SdePath) <= 0 {
+		config.SdePath = DefaultSdePath
+	}
+
+	if _, err = ParseRoutePreference(config.RoutePreference); err != nil {
+		config.RoutePreference = string(RouteShortest)
+	}
+
+	if config.FleetReminderMinutes <= 0 {
+		config.FleetReminderMinutes = DefaultFleetReminderMinutes
+	}
+
+	if config.WaitlistTimeoutMinutes <= 0 {
+		config.WaitlistTimeoutMinutes = DefaultWaitlistTimeoutMinutes
+	}
+
+	if config.DespawnConfirmations <= 0 {
+		config.DespawnConfirmations = DefaultDespawnConfirmations
+	}
+
+	config.SSO.applyDefaults()
+
+	if config.ApiRateLimit <= 0 {
+		config.ApiRateLimit = DefaultApiRateLimit
+	}
+
+	if config.RespawnMinHours <= 0 {
+		config.RespawnMinHours = DefaultRespawnMinHours
+	}
+
+	if config.RespawnMaxHours <= 0 {
+		config.RespawnMaxHours = DefaultRespawnMaxHours
+	}
+
+	if config.RespawnMaxHours < config.RespawnMinHours {
+		config.RespawnMaxHours = config.RespawnMinHours
+	}
+
+	return &config
+}
+
+// DefaultRouteOptions are used for jumps from the default staging system
+func (config *Config) DefaultRouteOptions() RouteOptions {
+	preference, _ := ParseRoutePreference(config.RoutePreference)
+
+	return RouteOptions{
+		Preference: preference,
+	}
+}
+
+// GetAdminsForGuild is just a redis call, so this is super fast
+func (server *Server) GetAdminsForGuild(guildId string) []string {
+	admins := server.Redis.SMembers(fmt.Sprintf("incursions:%v:admins", guildId))
+
+	if admins.Err() == nil {
+		// TODO: We should do validation here
+		return admins.Val()
+	}
+
+	return make([]string, 0)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	recentEventCount  = 20
+	historyPageLength = 50
+)
+
+// dashboardTemplates are kept in the binary so there is nothing extra to deploy
+var dashboardTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+	"percent": func(value float32) string {
+		return fmt.Sprintf("%.1f%%", value*100)
+	},
+	"security": func(value float32) string {
+		return fmt.Sprintf("%.1f", value)
+	},
+	"eveTime": func(t time.Time) string {
+		return t.UTC().Format(eveTimeLayout)
+	},
+}).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; background: #1b1d22; color: #ddd; }
+a { color: #7fb4ff; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: 0.3em 0.6em; border-bottom: 1px solid #333; }
+nav a { margin-right: 1em; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<nav><a href="/dashboard">Incursions</a><a href="/dashboard/history">History</a><a href="/dashboard/guilds">Guilds</a><a href="/admin">Admin</a></nav>
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "footer"}}<p class="muted">Updated {{eveTime .Now}} EVE time</p>
+</body>
+</html>
+{{end}}
+
+{{define "events"}}<table>
+<tr><th>When</th><th>What</th><th>Staging</th><th>Constellation</th><th>Faction</th><th>State</th><th>Influence</th></tr>
+{{range .}}<tr><td>{{eveTime .At}}</td><td>{{.Type}}</td><td>{{.StagingSystemName}} ({{security .SecurityStatus}})</td><td>{{.ConstellationName}} - {{.RegionName}}</td><td>{{.FactionName}}</td><td>{{if .PreviousState}}{{.PreviousState}} &rarr; {{end}}{{.State}}</td><td>{{percent .Influence}}</td></tr>
+{{else}}<tr><td colspan="7" class="muted">Nothing has happened yet</td></tr>
+{{end}}</table>
+{{end}}
+
+{{define "incursions"}}{{template "header" .}}
+<form method="get">
+<label>Filter and route for <select name="guild" onchange="this.form.submit()">
+<option value="">Default settings</option>
+{{range .Guilds}}<option value="{{.Id}}"{{if eq .Id $.GuildId}} selected{{end}}>{{.Name}}</option>{{end}}
+</select></label>
+</form>
+<table>
+<tr><th>Staging</th><th>Constellation</th><th>Faction</th><th>State</th><th>Influence</th><th>Boss</th><th>Jumps</th></tr>
+{{range .Incursions}}<tr><td>{{.Staging}} ({{security .Security}})</td><td>{{.Constellation}} - {{.Region}}</td><td>{{.Faction}}</td><td>{{.State}}</td><td>{{percent .Influence}}</td><td>{{if .HasBoss}}Spawned{{end}}</td><td>{{.Route}}</td></tr>
+{{else}}<tr><td colspan="7" class="muted">No incursions match these settings</td></tr>
+{{end}}</table>
+<h2>Recent events</h2>
+{{template "events" .Events}}
+{{template "footer" .}}{{end}}
+
+{{define "history"}}{{template "header" .}}
+{{template "events" .Events}}
+<p>{{if .PreviousPage}}<a href="?page={{.PreviousPage}}">Newer</a>{{end}} Page {{.Page}} of {{.Pages}} {{if .NextPage}}<a href="?page={{.NextPage}}">Older</a>{{end}}</p>
+{{template "footer" .}}{{end}}
+
+{{define "guilds"}}{{template "header" .}}
+<table>
+<tr><th>Guild</th><th>Home</th><th>Routes</th><th>Avoiding</th><th>Factions</th><th>Broadcast channel</th><th>Admins</th><th>Instructions</th></tr>
+{{range .Guilds}}<tr><td>{{.Name}}</td><td>{{.Home}}</td><td>{{.RoutePreference}}</td><td>{{.Avoid}}</td><td>{{.Factions}}</td><td>{{.BroadcastChannel}}</td><td>{{.Admins}}</td><td>{{.Instructions}}</td></tr>
+{{else}}<tr><td colspan="8" class="muted">You can't manage any of the bot's guilds</td></tr>
+{{end}}</table>
+{{template "footer" .}}{{end}}
+`))
+
+// DashboardIncursion is an incursion flattened for the page
+type DashboardIncursion struct {
+	Staging       string
+	Security      float32
+	Constellation string
+	Region        string
+	Faction       string
+	State         string
+	Influence     float32
+	HasBoss       bool
+	Route         string
+}
+
+// DashboardGuild is a guild's configuration spelled out with names instead of ids
+type DashboardGuild struct {
+	Id               string
+	Name             string
+	Home             string
+	RoutePreference  string
+	Avoid            string
+	Factions         string
+	BroadcastChannel string
+	Admins           int
+	Instructions     string
+}
+
+// renderDashboard runs the template into a buffer first so a broken page doesn't go out half written
+func renderDashboard(c *gin.Context, name string, data gin.H) {
+	data["Now"] = time.Now()
+
+	var buffer bytes.Buffer
+	if err := dashboardTemplates.ExecuteTemplate(&buffer, name, data); err != nil {
+		RequestLog(c).Error("Unable to render dashboard page", LogFields{"page": name, "error": err})
+		c.String(http.StatusInternalServerError, "Unable to render page")
+		return
+	}
+
+	c.Data(http.StatusOK, "text/html; charset=utf-8", buffer.Bytes())
+}
+
+// systemNames turns system ids into names, leaving the id when we can't look it up
+func (server *Server) systemNames(ids []int) string {
+	names := make([]string, 0, len(ids))
+
+	for _, id := range ids {
+		if system := server.GetSystem(id); system != nil {
+			names = append(names, system.Name)
+		} else {
+			names = append(names, strconv.Itoa(id))
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+// homeName is the guild's home system, or "Not set" rather than a system id of 0
+func (server *Server) homeName(settings *GuildSettings) string {
+	if settings.HomeSystemId <= 0 {
+		return "Not set"
+	}
+
+	return server.systemNames([]int{settings.HomeSystemId})
+}
+
+func (server *Server) GetDashboardIncursions(settings *GuildSettings) []*DashboardIncursion {
+	incursions, _ := server.GetIncursions()
+	rows := make([]*DashboardIncursion, 0, len(incursions))
+
+	for _, incursion := range incursions {
+		if incursion.StagingSystem == nil || !server.wantsIncursion(incursion, settings) {
+			continue
+		}
+
+		row := &DashboardIncursion{
+			Staging:       incursion.StagingSystem.Name,
+			Security:      incursion.StagingSystem.SecurityStatus,
+			Constellation: incursion.ConsellationName,
+			Faction:       DescribeKind(incursion),
+			State:         RulesForIncursion(incursion).DescribeState(incursion.State),
+			Influence:     incursion.Influence,
+			HasBoss:       RulesForIncursion(incursion).HasBoss && incursion.HasBoss,
+			Route:         server.DescribeRouteForGuild(settings, incursion),
+		}
+
+		if constellation := server.GetConstellationForIncursion(incursion); constellation != nil {
+			row.Region = constellation.RegionName
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func (server *Server) GetDashboardGuild(guildId string) *DashboardGuild {
+	settings := server.GetGuildSettings(guildId)
+
+	factions := make([]string, 0, len(settings.Factions))
+	for _, id := range settings.Factions {
+		factions = append(factions, server.GetFactionName(id))
+	}
+
+	if len(factions) <= 0 {
+		factions = append(factions, "All")
+	}
+
+	channel, err := GetBroadcastChannelForGuild(server.Redis, guildId)
+	if err != nil {
+		channel = "Not set"
+	}
+
+	return &DashboardGuild{
+		Id:               guildId,
+		Name:             server.Guilds.Name(guildId),
+		Home:             server.homeName(settings),
+		RoutePreference:  string(settings.RouteOptions().preference()),
+		Avoid:            server.systemNames(settings.Avoid),
+		Factions:         strings.Join(factions, ", "),
+		BroadcastChannel: channel,
+		Admins:           len(server.GetAdminsForGuild(guildId)),
+		Instructions:     strings.Join(server.GetInstructionNames(guildId), ", "),
+	}
+}
+
+// dashboardGuilds is just the name of every guild, enough to pick one on the public pages
+func (server *Server) dashboardGuilds() []*DashboardGuild {
+	guilds := make([]*DashboardGuild, 0)
+
+	for _, guildId := range server.Guilds.IDs() {
+		guilds = append(guilds, &DashboardGuild{Id: guildId, Name: server.Guilds.Name(guildId)})
+	}
+
+	sort.Slice(guilds, func(i, j int) bool {
+		return guilds[i].Name < guilds[j].Name
+	})
+
+	return guilds
+}
+
+// dashboardIncursions shows the incursions with the filters and routes of the guild picked, or the defaults
+func (server *Server) dashboardIncursions(c *gin.Context) {
+	guildId := c.Query("guild")
+	settings := server.DefaultGuildSettings()
+
+	if len(guildId) > 0 && server.Guilds.Has(guildId) {
+		settings = server.GetGuildSettings(guildId)
+	} else {
+		guildId = ""
+	}
+
+	renderDashboard(c, "incursions", gin.H{
+		"Title":      "Incursions",
+		"GuildId":    guildId,
+		"Guilds":     server.dashboardGuilds(),
+		"Incursions": server.GetDashboardIncursions(settings),
+		"Events":     server.GetEvents(0, recentEventCount),
+	})
+}
+
+func (server *Server) dashboardHistory(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	pages := (server.CountEvents() + historyPageLength - 1) / historyPageLength
+	if pages < 1 {
+		pages = 1
+	}
+
+	data := gin.H{
+		"Title":  "History",
+		"Events": server.GetEvents((page-1)*historyPageLength, historyPageLength),
+		"Page":   page,
+		"Pages":  pages,
+	}
+
+	if page > 1 {
+		data["PreviousPage"] = page - 1
+	}
+
+	if page < pages {
+		data["NextPage"] = page + 1
+	}
+
+	renderDashboard(c, "history", data)
+}
+
+// dashboardGuildSettings shows the configuration of the guilds the logged in user can manage. Channels, admins and
+// instructions aren't for everyone, so it sits behind the admin session.
+func (server *Server) dashboardGuildSettings(c *gin.Context) {
+	session := adminSession(c)
+	guilds := make([]*DashboardGuild, 0)
+
+	for _, guildId := range server.Guilds.IDs() {
+		if server.CanManage(session, guildId) {
+			guilds = append(guilds, server.GetDashboardGuild(guildId))
+		}
+	}
+
+	sort.Slice(guilds, func(i, j int) bool {
+		return guilds[i].Name < guilds[j].Name
+	})
+
+	renderDashboard(c, "guilds", gin.H{
+		"Title":  "Guilds",
+		"Guilds": guilds,
+	})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Roles a system can play inside an incursion's constellation
+const (
+	SiteRoleStaging  = "Staging"
+	SiteRoleVanguard = "Vanguard"
+	SiteRoleAssault  = "Assault"
+	SiteRoleHQ       = "HQ"
+
+	// How many of the systems furthest from staging (after HQ) host assault sites
+	assaultSystemCount = 2
+
+	// Discord embeds can't have more fields than this
+	maxEmbedFields = 25
+)
+
+// InfestedSystem is one system of an incursion along with what it's for
+type InfestedSystem struct {
+	System *EsiSystem
+	Role   string
+	// Jumps from the staging system
+	Jumps int
+}
+
+// FindIncursion matches a constellation name or the name of any infested system, case insensitive
+func (server *Server) FindIncursion(incursions []*EsiIncursion, name string) *EsiIncursion {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if len(name) <= 0 {
+		return nil
+	}
+
+	for _, incursion := range incursions {
+		if strings.ToLower(incursion.ConsellationName) == name {
+			return incursion
+		}
+	}
+
+	for _, incursion := range incursions {
+		for _, id := range incursion.InfestedSolarSystems {
+			if system := server.GetSystem(id); system != nil && strings.ToLower(system.Name) == name {
+				return incursion
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetInfestedSystems works out the role of every infested system. ESI doesn't tell us, so this goes by layout:
+// the HQ is the system furthest from staging, the next furthest host assaults and the rest are vanguards.
+func (server *Server) GetInfestedSystems(incursion *EsiIncursion) []*InfestedSystem {
+	systems := make([]*InfestedSystem, 0, len(incursion.InfestedSolarSystems))
+
+	for _, id := range incursion.InfestedSolarSystems {
+		system := server.GetSystem(id)
+
+		if system == nil {
+			Log.Warn("Unable to look up infested system", LogFields{"system": id, "constellation": incursion.ConstellationId})
+			continue
+		}
+
+		route := server.GetRouteWithOptions(incursion.StagingSolarSystemId, id, RouteOptions{Preference: RouteShortest})
+
+		systems = append(systems, &InfestedSystem{
+			System: system,
+			Role:   SiteRoleVanguard,
+			Jumps:  JumpCount(route),
+		})
+	}
+
+	// Staging first, then closest to furthest
+	sort.SliceStable(systems, func(i, j int) bool {
+		if systems[i].System.SystemId == incursion.StagingSolarSystemId {
+			return true
+		}
+		if systems[j].System.SystemId == incursion.StagingSolarSystemId {
+			return false
+		}
+		return systems[i].Jumps < systems[j].Jumps
+	})
+
+	remaining := systems
+	if len(remaining) > 0 && remaining[0].System.SystemId == incursion.StagingSolarSystemId {
+		remaining[0].Role = SiteRoleStaging
+		remaining = remaining[1:]
+	}
+
+	if len(remaining) > 0 {
+		remaining[len(remaining)-1].Role = SiteRoleHQ
+		remaining = remaining[:len(remaining)-1]
+	}
+
+	for i := len(remaining) - 1; i >= 0 && i >= len(remaining)-assaultSystemCount; i-- {
+		remaining[i].Role = SiteRoleAssault
+	}
+
+	return systems
+}
+
+// GetStationNames resolves the names of every station in the system
+func (server *Server) GetStationNames(system *EsiSystem) []string {
+	names := make([]string, 0, len(system.Stations))
+	missing := &NameRequest{Ids: make([]int, 0)}
+
+	for _, id := range system.Stations {
+		if server.GetNameForId(id) == nil {
+			missing.Ids = append(missing.Ids, id)
+		}
+	}
+
+	if len(missing.Ids) > 0 {
+		server.GetNames(missing)
+	}
+
+	for _, id := range system.Stations {
+		if name := server.GetNameForId(id); name != nil {
+			names = append(names, name.Name)
+		}
+	}
+
+	return names
+}
+
+func (server *Server) describeRoute(route []int) string {
+	names := make([]string, 0, len(route))
+
+	for _, id := range route {
+		if system := server.GetSystem(id); system != nil {
+			names = append(names, fmt.Sprintf("%v (%.1f)", system.Name, system.SecurityStatus))
+		} else {
+			names = append(names, fmt.Sprint(id))
+		}
+	}
+
+	return strings.Join(names, " > ")
+}
+
+// GetIncursionEmbed is the full breakdown of a single incursion
+func (server *Server) GetIncursionEmbed(incursion *EsiIncursion, settings *GuildSettings) *discordgo.MessageEmbed {
+	constellation := server.GetConstellationForIncursion(incursion)
+	systems := server.GetInfestedSystems(incursion)
+
+	embed := &discordgo.MessageEmbed{
+		Title:  fmt.Sprintf("Incursion in %v", incursion.ConsellationName),
+		Color:  incursionStateColor(incursion.State),
+		Fields: make([]*discordgo.MessageEmbedField, 0, len(systems)+1),
+	}
+
+	if constellation != nil {
+		embed.Title = fmt.Sprintf("Incursion in %v - %v", constellation.Name, constellation.RegionName)
+		embed.URL = strings.Replace(fmt.Sprintf("http://evemaps.dotlan.net/map/%v/%v", constellation.RegionName, constellation.Name), " ", "_", -1)
+	}
+
+	embed.Description = fmt.Sprintf("%v - Status %v%v - Influence: %.3v%%\n%v", DescribeKind(incursion), RulesForIncursion(incursion).DescribeState(incursion.State), describeBoss(incursion), incursion.Influence*100, server.DescribeRouteForGuild(settings, incursion))
+
+	var hq *InfestedSystem
+
+	// Leave room for the route at the end
+	for _, infested := range systems {
+		if len(embed.Fields) >= maxEmbedFields-1 {
+			break
+		}
+
+		if infested.Role == SiteRoleHQ {
+			hq = infested
+		}
+
+		stations := server.GetStationNames(infested.System)
+		docking := "No stations"
+		if len(stations) > 0 {
+			docking = "Dock: " + strings.Join(stations, ", ")
+		}
+
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("%v (%.1f) - %v - %v jumps from staging", infested.System.Name, infested.System.SecurityStatus, infested.Role, JumpsText(infested.Jumps)),
+			Value: truncate(docking, 1024),
+		})
+	}
+
+	if hq != nil {
+		route := server.GetRouteWithOptions(incursion.StagingSolarSystemId, hq.System.SystemId, RouteOptions{Preference: RouteShortest})
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  "Route from staging to HQ",
+			Value: truncate(server.describeRoute(route), 1024),
+		})
+	}
+
+	return embed
+}
+
+func incursionStateColor(state string) int {
+	switch state {
+	case "established":
+		return 0x2ecc71
+	case "mobilizing":
+		return 0xf1c40f
+	case "withdrawing":
+		return 0xe74c3c
+	}
+	return 0x95a5a6
+}
+
+// truncate keeps text within Discord's limits, which count characters rather than bytes
+func truncate(text string, limit int) string {
+	runes := []rune(text)
+
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-3]) + "..."
+}
+
+func (server *Server) HandleIncursionDetails(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	name := strings.TrimSpace(strings.Replace(message.Content, "!incursion", "", 1))
+
+	if len(name) <= 0 {
+		server.SendMessage(message.ChannelID, "Usage: !incursion <constellation or system>")
+		return
+	}
+
+	incursions, _ := server.GetIncursions()
+	incursion := server.FindIncursion(incursions, name)
+
+	if incursion == nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("No incursion found in %v", name))
+		return
+	}
+
+	embed := server.GetIncursionEmbed(incursion, server.GetGuildSettingsForChannel(message.ChannelID))
+
+	server.SendEmbed(message.ChannelID, embed)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"Jita", 10, "Jita"},
+		{"Amarr Prime", 8, "Amarr..."},
+		{"Ōtsuki Ōtsuki", 13, "Ōtsuki Ōtsuki"},
+		{"ÖÖÖÖÖÖ", 5, "ÖÖ..."},
+		{"⚔⚔⚔⚔⚔⚔⚔", 6, "⚔⚔⚔..."},
+	}
+
+	for _, test := range tests {
+		got := truncate(test.text, test.limit)
+
+		if got != test.want || !utf8.ValidString(got) {
+			t.Errorf("truncate(%q, %d) = %q, want %q", test.text, test.limit, got, test.want)
+		}
+	}
+}
@@ -1,131 +1,313 @@
-package main
-
-import (
-	"fmt"
-	"log"
-	"os"
-	"strings"
-	"bytes"
-
-	"errors"
-	"github.com/bwmarrin/discordgo"
-	"github.com/go-redis/redis"
-)
-
-var (
-	Guilds map[string]*discordgo.Guild = make(map[string]*discordgo.Guild, 0)
-)
-
-func (server *Server) SetupDiscord(config *Config, waitChan chan bool) {
-	discord, err := discordgo.New("Bot " + os.Getenv("DISCORD_BOT_TOKEN"))
-
-	if err != nil {
-		panic(fmt.Sprintf("Unable to set up Discord! Check the bot token! Error: %v", err))
-	}
-
-	if err = discord.Open(); err != nil {
-		panic(fmt.Sprintf("Error opening Discord Session. %v", err))
-	}
-	defer discord.Close()
-
-	discord.AddHandler(server.OnMessageCreate)
-	discord.AddHandler(server.OnGuildJoin)
-
-	log.Printf("Connected to Discord...")
-
-	// Block on this function call
-
-	// Send that we have been setup
-	waitChan <- true
-
-	// TODO: this feels bad, probably want to return it on the channel
-	server.Discord = discord
-
-	// Block on this channel
-	<-waitChan
-	log.Printf("Disconnected to Discord...")
-}
-
-func (server *Server) OnMessageCreate(s *discordgo.Session, message *discordgo.MessageCreate) {
-	// Ignore if it came from us, always
-	if message.Author.ID == s.State.User.ID {
-		return
-	}
-
-	log.Printf("Message received %v", message.Content)
-
-	if strings.HasPrefix(message.Content, "!") {
-		split := strings.Split(message.Content, " ")
-		commandCenter.ProcessCommand(split[0], s, message)
-	}
-}
-
-// Note: This gets called on startup
-func (server *Server) OnGuildJoin(s *discordgo.Session, event *discordgo.GuildCreate) {
-	log.Printf("Joined guild %v", event.Guild.Name)
-	Guilds[event.Guild.ID] = event.Guild
-}
-
-func (server *Server) OnGuildLeave(s *discordgo.Session, event *discordgo.GuildDelete) {
-	log.Printf("Left guild %v", event.Guild.Name)
-	delete(Guilds, event.Guild.ID)
-}
-
-func (server *Server) BroadcastMessage(message string) {
-	for id, _ := range Guilds {
-		_, err := GetBroadcastChannelForGuild(server.Redis, id)
-
-		if err != nil {
-			log.Printf("Error on broadcast. Guild has not set up broadcast channel!")
-			continue
-		}
-
-		buffer := bytes.NewBufferString(message)
-
-		// Append any mentions...
-		for _, mention := range server.GetAdminsForGuild(id) {
-			buffer.WriteString(fmt.Sprintf(" <@%v> ", mention))
-		}
-
-		server.SendMessage(channel, buffer.String())
-	}
-}
-
-func (server *Server) SendMessage(channel, message string) {
-	_, err := server.Discord.ChannelMessageSend(channel, message)
-	if err != nil {
-		log.Printf("Error sending message %v", err)
-		return
-	}
-}
-
-func (server *Server) SendDirectMessage(user *discordgo.User, message string) {
-	channel, err := server.Discord.UserChannelCreate(user.ID)
-
-	if err != nil {
-		log.Printf("Error creating PM for user %v", user.ID)
-		return
-	}
-
-	server.SendMessage(channel.ID, message)
-}
-
-func GetBroadcastChannelForGuild(redis *redis.Client, guildId string) (string, error) {
-	channel := redis.Get(fmt.Sprintf("discord:%v:broadcast_channel", guildId))
-	return channel.Val(), channel.Err()
-}
-
-func SetBroadcastChannelForGuild(redis *redis.Client, guildId, channelId string) {
-	redis.Set(fmt.Sprintf("discord:%v:broadcast_channel", guildId), channelId, 0)
-}
-
-func GetGuildIdForChannel(channelId string) (string, error) {
-	for id, guild := range Guilds {
-		for _, channel := range guild.Channels {
-			if channel.ID == channelId {
-				return id, nil
-			}
-		}
-	}
-	return "", errors.New("no guild found for known channel")
-}
\ No newline at end of file
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/go-redis/redis"
+)
+
+// GuildRegistry is every guild we are currently in. Discord events and commands both hit it from their own goroutines.
+type GuildRegistry struct {
+	lock   sync.RWMutex
+	guilds map[string]*discordgo.Guild
+	// Command prefixes by guild, every message has to be checked against one
+	prefixes map[string]string
+}
+
+func NewGuildRegistry() *GuildRegistry {
+	return &GuildRegistry{
+		guilds:   make(map[string]*discordgo.Guild),
+		prefixes: make(map[string]string),
+	}
+}
+
+func (registry *GuildRegistry) Add(guild *discordgo.Guild) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.guilds[guild.ID] = guild
+}
+
+func (registry *GuildRegistry) Remove(guildId string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	delete(registry.guilds, guildId)
+	delete(registry.prefixes, guildId)
+}
+
+// Prefix is the guild's command prefix, if we have seen it since starting
+func (registry *GuildRegistry) Prefix(guildId string) (string, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	prefix, ok := registry.prefixes[guildId]
+	return prefix, ok
+}
+
+func (registry *GuildRegistry) SetPrefix(guildId, prefix string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.prefixes[guildId] = prefix
+}
+
+// IDs returns a snapshot of the guild ids so callers can loop without holding the lock
+func (registry *GuildRegistry) IDs() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	ids := make([]string, 0, len(registry.guilds))
+	for id := range registry.guilds {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func (registry *GuildRegistry) Count() int {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return len(registry.guilds)
+}
+
+func (registry *GuildRegistry) Has(guildId string) bool {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	_, ok := registry.guilds[guildId]
+	return ok
+}
+
+// Guild is what Discord told us about the guild when we joined it
+func (registry *GuildRegistry) Guild(guildId string) (*discordgo.Guild, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	guild, ok := registry.guilds[guildId]
+	return guild, ok
+}
+
+// Name is the guild's name as Discord gave it to us, or the id if we haven't seen it
+func (registry *GuildRegistry) Name(guildId string) string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	if guild, ok := registry.guilds[guildId]; ok && len(guild.Name) > 0 {
+		return guild.Name
+	}
+
+	return guildId
+}
+
+// GuildIdForChannel looks through all the channels we can see for the guild that owns channelId
+func (registry *GuildRegistry) GuildIdForChannel(channelId string) (string, error) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	for id, guild := range registry.guilds {
+		for _, channel := range guild.Channels {
+			if channel.ID == channelId {
+				return id, nil
+			}
+		}
+	}
+	return "", errors.New("no guild found for known channel")
+}
+
+func (server *Server) SetupDiscord(config *Config, waitChan chan bool) {
+	discord, err := discordgo.New("Bot " + os.Getenv("DISCORD_BOT_TOKEN"))
+
+	if err != nil {
+		panic(fmt.Sprintf("Unable to set up Discord! Check the bot token! Error: %v", err))
+	}
+
+	if err = discord.Open(); err != nil {
+		panic(fmt.Sprintf("Error opening Discord Session. %v", err))
+	}
+	defer discord.Close()
+
+	discord.AddHandler(server.OnMessageCreate)
+	discord.AddHandler(server.OnGuildJoin)
+	discord.AddHandler(server.OnGuildLeave)
+	discord.AddHandler(server.OnReactionAdd)
+	discord.AddHandler(server.OnReactionRemove)
+
+	Log.Info("Connected to Discord", nil)
+
+	// Block on this function call
+
+	// TODO: this feels bad, probably want to return it on the channel
+	server.Discord = discord
+
+	// Send that we have been setup
+	waitChan <- true
+
+	// Block on this channel
+	<-waitChan
+	Log.Info("Disconnected from Discord", nil)
+}
+
+func (server *Server) OnMessageCreate(s *discordgo.Session, message *discordgo.MessageCreate) {
+	// Ignore if it came from us, always
+	if message.Author.ID == s.State.User.ID {
+		return
+	}
+
+	logger := Log.With(LogFields{"channel": message.ChannelID, "author": message.Author.ID})
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err == nil {
+		logger = logger.With(LogFields{"guild": guildId})
+	}
+
+	logger.Debug("Message received", LogFields{"content": MessageContent(message.Content)})
+
+	prefix := server.CommandPrefix(guildId)
+
+	if strings.HasPrefix(message.Content, prefix) {
+		// Handlers all know their commands by the default prefix
+		message.Content = DefaultCommandPrefix + strings.TrimPrefix(message.Content, prefix)
+
+		// Split on any whitespace, some commands take a fit pasted on the next line
+		split := strings.Fields(message.Content)
+		commandCenter.ProcessCommand(split[0], logger, s, message)
+	}
+}
+
+// Note: This gets called on startup
+func (server *Server) OnGuildJoin(s *discordgo.Session, event *discordgo.GuildCreate) {
+	Log.Info("Joined guild", LogFields{"guild": event.Guild.ID, "name": event.Guild.Name})
+	server.Guilds.Add(event.Guild)
+}
+
+func (server *Server) OnGuildLeave(s *discordgo.Session, event *discordgo.GuildDelete) {
+	Log.Info("Left guild", LogFields{"guild": event.Guild.ID})
+	server.Guilds.Remove(event.Guild.ID)
+}
+
+func (server *Server) BroadcastMessage(logger *Logger, message string) {
+	server.BroadcastGuildMessage(logger, func(guildId string) string {
+		return message
+	})
+}
+
+// BroadcastGuildMessage builds a message for each guild, skipping the ones that come back empty
+func (server *Server) BroadcastGuildMessage(logger *Logger, build func(guildId string) string) {
+	for _, id := range server.Guilds.IDs() {
+		channel, err := GetBroadcastChannelForGuild(server.Redis, id)
+
+		if err != nil {
+			logger.Warn("Guild has not set up a broadcast channel", LogFields{"guild": id})
+			continue
+		}
+
+		message := build(id)
+
+		if len(message) <= 0 {
+			continue
+		}
+
+		buffer := bytes.NewBufferString(message)
+
+		// Append any mentions...
+		for _, mention := range server.GetAdminsForGuild(id) {
+			buffer.WriteString(fmt.Sprintf(" <@%v> ", mention))
+		}
+
+		server.SendMessage(channel, buffer.String())
+	}
+}
+
+func (server *Server) SendMessage(channel, message string) {
+	_, err := server.Discord.ChannelMessageSend(channel, message)
+	if err != nil {
+		Log.Warn("Unable to send message", LogFields{"channel": channel, "error": err})
+		discordSendFailures.Inc("message")
+		return
+	}
+}
+
+// SendEmbed posts the embed, counting and logging it when Discord won't take it
+func (server *Server) SendEmbed(channel string, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	posted, err := server.Discord.ChannelMessageSendEmbed(channel, embed)
+
+	if err != nil {
+		Log.Warn("Unable to send embed", LogFields{"channel": channel, "error": err})
+		discordSendFailures.Inc("embed")
+	}
+
+	return posted, err
+}
+
+// SendDirectMessage DMs the user. The error matters when the message is the only copy of something, users can
+// turn off DMs from server members.
+func (server *Server) SendDirectMessage(user *discordgo.User, message string) error {
+	channel, err := server.Discord.UserChannelCreate(user.ID)
+
+	if err == nil {
+		_, err = server.Discord.ChannelMessageSend(channel.ID, message)
+	}
+
+	if err != nil {
+		Log.Warn("Unable to send a direct message", LogFields{"user": user.ID, "error": err})
+		discordSendFailures.Inc("direct_message")
+	}
+
+	return err
+}
+
+// isDirectMessage is true when the channel is a DM with the bot, so only the user can read what we post in it
+func isDirectMessage(session *discordgo.Session, channelId string) bool {
+	channel, err := session.State.Channel(channelId)
+
+	if err != nil {
+		channel, err = session.Channel(channelId)
+	}
+
+	if err != nil {
+		return false
+	}
+
+	return channel.Type == discordgo.ChannelTypeDM
+}
+
+// SendPrivateReply answers in the channel when it's a DM, otherwise DMs the author and says so in the channel.
+// Use it for anything that shouldn't be public, like where someone's character is.
+func (server *Server) SendPrivateReply(session *discordgo.Session, message *discordgo.MessageCreate, reply string) {
+	if isDirectMessage(session, message.ChannelID) {
+		server.SendMessage(message.ChannelID, reply)
+		return
+	}
+
+	if err := server.SendDirectMessage(message.Author, reply); err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("<@%v> I couldn't DM you, allow DMs from server members and try again", message.Author.ID))
+		return
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("<@%v> sent you a DM", message.Author.ID))
+}
+
+func GetBroadcastChannelForGuild(redis *redis.Client, guildId string) (string, error) {
+	channel := redis.Get(fmt.Sprintf("discord:%v:broadcast_channel", guildId))
+	return channel.Val(), channel.Err()
+}
+
+func SetBroadcastChannelForGuild(redis *redis.Client, guildId, channelId string) {
+	redis.Set(fmt.Sprintf("discord:%v:broadcast_channel", guildId), channelId, 0)
+}
+
+func DeleteBroadcastChannelForGuild(redis *redis.Client, guildId string) {
+	redis.Del(fmt.Sprintf("discord:%v:broadcast_channel", guildId))
+}
+
+func (server *Server) GetGuildIdForChannel(channelId string) (string, error) {
+	return server.Guilds.GuildIdForChannel(channelId)
+}
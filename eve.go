@@ -1,395 +1,511 @@
-package main
-
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"github.com/go-redis/redis"
-	"io/ioutil"
-	"log"
-	"net/http"
-	"time"
-)
-
-const EsiHostname = "https://esi.evetech.net"
-
-type EsiStatus struct {
-	Players       int       `json:"players"`
-	ServerVersion string    `json:"server_version"`
-	StartTime     time.Time `json:"start_time"`
-}
-
-type EsiIncursion struct {
-	ConstellationId      int `json:"constellation_id"`
-	ConsellationName     string
-	FactionId            int `json:"faction_id"`
-	StagingSolarSystemId int `json:"staging_solar_system_id"`
-	StagingSystem        *EsiSystem
-	HasBoss              bool    `json:"has_boss"`
-	InfestedSolarSystems []int   `json:"infested_solar_systems"`
-	Influence            float32 `json:"influence"`
-	State                string  `json:"state"`
-	Type                 string  `json:"type"`
-	Route                []int   `json:"route"`
-	DeathTime            int     // temp for dead incursions
-}
-
-type NameRequest struct {
-	Ids []int `json:"ids"`
-}
-
-type EsiName struct {
-	Category string `json:"category"`
-	Id       int    `json:"id"`
-	Name     string `json:"name"`
-}
-
-type EsiConstellation struct {
-	ConstellationId int    `json:"constellation_id"`
-	Name            string `json:"name"`
-	RegionId        int    `json:"region_id"`
-	RegionName      string `json:"region_name"`
-	Systems         []int  `json:"systems"`
-}
-
-type EsiSystem struct {
-	ConstellationId int     `json:"constellation_id"`
-	Name            string  `json:"name"`
-	SystemId        int     `json:"system_id"`
-	SecurityStatus  float32 `json:"security_status"`
-	SecurityClass   string  `json:"security_class"`
-}
-
-var (
-	CachedNames          map[int]*EsiName = make(map[int]*EsiName)
-	CachedIncursions     []*EsiIncursion
-	CachedConstellations map[int]*EsiConstellation = make(map[int]*EsiConstellation)
-	CachedSystems        map[int]*EsiSystem        = make(map[int]*EsiSystem)
-	LastIncursionFetch   int64                     = 0
-)
-
-func GetTqStatus() *EsiStatus {
-	bytes := getEndpointResult("/latest/status")
-	if bytes == nil {
-		return nil
-	}
-
-	var esiStatus EsiStatus
-	json.Unmarshal(bytes, &esiStatus)
-
-	return &esiStatus
-}
-
-func (server *Server) GetNames(ids *NameRequest) []*EsiName {
-	// Sweet sweet copying data
-	ids.Ids = UniqueInts(ids.Ids)
-
-	bytes := postEndpointResult("/latest/universe/names", ids.Ids)
-
-	if bytes == nil {
-		return nil
-	}
-
-	var names []*EsiName
-	err := json.Unmarshal(bytes, &names)
-
-	if err != nil {
-		log.Printf("Error unmarshalling json. %v", err)
-		return nil
-	}
-
-	// Populate the names cache
-	for _, name := range names {
-		CachedNames[name.Id] = name
-
-		bytes, _ := json.Marshal(name)
-		server.Redis.Set(fmt.Sprintf("esi:names:%d", name.Id), string(bytes), 0)
-	}
-
-	return names
-}
-
-// Gets a list of the current incursions and returns whether or not it was cached or a new set
-func (server *Server) GetIncursions() ([]*EsiIncursion, bool) {
-	if GetEpoch()-LastIncursionFetch <= 300 {
-		return CachedIncursions, false
-	}
-
-	bytes := getEndpointResult("/latest/incursions")
-
-	if bytes == nil {
-		return nil, false
-	}
-
-	var incursions []*EsiIncursion
-	err := json.Unmarshal(bytes, &incursions)
-
-	if err != nil {
-		log.Printf("Error unmarshalling json. %v", err)
-		return nil, false
-	}
-
-	server.PopulateIncursionData(incursions)
-
-	CachedIncursions = incursions
-	LastIncursionFetch = GetEpoch()
-	return incursions, true
-}
-
-func (server *Server) PopulateIncursionData(incursions []*EsiIncursion) {
-	ids := &NameRequest{
-		Ids: make([]int, 0),
-	}
-
-	// Populate with names
-	for _, incursion := range incursions {
-		constellation := GetNameForId(incursion.ConstellationId, server.Redis)
-
-		if constellation != nil {
-			incursion.ConsellationName = constellation.Name
-		} else {
-			ids.Ids = append(ids.Ids, incursion.ConstellationId)
-		}
-	}
-
-	if len(ids.Ids) > 0 {
-		server.GetNames(ids)
-
-		// Populate with names, again
-		for _, incursion := range incursions {
-			constellation := GetNameForId(incursion.ConstellationId, server.Redis)
-
-			if constellation != nil {
-				incursion.ConsellationName = constellation.Name
-			}
-		}
-	}
-
-	// Grab system and jump data
-	for _, incursion := range incursions {
-		// only fetch if we need it
-		if incursion.StagingSystem == nil {
-			system := server.GetSystem(incursion.StagingSolarSystemId)
-
-			incursion.StagingSystem = system
-		}
-
-		if len(incursion.Route) <= 0 {
-			route := server.GetRoute(server.Config.DefaultStagingSystemId, incursion.StagingSolarSystemId)
-
-			incursion.Route = route
-		}
-	}
-}
-
-func GetNameForId(id int, redis *redis.Client) *EsiName {
-	// Check memory cache first
-	nameAttempt := CachedNames[id]
-
-	// TODO: Put this check into an "isvalid" that hangs off the struct
-	if nameAttempt != nil {
-		return nameAttempt
-	}
-
-	// Check Redis
-	// TODO: put magic string in method
-	fetchCmd := redis.Get(fmt.Sprintf("esi:names:%d", id))
-
-	// Check for existence
-	if fetchCmd.Err() == nil {
-		// Parse json, populate memory cache, return result
-		var name EsiName
-		err := json.Unmarshal([]byte(fetchCmd.Val()), &name)
-		if err == nil {
-			CachedNames[id] = &name
-			return &name
-		}
-	}
-
-	// If we fail on our two caches, return nothing, they will have to fetch.
-	// The reason we don't automatically call HTTP requests here is two-fold.
-	// 1. Doing an HTTP request to an external service from a seemingly innocuous method name
-	// 		is really bad and will cause stalls in weird places
-	// 2. Rate limiting from ESI. This method does not batch (although it could)
-	return nil
-}
-
-func (server *Server) GetConstellation(id int) *EsiConstellation {
-	// Check our cache first!
-
-	var constellation EsiConstellation
-	cacheAttempt := CachedConstellations[id]
-
-	if cacheAttempt != nil {
-		return cacheAttempt
-	}
-
-	cmd := server.Redis.Get(fmt.Sprintf("esi:constellations:%v", id))
-
-	if cmd.Err() == nil {
-		err := json.Unmarshal([]byte(cmd.Val()), &constellation)
-
-		if err == nil {
-			return &constellation
-		}
-	}
-
-	resp := getEndpointResult(fmt.Sprintf("/latest/universe/constellations/%v", id))
-
-	if resp == nil {
-		return nil
-	}
-
-	err := json.Unmarshal(resp, &constellation)
-
-	if err != nil {
-		return nil
-	}
-
-	// Lets look up the region so it can get cached appropriately
-	name := GetNameForId(constellation.RegionId, server.Redis)
-
-	if name == nil {
-		// Request name
-		server.GetNames(&NameRequest{
-			Ids: []int{constellation.RegionId},
-		})
-
-		name = GetNameForId(constellation.RegionId, server.Redis)
-	}
-
-	if name != nil {
-		// Set it if we got it
-		constellation.RegionName = name.Name
-	}
-
-	// Save to cache!
-	CachedConstellations[id] = &constellation
-	bytes, _ := json.Marshal(constellation)
-
-	// It's ok if this fails
-	server.Redis.Set(fmt.Sprintf("esi:constellations:%v", id), string(bytes), 0)
-
-	return &constellation
-}
-
-func (server *Server) GetSystem(id int) *EsiSystem {
-
-	var system EsiSystem
-	cacheAttempt := CachedSystems[id]
-
-	if cacheAttempt != nil {
-		return cacheAttempt
-	}
-
-	cmd := server.Redis.Get(fmt.Sprintf("esi:systems:%v", id))
-
-	if cmd.Err() == nil {
-		err := json.Unmarshal([]byte(cmd.Val()), &system)
-
-		if err == nil {
-			return &system
-		}
-	}
-
-	resp := getEndpointResult(fmt.Sprintf("/latest/universe/systems/%v", id))
-
-	if resp == nil {
-		return nil
-	}
-
-	err := json.Unmarshal(resp, &system)
-
-	if err != nil {
-		log.Printf("Error %v", err)
-		return nil
-	}
-
-	// Save to cache!
-	CachedSystems[id] = &system
-	bytes, _ := json.Marshal(system)
-
-	// It's ok if this fails
-	server.Redis.Set(fmt.Sprintf("esi:systems:%v", id), string(bytes), 0)
-
-	return &system
-}
-
-func (server *Server) GetRoute(src, dst int) []int {
-	var jumps []int
-
-	cmd := server.Redis.Get(fmt.Sprintf("esi:routes:%v:%v", src, dst))
-
-	if cmd.Err() == nil {
-		err := json.Unmarshal([]byte(cmd.Val()), &jumps)
-
-		if err == nil {
-			return jumps
-		}
-	}
-
-	resp := getEndpointResult(fmt.Sprintf("/latest/route/%v/%v", src, dst))
-
-	if resp == nil {
-		return nil
-	}
-
-	err := json.Unmarshal(resp, &jumps)
-
-	if err != nil {
-		return nil
-	}
-
-	bytes, _ := json.Marshal(jumps)
-
-	server.Redis.Set(fmt.Sprintf("esi:systems:%v:%v", src, dst), string(bytes), 0)
-
-	return jumps
-}
-
-func buildUrl(path string) string {
-	return fmt.Sprintf("%v%v", EsiHostname, path)
-}
-
-func getEndpointResult(path string) []byte {
-	resp, err := http.DefaultClient.Get(buildUrl(path))
-
-	if err != nil {
-		log.Printf("Error requesting %v. Err: %v", path, err)
-		return nil
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-
-	if err != nil {
-		log.Printf("Can't read body! %v", err)
-		return nil
-	}
-
-	return body
-}
-
-func postEndpointResult(path string, v interface{}) []byte {
-	content, err := json.Marshal(v)
-
-	if err != nil {
-		log.Printf("Error marshalling json")
-		return nil
-	}
-
-	resp, err := http.DefaultClient.Post(buildUrl(path), "application/json", bytes.NewBuffer(content))
-
-	if err != nil {
-		log.Printf("Error making http request. %v", err)
-		return nil
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-
-	if err != nil {
-		log.Printf("Can't read body. %v", err)
-		return nil
-	}
-
-	return body
-}
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-redis/redis"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var EsiHostname = "https://esi.evetech.net"
+
+type EsiStatus struct {
+	Players       int       `json:"players"`
+	ServerVersion string    `json:"server_version"`
+	StartTime     time.Time `json:"start_time"`
+}
+
+type EsiIncursion struct {
+	ConstellationId      int `json:"constellation_id"`
+	ConsellationName     string
+	FactionId            int `json:"faction_id"`
+	FactionName          string
+	StagingSolarSystemId int `json:"staging_solar_system_id"`
+	StagingSystem        *EsiSystem
+	HasBoss              bool    `json:"has_boss"`
+	InfestedSolarSystems []int   `json:"infested_solar_systems"`
+	Influence            float32 `json:"influence"`
+	State                string  `json:"state"`
+	Type                 string  `json:"type"`
+	Route                []int   `json:"route"`
+	DeathTime            int     // temp for dead incursions
+}
+
+type NameRequest struct {
+	Ids []int `json:"ids"`
+}
+
+type EsiName struct {
+	Category string `json:"category"`
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+}
+
+type EsiConstellation struct {
+	ConstellationId int    `json:"constellation_id"`
+	Name            string `json:"name"`
+	RegionId        int    `json:"region_id"`
+	RegionName      string `json:"region_name"`
+	Systems         []int  `json:"systems"`
+}
+
+type EsiSystem struct {
+	ConstellationId int     `json:"constellation_id"`
+	Name            string  `json:"name"`
+	SystemId        int     `json:"system_id"`
+	SecurityStatus  float32 `json:"security_status"`
+	SecurityClass   string  `json:"security_class"`
+	Stations        []int   `json:"stations"`
+}
+
+// Cache namespaces and lifetimes. Universe data practically never changes, routes can when gates do.
+const (
+	NameCacheNamespace          = "esi:names"
+	ConstellationCacheNamespace = "esi:constellations"
+	SystemCacheNamespace        = "esi:systems"
+	RouteCacheNamespace         = "esi:routes"
+
+	UniverseCacheTTL = time.Hour * 24 * 30
+	RouteCacheTTL    = time.Hour * 24
+
+	IncursionCacheSeconds = 300
+)
+
+// EsiCaches are all the caches we keep for ESI lookups
+type EsiCaches struct {
+	Names          *Cache
+	Constellations *Cache
+	Systems        *Cache
+	Routes         *Cache
+}
+
+func NewEsiCaches(redis *redis.Client) *EsiCaches {
+	return &EsiCaches{
+		Names:          NewCache(redis, NameCacheNamespace, UniverseCacheTTL),
+		Constellations: NewCache(redis, ConstellationCacheNamespace, UniverseCacheTTL),
+		Systems:        NewCache(redis, SystemCacheNamespace, UniverseCacheTTL),
+		Routes:         NewCache(redis, RouteCacheNamespace, RouteCacheTTL),
+	}
+}
+
+// Prune drops anything expired from the memory tier of every cache
+func (caches *EsiCaches) Prune() {
+	caches.Names.Prune()
+	caches.Constellations.Prune()
+	caches.Systems.Prune()
+	caches.Routes.Prune()
+}
+
+// IncursionCache holds the last list of incursions we fetched. Everything in it is fully populated
+// before it gets stored, so readers must treat the incursions as read only.
+type IncursionCache struct {
+	lock       sync.Mutex
+	incursions []*EsiIncursion
+	lastFetch  int64
+	// Bumped on every list we store, so checks can tell which list they last looked at
+	fetches int64
+	// Kept apart from the lock so reading it never waits on a fetch
+	count int64
+}
+
+// Count is how many incursions were in the last list we fetched
+func (cache *IncursionCache) Count() int {
+	return int(atomic.LoadInt64(&cache.count))
+}
+
+// LastFetch is when ESI last gave us a list we trusted, zero if it hasn't yet
+func (cache *IncursionCache) LastFetch() time.Time {
+	epoch := atomic.LoadInt64(&cache.lastFetch)
+
+	if epoch <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(epoch, 0).UTC()
+}
+
+func GetTqStatus() *EsiStatus {
+	bytes := getEndpointResult("/latest/status")
+	if bytes == nil {
+		return nil
+	}
+
+	var esiStatus EsiStatus
+	json.Unmarshal(bytes, &esiStatus)
+
+	return &esiStatus
+}
+
+func (server *Server) GetNames(ids *NameRequest) []*EsiName {
+	// Sweet sweet copying data
+	ids.Ids = UniqueInts(ids.Ids)
+
+	bytes := postEndpointResult("/latest/universe/names", ids.Ids)
+
+	if bytes == nil {
+		return nil
+	}
+
+	var names []*EsiName
+	err := json.Unmarshal(bytes, &names)
+
+	if err != nil {
+		Log.Warn("Unable to parse names from ESI", LogFields{"error": err})
+		return nil
+	}
+
+	// Populate the names cache
+	for _, name := range names {
+		server.Caches.Names.Set(name.Id, name)
+	}
+
+	return names
+}
+
+// Gets a list of the current incursions and returns whether or not it was cached or a new set
+func (server *Server) GetIncursions() ([]*EsiIncursion, bool) {
+	incursions, _, new := server.fetchIncursions()
+	return incursions, new
+}
+
+// fetchIncursions is GetIncursions that also says which fetch the list came from. Whoever happens to call
+// first gets the new set, so anything diffing lists has to go by this rather than by the new flag.
+func (server *Server) fetchIncursions() ([]*EsiIncursion, int64, bool) {
+	cache := &server.Incursions
+
+	// Only one fetch at a time, everyone else can wait for the result
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if GetEpoch()-cache.lastFetch <= IncursionCacheSeconds {
+		return cache.incursions, cache.fetches, false
+	}
+
+	bytes := getEndpointResult("/latest/incursions")
+
+	if bytes == nil {
+		return nil, cache.fetches, false
+	}
+
+	var incursions []*EsiIncursion
+	err := json.Unmarshal(bytes, &incursions)
+
+	if err != nil {
+		Log.Warn("Unable to parse incursions from ESI", LogFields{"error": err})
+		return nil, cache.fetches, false
+	}
+
+	if err = validateIncursions(incursions); err != nil {
+		Log.Warn("Rejecting incursion response from ESI", LogFields{"error": err})
+		atomic.AddInt64(&IncursionAnomalies.RejectedResponses, 1)
+		return nil, cache.fetches, false
+	}
+
+	server.PopulateIncursionData(incursions)
+
+	cache.incursions = incursions
+	cache.fetches++
+	// Stored atomically for LastFetch, everything else reads it under the lock
+	atomic.StoreInt64(&cache.lastFetch, GetEpoch())
+	atomic.StoreInt64(&cache.count, int64(len(incursions)))
+	return incursions, cache.fetches, true
+}
+
+func (server *Server) PopulateIncursionData(incursions []*EsiIncursion) {
+	ids := &NameRequest{
+		Ids: make([]int, 0),
+	}
+
+	// Populate with names
+	for _, incursion := range incursions {
+		constellation := server.GetNameForId(incursion.ConstellationId)
+
+		if constellation != nil {
+			incursion.ConsellationName = constellation.Name
+		} else {
+			ids.Ids = append(ids.Ids, incursion.ConstellationId)
+		}
+	}
+
+	if len(ids.Ids) > 0 {
+		server.GetNames(ids)
+
+		// Populate with names, again
+		for _, incursion := range incursions {
+			constellation := server.GetNameForId(incursion.ConstellationId)
+
+			if constellation != nil {
+				incursion.ConsellationName = constellation.Name
+			}
+		}
+	}
+
+	// Grab system and jump data
+	for _, incursion := range incursions {
+		if len(incursion.FactionName) <= 0 {
+			incursion.FactionName = server.GetFactionName(incursion.FactionId)
+		}
+
+		// only fetch if we need it
+		if incursion.StagingSystem == nil {
+			system := server.GetSystem(incursion.StagingSolarSystemId)
+
+			incursion.StagingSystem = system
+		}
+
+		if len(incursion.Route) <= 0 {
+			route := server.GetRoute(server.Config.DefaultStagingSystemId, incursion.StagingSolarSystemId)
+
+			incursion.Route = route
+		}
+	}
+}
+
+func (server *Server) GetNameForId(id int) *EsiName {
+	var name EsiName
+
+	// Static data never needs a lookup
+	if universeName := server.Universe.Name(id); universeName != nil {
+		return universeName
+	}
+
+	// Check our caches
+	if server.Caches.Names.Get(id, &name) {
+		return &name
+	}
+
+	// If we fail on our two caches, return nothing, they will have to fetch.
+	// The reason we don't automatically call HTTP requests here is two-fold.
+	// 1. Doing an HTTP request to an external service from a seemingly innocuous method name
+	// 		is really bad and will cause stalls in weird places
+	// 2. Rate limiting from ESI. This method does not batch (although it could)
+	return nil
+}
+
+func (server *Server) GetConstellation(id int) *EsiConstellation {
+	var constellation EsiConstellation
+
+	if universeConstellation := server.Universe.Constellation(id); universeConstellation != nil {
+		return server.Universe.EsiConstellation(universeConstellation)
+	}
+
+	// Check our cache first!
+	if server.Caches.Constellations.Get(id, &constellation) {
+		return &constellation
+	}
+
+	resp := getEndpointResult(fmt.Sprintf("/latest/universe/constellations/%v", id))
+
+	if resp == nil {
+		return nil
+	}
+
+	err := json.Unmarshal(resp, &constellation)
+
+	if err != nil {
+		return nil
+	}
+
+	// Lets look up the region so it can get cached appropriately
+	name := server.GetNameForId(constellation.RegionId)
+
+	if name == nil {
+		// Request name
+		server.GetNames(&NameRequest{
+			Ids: []int{constellation.RegionId},
+		})
+
+		name = server.GetNameForId(constellation.RegionId)
+	}
+
+	if name != nil {
+		// Set it if we got it
+		constellation.RegionName = name.Name
+	}
+
+	// Save to cache!
+	server.Caches.Constellations.Set(id, constellation)
+
+	return &constellation
+}
+
+func (server *Server) GetSystem(id int) *EsiSystem {
+	var system EsiSystem
+
+	if universeSystem := server.Universe.System(id); universeSystem != nil {
+		return universeSystem.EsiSystem()
+	}
+
+	if server.Caches.Systems.Get(id, &system) {
+		return &system
+	}
+
+	resp := getEndpointResult(fmt.Sprintf("/latest/universe/systems/%v", id))
+
+	if resp == nil {
+		return nil
+	}
+
+	err := json.Unmarshal(resp, &system)
+
+	if err != nil {
+		Log.Warn("Unable to parse system from ESI", LogFields{"system": id, "error": err})
+		return nil
+	}
+
+	// Save to cache!
+	server.Caches.Systems.Set(id, system)
+
+	return &system
+}
+
+func (server *Server) GetRoute(src, dst int) []int {
+	return server.GetRouteWithOptions(src, dst, server.Config.DefaultRouteOptions())
+}
+
+// GetRouteWithOptions calculates the route locally when we have the SDE, otherwise it asks ESI
+func (server *Server) GetRouteWithOptions(src, dst int, options RouteOptions) []int {
+	if server.Universe != nil {
+		return server.Universe.Route(src, dst, options)
+	}
+
+	var jumps []int
+
+	key := options.cacheKey(src, dst)
+
+	if server.Caches.Routes.Get(key, &jumps) {
+		return jumps
+	}
+
+	// ESI doesn't know about secure-only, secure is the closest it gets
+	flag := options.preference()
+	if flag == RouteSecureOnly {
+		flag = RouteSecure
+	}
+
+	path := fmt.Sprintf("/latest/route/%v/%v?flag=%v", src, dst, flag)
+	for _, id := range options.Avoid {
+		path += fmt.Sprintf("&avoid=%v", id)
+	}
+
+	resp := getEndpointResult(path)
+
+	if resp == nil {
+		return nil
+	}
+
+	err := json.Unmarshal(resp, &jumps)
+
+	if err != nil {
+		return nil
+	}
+
+	server.Caches.Routes.Set(key, jumps)
+
+	return jumps
+}
+
+func buildUrl(path string) string {
+	return fmt.Sprintf("%v%v", EsiHostname, path)
+}
+
+func getEndpointResult(path string) []byte {
+	start := time.Now()
+	resp, err := http.DefaultClient.Get(buildUrl(path))
+	observeEsiRequest(http.MethodGet, path, start, resp)
+
+	if err != nil {
+		Log.Warn("ESI request failed", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+	defer resp.Body.Close()
+
+	// ESI answers errors with a json body, don't hand that back as if it were the result
+	if resp.StatusCode != http.StatusOK {
+		Log.Warn("ESI returned an error", LogFields{"esi_path": path, "status": resp.StatusCode})
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		Log.Warn("Unable to read ESI response", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+
+	return body
+}
+
+// getAuthenticatedEndpointResult is getEndpointResult for endpoints that need a character's access token
+func getAuthenticatedEndpointResult(path, accessToken string) []byte {
+	request, err := http.NewRequest(http.MethodGet, buildUrl(path), nil)
+
+	if err != nil {
+		Log.Error("Unable to build ESI request", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(request)
+	observeEsiRequest(http.MethodGet, path, start, resp)
+
+	if err != nil {
+		Log.Warn("ESI request failed", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		Log.Warn("ESI returned an error", LogFields{"esi_path": path, "status": resp.StatusCode})
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		Log.Warn("Unable to read ESI response", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+
+	return body
+}
+
+func postEndpointResult(path string, v interface{}) []byte {
+	content, err := json.Marshal(v)
+
+	if err != nil {
+		Log.Error("Unable to encode ESI request", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Post(buildUrl(path), "application/json", bytes.NewBuffer(content))
+	observeEsiRequest(http.MethodPost, path, start, resp)
+
+	if err != nil {
+		Log.Warn("ESI request failed", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		Log.Warn("ESI returned an error", LogFields{"esi_path": path, "status": resp.StatusCode})
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		Log.Warn("Unable to read ESI response", LogFields{"esi_path": path, "error": err})
+		return nil
+	}
+
+	return body
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventSpawned      EventType = "spawned"
+	EventStateChanged EventType = "state_changed"
+	EventBossSpawned  EventType = "boss_spawned"
+	EventDespawned    EventType = "despawned"
+)
+
+// How many events a subscriber can fall behind by before it starts missing them
+const subscriberBuffer = 32
+
+const (
+	eventsKey       = "bot:events"
+	eventsNextIdKey = "bot:events:next_id"
+
+	// How many events we keep for the history
+	maxEvents = 1000
+)
+
+// IncursionEvent is something that happened to an incursion, with enough of the incursion copied in that
+// it still makes sense long after the incursion is gone
+type IncursionEvent struct {
+	Id                int64     `json:"id"`
+	Type              EventType `json:"type"`
+	At                time.Time `json:"at"`
+	ConstellationId   int       `json:"constellation_id"`
+	ConstellationName string    `json:"constellation_name"`
+	RegionName        string    `json:"region_name"`
+	StagingSystemId   int       `json:"staging_system_id"`
+	StagingSystemName string    `json:"staging_system_name"`
+	SecurityStatus    float32   `json:"security_status"`
+	FactionId         int       `json:"faction_id"`
+	FactionName       string    `json:"faction_name"`
+	State             string    `json:"state"`
+	PreviousState     string    `json:"previous_state,omitempty"`
+	Influence         float32   `json:"influence"`
+	HasBoss           bool      `json:"has_boss"`
+}
+
+// EventHub hands every recorded event to whoever is streaming them
+type EventHub struct {
+	lock        sync.Mutex
+	subscribers map[chan *IncursionEvent]bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: make(map[chan *IncursionEvent]bool),
+	}
+}
+
+func (hub *EventHub) Subscribe() chan *IncursionEvent {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	events := make(chan *IncursionEvent, subscriberBuffer)
+	hub.subscribers[events] = true
+	return events
+}
+
+func (hub *EventHub) Unsubscribe(events chan *IncursionEvent) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	delete(hub.subscribers, events)
+}
+
+func (hub *EventHub) Count() int {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	return len(hub.subscribers)
+}
+
+// Publish never blocks the incursion checker, a subscriber that isn't keeping up misses the event
+func (hub *EventHub) Publish(event *IncursionEvent) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+
+	for events := range hub.subscribers {
+		select {
+		case events <- event:
+		default:
+			Log.Warn("Event stream subscriber is full, dropping event", LogFields{"event": event.Id})
+		}
+	}
+}
+
+func (server *Server) NewIncursionEvent(eventType EventType, incursion *EsiIncursion, previousState string) *IncursionEvent {
+	event := &IncursionEvent{
+		Type:              eventType,
+		At:                time.Now().UTC(),
+		ConstellationId:   incursion.ConstellationId,
+		ConstellationName: incursion.ConsellationName,
+		StagingSystemId:   incursion.StagingSolarSystemId,
+		FactionId:         incursion.FactionId,
+		FactionName:       incursion.FactionName,
+		State:             incursion.State,
+		PreviousState:     previousState,
+		Influence:         incursion.Influence,
+		HasBoss:           incursion.HasBoss,
+	}
+
+	if incursion.StagingSystem != nil {
+		event.StagingSystemName = incursion.StagingSystem.Name
+		event.SecurityStatus = incursion.StagingSystem.SecurityStatus
+	}
+
+	if constellation := server.GetConstellationForIncursion(incursion); constellation != nil {
+		event.RegionName = constellation.RegionName
+	}
+
+	return event
+}
+
+// RecordEvent numbers the event and adds it to the front of the history
+func (server *Server) RecordEvent(logger *Logger, event *IncursionEvent) {
+	id, err := server.Redis.Incr(eventsNextIdKey).Result()
+
+	if err != nil {
+		logger.Error("Unable to number event", LogFields{"type": event.Type, "staging": event.StagingSystemName, "error": err})
+		return
+	}
+
+	event.Id = id
+
+	bytes, err := json.Marshal(event)
+
+	if err != nil {
+		logger.Error("Unable to save event", LogFields{"type": event.Type, "staging": event.StagingSystemName, "error": err})
+		return
+	}
+
+	server.Redis.LPush(eventsKey, string(bytes))
+	server.Redis.LTrim(eventsKey, 0, maxEvents-1)
+
+	server.Events.Publish(event)
+}
+
+// GetEvents returns up to count events, newest first, skipping the first offset
+func (server *Server) GetEvents(offset, count int) []*IncursionEvent {
+	events := make([]*IncursionEvent, 0, count)
+
+	for _, raw := range server.Redis.LRange(eventsKey, int64(offset), int64(offset+count-1)).Val() {
+		var event IncursionEvent
+
+		if err := json.Unmarshal([]byte(raw), &event); err != nil {
+			Log.Warn("Unable to parse event", LogFields{"error": err})
+			continue
+		}
+
+		events = append(events, &event)
+	}
+
+	return events
+}
+
+// CountEvents is how much history we have
+func (server *Server) CountEvents() int {
+	return int(server.Redis.LLen(eventsKey).Val())
+}
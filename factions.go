@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	FactionSanshasNation = 500019
+	FactionTriglavian    = 500026
+)
+
+// Factions that have run incursions. Anything else gets resolved through ESI.
+var knownFactions = map[int]string{
+	FactionSanshasNation: "Sansha's Nation",
+	FactionTriglavian:    "Triglavian Collective",
+}
+
+// IncursionRules are the parts of an incursion that depend on who is running it
+type IncursionRules struct {
+	// What each ESI state means for this kind of incursion
+	StateNames map[string]string
+	// Roughly how long is left once the incursion reaches a state
+	StateTimers map[string]string
+	// Whether the boss spawning is worth telling anyone about
+	HasBoss bool
+}
+
+// Sansha incursions run established (up to 5 days) > mobilizing (48h) > withdrawing (24h) and spawn a mothership in the HQ
+var sanshaRules = &IncursionRules{
+	StateNames: map[string]string{
+		"established": "established",
+		"mobilizing":  "mobilizing",
+		"withdrawing": "withdrawing",
+	},
+	StateTimers: map[string]string{
+		"established": "up to 5 days left",
+		"mobilizing":  "about 48 hours left",
+		"withdrawing": "about 24 hours left",
+	},
+	HasBoss: true,
+}
+
+// Triglavian events don't have a boss and don't follow the Sansha timers, so we only translate the states
+var triglavianRules = &IncursionRules{
+	StateNames: map[string]string{
+		"established": "invading",
+		"mobilizing":  "escalating",
+		"withdrawing": "retreating",
+	},
+	StateTimers: map[string]string{},
+	HasBoss:     false,
+}
+
+// The incursion type ESI reports for every incursion, whoever is running it
+const IncursionTypeDefault = "Incursion"
+
+// Rules by faction, which is what decides how an incursion plays out
+var rulesByFaction = map[int]*IncursionRules{
+	FactionSanshasNation: sanshaRules,
+	FactionTriglavian:    triglavianRules,
+}
+
+// Rules by the type ESI reports, lower cased, for factions we don't know. Only types that name a kind of their
+// own belong here, never IncursionTypeDefault.
+var rulesByType = map[string]*IncursionRules{}
+
+// RulesForIncursion picks the rules by faction, then by type for factions we don't know, and falls back
+// to Sansha since that's what ESI has always reported
+func RulesForIncursion(incursion *EsiIncursion) *IncursionRules {
+	if rules, ok := rulesByFaction[incursion.FactionId]; ok {
+		return rules
+	}
+
+	if rules, ok := rulesByType[strings.ToLower(strings.TrimSpace(incursion.Type))]; ok {
+		return rules
+	}
+
+	return sanshaRules
+}
+
+// DescribeKind is who is running the incursion and what type ESI says it is, like "Sansha's Nation Incursion"
+func DescribeKind(incursion *EsiIncursion) string {
+	kind := strings.TrimSpace(incursion.Type)
+
+	if len(kind) <= 0 {
+		kind = IncursionTypeDefault
+	}
+
+	if len(incursion.FactionName) <= 0 {
+		return kind
+	}
+
+	return fmt.Sprintf("%v %v", incursion.FactionName, kind)
+}
+
+// DescribeState is the state as players of this kind of incursion know it, plus how long it has left when we know that
+func (rules *IncursionRules) DescribeState(state string) string {
+	name, ok := rules.StateNames[state]
+
+	if !ok {
+		name = state
+	}
+
+	if timer, ok := rules.StateTimers[state]; ok {
+		return fmt.Sprintf("%v (%v)", name, timer)
+	}
+
+	return name
+}
+
+// GetFactionName resolves the faction running an incursion
+func (server *Server) GetFactionName(id int) string {
+	if name, ok := knownFactions[id]; ok {
+		return name
+	}
+
+	name := server.GetNameForId(id)
+
+	if name == nil {
+		server.GetNames(&NameRequest{Ids: []int{id}})
+		name = server.GetNameForId(id)
+	}
+
+	if name == nil {
+		return fmt.Sprintf("Faction %v", id)
+	}
+
+	return name.Name
+}
+
+// FindFaction matches part of a faction name, so "sansha" or "trig" are enough. An exact name wins over a prefix,
+// which wins over a match anywhere in the name, and ties go to the lowest faction id.
+func FindFaction(name string) (int, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if len(name) <= 0 {
+		return 0, false
+	}
+
+	ids := make([]int, 0, len(knownFactions))
+	for id := range knownFactions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	found, foundRank := 0, 0
+
+	for _, id := range ids {
+		faction := strings.ToLower(knownFactions[id])
+		rank := 0
+
+		switch {
+		case faction == name:
+			rank = 3
+		case strings.HasPrefix(faction, name):
+			rank = 2
+		case strings.Contains(faction, name):
+			rank = 1
+		}
+
+		if rank > foundRank {
+			found, foundRank = id, rank
+		}
+	}
+
+	return found, foundRank > 0
+}
+
+// WantsFaction is true if the guild hasn't filtered factions or has this one in its list
+func (settings *GuildSettings) WantsFaction(factionId int) bool {
+	if len(settings.Factions) <= 0 {
+		return true
+	}
+
+	for _, id := range settings.Factions {
+		if id == factionId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (server *Server) SetFactions(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	args := strings.Fields(strings.Replace(message.Content, "!setfactions", "", -1))
+	factions := make([]int, 0, len(args))
+	names := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		if strings.ToLower(arg) == "all" {
+			factions = make([]int, 0)
+			names = make([]string, 0)
+			break
+		}
+
+		id, found := FindFaction(arg)
+
+		if !found {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Unknown faction %q", arg))
+			return
+		}
+
+		factions = append(factions, id)
+		names = append(names, knownFactions[id])
+	}
+
+	settings := server.GetGuildSettings(guildId)
+	settings.Factions = UniqueInts(factions)
+
+	if err := server.SaveGuildSettings(guildId, settings); err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to set factions. Error: %v", err))
+		return
+	}
+
+	if len(names) <= 0 {
+		server.SendMessage(message.ChannelID, "Showing incursions from every faction")
+		return
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("Only showing incursions from %v", strings.Join(names, ", ")))
+}
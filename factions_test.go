@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRulesForIncursion(t *testing.T) {
+	rulesByType["invasion"] = triglavianRules
+	defer delete(rulesByType, "invasion")
+
+	tests := []struct {
+		name      string
+		incursion *EsiIncursion
+		want      *IncursionRules
+	}{
+		{"sansha", &EsiIncursion{FactionId: FactionSanshasNation, Type: "Incursion"}, sanshaRules},
+		{"triglavian with the type ESI reports", &EsiIncursion{FactionId: FactionTriglavian, Type: "Incursion"}, triglavianRules},
+		{"faction wins over type", &EsiIncursion{FactionId: FactionSanshasNation, Type: "Invasion"}, sanshaRules},
+		{"unknown faction falls back to type", &EsiIncursion{FactionId: 1, Type: " Invasion "}, triglavianRules},
+		{"unknown faction with the default type", &EsiIncursion{FactionId: 1, Type: "Incursion"}, sanshaRules},
+		{"unknown everything", &EsiIncursion{FactionId: 1, Type: "Something"}, sanshaRules},
+	}
+
+	for _, test := range tests {
+		if rules := RulesForIncursion(test.incursion); rules != test.want {
+			t.Errorf("%v: got the wrong rules", test.name)
+		}
+	}
+}
+
+func TestDescribeKind(t *testing.T) {
+	tests := []struct {
+		incursion *EsiIncursion
+		want      string
+	}{
+		{&EsiIncursion{FactionName: "Sansha's Nation", Type: "Incursion"}, "Sansha's Nation Incursion"},
+		{&EsiIncursion{FactionName: "Sansha's Nation"}, "Sansha's Nation Incursion"},
+		{&EsiIncursion{Type: "Invasion"}, "Invasion"},
+	}
+
+	for _, test := range tests {
+		if kind := DescribeKind(test.incursion); kind != test.want {
+			t.Errorf("DescribeKind = %q, want %q", kind, test.want)
+		}
+	}
+}
+
+func TestFindFaction(t *testing.T) {
+	tests := []struct {
+		name  string
+		want  int
+		found bool
+	}{
+		{"sansha", FactionSanshasNation, true},
+		{"Triglavian Collective", FactionTriglavian, true},
+		{"trig", FactionTriglavian, true},
+		{"nation", FactionSanshasNation, true},
+		{"a", FactionSanshasNation, true},
+		{"drifters", 0, false},
+		{" ", 0, false},
+	}
+
+	for _, test := range tests {
+		// Map order changes between runs, so ask more than once
+		for i := 0; i < 10; i++ {
+			id, found := FindFaction(test.name)
+
+			if id != test.want || found != test.found {
+				t.Fatalf("FindFaction(%q) = %v, %v, want %v, %v", test.name, id, found, test.want, test.found)
+			}
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// How many entries a feed carries
+	feedLength = 50
+
+	// Atom needs someone to credit, the entries are all the bot's own
+	feedAuthor = "Incursion Bot"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Id      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary"`
+	Link    atomLink `xml:"link"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Guid        rssGuid `xml:"guid"`
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+// rssGuid is an id, not a link, readers assume a guid is a permalink unless told otherwise
+type rssGuid struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// SecurityBand is highsec, lowsec or nullsec the way players split space up. The game rounds to one decimal
+// before deciding, so 0.04 is a 0.0 nullsec system.
+func SecurityBand(security float32) string {
+	switch {
+	case IsHighSec(security):
+		return "highsec"
+	case security >= LowSecThreshold:
+		return "lowsec"
+	}
+	return "nullsec"
+}
+
+// feedFilter applies ?security=highsec,lowsec,nullsec and ?region=<name>,<name>
+func feedFilter(c *gin.Context) func(event *IncursionEvent) bool {
+	bands := splitFilter(c.Query("security"))
+	regions := splitFilter(c.Query("region"))
+
+	return func(event *IncursionEvent) bool {
+		if len(bands) > 0 && !Exists(bands, SecurityBand(event.SecurityStatus)) {
+			return false
+		}
+
+		if len(regions) > 0 && !Exists(regions, strings.ToLower(event.RegionName)) {
+			return false
+		}
+
+		return true
+	}
+}
+
+func splitFilter(value string) []string {
+	values := make([]string, 0)
+
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		if part = strings.TrimSpace(part); len(part) > 0 {
+			values = append(values, part)
+		}
+	}
+
+	return values
+}
+
+// DescribeEvent is the one line headline for an event
+func DescribeEvent(event *IncursionEvent) string {
+	where := fmt.Sprintf("%v (%v, %v)", event.StagingSystemName, event.ConstellationName, event.RegionName)
+
+	switch event.Type {
+	case EventSpawned:
+		return fmt.Sprintf("%v incursion spawned in %v", event.FactionName, where)
+	case EventStateChanged:
+		return fmt.Sprintf("Incursion in %v is now %v", where, event.State)
+	case EventBossSpawned:
+		return fmt.Sprintf("Boss spawned in the incursion in %v", where)
+	case EventDespawned:
+		return fmt.Sprintf("Incursion in %v has despawned", where)
+	}
+
+	return fmt.Sprintf("Incursion in %v: %v", where, event.Type)
+}
+
+func describeEventDetails(event *IncursionEvent) string {
+	details := fmt.Sprintf("%v, staging in %v {%.1f %v}, influence %.1f%%", event.FactionName, event.StagingSystemName, event.SecurityStatus, SecurityBand(event.SecurityStatus), event.Influence*100)
+
+	if len(event.PreviousState) > 0 && event.PreviousState != event.State {
+		details += fmt.Sprintf(", %v -> %v", event.PreviousState, event.State)
+	}
+
+	return details
+}
+
+// feedEvents are the newest events that pass the filters
+func (server *Server) feedEvents(c *gin.Context) []*IncursionEvent {
+	wanted := feedFilter(c)
+	events := make([]*IncursionEvent, 0, feedLength)
+
+	for _, event := range server.GetEvents(0, maxEvents) {
+		if wanted(event) {
+			events = append(events, event)
+		}
+
+		if len(events) >= feedLength {
+			break
+		}
+	}
+
+	return events
+}
+
+func feedBaseUrl() string {
+	return strings.TrimSuffix(os.Getenv("HOSTED_URL"), "/")
+}
+
+func (server *Server) atomFeed(c *gin.Context) {
+	events := server.feedEvents(c)
+	base := feedBaseUrl()
+
+	feed := &atomFeed{
+		Id:      base + "/feeds/incursions.atom",
+		Title:   "Incursions",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: feedAuthor},
+		Link:    atomLink{Href: base + c.Request.URL.RequestURI(), Rel: "self"},
+		Entries: make([]atomEntry, 0, len(events)),
+	}
+
+	if len(events) > 0 {
+		feed.Updated = events[0].At.UTC().Format(time.RFC3339)
+	}
+
+	for _, event := range events {
+		feed.Entries = append(feed.Entries, atomEntry{
+			Id:      fmt.Sprintf("%v/feeds/incursions.atom#event-%d", base, event.Id),
+			Title:   DescribeEvent(event),
+			Updated: event.At.UTC().Format(time.RFC3339),
+			Summary: describeEventDetails(event),
+			Link:    atomLink{Href: base + "/dashboard/history"},
+		})
+	}
+
+	server.renderFeed(c, "application/atom+xml; charset=utf-8", feed)
+}
+
+func (server *Server) rssFeed(c *gin.Context) {
+	events := server.feedEvents(c)
+	base := feedBaseUrl()
+
+	feed := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:       "Incursions",
+			Link:        base + "/dashboard",
+			Description: "Incursion spawns, state changes and despawns",
+			Items:       make([]rssItem, 0, len(events)),
+		},
+	}
+
+	for _, event := range events {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Guid:        rssGuid{IsPermaLink: "false", Value: fmt.Sprintf("%v/feeds/incursions.rss#event-%d", base, event.Id)},
+			Title:       DescribeEvent(event),
+			Link:        base + "/dashboard/history",
+			Description: describeEventDetails(event),
+			PubDate:     event.At.UTC().Format(time.RFC1123Z),
+		})
+	}
+
+	server.renderFeed(c, "application/rss+xml; charset=utf-8", feed)
+}
+
+func (server *Server) renderFeed(c *gin.Context, contentType string, feed interface{}) {
+	body, err := xml.MarshalIndent(feed, "", "  ")
+
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unable to build feed")
+		return
+	}
+
+	c.Data(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSecurityBand(t *testing.T) {
+	tests := []struct {
+		security float32
+		want     string
+	}{
+		{1.0, "highsec"},
+		{0.5, "highsec"},
+		{0.45, "highsec"},
+		{0.44, "lowsec"},
+		{0.1, "lowsec"},
+		{0.05, "lowsec"},
+		{0.04, "nullsec"},
+		{0.01, "nullsec"},
+		{0.0, "nullsec"},
+		{-0.5, "nullsec"},
+	}
+
+	for _, test := range tests {
+		if band := SecurityBand(test.security); band != test.want {
+			t.Errorf("SecurityBand(%v) = %v, want %v", test.security, band, test.want)
+		}
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	server.RecordEvent(Log, &IncursionEvent{
+		Type:              EventSpawned,
+		At:                time.Now(),
+		StagingSystemName: "Staging",
+		SecurityStatus:    0.7,
+		FactionName:       "Sansha's Nation",
+	})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/feeds/incursions.atom", server.atomFeed)
+	router.GET("/feeds/incursions.rss", server.rssFeed)
+
+	get := func(path string) string {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Body.String()
+	}
+
+	if atom := get("/feeds/incursions.atom"); !strings.Contains(atom, "<author>") || !strings.Contains(atom, "<entry>") {
+		t.Errorf("atom feed is missing the author or entries:\n%v", atom)
+	}
+
+	if rss := get("/feeds/incursions.rss"); !strings.Contains(rss, `<guid isPermaLink="false">`) {
+		t.Errorf("rss guid isn't marked as not a permalink:\n%v", rss)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Fit is an EFT formatted fit broken down into what we compare
+type Fit struct {
+	Ship string `json:"ship"`
+	Name string `json:"name"`
+	// Module name to how many are fitted, charges are ignored
+	Modules map[string]int `json:"modules"`
+	// Drones and cargo with their quantities
+	Items    map[string]int `json:"items"`
+	Implants []string       `json:"implants"`
+	// The fit as it was pasted, so it can be handed back out
+	Raw string `json:"raw"`
+}
+
+// FitDiff is what a pilot needs to change to match a doctrine fit
+type FitDiff struct {
+	Missing         map[string]int
+	Extra           map[string]int
+	MissingImplants []string
+	ExtraImplants   []string
+	WrongShip       bool
+}
+
+var (
+	eftHeader   = regexp.MustCompile(`^\[([^,\]]+),\s*([^\]]*)\]$`)
+	eftQuantity = regexp.MustCompile(`^(.+?)\s+x(\d+)$`)
+	emptySlot   = regexp.MustCompile(`^\[Empty .+ slot\]$`)
+
+	// EFT has no section for implants, pyfa and the in game export just list them after the cargo.
+	// They're recognised by the manufacturer or set prefix, or by the slot code most of them end in (EM-802, ZMX10).
+	implantPrefix = regexp.MustCompile(`(?i)^(hardwiring|(high|mid|low)-grade |genolution |inherent implants |eifyr and co\. |zainou |poteque |ogdin's |pashan's |zor's |shaqil's |whelan machorin's |(synth|standard|improved|strong|agency) .+ booster$)`)
+	implantSlot   = regexp.MustCompile(`\b[A-Z]{1,3}-?\d{2,4}$`)
+)
+
+func isImplant(line string) bool {
+	return !strings.Contains(line, ",") && (implantPrefix.MatchString(line) || implantSlot.MatchString(line))
+}
+
+// ParseEFT reads a fit in the EFT format that pyfa and the game both export
+func ParseEFT(text string) (*Fit, error) {
+	lines := strings.Split(strings.Replace(strings.TrimSpace(text), "\r\n", "\n", -1), "\n")
+
+	if len(lines) <= 0 {
+		return nil, errors.New("fit is empty")
+	}
+
+	header := eftHeader.FindStringSubmatch(strings.TrimSpace(lines[0]))
+
+	if header == nil {
+		return nil, errors.New("fits start with [Ship, Fit name]")
+	}
+
+	fit := &Fit{
+		Ship:     strings.TrimSpace(header[1]),
+		Name:     strings.TrimSpace(header[2]),
+		Modules:  make(map[string]int),
+		Items:    make(map[string]int),
+		Implants: make([]string, 0),
+		Raw:      strings.TrimSpace(text),
+	}
+
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+
+		if len(line) <= 0 || emptySlot.MatchString(line) {
+			continue
+		}
+
+		// Drones, fighters and cargo
+		if match := eftQuantity.FindStringSubmatch(line); match != nil {
+			count, _ := strconv.Atoi(match[2])
+			fit.Items[strings.TrimSpace(match[1])] += count
+			continue
+		}
+
+		if isImplant(line) {
+			fit.Implants = append(fit.Implants, line)
+			continue
+		}
+
+		// Modules can have a charge loaded, "Module, Charge"
+		module := strings.TrimSpace(strings.SplitN(line, ",", 2)[0])
+		// Offline modules are marked with /OFFLINE
+		module = strings.TrimSpace(strings.TrimSuffix(module, "/OFFLINE"))
+
+		fit.Modules[module]++
+	}
+
+	return fit, nil
+}
+
+// Compare works out how fit differs from the doctrine
+func (doctrine *Fit) Compare(fit *Fit) *FitDiff {
+	diff := &FitDiff{
+		Missing:         make(map[string]int),
+		Extra:           make(map[string]int),
+		MissingImplants: make([]string, 0),
+		ExtraImplants:   make([]string, 0),
+		WrongShip:       !strings.EqualFold(doctrine.Ship, fit.Ship),
+	}
+
+	compareCounts(doctrine.Modules, fit.Modules, diff)
+	compareCounts(doctrine.Items, fit.Items, diff)
+
+	// Implants go both ways like modules, so swapping one for another shows up as missing one and having the other
+	for _, implant := range doctrine.Implants {
+		if !Exists(fit.Implants, implant) {
+			diff.MissingImplants = append(diff.MissingImplants, implant)
+		}
+	}
+
+	for _, implant := range fit.Implants {
+		if !Exists(doctrine.Implants, implant) {
+			diff.ExtraImplants = append(diff.ExtraImplants, implant)
+		}
+	}
+
+	return diff
+}
+
+func compareCounts(want, have map[string]int, diff *FitDiff) {
+	for name, count := range want {
+		if have[name] < count {
+			diff.Missing[name] += count - have[name]
+		}
+	}
+
+	for name, count := range have {
+		if want[name] < count {
+			diff.Extra[name] += count - want[name]
+		}
+	}
+}
+
+func (diff *FitDiff) Matches() bool {
+	return !diff.WrongShip && len(diff.Missing) == 0 && len(diff.Extra) == 0 && len(diff.MissingImplants) == 0 && len(diff.ExtraImplants) == 0
+}
+
+func describeCounts(counts map[string]int) string {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%dx %v", counts[name], name))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func doctrinesKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:doctrines", guildId)
+}
+
+// GetDoctrineFits returns every fit in the guild's doctrines, keyed by doctrine name then ship
+func (server *Server) GetDoctrineFits(guildId string) map[string][]*Fit {
+	doctrines := make(map[string][]*Fit)
+
+	cmd := server.Redis.HGetAll(doctrinesKey(guildId))
+
+	if cmd.Err() != nil {
+		return doctrines
+	}
+
+	for name, raw := range cmd.Val() {
+		var fits []*Fit
+
+		if err := json.Unmarshal([]byte(raw), &fits); err != nil {
+			Log.Warn("Unable to parse doctrine", LogFields{"guild": guildId, "doctrine": name, "error": err})
+			continue
+		}
+
+		doctrines[name] = fits
+	}
+
+	return doctrines
+}
+
+// SaveDoctrineFit adds the fit to the doctrine, replacing any fit for the same ship and name
+func (server *Server) SaveDoctrineFit(guildId, doctrine string, fit *Fit) error {
+	fits := server.GetDoctrineFits(guildId)[doctrine]
+
+	remaining := make([]*Fit, 0, len(fits)+1)
+	for _, existing := range fits {
+		if !strings.EqualFold(existing.Ship, fit.Ship) || !strings.EqualFold(existing.Name, fit.Name) {
+			remaining = append(remaining, existing)
+		}
+	}
+	remaining = append(remaining, fit)
+
+	bytes, err := json.Marshal(remaining)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Redis.HSet(doctrinesKey(guildId), doctrine, string(bytes)).Err()
+}
+
+// closestDoctrineFit picks the fit for the same hull with the fewest differences
+func closestDoctrineFit(fits []*Fit, fit *Fit) (*Fit, *FitDiff) {
+	var best *Fit
+	var bestDiff *FitDiff
+	bestScore := -1
+
+	for _, candidate := range fits {
+		diff := candidate.Compare(fit)
+		score := len(diff.Missing) + len(diff.Extra) + len(diff.MissingImplants) + len(diff.ExtraImplants)
+
+		if diff.WrongShip {
+			score += 1000
+		}
+
+		if bestScore < 0 || score < bestScore {
+			best, bestDiff, bestScore = candidate, diff, score
+		}
+	}
+
+	return best, bestDiff
+}
+
+// splitFitCommand separates "!command args" on the first line from the fit pasted below it
+func splitFitCommand(content string) ([]string, string) {
+	parts := strings.SplitN(content, "\n", 2)
+	args := strings.Fields(parts[0])[1:]
+
+	fit := ""
+	if len(parts) > 1 {
+		fit = strings.Trim(strings.TrimSpace(parts[1]), "`")
+	}
+
+	return args, fit
+}
+
+// HandleDoctrine is !doctrine list | show <name> | add <name> with the fit pasted below | remove <name>
+func (server *Server) HandleDoctrine(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args, pasted := splitFitCommand(message.Content)
+
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, "Doctrines only work from a server channel")
+		return
+	}
+
+	if len(args) <= 0 || strings.ToLower(args[0]) == "list" {
+		doctrines := server.GetDoctrineFits(guildId)
+
+		if len(doctrines) <= 0 {
+			server.SendMessage(message.ChannelID, "No doctrines yet. Admins can add fits with !doctrine add <name> and the EFT fit on the next lines")
+			return
+		}
+
+		lines := make([]string, 0, len(doctrines))
+		for name, fits := range doctrines {
+			ships := make([]string, 0, len(fits))
+			for _, fit := range fits {
+				ships = append(ships, fmt.Sprintf("%v (%v)", fit.Ship, fit.Name))
+			}
+			lines = append(lines, fmt.Sprintf("**%v**: %v", name, strings.Join(ships, ", ")))
+		}
+		sort.Strings(lines)
+
+		server.SendMessage(message.ChannelID, strings.Join(lines, "\n"))
+		return
+	}
+
+	if len(args) < 2 {
+		server.SendMessage(message.ChannelID, "Usage: !doctrine list | show <name> | add <name> | remove <name>")
+		return
+	}
+
+	name := strings.ToLower(args[1])
+
+	switch strings.ToLower(args[0]) {
+	case "show":
+		fits := server.GetDoctrineFits(guildId)[name]
+
+		if len(fits) <= 0 {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("No doctrine called %v", name))
+			return
+		}
+
+		for _, fit := range fits {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("```\n%v\n```", fit.Raw))
+		}
+	case "add":
+		if _, ok := server.guildAdminCheck(logger, message); !ok {
+			return
+		}
+
+		fit, err := ParseEFT(pasted)
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to read that fit. %v", err))
+			return
+		}
+
+		if err = server.SaveDoctrineFit(guildId, name, fit); err != nil {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to save fit. Error: %v", err))
+			return
+		}
+
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Added %v (%v) to the %v doctrine", fit.Ship, fit.Name, name))
+	case "remove":
+		if _, ok := server.guildAdminCheck(logger, message); !ok {
+			return
+		}
+
+		server.Redis.HDel(doctrinesKey(guildId), name)
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Removed the %v doctrine", name))
+	default:
+		server.SendMessage(message.ChannelID, "Usage: !doctrine list | show <name> | add <name> | remove <name>")
+	}
+}
+
+// HandleCheckFit is !checkfit [doctrine] with the pilot's EFT fit on the next lines
+func (server *Server) HandleCheckFit(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args, pasted := splitFitCommand(message.Content)
+
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, "Fits can only be checked from a server channel")
+		return
+	}
+
+	fit, err := ParseEFT(pasted)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Paste your EFT fit on the lines after !checkfit. %v", err))
+		return
+	}
+
+	// Check against one doctrine if asked, otherwise everything we know about
+	candidates := make([]*Fit, 0)
+	for name, fits := range server.GetDoctrineFits(guildId) {
+		if len(args) <= 0 || strings.EqualFold(args[0], name) {
+			candidates = append(candidates, fits...)
+		}
+	}
+
+	if len(candidates) <= 0 {
+		server.SendMessage(message.ChannelID, "No doctrine fits to check against")
+		return
+	}
+
+	doctrine, diff := closestDoctrineFit(candidates, fit)
+
+	embed := &discordgo.MessageEmbed{
+		Title:  fmt.Sprintf("%v (%v) vs doctrine %v (%v)", fit.Ship, fit.Name, doctrine.Ship, doctrine.Name),
+		Color:  0x2ecc71,
+		Fields: make([]*discordgo.MessageEmbedField, 0),
+	}
+
+	if diff.Matches() {
+		embed.Description = "Fit matches the doctrine, x up!"
+		server.SendEmbed(message.ChannelID, embed)
+		return
+	}
+
+	embed.Color = 0xe74c3c
+
+	if diff.WrongShip {
+		embed.Description = fmt.Sprintf("Doctrine hull is a %v", doctrine.Ship)
+	}
+
+	if len(diff.Missing) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Missing", Value: truncate(describeCounts(diff.Missing), 1024)})
+	}
+
+	if len(diff.Extra) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Not in doctrine", Value: truncate(describeCounts(diff.Extra), 1024)})
+	}
+
+	if len(diff.MissingImplants) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Implants the doctrine expects", Value: truncate(strings.Join(diff.MissingImplants, "\n"), 1024)})
+	}
+
+	if len(diff.ExtraImplants) > 0 {
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{Name: "Implants not in doctrine", Value: truncate(strings.Join(diff.ExtraImplants, "\n"), 1024)})
+	}
+
+	server.SendEmbed(message.ChannelID, embed)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+const testDoctrineFit = `[Vindicator, Shield DPS]
+Gyrostabilizer II
+Gyrostabilizer II
+Damage Control II
+[Empty Low slot]
+
+Large Shield Extender II
+Stasis Webifier II/OFFLINE
+
+Neutron Blaster Cannon II, Void L
+Neutron Blaster Cannon II, Void L
+
+Large Hybrid Burst Aerator II
+
+Hammerhead II x5
+
+Void L x2000
+High-grade Amulet Alpha
+Zainou 'Gnome' Shield Management SM-703`
+
+func TestParseEFT(t *testing.T) {
+	fit, err := ParseEFT(testDoctrineFit)
+
+	if err != nil {
+		t.Fatalf("ParseEFT failed: %v", err)
+	}
+
+	if fit.Ship != "Vindicator" || fit.Name != "Shield DPS" {
+		t.Errorf("header = %q, %q", fit.Ship, fit.Name)
+	}
+
+	modules := map[string]int{
+		"Gyrostabilizer II":             2,
+		"Damage Control II":             1,
+		"Large Shield Extender II":      1,
+		"Stasis Webifier II":            1,
+		"Neutron Blaster Cannon II":     2,
+		"Large Hybrid Burst Aerator II": 1,
+	}
+
+	if fmt.Sprint(fit.Modules) != fmt.Sprint(modules) {
+		t.Errorf("modules = %v, want %v", fit.Modules, modules)
+	}
+
+	if fit.Items["Hammerhead II"] != 5 || fit.Items["Void L"] != 2000 || len(fit.Items) != 2 {
+		t.Errorf("items = %v", fit.Items)
+	}
+
+	if fmt.Sprint(fit.Implants) != "[High-grade Amulet Alpha Zainou 'Gnome' Shield Management SM-703]" {
+		t.Errorf("implants = %q", fit.Implants)
+	}
+}
+
+func TestParseEFTRejectsNonFits(t *testing.T) {
+	for _, text := range []string{"", "Vindicator, Shield DPS", "[Vindicator]"} {
+		if _, err := ParseEFT(text); err == nil {
+			t.Errorf("ParseEFT(%q) accepted a non-fit", text)
+		}
+	}
+}
+
+func TestCompareFits(t *testing.T) {
+	doctrine, _ := ParseEFT(testDoctrineFit)
+
+	same, _ := ParseEFT(testDoctrineFit + "\r\n")
+	if diff := doctrine.Compare(same); !diff.Matches() {
+		t.Errorf("identical fit doesn't match: %+v", diff)
+	}
+
+	cheap, _ := ParseEFT(`[vindicator, cheap]
+Gyrostabilizer I
+Gyrostabilizer II
+Damage Control II
+Large Shield Extender II
+Stasis Webifier II
+Neutron Blaster Cannon II, Null L
+Neutron Blaster Cannon II, Null L
+Large Hybrid Burst Aerator II
+Hammerhead II x5
+Void L x2000
+High-grade Amulet Alpha
+Zainou 'Gnome' Shield Management SM-703`)
+
+	diff := doctrine.Compare(cheap)
+
+	if diff.WrongShip {
+		t.Error("hull names should compare case insensitively")
+	}
+
+	if diff.Missing["Gyrostabilizer II"] != 1 || diff.Extra["Gyrostabilizer I"] != 1 || diff.Matches() {
+		t.Errorf("diff = %+v", diff)
+	}
+}
+
+func TestCompareImplantsBothWays(t *testing.T) {
+	doctrine, _ := ParseEFT(testDoctrineFit)
+
+	tests := []struct {
+		name     string
+		implants string
+		missing  string
+		extra    string
+	}{
+		{"missing", "High-grade Amulet Alpha", "[Zainou 'Gnome' Shield Management SM-703]", "[]"},
+		{"extra", "High-grade Amulet Alpha\nZainou 'Gnome' Shield Management SM-703\nInherent Implants 'Lancer' Gunnery RF-903", "[]", "[Inherent Implants 'Lancer' Gunnery RF-903]"},
+		{"substituted", "High-grade Amulet Alpha\nZainou 'Gnome' Shield Management SM-701", "[Zainou 'Gnome' Shield Management SM-703]", "[Zainou 'Gnome' Shield Management SM-701]"},
+	}
+
+	for _, test := range tests {
+		fit, _ := ParseEFT(testDoctrineFit[:len(testDoctrineFit)-len("High-grade Amulet Alpha\nZainou 'Gnome' Shield Management SM-703")] + test.implants)
+		diff := doctrine.Compare(fit)
+
+		if fmt.Sprint(diff.MissingImplants) != test.missing || fmt.Sprint(diff.ExtraImplants) != test.extra {
+			t.Errorf("%v: missing %q, extra %q", test.name, diff.MissingImplants, diff.ExtraImplants)
+		}
+
+		if diff.Matches() {
+			t.Errorf("%v: fit with different implants matches the doctrine", test.name)
+		}
+	}
+}
+
+func TestClosestDoctrineFit(t *testing.T) {
+	doctrine, _ := ParseEFT(testDoctrineFit)
+	other, _ := ParseEFT("[Nightmare, Armor]\nHeat Sink II")
+	fit, _ := ParseEFT(testDoctrineFit)
+
+	if best, _ := closestDoctrineFit([]*Fit{other, doctrine}, fit); best != doctrine {
+		t.Errorf("picked %v instead of the matching hull", best.Ship)
+	}
+}
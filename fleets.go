@@ -0,0 +1,672 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// Roles a pilot can fly in a fleet
+const (
+	RoleDPS     = "DPS"
+	RoleLogi    = "Logi"
+	RoleBooster = "Booster"
+)
+
+var pilotRoles = []string{RoleDPS, RoleLogi, RoleBooster}
+
+// Reacting to a fleet's sign-up message with one of these signs you up for the role
+const (
+	EmojiDPS     = "⚔️"
+	EmojiLogi    = "🚑"
+	EmojiBooster = "📣"
+)
+
+var roleEmoji = map[string]string{
+	EmojiDPS:     RoleDPS,
+	EmojiLogi:    RoleLogi,
+	EmojiBooster: RoleBooster,
+}
+
+const (
+	// EVE runs on UTC
+	eveTimeLayout = "2006-01-02 15:04"
+
+	DefaultFleetReminderMinutes = 15
+
+	// Fleets hang around this long after they start so people can still look them up
+	fleetRetention = time.Hour * 12
+)
+
+type FleetSignup struct {
+	UserId     string    `json:"user_id"`
+	Ship       string    `json:"ship"`
+	Role       string    `json:"role"`
+	SignedUpAt time.Time `json:"signed_up_at"`
+}
+
+type Fleet struct {
+	Id        int            `json:"id"`
+	GuildId   string         `json:"guild_id"`
+	ChannelId string         `json:"channel_id"`
+	MessageId string         `json:"message_id"`
+	FcId      string         `json:"fc_id"`
+	Incursion string         `json:"incursion"`
+	Doctrine  string         `json:"doctrine"`
+	StartsAt  time.Time      `json:"starts_at"`
+	Signups   []*FleetSignup `json:"signups"`
+	Reminded  bool           `json:"reminded"`
+}
+
+// fleetLock serializes every read-modify-write of fleets, sign-ups come in from commands and reactions at once
+var fleetLock sync.Mutex
+
+func fleetsKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:fleets", guildId)
+}
+
+func fleetIdKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:fleets:next_id", guildId)
+}
+
+// Maps sign-up message ids back to the guild and fleet so reactions can find them
+const fleetMessagesKey = "bot:fleet_messages"
+
+// ParseRole accepts the common ways people write their role
+func ParseRole(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "dps", "damage":
+		return RoleDPS, nil
+	case "logi", "logistics", "logo":
+		return RoleLogi, nil
+	case "booster", "boost", "boosts", "links":
+		return RoleBooster, nil
+	}
+
+	return "", fmt.Errorf("unknown role %q, expected one of %v", value, strings.Join(pilotRoles, ", "))
+}
+
+// ParseFleetTime accepts "2018-10-20T19:00", "19:00" (the next time it's 19:00 EVE time) or "+90m" from now.
+// Times that have already gone are refused.
+func ParseFleetTime(value string, now time.Time) (time.Time, error) {
+	now = now.UTC()
+
+	if strings.HasPrefix(value, "+") {
+		duration, err := time.ParseDuration(value[1:])
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if duration <= 0 {
+			return time.Time{}, errors.New("fleets have to start in the future")
+		}
+
+		return now.Add(duration), nil
+	}
+
+	if at, err := time.Parse(eveTimeLayout, strings.Replace(value, "T", " ", 1)); err == nil {
+		if at.Before(now) {
+			return time.Time{}, fmt.Errorf("%v EVE time has already passed", at.Format(eveTimeLayout))
+		}
+
+		return at, nil
+	}
+
+	clock, err := time.Parse("15:04", value)
+
+	if err != nil {
+		return time.Time{}, errors.New("times look like 2018-10-20T19:00, 19:00 or +90m, all in EVE time")
+	}
+
+	at := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.UTC)
+
+	if at.Before(now) {
+		at = at.Add(time.Hour * 24)
+	}
+
+	return at, nil
+}
+
+func (server *Server) GetFleets(guildId string) []*Fleet {
+	fleets := make([]*Fleet, 0)
+
+	cmd := server.Redis.HGetAll(fleetsKey(guildId))
+
+	if cmd.Err() != nil {
+		return fleets
+	}
+
+	for id, raw := range cmd.Val() {
+		var fleet Fleet
+
+		if err := json.Unmarshal([]byte(raw), &fleet); err != nil {
+			Log.Warn("Unable to parse fleet", LogFields{"guild": guildId, "fleet": id, "error": err})
+			continue
+		}
+
+		fleets = append(fleets, &fleet)
+	}
+
+	sort.Slice(fleets, func(i, j int) bool {
+		return fleets[i].StartsAt.Before(fleets[j].StartsAt)
+	})
+
+	return fleets
+}
+
+func (server *Server) GetFleet(guildId string, id int) *Fleet {
+	cmd := server.Redis.HGet(fleetsKey(guildId), strconv.Itoa(id))
+
+	if cmd.Err() != nil {
+		return nil
+	}
+
+	var fleet Fleet
+
+	if err := json.Unmarshal([]byte(cmd.Val()), &fleet); err != nil {
+		Log.Warn("Unable to parse fleet", LogFields{"guild": guildId, "fleet": id, "error": err})
+		return nil
+	}
+
+	return &fleet
+}
+
+func (server *Server) SaveFleet(fleet *Fleet) error {
+	bytes, err := json.Marshal(fleet)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Redis.HSet(fleetsKey(fleet.GuildId), strconv.Itoa(fleet.Id), string(bytes)).Err()
+}
+
+func (server *Server) DeleteFleet(fleet *Fleet) {
+	server.Redis.HDel(fleetsKey(fleet.GuildId), strconv.Itoa(fleet.Id))
+
+	if len(fleet.MessageId) > 0 {
+		server.Redis.HDel(fleetMessagesKey, fleet.MessageId)
+	}
+}
+
+// SignUp adds or replaces the user's sign-up
+func (fleet *Fleet) SignUp(userId, ship, role string) {
+	fleet.Leave(userId)
+
+	fleet.Signups = append(fleet.Signups, &FleetSignup{
+		UserId:     userId,
+		Ship:       ship,
+		Role:       role,
+		SignedUpAt: time.Now().UTC(),
+	})
+}
+
+// Leave removes the user's sign-up and returns whether they had one
+func (fleet *Fleet) Leave(userId string) bool {
+	remaining := make([]*FleetSignup, 0, len(fleet.Signups))
+
+	for _, signup := range fleet.Signups {
+		if signup.UserId != userId {
+			remaining = append(remaining, signup)
+		}
+	}
+
+	left := len(remaining) != len(fleet.Signups)
+	fleet.Signups = remaining
+	return left
+}
+
+func (server *Server) GetFleetEmbed(fleet *Fleet) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title: fmt.Sprintf("Fleet #%v - %v - %v EVE time", fleet.Id, fleet.Incursion, fleet.StartsAt.Format(eveTimeLayout)),
+		Description: fmt.Sprintf("FC: <@%v>\nDoctrine: %v\nReact with %v for DPS, %v for Logi or %v for Boosts, or use `!fleet join %v <ship> <role>`",
+			fleet.FcId, fleet.Doctrine, EmojiDPS, EmojiLogi, EmojiBooster, fleet.Id),
+		Timestamp: fleet.StartsAt.Format(time.RFC3339),
+		Color:     0x3498db,
+		Fields:    make([]*discordgo.MessageEmbedField, 0, len(pilotRoles)),
+	}
+
+	for _, role := range pilotRoles {
+		pilots := make([]string, 0)
+
+		for _, signup := range fleet.Signups {
+			if signup.Role != role {
+				continue
+			}
+
+			if len(signup.Ship) > 0 {
+				pilots = append(pilots, fmt.Sprintf("%v (%v)", server.PilotName(signup.UserId), signup.Ship))
+			} else {
+				pilots = append(pilots, server.PilotName(signup.UserId))
+			}
+		}
+
+		value := "Nobody yet"
+		if len(pilots) > 0 {
+			value = strings.Join(pilots, "\n")
+		}
+
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:   fmt.Sprintf("%v (%d)", role, len(pilots)),
+			Value:  truncate(value, 1024),
+			Inline: true,
+		})
+	}
+
+	return embed
+}
+
+// PilotName is how we show a Discord user in lists
+func (server *Server) PilotName(userId string) string {
+	if character := server.MainCharacter(userId); character != nil {
+		return character.Name
+	}
+
+	return fmt.Sprintf("<@%v>", userId)
+}
+
+// refreshFleetMessage edits the sign-up message in place so it always shows the current list. It's called after
+// fleetLock is released, so it redraws from what's saved in case another change landed in between.
+func (server *Server) refreshFleetMessage(fleet *Fleet) {
+	if latest := server.GetFleet(fleet.GuildId, fleet.Id); latest != nil {
+		fleet = latest
+	}
+
+	if len(fleet.MessageId) <= 0 {
+		return
+	}
+
+	_, err := server.Discord.ChannelMessageEditEmbed(fleet.ChannelId, fleet.MessageId, server.GetFleetEmbed(fleet))
+
+	if err != nil {
+		Log.Warn("Unable to update sign-up message", LogFields{"guild": fleet.GuildId, "channel": fleet.ChannelId, "fleet": fleet.Id, "error": err})
+	}
+}
+
+func (server *Server) HandleFleet(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args := commandArgs(message)
+
+	if len(args) <= 0 {
+		server.SendMessage(message.ChannelID, "Usage: !fleet create <incursion> <time> <doctrine> | list | show <id> | join <id> <ship> <role> | leave <id> | cancel <id>")
+		return
+	}
+
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, "Fleets can only be run from a server channel")
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "create":
+		if !server.IsFleetCommander(guildId, message.Author.ID) {
+			server.SendMessage(message.ChannelID, "Only FCs and admins can create fleets")
+			return
+		}
+
+		server.createFleet(logger, guildId, message, args[1:])
+	case "list":
+		server.listFleets(guildId, message)
+	case "show":
+		if fleet := server.withFleet(logger, guildId, message, args[1:], nil); fleet != nil {
+			server.SendEmbed(message.ChannelID, server.GetFleetEmbed(fleet))
+		}
+	case "join":
+		if len(args) < 4 {
+			server.SendMessage(message.ChannelID, "Usage: !fleet join <id> <ship> <role>")
+			return
+		}
+
+		role, err := ParseRole(args[len(args)-1])
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, err.Error())
+			return
+		}
+
+		ship := strings.Join(args[2:len(args)-1], " ")
+
+		name := server.PilotName(message.Author.ID)
+
+		server.withFleet(logger, guildId, message, args[1:], func(fleet *Fleet) (bool, string) {
+			fleet.SignUp(message.Author.ID, ship, role)
+			return true, fmt.Sprintf("%v signed up for fleet #%v as %v in a %v", name, fleet.Id, role, ship)
+		})
+	case "leave":
+		name := server.PilotName(message.Author.ID)
+
+		server.withFleet(logger, guildId, message, args[1:], func(fleet *Fleet) (bool, string) {
+			if !fleet.Leave(message.Author.ID) {
+				return false, fmt.Sprintf("You aren't signed up for fleet #%v", fleet.Id)
+			}
+
+			return true, fmt.Sprintf("%v left fleet #%v", name, fleet.Id)
+		})
+	case "cancel":
+		admin := server.IsGuildAdmin(guildId, message.Author.ID)
+		cancelled := false
+
+		fleet := server.withFleet(logger, guildId, message, args[1:], func(fleet *Fleet) (bool, string) {
+			if fleet.FcId != message.Author.ID && !admin {
+				return false, "Only the FC or an admin can cancel a fleet"
+			}
+
+			server.DeleteFleet(fleet)
+			cancelled = true
+			return false, fmt.Sprintf("Fleet #%v cancelled", fleet.Id)
+		})
+
+		if !cancelled {
+			return
+		}
+
+		for _, signup := range fleet.Signups {
+			server.SendDirectMessage(&discordgo.User{ID: signup.UserId}, fmt.Sprintf("Fleet #%v (%v at %v EVE time) has been cancelled", fleet.Id, fleet.Incursion, fleet.StartsAt.Format(eveTimeLayout)))
+		}
+	default:
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unknown fleet command %q", args[0]))
+	}
+}
+
+// fleetUpdate changes a fleet under fleetLock. It returns whether to save the fleet and what to reply, the reply
+// is sent once the lock is released.
+type fleetUpdate func(fleet *Fleet) (bool, string)
+
+// withFleet looks up the fleet from the first argument, runs update on it if there is one and saves it afterwards
+// if update asks. Returns the fleet, or nil if the user has already been told why there isn't one.
+func (server *Server) withFleet(logger *Logger, guildId string, message *discordgo.MessageCreate, args []string, update fleetUpdate) *Fleet {
+	if len(args) <= 0 {
+		server.SendMessage(message.ChannelID, "Which fleet? Use !fleet list to see them")
+		return nil
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("%q isn't a fleet number", args[0]))
+		return nil
+	}
+
+	fleet, saved, reply, err := server.updateFleet(guildId, id, update)
+
+	if fleet == nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("No fleet #%v", id))
+		return nil
+	}
+
+	if err != nil {
+		logger.Error("Unable to save fleet", LogFields{"guild": fleet.GuildId, "fleet": fleet.Id, "error": err})
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to save fleet. Error: %v", err))
+		return nil
+	}
+
+	if len(reply) > 0 {
+		server.SendMessage(message.ChannelID, reply)
+	}
+
+	if saved {
+		server.refreshFleetMessage(fleet)
+	}
+
+	return fleet
+}
+
+// updateFleet runs update on the fleet while holding fleetLock and saves it if asked. The fleet is nil if there's
+// no such fleet. Nothing in here talks to Discord, that can be slow and everyone else is waiting.
+func (server *Server) updateFleet(guildId string, id int, update fleetUpdate) (fleet *Fleet, saved bool, reply string, err error) {
+	fleetLock.Lock()
+	defer fleetLock.Unlock()
+
+	if fleet = server.GetFleet(guildId, id); fleet == nil || update == nil {
+		return
+	}
+
+	if saved, reply = update(fleet); saved {
+		err = server.SaveFleet(fleet)
+	}
+
+	return
+}
+
+func (server *Server) createFleet(logger *Logger, guildId string, message *discordgo.MessageCreate, args []string) {
+	if len(args) < 3 {
+		server.SendMessage(message.ChannelID, "Usage: !fleet create <incursion> <time> <doctrine>")
+		return
+	}
+
+	startsAt, err := ParseFleetTime(args[1], time.Now())
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, err.Error())
+		return
+	}
+
+	incursion := args[0]
+
+	// Use the proper name if it's a live incursion
+	incursions, _ := server.GetIncursions()
+	if found := server.FindIncursion(incursions, incursion); found != nil {
+		incursion = found.ConsellationName
+	}
+
+	idCmd := server.Redis.Incr(fleetIdKey(guildId))
+
+	if idCmd.Err() != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to create fleet. Error: %v", idCmd.Err()))
+		return
+	}
+
+	fleet := &Fleet{
+		Id:        int(idCmd.Val()),
+		GuildId:   guildId,
+		ChannelId: message.ChannelID,
+		FcId:      message.Author.ID,
+		Incursion: incursion,
+		Doctrine:  strings.Join(args[2:], " "),
+		StartsAt:  startsAt,
+		Signups:   make([]*FleetSignup, 0),
+	}
+
+	if err = server.SaveFleet(fleet); err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to save fleet. Error: %v", err))
+		return
+	}
+
+	posted, err := server.SendEmbed(message.ChannelID, server.GetFleetEmbed(fleet))
+
+	if err != nil {
+		return
+	}
+
+	_, _, _, err = server.updateFleet(guildId, fleet.Id, func(fleet *Fleet) (bool, string) {
+		fleet.MessageId = posted.ID
+		return true, ""
+	})
+
+	if err != nil {
+		logger.Error("Unable to save fleet", LogFields{"guild": guildId, "fleet": fleet.Id, "error": err})
+		return
+	}
+
+	// Reactions only count once the message is known, so ours go on after that
+	server.Redis.HSet(fleetMessagesKey, posted.ID, fmt.Sprintf("%v:%v", guildId, fleet.Id))
+
+	for _, emoji := range []string{EmojiDPS, EmojiLogi, EmojiBooster} {
+		server.Discord.MessageReactionAdd(posted.ChannelID, posted.ID, emoji)
+	}
+}
+
+func (server *Server) listFleets(guildId string, message *discordgo.MessageCreate) {
+	fleets := server.GetFleets(guildId)
+
+	if len(fleets) <= 0 {
+		server.SendMessage(message.ChannelID, "No fleets scheduled")
+		return
+	}
+
+	lines := make([]string, 0, len(fleets))
+	for _, fleet := range fleets {
+		lines = append(lines, fmt.Sprintf("#%v - %v - %v EVE time - %v - FC %v - %d signed up", fleet.Id, fleet.Incursion, fleet.StartsAt.Format(eveTimeLayout), fleet.Doctrine, server.PilotName(fleet.FcId), len(fleet.Signups)))
+	}
+
+	server.SendMessage(message.ChannelID, strings.Join(lines, "\n"))
+}
+
+// fleetForMessage finds the guild and id of the fleet a sign-up message belongs to
+func (server *Server) fleetForMessage(messageId string) (string, int, bool) {
+	cmd := server.Redis.HGet(fleetMessagesKey, messageId)
+
+	if cmd.Err() != nil {
+		return "", 0, false
+	}
+
+	parts := strings.SplitN(cmd.Val(), ":", 2)
+
+	if len(parts) != 2 {
+		return "", 0, false
+	}
+
+	id, err := strconv.Atoi(parts[1])
+
+	if err != nil {
+		return "", 0, false
+	}
+
+	return parts[0], id, true
+}
+
+func (server *Server) OnReactionAdd(s *discordgo.Session, reaction *discordgo.MessageReactionAdd) {
+	if reaction.UserID == s.State.User.ID {
+		return
+	}
+
+	server.updateSignupFromReaction(reaction.MessageReaction, true)
+}
+
+func (server *Server) OnReactionRemove(s *discordgo.Session, reaction *discordgo.MessageReactionRemove) {
+	if reaction.UserID == s.State.User.ID {
+		return
+	}
+
+	server.updateSignupFromReaction(reaction.MessageReaction, false)
+}
+
+func (server *Server) updateSignupFromReaction(reaction *discordgo.MessageReaction, added bool) {
+	role, ok := roleEmoji[reaction.Emoji.Name]
+
+	if !ok {
+		return
+	}
+
+	guildId, id, ok := server.fleetForMessage(reaction.MessageID)
+
+	if !ok {
+		return
+	}
+
+	fleet, saved, _, err := server.updateFleet(guildId, id, func(fleet *Fleet) (bool, string) {
+		if added {
+			// Keep the ship if they told us one with !fleet join
+			ship := ""
+			for _, signup := range fleet.Signups {
+				if signup.UserId == reaction.UserID {
+					ship = signup.Ship
+				}
+			}
+
+			fleet.SignUp(reaction.UserID, ship, role)
+			return true, ""
+		}
+
+		// Only drop them if this reaction was the role they're signed up as
+		for _, signup := range fleet.Signups {
+			if signup.UserId == reaction.UserID && signup.Role == role {
+				return fleet.Leave(reaction.UserID), ""
+			}
+		}
+
+		return false, ""
+	})
+
+	if err != nil {
+		Log.Error("Unable to save fleet", LogFields{"guild": guildId, "fleet": id, "user": reaction.UserID, "error": err})
+		return
+	}
+
+	if saved {
+		server.refreshFleetMessage(fleet)
+	}
+}
+
+// fleetReminder is a reminder worked out under fleetLock, to be sent once it's released
+type fleetReminder struct {
+	channelId string
+	userIds   []string
+	text      string
+}
+
+// remindFleets DMs everyone signed up for a fleet that is about to start, and cleans up old fleets
+func (server *Server) remindFleets(logger *Logger) {
+	now := time.Now().UTC()
+	window := time.Minute * time.Duration(server.Config.FleetReminderMinutes)
+
+	// Sending can take a while with a lot of sign-ups, so don't hold up sign-ups while it happens
+	for _, reminder := range server.dueFleetReminders(logger, now, window) {
+		for _, userId := range reminder.userIds {
+			server.SendDirectMessage(&discordgo.User{ID: userId}, reminder.text)
+		}
+
+		server.SendMessage(reminder.channelId, reminder.text)
+	}
+}
+
+// dueFleetReminders marks fleets starting within the window as reminded and returns who to remind
+func (server *Server) dueFleetReminders(logger *Logger, now time.Time, window time.Duration) []*fleetReminder {
+	fleetLock.Lock()
+	defer fleetLock.Unlock()
+
+	reminders := make([]*fleetReminder, 0)
+
+	for _, guildId := range server.Guilds.IDs() {
+		for _, fleet := range server.GetFleets(guildId) {
+			if now.Sub(fleet.StartsAt) > fleetRetention {
+				server.DeleteFleet(fleet)
+				continue
+			}
+
+			if fleet.Reminded || fleet.StartsAt.Sub(now) > window {
+				continue
+			}
+
+			reminder := &fleetReminder{
+				channelId: fleet.ChannelId,
+				userIds:   make([]string, 0, len(fleet.Signups)),
+				text:      fmt.Sprintf("Fleet #%v to %v (%v) starts at %v EVE time. FC is %v", fleet.Id, fleet.Incursion, fleet.Doctrine, fleet.StartsAt.Format(eveTimeLayout), server.PilotName(fleet.FcId)),
+			}
+
+			for _, signup := range fleet.Signups {
+				reminder.userIds = append(reminder.userIds, signup.UserId)
+			}
+
+			fleet.Reminded = true
+
+			if err := server.SaveFleet(fleet); err != nil {
+				logger.Error("Unable to save fleet", LogFields{"guild": guildId, "fleet": fleet.Id, "error": err})
+				continue
+			}
+
+			reminders = append(reminders, reminder)
+		}
+	}
+
+	return reminders
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestDueFleetReminders(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	server.Guilds.Add(&discordgo.Guild{ID: "guild", Name: "Guild"})
+
+	now := time.Now().UTC()
+
+	soon := &Fleet{Id: 1, GuildId: "guild", ChannelId: "fleets", FcId: "fc", StartsAt: now.Add(time.Minute * 10), Signups: make([]*FleetSignup, 0)}
+	soon.SignUp("pilot-1", "Vindicator", RoleDPS)
+	soon.SignUp("pilot-2", "Nestor", RoleLogi)
+
+	later := &Fleet{Id: 2, GuildId: "guild", ChannelId: "fleets", StartsAt: now.Add(time.Hour * 2), Signups: make([]*FleetSignup, 0)}
+	old := &Fleet{Id: 3, GuildId: "guild", ChannelId: "fleets", StartsAt: now.Add(-fleetRetention - time.Hour), Signups: make([]*FleetSignup, 0)}
+
+	for _, fleet := range []*Fleet{soon, later, old} {
+		if err := server.SaveFleet(fleet); err != nil {
+			t.Fatalf("SaveFleet failed: %v", err)
+		}
+	}
+
+	reminders := server.dueFleetReminders(Log, now, time.Minute*15)
+
+	if len(reminders) != 1 {
+		t.Fatalf("got %d reminders, want 1", len(reminders))
+	}
+
+	if reminders[0].channelId != "fleets" || len(reminders[0].userIds) != 2 {
+		t.Errorf("reminder = %+v", reminders[0])
+	}
+
+	if !server.GetFleet("guild", 1).Reminded {
+		t.Error("fleet wasn't marked as reminded")
+	}
+
+	if server.GetFleet("guild", 3) != nil {
+		t.Error("fleet past retention wasn't deleted")
+	}
+
+	if again := server.dueFleetReminders(Log, now, time.Minute*15); len(again) != 0 {
+		t.Errorf("reminded again: %+v", again)
+	}
+}
+
+func TestParseFleetTime(t *testing.T) {
+	now := time.Date(2018, 10, 20, 18, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+		ok    bool
+	}{
+		{"2018-10-20T19:00", time.Date(2018, 10, 20, 19, 0, 0, 0, time.UTC), true},
+		{"2018-10-21 02:30", time.Date(2018, 10, 21, 2, 30, 0, 0, time.UTC), true},
+		{"19:00", time.Date(2018, 10, 20, 19, 0, 0, 0, time.UTC), true},
+		{"17:00", time.Date(2018, 10, 21, 17, 0, 0, 0, time.UTC), true},
+		{"+90m", now.Add(time.Minute * 90), true},
+		{"2018-10-20T17:59", time.Time{}, false},
+		{"2017-01-01T19:00", time.Time{}, false},
+		{"+-5m", time.Time{}, false},
+		{"tomorrow", time.Time{}, false},
+	}
+
+	for _, test := range tests {
+		at, err := ParseFleetTime(test.value, now)
+
+		if (err == nil) != test.ok || !at.Equal(test.want) {
+			t.Errorf("ParseFleetTime(%q) = %v, %v, want %v", test.value, at, err, test.want)
+		}
+	}
+}
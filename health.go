@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Discord heartbeats every 40 seconds or so, missing a few in a row means the gateway is gone
+	discordHeartbeatMaxAge = time.Minute * 3
+
+	// The checker fetches every 5 minutes, a few misses in a row and our incursions are out of date
+	incursionFetchMaxAge = time.Minute * 20
+)
+
+// HealthCheck is the state of one thing the bot depends on
+type HealthCheck struct {
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
+	// Seconds since the dependency last did what we expect of it, when that means something
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+}
+
+type HealthReport struct {
+	Status        string                  `json:"status"`
+	UptimeSeconds float64                 `json:"uptime_seconds"`
+	Checks        map[string]*HealthCheck `json:"checks"`
+}
+
+func ageSeconds(since time.Time) *float64 {
+	age := time.Since(since).Seconds()
+	return &age
+}
+
+func (server *Server) checkRedis() *HealthCheck {
+	if err := server.Redis.Ping().Err(); err != nil {
+		return &HealthCheck{Message: err.Error()}
+	}
+
+	return &HealthCheck{Healthy: true}
+}
+
+func (server *Server) checkDiscord() *HealthCheck {
+	if server.Discord == nil {
+		return &HealthCheck{Message: "not connected"}
+	}
+
+	server.Discord.RLock()
+	ready := server.Discord.DataReady
+	lastAck := server.Discord.LastHeartbeatAck
+	server.Discord.RUnlock()
+
+	check := &HealthCheck{AgeSeconds: ageSeconds(lastAck)}
+
+	switch {
+	case !ready:
+		check.Message = "gateway is not connected"
+	case time.Since(lastAck) > discordHeartbeatMaxAge:
+		check.Message = "gateway stopped acknowledging heartbeats"
+	default:
+		check.Healthy = true
+	}
+
+	return check
+}
+
+func (server *Server) checkIncursionFetch() *HealthCheck {
+	lastFetch := server.Incursions.LastFetch()
+
+	if lastFetch.IsZero() {
+		return &HealthCheck{Message: "incursions haven't been fetched yet"}
+	}
+
+	check := &HealthCheck{AgeSeconds: ageSeconds(lastFetch)}
+
+	if time.Since(lastFetch) > incursionFetchMaxAge {
+		check.Message = "incursions are out of date"
+	} else {
+		check.Healthy = true
+	}
+
+	return check
+}
+
+func respondHealth(c *gin.Context, checks map[string]*HealthCheck) {
+	report := &HealthReport{
+		Status:        "ok",
+		UptimeSeconds: time.Since(startedAt).Seconds(),
+		Checks:        checks,
+	}
+
+	status := http.StatusOK
+
+	for _, check := range checks {
+		if !check.Healthy {
+			report.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, report)
+}
+
+// healthz is whether the bot is alive, Redis and Discord have to be reachable for it to do anything at all
+func (server *Server) healthz(c *gin.Context) {
+	respondHealth(c, map[string]*HealthCheck{
+		"redis":   server.checkRedis(),
+		"discord": server.checkDiscord(),
+	})
+}
+
+// readyz is healthz plus incursions recent enough to be worth serving
+func (server *Server) readyz(c *gin.Context) {
+	respondHealth(c, map[string]*HealthCheck{
+		"redis":      server.checkRedis(),
+		"discord":    server.checkDiscord(),
+		"incursions": server.checkIncursionFetch(),
+	})
+}
@@ -1,166 +1,285 @@
-package main
-
-import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"log"
-	"strings"
-)
-
-const RedisIncursionKey = "incursions"
-
-func (server *Server) SetupIncursions() error {
-	incursionsCmd := server.Redis.Get(RedisIncursionKey)
-	if incursionsCmd.Err() != nil {
-		// Essentially no stashed incursions
-		return incursionsCmd.Err()
-	}
-
-	var savedIncursions []*EsiIncursion
-
-	err := json.Unmarshal([]byte(incursionsCmd.Val()), &savedIncursions)
-
-	if err != nil {
-		log.Printf("[ERROR] Unable to parse saved incursion json in redis! JSON: %v Error: %v", incursionsCmd.Val(), err)
-		return err
-	}
-
-	// Resolve all the names
-	// Note: It would be possible to have all the names serialized out with json, but that might be a discussion for later
-	server.PopulateIncursionData(savedIncursions)
-
-	return nil
-}
-
-func (server *Server) checkIncursions() {
-	incursions, new := server.GetIncursions()
-
-	// If we got a cached version, don't even bother checking...
-	if !new {
-		return
-	}
-
-	// Otherwise, lets compare our scheduler incursions to the returned incursions
-	// Note: Special case, the first time this runs we will have no cached incursions, so lets just skip that run to hydrate the cache
-
-	if len(lastIncursions) <= 0 {
-		lastIncursions = incursions // hydrate
-		return
-	}
-
-	newIncursions := make([]*EsiIncursion, 0)
-	changedIncursions := make([]*EsiIncursion, 0)
-	deadIncursions = make([]*EsiIncursion, 0)
-
-	// Lets just walk through the array and attempt to compare each other incursion
-	for _, inc := range incursions {
-		foundExisting := false
-		for _, existing := range lastIncursions {
-			if inc.StagingSolarSystemId == existing.StagingSolarSystemId {
-				// Check if state also changed
-				if inc.State != existing.State {
-					// Set the "previous state" temp variable so we can use later
-					changedIncursions = append(changedIncursions, inc)
-				}
-
-				foundExisting = true
-				break
-			}
-		}
-
-		if !foundExisting {
-			newIncursions = append(newIncursions, inc)
-		}
-	}
-
-	for _, existing := range lastIncursions {
-		foundExisting := false
-		for _, new := range incursions {
-			if existing.StagingSolarSystemId == new.StagingSolarSystemId {
-				foundExisting = true
-				break
-			}
-		}
-
-		// It's still alive, SKIP
-		if foundExisting {
-			continue
-		}
-
-		deadIncursions = append(deadIncursions, existing)
-	}
-
-	var buffer = bytes.NewBufferString("")
-
-	for _, changed := range changedIncursions {
-		server.GetChangedIncursionMessage(changed, buffer)
-	}
-
-	for _, new := range newIncursions {
-		server.GetNewIncursionMessage(new, buffer)
-	}
-
-	for _, dead := range deadIncursions {
-		server.GetDespawnedIncursionMessage(dead, buffer)
-	}
-
-	// Did any new info come through?
-	if buffer.Len() > 0 {
-		msg := buffer.String()
-
-		if len(msg) > 0 {
-			server.BroadcastMessage(msg)
-		} else {
-			log.Printf("All remains quiet...")
-		}
-	}
-
-	// Cache of the last result
-	lastIncursions = incursions
-}
-
-// TODO: It feels like this method doesn't belong here since the struct isn't here
-func (server *Server) GetConstellationForIncursion(incursion *EsiIncursion) *EsiConstellation {
-	return server.GetConstellation(incursion.ConstellationId)
-}
-
-func (server *Server) GetNewIncursionMessage(incursion *EsiIncursion, buffer *bytes.Buffer) {
-	constellation := server.GetConstellationForIncursion(incursion)
-	dotlan := fmt.Sprintf("http://evemaps.dotlan.net/map/%v/%v", constellation.RegionName, constellation.Name)
-
-	dotlan = strings.Replace(dotlan, " ", "_", -1)
-
-	// Filter
-	if incursion.StagingSystem.SecurityStatus <= server.Config.SecurityStatusThreshold {
-		buffer.WriteString(fmt.Sprintf("New Incursion detected in %v {%.1v} {%v - %v} - %v jumps from staging - Dotlan: %v\n", incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName, len(incursion.Route)-1, dotlan))
-	}
-}
-
-func (server *Server) GetDefaultIncurionsMessage(incursion *EsiIncursion, buffer *bytes.Buffer) {
-	constellation := server.GetConstellationForIncursion(incursion)
-	dotlan := fmt.Sprintf("http://evemaps.dotlan.net/map/%v/%v", constellation.RegionName, constellation.Name)
-	dotlan = strings.Replace(dotlan, " ", "_", -1)
-
-	if incursion.StagingSystem.SecurityStatus <= server.Config.SecurityStatusThreshold {
-		buffer.WriteString(fmt.Sprintf("%v {%.1v} {%v - %v} Influence: %.3v%% - Status %v- %v jumps from staging - Dotlan: %v\n", incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName, incursion.Influence*100, incursion.State, len(incursion.Route)-1, dotlan))
-	}
-}
-
-func (server *Server) GetChangedIncursionMessage(incursion *EsiIncursion, buffer *bytes.Buffer) {
-	constellation := server.GetConstellationForIncursion(incursion)
-	dotlan := fmt.Sprintf("http://evemaps.dotlan.net/map/%v/%v", constellation.RegionName, constellation.Name)
-	dotlan = strings.Replace(dotlan, " ", "_", -1)
-
-	if incursion.StagingSystem.SecurityStatus <= server.Config.SecurityStatusThreshold {
-		buffer.WriteString(fmt.Sprintf("Incursion in %v {%.1v} {%v - %v} Changed status to - Status %v - %v jumps from staging - Dotlan: %v\n", incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName, incursion.State, len(incursion.Route)-1, dotlan))
-	}
-}
-
-func (server *Server) GetDespawnedIncursionMessage(incursion *EsiIncursion, buffer *bytes.Buffer) {
-	constellation := server.GetConstellationForIncursion(incursion)
-
-	if incursion.StagingSystem.SecurityStatus <= server.Config.SecurityStatusThreshold {
-		buffer.WriteString(fmt.Sprintf("Incursion in %v {%.1v} {%v - %v} Despawned", incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName))
-	}
-}
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const RedisIncursionKey = "incursions"
+
+// DefaultDespawnConfirmations is how many successful fetches in a row an incursion has to be missing
+// from before we call it despawned. ESI has a habit of handing back partial lists every now and then.
+const DefaultDespawnConfirmations = 3
+
+var knownIncursionStates = []string{"established", "mobilizing", "withdrawing"}
+
+// IncursionAnomalyCounts keeps track of the responses we decided not to trust
+type IncursionAnomalyCounts struct {
+	RejectedResponses  int64
+	EmptyResponses     int64
+	SuppressedDespawns int64
+}
+
+// IncursionAnomalies is updated atomically from the scheduler and read by anyone that wants to report on it
+var IncursionAnomalies IncursionAnomalyCounts
+
+// IncursionTracker remembers what the last check saw so the next one can tell what changed
+type IncursionTracker struct {
+	lock sync.Mutex
+	last []*EsiIncursion
+	// Which fetch last was compared against
+	checked int64
+	// How many fetches in a row each incursion (by staging system) has been missing from
+	missing map[int]int
+}
+
+func NewIncursionTracker() IncursionTracker {
+	return IncursionTracker{
+		last:    make([]*EsiIncursion, 0),
+		missing: make(map[int]int),
+	}
+}
+
+// validateIncursions makes sure that what ESI sent back actually looks like incursions and not an error body
+func validateIncursions(incursions []*EsiIncursion) error {
+	if incursions == nil {
+		return errors.New("response was not a list of incursions")
+	}
+
+	for i, incursion := range incursions {
+		if incursion == nil {
+			return fmt.Errorf("incursion %d is null", i)
+		}
+
+		if incursion.ConstellationId <= 0 || incursion.StagingSolarSystemId <= 0 {
+			return fmt.Errorf("incursion %d is missing constellation or staging system", i)
+		}
+
+		if !Exists(knownIncursionStates, incursion.State) {
+			return fmt.Errorf("incursion %d has unknown state %q", i, incursion.State)
+		}
+
+		if incursion.Influence < 0 || incursion.Influence > 1 {
+			return fmt.Errorf("incursion %d has influence out of range %v", i, incursion.Influence)
+		}
+
+		if len(incursion.InfestedSolarSystems) == 0 {
+			return fmt.Errorf("incursion %d has no infested systems", i)
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) SetupIncursions() error {
+	incursionsCmd := server.Redis.Get(RedisIncursionKey)
+	if incursionsCmd.Err() != nil {
+		// Essentially no stashed incursions
+		return incursionsCmd.Err()
+	}
+
+	var savedIncursions []*EsiIncursion
+
+	err := json.Unmarshal([]byte(incursionsCmd.Val()), &savedIncursions)
+
+	if err != nil {
+		Log.Error("Unable to parse saved incursions", LogFields{"key": RedisIncursionKey, "error": err})
+		return err
+	}
+
+	// Resolve all the names
+	// Note: It would be possible to have all the names serialized out with json, but that might be a discussion for later
+	server.PopulateIncursionData(savedIncursions)
+
+	return nil
+}
+
+func (server *Server) checkIncursions(logger *Logger) {
+	// Runs can overlap if ESI is being slow, make sure they take turns
+	tracker := &server.Tracker
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	incursions, fetch, _ := server.fetchIncursions()
+
+	// If ESI failed us or it's the same list we already compared against, don't even bother checking...
+	if incursions == nil || fetch == tracker.checked {
+		return
+	}
+
+	tracker.checked = fetch
+
+	lastIncursions := tracker.last
+	missingIncursions := tracker.missing
+
+	// Otherwise, lets compare our scheduler incursions to the returned incursions
+	// Note: Special case, the first time this runs we will have no cached incursions, so lets just skip that run to hydrate the cache
+
+	if len(lastIncursions) <= 0 {
+		tracker.last = incursions // hydrate
+		return
+	}
+
+	if len(incursions) == 0 {
+		// Technically valid, but there has never been a moment without incursions in New Eden
+		logger.Warn("ESI returned no incursions", LogFields{"tracked": len(lastIncursions)})
+		atomic.AddInt64(&IncursionAnomalies.EmptyResponses, 1)
+	}
+
+	newIncursions := make([]*EsiIncursion, 0)
+	changedIncursions := make([]*EsiIncursion, 0)
+	deadIncursions := make([]*EsiIncursion, 0)
+
+	// Lets just walk through the array and attempt to compare each other incursion
+	for _, inc := range incursions {
+		foundExisting := false
+		for _, existing := range lastIncursions {
+			if inc.StagingSolarSystemId == existing.StagingSolarSystemId {
+				// Check if state also changed
+				if inc.State != existing.State {
+					// Set the "previous state" temp variable so we can use later
+					changedIncursions = append(changedIncursions, inc)
+					server.RecordEvent(logger, server.NewIncursionEvent(EventStateChanged, inc, existing.State))
+				}
+
+				if inc.HasBoss && !existing.HasBoss && RulesForIncursion(inc).HasBoss {
+					server.RecordEvent(logger, server.NewIncursionEvent(EventBossSpawned, inc, ""))
+				}
+
+				foundExisting = true
+				break
+			}
+		}
+
+		if !foundExisting {
+			newIncursions = append(newIncursions, inc)
+			server.RecordEvent(logger, server.NewIncursionEvent(EventSpawned, inc, ""))
+		}
+	}
+
+	// Incursions that went missing but haven't been gone long enough to call dead
+	stillTracked := make([]*EsiIncursion, 0)
+
+	for _, existing := range lastIncursions {
+		foundExisting := false
+		for _, new := range incursions {
+			if existing.StagingSolarSystemId == new.StagingSolarSystemId {
+				foundExisting = true
+				break
+			}
+		}
+
+		// It's still alive, SKIP
+		if foundExisting {
+			delete(missingIncursions, existing.StagingSolarSystemId)
+			continue
+		}
+
+		missingIncursions[existing.StagingSolarSystemId]++
+		misses := missingIncursions[existing.StagingSolarSystemId]
+
+		if misses < server.Config.DespawnConfirmations {
+			logger.Warn("Incursion missing from ESI, suppressing despawn for now", LogFields{"staging": existing.StagingSolarSystemId, "misses": misses, "confirmations": server.Config.DespawnConfirmations})
+			atomic.AddInt64(&IncursionAnomalies.SuppressedDespawns, 1)
+			stillTracked = append(stillTracked, existing)
+			continue
+		}
+
+		delete(missingIncursions, existing.StagingSolarSystemId)
+		deadIncursions = append(deadIncursions, existing)
+		server.RecordEvent(logger, server.NewIncursionEvent(EventDespawned, existing, existing.State))
+	}
+
+	// Every guild gets their own copy since jumps depend on their home and route preferences
+	server.BroadcastGuildMessage(logger, func(guildId string) string {
+		settings := server.GetGuildSettings(guildId)
+		var buffer = bytes.NewBufferString("")
+
+		for _, changed := range changedIncursions {
+			server.GetChangedIncursionMessage(changed, settings, buffer)
+		}
+
+		for _, new := range newIncursions {
+			server.GetNewIncursionMessage(new, settings, buffer)
+		}
+
+		for _, dead := range deadIncursions {
+			server.GetDespawnedIncursionMessage(dead, settings, buffer)
+		}
+
+		// Did any new info come through?
+		if buffer.Len() <= 0 {
+			logger.Debug("All remains quiet", LogFields{"guild": guildId})
+		}
+
+		return buffer.String()
+	})
+
+	// Cache of the last result, plus anything we are still waiting on to confirm a despawn
+	tracked := make([]*EsiIncursion, 0, len(incursions)+len(stillTracked))
+	tracked = append(tracked, incursions...)
+	tracker.last = append(tracked, stillTracked...)
+}
+
+// TODO: It feels like this method doesn't belong here since the struct isn't here
+func (server *Server) GetConstellationForIncursion(incursion *EsiIncursion) *EsiConstellation {
+	return server.GetConstellation(incursion.ConstellationId)
+}
+
+// wantsIncursion applies the security threshold and the guild's faction filter
+func (server *Server) wantsIncursion(incursion *EsiIncursion, settings *GuildSettings) bool {
+	return incursion.StagingSystem.SecurityStatus <= server.Config.SecurityStatusThreshold && settings.WantsFaction(incursion.FactionId)
+}
+
+// describeBoss is only worth mentioning for incursions that have one
+func describeBoss(incursion *EsiIncursion) string {
+	if !RulesForIncursion(incursion).HasBoss || !incursion.HasBoss {
+		return ""
+	}
+	return " - Boss spawned"
+}
+
+func (server *Server) GetNewIncursionMessage(incursion *EsiIncursion, settings *GuildSettings, buffer *bytes.Buffer) {
+	constellation := server.GetConstellationForIncursion(incursion)
+	dotlan := fmt.Sprintf("http://evemaps.dotlan.net/map/%v/%v", constellation.RegionName, constellation.Name)
+
+	dotlan = strings.Replace(dotlan, " ", "_", -1)
+
+	// Filter
+	if server.wantsIncursion(incursion, settings) {
+		buffer.WriteString(fmt.Sprintf("New %v detected in %v {%.1v} {%v - %v} - %v - Dotlan: %v\n", DescribeKind(incursion), incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName, server.DescribeRouteForGuild(settings, incursion), dotlan))
+	}
+}
+
+func (server *Server) GetDefaultIncurionsMessage(incursion *EsiIncursion, settings *GuildSettings, buffer *bytes.Buffer) {
+	constellation := server.GetConstellationForIncursion(incursion)
+	dotlan := fmt.Sprintf("http://evemaps.dotlan.net/map/%v/%v", constellation.RegionName, constellation.Name)
+	dotlan = strings.Replace(dotlan, " ", "_", -1)
+
+	if server.wantsIncursion(incursion, settings) {
+		buffer.WriteString(fmt.Sprintf("%v {%.1v} {%v - %v} %v - Influence: %.3v%% - Status %v%v - %v - Dotlan: %v\n", incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName, DescribeKind(incursion), incursion.Influence*100, RulesForIncursion(incursion).DescribeState(incursion.State), describeBoss(incursion), server.DescribeRouteForGuild(settings, incursion), dotlan))
+	}
+}
+
+func (server *Server) GetChangedIncursionMessage(incursion *EsiIncursion, settings *GuildSettings, buffer *bytes.Buffer) {
+	constellation := server.GetConstellationForIncursion(incursion)
+	dotlan := fmt.Sprintf("http://evemaps.dotlan.net/map/%v/%v", constellation.RegionName, constellation.Name)
+	dotlan = strings.Replace(dotlan, " ", "_", -1)
+
+	if server.wantsIncursion(incursion, settings) {
+		buffer.WriteString(fmt.Sprintf("%v in %v {%.1v} {%v - %v} Changed status to - Status %v%v - %v - Dotlan: %v\n", DescribeKind(incursion), incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName, RulesForIncursion(incursion).DescribeState(incursion.State), describeBoss(incursion), server.DescribeRouteForGuild(settings, incursion), dotlan))
+	}
+}
+
+func (server *Server) GetDespawnedIncursionMessage(incursion *EsiIncursion, settings *GuildSettings, buffer *bytes.Buffer) {
+	constellation := server.GetConstellationForIncursion(incursion)
+
+	if server.wantsIncursion(incursion, settings) {
+		buffer.WriteString(fmt.Sprintf("%v in %v {%.1v} {%v - %v} Despawned\n", DescribeKind(incursion), incursion.StagingSystem.Name, incursion.StagingSystem.SecurityStatus, incursion.ConsellationName, constellation.RegionName))
+	}
+}
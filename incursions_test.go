@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func eventTypes(events []*IncursionEvent) []EventType {
+	types := make([]EventType, 0, len(events))
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestValidateIncursions(t *testing.T) {
+	valid := testIncursion(testSystemStaging, testConstellationBeta, "established")
+
+	tests := []struct {
+		name       string
+		incursions []*EsiIncursion
+		ok         bool
+	}{
+		{"valid", []*EsiIncursion{valid}, true},
+		{"empty list", []*EsiIncursion{}, true},
+		{"not a list", nil, false},
+		{"null entry", []*EsiIncursion{nil}, false},
+		{"missing staging", []*EsiIncursion{{ConstellationId: 1, State: "established", InfestedSolarSystems: []int{1}}}, false},
+		{"unknown state", []*EsiIncursion{testIncursion(testSystemStaging, testConstellationBeta, "bogus")}, false},
+	}
+
+	for _, test := range tests {
+		if err := validateIncursions(test.incursions); (err == nil) != test.ok {
+			t.Errorf("%v: validateIncursions error = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestGetIncursionsCachesAndPopulates(t *testing.T) {
+	server, esi, stop := newTestServer(t)
+	defer stop()
+
+	esi.Serve(testIncursion(testSystemStaging, testConstellationBeta, "established"))
+
+	incursions, fresh := server.GetIncursions()
+
+	if !fresh || len(incursions) != 1 {
+		t.Fatalf("GetIncursions = %d incursions, fresh %v", len(incursions), fresh)
+	}
+
+	incursion := incursions[0]
+	if incursion.ConsellationName != "Beta" || incursion.StagingSystem == nil || incursion.StagingSystem.Name != "Staging" {
+		t.Errorf("incursion wasn't populated from the universe: %+v", incursion)
+	}
+
+	if JumpCount(incursion.Route) != 3 {
+		t.Errorf("route from home = %v, want 3 jumps", incursion.Route)
+	}
+
+	if _, fresh = server.GetIncursions(); fresh {
+		t.Error("second call went back to ESI instead of using the cache")
+	}
+
+	if esi.Fetches() != 1 {
+		t.Errorf("ESI was asked %d times, want 1", esi.Fetches())
+	}
+}
+
+func TestCheckIncursionsWaitsBeforeDespawning(t *testing.T) {
+	server, esi, stop := newTestServer(t)
+	defer stop()
+
+	home := testIncursion(testSystemHub, testConstellationAlpha, "established")
+	staging := testIncursion(testSystemStaging, testConstellationBeta, "established")
+
+	check := func(incursions ...*EsiIncursion) {
+		esi.Serve(incursions...)
+		server.expireIncursions()
+		server.checkIncursions(Log)
+	}
+
+	check(home)
+	check(home, staging)
+
+	if types := eventTypes(server.GetEvents(0, 10)); fmt.Sprint(types) != "[spawned]" {
+		t.Fatalf("events after a spawn = %v", types)
+	}
+
+	// One miss isn't enough with two confirmations
+	check(home)
+
+	if server.CountEvents() != 1 {
+		t.Fatalf("despawned after a single miss, events %v", eventTypes(server.GetEvents(0, 10)))
+	}
+
+	check(home)
+
+	events := server.GetEvents(0, 10)
+	if fmt.Sprint(eventTypes(events)) != "[despawned spawned]" {
+		t.Fatalf("events after two misses = %v", eventTypes(events))
+	}
+
+	if events[0].StagingSystemName != "Staging" || events[0].RegionName != "Test Region" {
+		t.Errorf("despawn event = %+v", events[0])
+	}
+}
+
+func TestCheckIncursionsRecoversFromAMiss(t *testing.T) {
+	server, esi, stop := newTestServer(t)
+	defer stop()
+
+	staging := testIncursion(testSystemStaging, testConstellationBeta, "established")
+
+	for _, incursions := range [][]*EsiIncursion{{staging}, {}, {staging}, {}} {
+		esi.Serve(incursions...)
+		server.expireIncursions()
+		server.checkIncursions(Log)
+	}
+
+	// Missing, back, missing again is one miss in a row, not two
+	if server.CountEvents() != 0 {
+		t.Errorf("events = %v, want none", eventTypes(server.GetEvents(0, 10)))
+	}
+}
+
+func TestConcurrentIncursionChecks(t *testing.T) {
+	server, esi, stop := newTestServer(t)
+	defer stop()
+
+	home := testIncursion(testSystemHub, testConstellationAlpha, "established")
+	staging := testIncursion(testSystemStaging, testConstellationBeta, "mobilizing")
+
+	esi.Serve(home)
+	server.checkIncursions(Log)
+
+	esi.Serve(home, staging)
+	server.expireIncursions()
+
+	events := server.Events.Subscribe()
+	defer server.Events.Unsubscribe(events)
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wait.Add(3)
+
+		go func() {
+			defer wait.Done()
+			server.checkIncursions(Log)
+		}()
+
+		go func() {
+			defer wait.Done()
+
+			incursions, _ := server.GetIncursions()
+			for _, incursion := range incursions {
+				server.DescribeRouteForGuild(server.DefaultGuildSettings(), incursion)
+			}
+		}()
+
+		go func(worker int) {
+			defer wait.Done()
+
+			id := fmt.Sprint(worker)
+			server.Guilds.Add(&discordgo.Guild{ID: id, Name: "Guild " + id})
+			server.Guilds.IDs()
+			server.Guilds.Name(id)
+		}(worker)
+	}
+
+	wait.Wait()
+
+	if esi.Fetches() != 2 {
+		t.Errorf("ESI was asked %d times, want 2", esi.Fetches())
+	}
+
+	if types := eventTypes(server.GetEvents(0, 10)); fmt.Sprint(types) != "[spawned]" {
+		t.Errorf("events = %v, want exactly one spawn", types)
+	}
+
+	select {
+	case event := <-events:
+		if event.StagingSystemId != testSystemStaging {
+			t.Errorf("streamed event = %+v", event)
+		}
+	default:
+		t.Error("the spawn wasn't published to subscribers")
+	}
+
+	if server.Incursions.Count() != 2 {
+		t.Errorf("Count = %d, want 2", server.Incursions.Count())
+	}
+}
+
+func TestGuildRegistryConcurrentAccess(t *testing.T) {
+	registry := NewGuildRegistry()
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wait.Add(1)
+
+		go func(worker int) {
+			defer wait.Done()
+
+			id := fmt.Sprint(worker)
+			channel := &discordgo.Channel{ID: "channel-" + id}
+
+			for i := 0; i < 50; i++ {
+				registry.Add(&discordgo.Guild{ID: id, Name: "Guild " + id, Channels: []*discordgo.Channel{channel}})
+
+				if found, err := registry.GuildIdForChannel(channel.ID); err != nil || found != id {
+					t.Errorf("GuildIdForChannel(%v) = %v, %v", channel.ID, found, err)
+				}
+
+				registry.IDs()
+				registry.Count()
+				registry.Has(id)
+
+				if i%2 == 0 {
+					registry.Remove(id)
+				}
+			}
+		}(worker)
+	}
+
+	wait.Wait()
+
+	if registry.Count() != 8 {
+		t.Errorf("Count = %d, want 8", registry.Count())
+	}
+}
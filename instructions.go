@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	// The name instructions get when nobody picks one, and the name the old single instructions live under
+	DefaultInstructionsName = "default"
+
+	// How many old versions of each document we keep around to roll back to
+	maxInstructionVersions = 50
+
+	// Discord won't take a message longer than this
+	maxMessageLength = 2000
+)
+
+var instructionsName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+// InstructionsVersion is one edit of a named instructions document
+type InstructionsVersion struct {
+	// Numbers only ever go up, so they stay put when old versions are trimmed
+	Version  int       `json:"version"`
+	Text     string    `json:"text"`
+	AuthorId string    `json:"author_id"`
+	SetAt    time.Time `json:"set_at"`
+}
+
+// legacyInstructionsKey is where instructions lived before they had names
+func legacyInstructionsKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:instructions", guildId)
+}
+
+func instructionNamesKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:instructions:names", guildId)
+}
+
+// instructionsHistoryKey is a list of versions, newest first
+func instructionsHistoryKey(guildId, name string) string {
+	return fmt.Sprintf("bot:%v:instructions:%v:history", guildId, name)
+}
+
+// instructionsVersionKey counts versions of the document so each gets a number of its own
+func instructionsVersionKey(guildId, name string) string {
+	return fmt.Sprintf("bot:%v:instructions:%v:version", guildId, name)
+}
+
+// migrateLegacyInstructions turns the old single instructions into the default document the first time we look.
+// The old key is taken before saving, saving looks at the history too and would come straight back here.
+func (server *Server) migrateLegacyInstructions(guildId string) {
+	legacy, ok := takeKey(server.Redis, legacyInstructionsKey(guildId))
+
+	if !ok {
+		return
+	}
+
+	if server.Redis.Exists(instructionsHistoryKey(guildId, DefaultInstructionsName)).Val() != 0 {
+		return
+	}
+
+	if _, err := server.SaveInstructions(guildId, DefaultInstructionsName, strings.TrimSpace(legacy), ""); err != nil {
+		Log.Error("Unable to migrate instructions", LogFields{"guild": guildId, "error": err})
+		// Put it back for next time
+		server.Redis.SetNX(legacyInstructionsKey(guildId), legacy, 0)
+	}
+}
+
+func (server *Server) GetInstructionNames(guildId string) []string {
+	server.migrateLegacyInstructions(guildId)
+
+	names := server.Redis.SMembers(instructionNamesKey(guildId)).Val()
+	sort.Strings(names)
+	return names
+}
+
+// GetInstructionsHistory returns every version we have, newest first
+func (server *Server) GetInstructionsHistory(guildId, name string) []*InstructionsVersion {
+	server.migrateLegacyInstructions(guildId)
+
+	versions := make([]*InstructionsVersion, 0)
+	raws := server.Redis.LRange(instructionsHistoryKey(guildId, name), 0, -1).Val()
+
+	for _, raw := range raws {
+		var version InstructionsVersion
+
+		if err := json.Unmarshal([]byte(raw), &version); err != nil {
+			Log.Warn("Unable to parse instructions", LogFields{"guild": guildId, "name": name, "error": err})
+			continue
+		}
+
+		versions = append(versions, &version)
+	}
+
+	return versions
+}
+
+// GetInstructionsText is the current version of the document, false if it doesn't exist
+func (server *Server) GetInstructionsText(guildId, name string) (string, bool) {
+	history := server.GetInstructionsHistory(guildId, name)
+
+	if len(history) <= 0 {
+		return "", false
+	}
+
+	return history[0].Text, true
+}
+
+// nextInstructionsVersion hands out the number for a new version
+func (server *Server) nextInstructionsVersion(guildId, name string) (int, error) {
+	cmd := server.Redis.Incr(instructionsVersionKey(guildId, name))
+	return int(cmd.Val()), cmd.Err()
+}
+
+// SaveInstructions adds a new version of the document and returns its number
+func (server *Server) SaveInstructions(guildId, name, text, authorId string) (int, error) {
+	number, err := server.nextInstructionsVersion(guildId, name)
+
+	if err != nil {
+		return 0, err
+	}
+
+	bytes, err := json.Marshal(&InstructionsVersion{
+		Version:  number,
+		Text:     text,
+		AuthorId: authorId,
+		SetAt:    time.Now().UTC(),
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	key := instructionsHistoryKey(guildId, name)
+
+	if err = server.Redis.LPush(key, string(bytes)).Err(); err != nil {
+		return 0, err
+	}
+
+	server.Redis.LTrim(key, 0, maxInstructionVersions-1)
+	return number, server.Redis.SAdd(instructionNamesKey(guildId), name).Err()
+}
+
+// FindInstructionsVersion looks a version up by its number, nil if it was trimmed or never existed
+func FindInstructionsVersion(history []*InstructionsVersion, number int) *InstructionsVersion {
+	for _, version := range history {
+		if version.Version == number {
+			return version
+		}
+	}
+	return nil
+}
+
+func (server *Server) DeleteInstructions(guildId, name string) {
+	server.Redis.Del(instructionsHistoryKey(guildId, name), instructionsVersionKey(guildId, name))
+	server.Redis.SRem(instructionNamesKey(guildId), name)
+}
+
+// SplitMessage breaks text into chunks Discord will accept, preferring paragraph then line breaks,
+// and closing and reopening code blocks so formatting survives the split
+func SplitMessage(text string, limit int) []string {
+	chunks := make([]string, 0)
+	// Leave room to close and reopen a code block
+	budget := limit - 8
+
+	for utf8.RuneCountInString(text) > limit {
+		// Limits are in characters, and cutting anywhere else could split one
+		end := runeOffset(text, budget)
+		cut := strings.LastIndex(text[:end], "\n\n")
+
+		if cut <= 0 {
+			cut = strings.LastIndex(text[:end], "\n")
+		}
+
+		if cut <= 0 {
+			cut = strings.LastIndex(text[:end], " ")
+		}
+
+		if cut <= 0 {
+			cut = end
+		}
+
+		chunk := text[:cut]
+		text = strings.TrimLeft(text[cut:], "\n")
+
+		// An odd number of fences means we are splitting inside a code block
+		if strings.Count(chunk, "```")%2 == 1 {
+			chunk += "\n```"
+			text = "```\n" + text
+		}
+
+		chunks = append(chunks, chunk)
+	}
+
+	if len(strings.TrimSpace(text)) > 0 {
+		chunks = append(chunks, text)
+	}
+
+	return chunks
+}
+
+// runeOffset is the byte offset of the nth character of text
+func runeOffset(text string, n int) int {
+	count := 0
+
+	for i := range text {
+		if count == n {
+			return i
+		}
+		count++
+	}
+
+	return len(text)
+}
+
+// SendLongDirectMessage DMs text over as many messages as it takes
+func (server *Server) SendLongDirectMessage(user *discordgo.User, text string) {
+	for _, chunk := range SplitMessage(text, maxMessageLength) {
+		server.SendDirectMessage(user, chunk)
+	}
+}
+
+// parseInstructionsCommand pulls "name" and the text after it out of "!command name text", text can span lines.
+// The first word is only a name if there is already a document called that, or it's alone on the command's line
+// with the text below. Anything else is the old "!command text" and goes to the default document.
+func parseInstructionsCommand(content, command string, names []string) (string, string) {
+	rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(content), command))
+
+	fields := strings.Fields(rest)
+	if len(fields) <= 0 {
+		return "", ""
+	}
+
+	name := strings.ToLower(fields[0])
+	text := strings.TrimSpace(strings.TrimPrefix(rest, fields[0]))
+
+	commandLine := strings.SplitN(strings.TrimSpace(content), "\n", 2)[0]
+	aloneOnLine := len(strings.Fields(commandLine)) == 2 && len(text) > 0
+
+	if Exists(names, name) || (aloneOnLine && instructionsName.MatchString(name)) {
+		return name, text
+	}
+
+	return DefaultInstructionsName, rest
+}
+
+// GetInstructions is !instructions [name] which DMs the document, or !instructions history <name>
+func (server *Server) GetInstructions(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		logger.Warn("Unable to find guild for channel", LogFields{"error": err})
+		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintainer of this bot.", err))
+		return
+	}
+
+	args := commandArgs(message)
+	names := server.GetInstructionNames(guildId)
+
+	if len(args) >= 2 && strings.ToLower(args[0]) == "history" {
+		server.sendInstructionsHistory(guildId, strings.ToLower(args[1]), message)
+		return
+	}
+
+	name := DefaultInstructionsName
+	if len(args) >= 1 {
+		name = strings.ToLower(args[0])
+	}
+
+	text, ok := server.GetInstructionsText(guildId, name)
+
+	if !ok {
+		if len(names) <= 0 {
+			server.SendDirectMessage(message.Author, "No instructions are set")
+			return
+		}
+
+		server.SendMessage(message.ChannelID, fmt.Sprintf("No instructions called %v. Try one of: %v", name, strings.Join(names, ", ")))
+		return
+	}
+
+	server.SendLongDirectMessage(message.Author, text)
+
+	if len(names) > 1 {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Sent you %v. Also available with !instructions <name>: %v", name, strings.Join(names, ", ")))
+	}
+}
+
+func (server *Server) sendInstructionsHistory(guildId, name string, message *discordgo.MessageCreate) {
+	history := server.GetInstructionsHistory(guildId, name)
+
+	if len(history) <= 0 {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("No instructions called %v", name))
+		return
+	}
+
+	lines := make([]string, 0, len(history))
+	for _, version := range history {
+		author := "unknown"
+		if len(version.AuthorId) > 0 {
+			author = server.PilotName(version.AuthorId)
+		}
+
+		lines = append(lines, fmt.Sprintf("v%d - %v by %v - %d characters", version.Version, version.SetAt.Format(eveTimeLayout), author, len(version.Text)))
+	}
+
+	for _, chunk := range SplitMessage(strings.Join(lines, "\n"), maxMessageLength) {
+		server.SendMessage(message.ChannelID, chunk)
+	}
+}
+
+// SetInstructions is !setinstructions [name] <text>, the text can carry on over multiple lines
+func (server *Server) SetInstructions(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	server.changeInstructions(logger, message, "!setinstructions", false)
+}
+
+// AppendInstructions is !appendinstructions [name] <text> for documents too long for one message
+func (server *Server) AppendInstructions(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	server.changeInstructions(logger, message, "!appendinstructions", true)
+}
+
+func (server *Server) changeInstructions(logger *Logger, message *discordgo.MessageCreate, command string, appendText bool) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	name, text := parseInstructionsCommand(message.Content, command, server.GetInstructionNames(guildId))
+
+	if len(text) <= 0 {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Usage: %v [name] <text>. Put a new name alone on the first line with the text below it. Names are lower case letters, numbers, - and _", command))
+		return
+	}
+
+	if appendText {
+		if existing, ok := server.GetInstructionsText(guildId, name); ok {
+			text = existing + "\n" + text
+		}
+	}
+
+	number, err := server.SaveInstructions(guildId, name, text, message.Author.ID)
+
+	if err != nil {
+		logger.Error("Unable to save instructions", LogFields{"guild": guildId, "name": name, "error": err})
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to set instructions. Error: %v", err))
+		return
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("Instructions %v saved (v%d, %d characters)", name, number, len(text)))
+}
+
+// RollbackInstructions is !rollbackinstructions <name> <version>, it saves the old version as the newest so nothing is lost
+func (server *Server) RollbackInstructions(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	args := commandArgs(message)
+
+	if len(args) < 2 {
+		server.SendMessage(message.ChannelID, "Usage: !rollbackinstructions <name> <version>")
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	history := server.GetInstructionsHistory(guildId, name)
+	if len(history) <= 0 {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("No instructions called %v", name))
+		return
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(args[1]), "v"))
+	old := FindInstructionsVersion(history, version)
+
+	if err != nil || old == nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("%v has versions %d to %d, see !instructions history %v", name, history[len(history)-1].Version, history[0].Version, name))
+		return
+	}
+
+	if _, err = server.SaveInstructions(guildId, name, old.Text, message.Author.ID); err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to roll back instructions. Error: %v", err))
+		return
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("Instructions %v rolled back to v%d", name, version))
+}
+
+func (server *Server) RemoveInstructions(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	args := commandArgs(message)
+
+	if len(args) < 1 {
+		server.SendMessage(message.ChannelID, "Usage: !deleteinstructions <name>")
+		return
+	}
+
+	name := strings.ToLower(args[0])
+	server.DeleteInstructions(guildId, name)
+	server.SendMessage(message.ChannelID, fmt.Sprintf("Instructions %v deleted", name))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseInstructionsCommand(t *testing.T) {
+	names := []string{"default", "logi"}
+
+	tests := []struct {
+		content string
+		name    string
+		text    string
+	}{
+		{"!setinstructions Welcome to the fleet", "default", "Welcome to the fleet"},
+		{"!setinstructions hello", "default", "hello"},
+		{"!setinstructions logi Broadcast for reps", "logi", "Broadcast for reps"},
+		{"!setinstructions LOGI Broadcast for reps", "logi", "Broadcast for reps"},
+		{"!setinstructions dps\nAnchor on the FC\nShoot the primary", "dps", "Anchor on the FC\nShoot the primary"},
+		{"!setinstructions\nRules:\nBe nice", "default", "Rules:\nBe nice"},
+		{"!setinstructions", "", ""},
+	}
+
+	for _, test := range tests {
+		name, text := parseInstructionsCommand(test.content, "!setinstructions", names)
+
+		if name != test.name || text != test.text {
+			t.Errorf("parseInstructionsCommand(%q) = %q, %q, want %q, %q", test.content, name, text, test.name, test.text)
+		}
+	}
+}
+
+func TestInstructionVersionsSurviveTrimming(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	for i := 1; i <= maxInstructionVersions+5; i++ {
+		number, err := server.SaveInstructions("guild", "logi", fmt.Sprintf("edit %d", i), "")
+
+		if err != nil || number != i {
+			t.Fatalf("SaveInstructions = %d, %v, want %d", number, err, i)
+		}
+	}
+
+	history := server.GetInstructionsHistory("guild", "logi")
+
+	if len(history) != maxInstructionVersions || history[0].Version != maxInstructionVersions+5 || history[len(history)-1].Version != 6 {
+		t.Fatalf("history has %d versions from v%d to v%d", len(history), history[len(history)-1].Version, history[0].Version)
+	}
+
+	if version := FindInstructionsVersion(history, 10); version == nil || version.Text != "edit 10" {
+		t.Errorf("v10 = %+v, want edit 10", version)
+	}
+
+	if version := FindInstructionsVersion(history, 5); version != nil {
+		t.Errorf("v5 should have been trimmed, got %+v", version)
+	}
+}
+
+func TestLegacyInstructionsMigrate(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	server.Redis.Set(legacyInstructionsKey("guild"), "  Old instructions  ", 0)
+
+	text, ok := server.GetInstructionsText("guild", DefaultInstructionsName)
+
+	if !ok || text != "Old instructions" {
+		t.Fatalf("GetInstructionsText = %q, %v, want Old instructions", text, ok)
+	}
+
+	if server.Redis.Exists(legacyInstructionsKey("guild")).Val() != 0 {
+		t.Errorf("legacy instructions should have been removed")
+	}
+
+	number, err := server.SaveInstructions("guild", DefaultInstructionsName, "New instructions", "")
+
+	if err != nil || number != 2 {
+		t.Errorf("SaveInstructions = %d, %v, want 2", number, err)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"paragraphs", strings.Repeat("Anchor on the FC and shoot the primary.\n\n", 10)},
+		{"no breaks", strings.Repeat("a", 250)},
+		{"non-ascii", strings.Repeat("Überfall ⚔ Крепость ", 20)},
+		{"non-ascii no breaks", strings.Repeat("ж⚔", 150)},
+		{"code block", "```\n" + strings.Repeat("x up in the DPS channel\n", 20) + "```"},
+	}
+
+	for _, test := range tests {
+		chunks := SplitMessage(test.text, 100)
+
+		if len(chunks) < 2 {
+			t.Errorf("%v: expected the text to be split, got %d chunks", test.name, len(chunks))
+		}
+
+		for _, chunk := range chunks {
+			if !utf8.ValidString(chunk) {
+				t.Errorf("%v: chunk %q isn't valid UTF-8", test.name, chunk)
+			}
+
+			if count := utf8.RuneCountInString(chunk); count > 100 {
+				t.Errorf("%v: chunk is %d characters, want at most 100", test.name, count)
+			}
+
+			if strings.Count(chunk, "```")%2 != 0 {
+				t.Errorf("%v: chunk %q leaves a code block open", test.name, chunk)
+			}
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long signing keys are trusted before we fetch them again
+	jwksRefreshInterval = time.Hour
+	// Don't hammer the SSO when someone sends tokens signed with a key it never had
+	jwksMinRefreshInterval = time.Minute
+	// Clock drift we put up with on expiry
+	jwtLeeway = time.Second * 30
+
+	// Every SSO token is for this audience as well as the application's client id
+	ssoAudience = "EVE Online"
+	// Subjects look like CHARACTER:EVE:<character id>
+	ssoSubjectPrefix = "CHARACTER:EVE:"
+)
+
+// ssoCharacter is who an SSO access token says logged in, and what they allowed us to do
+type ssoCharacter struct {
+	CharacterID   int
+	CharacterName string
+	Scopes        string
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyId     string `json:"kid"`
+}
+
+// ssoClaims are the parts of the access token we check. Audience and scopes come as a string or a list.
+type ssoClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"`
+	AuthParty string          `json:"azp"`
+	Name      string          `json:"name"`
+	Scopes    json.RawMessage `json:"scp"`
+	Expires   int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+type jsonWebKey struct {
+	KeyId     string `json:"kid"`
+	KeyType   string `json:"kty"`
+	Algorithm string `json:"alg"`
+	Modulus   string `json:"n"`
+	Exponent  string `json:"e"`
+}
+
+// jwksCache holds the SSO's signing keys by key id
+type jwksCache struct {
+	lock      sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+}
+
+var ssoKeys = &jwksCache{keys: make(map[string]*rsa.PublicKey)}
+
+// stringList reads a claim that can be either one string or a list of them
+func stringList(raw json.RawMessage) []string {
+	if len(raw) <= 0 {
+		return make([]string, 0)
+	}
+
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list
+	}
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil && len(single) > 0 {
+		return []string{single}
+	}
+
+	return make([]string, 0)
+}
+
+// parseRsaKey turns a JWK into a public key, nil if it isn't an RSA signing key
+func parseRsaKey(key *jsonWebKey) *rsa.PublicKey {
+	if key.KeyType != "RSA" || (len(key.Algorithm) > 0 && key.Algorithm != "RS256") {
+		return nil
+	}
+
+	modulus, err := base64.RawURLEncoding.DecodeString(key.Modulus)
+
+	if err != nil {
+		return nil
+	}
+
+	exponent, err := base64.RawURLEncoding.DecodeString(key.Exponent)
+
+	if err != nil || len(exponent) <= 0 || len(exponent) > 4 {
+		return nil
+	}
+
+	e := 0
+	for _, b := range exponent {
+		e = e<<8 | int(b)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(modulus), E: e}
+}
+
+// Key returns the signing key with the id, fetching the key set again when it's stale or doesn't have it
+func (cache *jwksCache) Key(url, keyId string) (*rsa.PublicKey, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	key, ok := cache.keys[keyId]
+	age := time.Since(cache.fetchedAt)
+
+	if ok && age < jwksRefreshInterval {
+		return key, nil
+	}
+
+	if !ok && age < jwksMinRefreshInterval {
+		return nil, fmt.Errorf("SSO has no signing key %q", keyId)
+	}
+
+	keys, err := fetchJwks(url)
+
+	if err != nil {
+		// Better a key we fetched a little while ago than nothing at all
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	cache.keys = keys
+	cache.fetchedAt = time.Now()
+
+	if key, ok = cache.keys[keyId]; !ok {
+		return nil, fmt.Errorf("SSO has no signing key %q", keyId)
+	}
+
+	return key, nil
+}
+
+func fetchJwks(url string) (map[string]*rsa.PublicKey, error) {
+	resp, err := http.Get(url)
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SSO key request failed. Status: %v", resp.Status)
+	}
+
+	var set struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+
+	for _, key := range set.Keys {
+		if parsed := parseRsaKey(key); parsed != nil {
+			keys[key.KeyId] = parsed
+		}
+	}
+
+	if len(keys) <= 0 {
+		return nil, errors.New("SSO didn't publish any RS256 signing keys")
+	}
+
+	return keys, nil
+}
+
+// issuerMatches accepts the issuer with or without the scheme, the SSO has used both
+func issuerMatches(issuer, expected string) bool {
+	trim := func(value string) string {
+		return strings.TrimSuffix(strings.TrimPrefix(value, "https://"), "/")
+	}
+
+	return len(issuer) > 0 && trim(issuer) == trim(expected)
+}
+
+// validateSsoToken checks the access token's signature and claims, and returns who it belongs to
+func validateSsoToken(token string, keys func(keyId string) (*rsa.PublicKey, error), issuer, clientId string, now time.Time) (*ssoCharacter, error) {
+	parts := strings.Split(token, ".")
+
+	if len(parts) != 3 {
+		return nil, errors.New("SSO access token isn't a JWT")
+	}
+
+	var header jwtHeader
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("SSO access token is signed with %q, expected RS256", header.Algorithm)
+	}
+
+	key, err := keys(header.KeyId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, errors.New("SSO access token signature isn't valid base64")
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("SSO access token signature doesn't match")
+	}
+
+	var claims ssoClaims
+	if err = decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if !issuerMatches(claims.Issuer, issuer) {
+		return nil, fmt.Errorf("SSO access token was issued by %q", claims.Issuer)
+	}
+
+	audience := stringList(claims.Audience)
+
+	if !Exists(audience, ssoAudience) || !Exists(audience, clientId) || (len(claims.AuthParty) > 0 && claims.AuthParty != clientId) {
+		return nil, errors.New("SSO access token wasn't issued to this application")
+	}
+
+	if claims.Expires <= 0 || now.After(time.Unix(claims.Expires, 0).Add(jwtLeeway)) {
+		return nil, errors.New("SSO access token has expired")
+	}
+
+	if claims.NotBefore > 0 && now.Add(jwtLeeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, errors.New("SSO access token isn't valid yet")
+	}
+
+	if !strings.HasPrefix(claims.Subject, ssoSubjectPrefix) {
+		return nil, fmt.Errorf("SSO access token is for %q, not a character", claims.Subject)
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(claims.Subject, ssoSubjectPrefix))
+
+	if err != nil || id <= 0 {
+		return nil, fmt.Errorf("SSO access token is for %q, not a character", claims.Subject)
+	}
+
+	return &ssoCharacter{
+		CharacterID:   id,
+		CharacterName: claims.Name,
+		Scopes:        strings.Join(stringList(claims.Scopes), " "),
+	}, nil
+}
+
+func decodeJwtPart(part string, into interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(part)
+
+	if err != nil {
+		return errors.New("SSO access token isn't valid base64")
+	}
+
+	if err = json.Unmarshal(raw, into); err != nil {
+		return errors.New("SSO access token isn't valid JSON")
+	}
+
+	return nil
+}
+
+// verifyToken works out which character the access token belongs to, checking it against the SSO's signing keys
+func (server *Server) verifyToken(accessToken string) (*ssoCharacter, error) {
+	keys := func(keyId string) (*rsa.PublicKey, error) {
+		return ssoKeys.Key(server.Config.SSO.JwksUrl, keyId)
+	}
+
+	return validateSsoToken(accessToken, keys, server.Config.SSO.Issuer, os.Getenv("EVE_SSO_CLIENT_ID"), time.Now())
+}
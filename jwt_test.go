@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testClientId = "test-client"
+
+// signTestToken builds an access token the way the SSO does, signed with the key
+func signTestToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	encode := func(part map[string]interface{}) string {
+		raw, err := json.Marshal(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	signed := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":  "https://login.eveonline.com",
+		"sub":  "CHARACTER:EVE:90000001",
+		"aud":  []string{testClientId, ssoAudience},
+		"azp":  testClientId,
+		"name": "Test Pilot",
+		"scp":  "esi-location.read_location.v1",
+		"exp":  now.Add(time.Minute * 20).Unix(),
+	}
+}
+
+func TestValidateSsoToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(keyId string) (*rsa.PublicKey, error) {
+		if keyId != "JWT-Signature-Key" {
+			return nil, errors.New("unknown key")
+		}
+		return &key.PublicKey, nil
+	}
+
+	now := time.Now()
+	header := map[string]interface{}{"alg": "RS256", "kid": "JWT-Signature-Key", "typ": "JWT"}
+
+	character, err := validateSsoToken(signTestToken(t, key, header, testClaims(now)), keys, DefaultSsoIssuer, testClientId, now)
+	if err != nil {
+		t.Fatalf("valid token was rejected: %v", err)
+	}
+
+	if character.CharacterID != 90000001 || character.CharacterName != "Test Pilot" || character.Scopes != "esi-location.read_location.v1" {
+		t.Errorf("validateSsoToken = %+v", character)
+	}
+
+	change := func(name string, value interface{}) map[string]interface{} {
+		claims := testClaims(now)
+		claims[name] = value
+		return claims
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		issuer string
+	}{
+		{"expired", signTestToken(t, key, header, change("exp", now.Add(-time.Minute).Unix())), DefaultSsoIssuer},
+		{"not yet valid", signTestToken(t, key, header, change("nbf", now.Add(time.Minute*5).Unix())), DefaultSsoIssuer},
+		{"another application", signTestToken(t, key, header, change("aud", []string{"someone-else", ssoAudience})), DefaultSsoIssuer},
+		{"missing the EVE audience", signTestToken(t, key, header, change("aud", testClientId)), DefaultSsoIssuer},
+		{"wrong issuer", signTestToken(t, key, header, testClaims(now)), "login.example.com"},
+		{"not a character", signTestToken(t, key, header, change("sub", "CORPORATION:EVE:1")), DefaultSsoIssuer},
+		{"signed with another key", signTestToken(t, other, header, testClaims(now)), DefaultSsoIssuer},
+		{"unknown key id", signTestToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "other"}, testClaims(now)), DefaultSsoIssuer},
+		{"wrong algorithm", signTestToken(t, key, map[string]interface{}{"alg": "none", "kid": "JWT-Signature-Key"}, testClaims(now)), DefaultSsoIssuer},
+		{"not a jwt", "opaque-token", DefaultSsoIssuer},
+	}
+
+	for _, test := range tests {
+		if _, err := validateSsoToken(test.token, keys, test.issuer, testClientId, now); err == nil {
+			t.Errorf("%v: token was accepted", test.name)
+		}
+	}
+}
+
+func TestStringList(t *testing.T) {
+	if list := stringList(json.RawMessage(`"one"`)); len(list) != 1 || list[0] != "one" {
+		t.Errorf("single string = %v", list)
+	}
+
+	if list := stringList(json.RawMessage(`["one","two"]`)); len(list) != 2 {
+		t.Errorf("list = %v", list)
+	}
+
+	if list := stringList(nil); len(list) != 0 {
+		t.Errorf("missing claim = %v", list)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// The scope pilots need to have linked with for us to see where they are
+const LocationScope = "esi-location.read_location.v1"
+
+type EsiLocation struct {
+	SolarSystemId int `json:"solar_system_id"`
+	StationId     int `json:"station_id"`
+	StructureId   int `json:"structure_id"`
+}
+
+// GetCharacterLocation asks ESI where the character is right now
+func (server *Server) GetCharacterLocation(userId string, character *LinkedCharacter) (*EsiLocation, error) {
+	if !character.HasScope(LocationScope) {
+		return nil, fmt.Errorf("%v was linked without permission to read their location, use !link to link them again", character.Name)
+	}
+
+	token, err := server.AccessToken(userId, character)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp := getAuthenticatedEndpointResult(fmt.Sprintf("/latest/characters/%v/location/", character.Id), token)
+
+	if resp == nil {
+		return nil, errors.New("ESI didn't answer with a location")
+	}
+
+	var location EsiLocation
+	if err = json.Unmarshal(resp, &location); err != nil {
+		return nil, err
+	}
+
+	return &location, nil
+}
+
+// LocateUser finds the user's main character and the system it is in
+func (server *Server) LocateUser(userId string) (*LinkedCharacter, *EsiSystem, error) {
+	character := server.MainCharacter(userId)
+
+	if character == nil {
+		return nil, nil, errors.New("You haven't linked a character, use !link to add one")
+	}
+
+	location, err := server.GetCharacterLocation(userId, character)
+
+	if err != nil {
+		return character, nil, err
+	}
+
+	system := server.GetSystem(location.SolarSystemId)
+
+	if system == nil {
+		return character, nil, fmt.Errorf("Unable to look up system %v", location.SolarSystemId)
+	}
+
+	return character, system, nil
+}
+
+// settingsFromSystem keeps the guild's route preferences but starts routes from the system instead of home
+func settingsFromSystem(settings *GuildSettings, system *EsiSystem) *GuildSettings {
+	located := *settings
+	located.HomeSystemId = system.SystemId
+	located.OriginName = system.Name
+	return &located
+}
+
+// HandleWhereAmI is !whereami, where the user's main is and how far that is from the guild's home, sent privately
+func (server *Server) HandleWhereAmI(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	character, system, err := server.LocateUser(message.Author.ID)
+
+	if err != nil {
+		logger.Warn("Unable to locate user", LogFields{"error": err})
+		server.SendPrivateReply(session, message, err.Error())
+		return
+	}
+
+	settings := server.GetGuildSettingsForChannel(message.ChannelID)
+	route := server.GetRouteWithOptions(system.SystemId, settings.HomeSystemId, settings.RouteOptions())
+
+	home := fmt.Sprintf("no %v route home", settings.RouteOptions().preference())
+	if route != nil {
+		home = fmt.Sprintf("%v gate jumps from home", JumpCountText(route))
+	}
+
+	// Where someone's character is isn't for the whole channel to see
+	server.SendPrivateReply(session, message, fmt.Sprintf("%v is in %v {%.1v}, %v", character.Name, system.Name, system.SecurityStatus, home))
+}
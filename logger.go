@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return "unknown"
+	}
+
+	return logLevelNames[level]
+}
+
+// ParseLogLevel accepts debug, info, warn (or warning) and error
+func ParseLogLevel(value string) (LogLevel, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	if value == "warning" {
+		return LevelWarn, nil
+	}
+
+	for i, name := range logLevelNames {
+		if name == value {
+			return LogLevel(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %v", value, strings.Join(logLevelNames, ", "))
+}
+
+// LogFields are the key/values attached to a line, guild, channel, command, task, esi_path, duration and so on
+type LogFields map[string]interface{}
+
+// Logger writes leveled lines carrying its fields. With hands out a child, so a command or a task can
+// tag everything it logs with the same correlation id.
+type Logger struct {
+	fields LogFields
+}
+
+// logOutput is set up once by ConfigureLogging before anything else runs
+var logOutput = struct {
+	lock   sync.Mutex
+	writer io.Writer
+	level  LogLevel
+	json   bool
+	// Message contents are left out of the logs unless this is on
+	messageContent bool
+}{
+	writer: os.Stderr,
+	level:  LevelInfo,
+}
+
+// Log is the root logger
+var Log = &Logger{}
+
+// ConfigureLogging reads LOG_LEVEL, LOG_FORMAT (text or json) and LOG_MESSAGE_CONTENT, and sends everything
+// still using the log package through Log so the whole bot logs one way
+func ConfigureLogging() {
+	if value := os.Getenv("LOG_LEVEL"); len(value) > 0 {
+		level, err := ParseLogLevel(value)
+
+		if err != nil {
+			Log.Warn("Ignoring LOG_LEVEL", LogFields{"error": err})
+		}
+
+		logOutput.level = level
+	}
+
+	logOutput.json = strings.EqualFold(os.Getenv("LOG_FORMAT"), "json")
+	logOutput.messageContent, _ = strconv.ParseBool(os.Getenv("LOG_MESSAGE_CONTENT"))
+
+	log.SetFlags(0)
+	log.SetOutput(legacyLogWriter{})
+}
+
+// NewCorrelationId is short enough to read in a log line and long enough not to repeat any time soon
+func NewCorrelationId() string {
+	id, err := randomToken(6)
+
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return id
+}
+
+// MessageContent is what we log for something a user typed, which is nothing unless LOG_MESSAGE_CONTENT is on
+func MessageContent(content string) string {
+	if logOutput.messageContent {
+		return content
+	}
+
+	return fmt.Sprintf("[redacted %d chars]", len(content))
+}
+
+// With is a child logger with fields added to every line
+func (logger *Logger) With(fields LogFields) *Logger {
+	merged := make(LogFields, len(logger.fields)+len(fields))
+
+	for key, value := range logger.fields {
+		merged[key] = value
+	}
+
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return &Logger{fields: merged}
+}
+
+func (logger *Logger) Debug(message string, fields ...LogFields) {
+	logger.write(LevelDebug, message, fields)
+}
+
+func (logger *Logger) Info(message string, fields ...LogFields) {
+	logger.write(LevelInfo, message, fields)
+}
+
+func (logger *Logger) Warn(message string, fields ...LogFields) {
+	logger.write(LevelWarn, message, fields)
+}
+
+func (logger *Logger) Error(message string, fields ...LogFields) {
+	logger.write(LevelError, message, fields)
+}
+
+func (logger *Logger) write(level LogLevel, message string, extra []LogFields) {
+	if level < logOutput.level {
+		return
+	}
+
+	fields := logger.fields
+	for _, more := range extra {
+		fields = (&Logger{fields: fields}).With(more).fields
+	}
+
+	var line []byte
+
+	if logOutput.json {
+		line = formatJsonLine(time.Now().UTC(), level, message, fields)
+	} else {
+		line = formatTextLine(time.Now().UTC(), level, message, fields)
+	}
+
+	logOutput.lock.Lock()
+	logOutput.writer.Write(line)
+	logOutput.lock.Unlock()
+}
+
+// logValue makes durations and errors read well in both formats
+func logValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return value
+}
+
+func sortedFieldKeys(fields LogFields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// formatTextLine is logfmt: time=... level=info msg="..." key=value
+func formatTextLine(at time.Time, level LogLevel, message string, fields LogFields) []byte {
+	var buffer bytes.Buffer
+
+	buffer.WriteString("time=" + at.Format(time.RFC3339))
+	buffer.WriteString(" level=" + level.String())
+	buffer.WriteString(" msg=" + quoteLogValue(message))
+
+	for _, key := range sortedFieldKeys(fields) {
+		buffer.WriteString(" " + key + "=" + quoteLogValue(fmt.Sprint(logValue(fields[key]))))
+	}
+
+	buffer.WriteString("\n")
+	return buffer.Bytes()
+}
+
+func quoteLogValue(value string) string {
+	if len(value) <= 0 || strings.ContainsAny(value, " \t\r\n\"=\\") {
+		return strconv.Quote(value)
+	}
+
+	return value
+}
+
+func formatJsonLine(at time.Time, level LogLevel, message string, fields LogFields) []byte {
+	entry := make(map[string]interface{}, len(fields)+3)
+
+	for key, value := range fields {
+		entry[key] = logValue(value)
+	}
+
+	entry["time"] = at.Format(time.RFC3339)
+	entry["level"] = level.String()
+	entry["msg"] = message
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"time": at.Format(time.RFC3339), "level": level.String(), "msg": message})
+	}
+
+	return append(line, '\n')
+}
+
+// requestLogger replaces gin's logger. Every request gets a correlation id, the caller's X-Request-ID if it sent
+// one, and only the path is logged since query strings carry stream tickets and calendar tokens.
+func requestLogger(c *gin.Context) {
+	start := time.Now()
+
+	id := c.GetHeader("X-Request-ID")
+	if len(id) <= 0 || len(id) > 64 {
+		id = NewCorrelationId()
+	}
+
+	logger := Log.With(LogFields{"cid": id, "method": c.Request.Method, "path": c.Request.URL.Path})
+	c.Set("log", logger)
+	c.Header("X-Request-ID", id)
+
+	c.Next()
+
+	fields := LogFields{"status": c.Writer.Status(), "duration": time.Since(start), "client_ip": c.ClientIP()}
+
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		logger.Error("Request failed", fields)
+	} else {
+		logger.Info("Request handled", fields)
+	}
+}
+
+// RequestLog is the request's logger, or the root one outside of a request
+func RequestLog(c *gin.Context) *Logger {
+	if logger, ok := c.Get("log"); ok {
+		if requestLogger, ok := logger.(*Logger); ok {
+			return requestLogger
+		}
+	}
+
+	return Log
+}
+
+// legacyLogWriter takes lines from the log package. The [WARN] style prefixes the bot has always used pick the level.
+type legacyLogWriter struct{}
+
+var legacyLevelPrefixes = map[string]LogLevel{
+	"[DEBUG]": LevelDebug,
+	"[INFO]":  LevelInfo,
+	"[WARN]":  LevelWarn,
+	"[ERROR]": LevelError,
+}
+
+func (writer legacyLogWriter) Write(p []byte) (int, error) {
+	message := strings.TrimRight(string(p), "\n")
+	level := LevelInfo
+
+	for prefix, prefixLevel := range legacyLevelPrefixes {
+		if strings.HasPrefix(message, prefix) {
+			level = prefixLevel
+			message = strings.TrimSpace(strings.TrimPrefix(message, prefix))
+			break
+		}
+	}
+
+	Log.write(level, message, nil)
+	return len(p), nil
+}
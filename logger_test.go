@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs sends everything logged into a buffer until the returned func puts things back
+func captureLogs(t *testing.T, env map[string]string) (*bytes.Buffer, func()) {
+	savedWriter, savedLevel, savedJson, savedContent := logOutput.writer, logOutput.level, logOutput.json, logOutput.messageContent
+	previous := make(map[string]*string, len(env))
+
+	for key, value := range env {
+		if old, ok := os.LookupEnv(key); ok {
+			previous[key] = &old
+		} else {
+			previous[key] = nil
+		}
+
+		if len(value) > 0 {
+			os.Setenv(key, value)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+
+	var buffer bytes.Buffer
+	logOutput.writer = &buffer
+	ConfigureLogging()
+
+	return &buffer, func() {
+		logOutput.writer = savedWriter
+		logOutput.level = savedLevel
+		logOutput.json = savedJson
+		logOutput.messageContent = savedContent
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+
+		for key, value := range previous {
+			if value != nil {
+				os.Setenv(key, *value)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  LogLevel
+		ok    bool
+	}{
+		{"debug", LevelDebug, true},
+		{" INFO ", LevelInfo, true},
+		{"warn", LevelWarn, true},
+		{"warning", LevelWarn, true},
+		{"error", LevelError, true},
+		{"loud", LevelInfo, false},
+	}
+
+	for _, test := range tests {
+		level, err := ParseLogLevel(test.value)
+
+		if level != test.want || (err == nil) != test.ok {
+			t.Errorf("ParseLogLevel(%q) = %v, %v, want %v", test.value, level, err, test.want)
+		}
+	}
+}
+
+func TestMessageContentIsRedactedByDefault(t *testing.T) {
+	tests := []struct {
+		setting string
+		shown   bool
+	}{
+		{"", false},
+		{"false", false},
+		{"yes please", false},
+		{"true", true},
+		{"1", true},
+	}
+
+	for _, test := range tests {
+		output, restore := captureLogs(t, map[string]string{"LOG_MESSAGE_CONTENT": test.setting, "LOG_LEVEL": "debug", "LOG_FORMAT": ""})
+
+		Log.Debug("Message received", LogFields{"content": MessageContent("!setinstructions secret plans")})
+		restore()
+
+		if shown := strings.Contains(output.String(), "secret plans"); shown != test.shown {
+			t.Errorf("LOG_MESSAGE_CONTENT=%q: content shown = %v, want %v in %q", test.setting, shown, test.shown, output.String())
+		}
+
+		if !test.shown && !strings.Contains(output.String(), "[redacted 29 chars]") {
+			t.Errorf("LOG_MESSAGE_CONTENT=%q: expected the length in %q", test.setting, output.String())
+		}
+	}
+}
+
+func TestLogLevelFilters(t *testing.T) {
+	output, restore := captureLogs(t, map[string]string{"LOG_LEVEL": "warn", "LOG_FORMAT": ""})
+	defer restore()
+
+	Log.Debug("debug line")
+	Log.Info("info line")
+	Log.Warn("warn line")
+	Log.Error("error line")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+
+	if len(lines) != 2 || !strings.Contains(lines[0], "level=warn") || !strings.Contains(lines[1], "level=error") {
+		t.Errorf("got %q, want only the warning and the error", lines)
+	}
+}
+
+func TestUnknownLogLevelFallsBackToInfo(t *testing.T) {
+	output, restore := captureLogs(t, map[string]string{"LOG_LEVEL": "loud", "LOG_FORMAT": ""})
+	defer restore()
+
+	if logOutput.level != LevelInfo {
+		t.Errorf("level = %v, want info", logOutput.level)
+	}
+
+	if !strings.Contains(output.String(), `msg="Ignoring LOG_LEVEL"`) {
+		t.Errorf("expected a warning about LOG_LEVEL, got %q", output.String())
+	}
+}
+
+func TestTextLogFormat(t *testing.T) {
+	output, restore := captureLogs(t, map[string]string{"LOG_LEVEL": "", "LOG_FORMAT": "text"})
+	defer restore()
+
+	parent := Log.With(LogFields{"cid": "abc123", "guild": "guild"})
+	child := parent.With(LogFields{"task": "Task Name"})
+
+	child.Warn("Unable to save", LogFields{"error": errors.New("redis went away"), "duration": time.Second})
+	parent.Info("Parent line")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %q", len(lines), output.String())
+	}
+
+	if !strings.HasSuffix(lines[0], ` level=warn msg="Unable to save" cid=abc123 duration=1s error="redis went away" guild=guild task="Task Name"`) {
+		t.Errorf("text line = %q", lines[0])
+	}
+
+	if strings.Contains(lines[1], "task=") {
+		t.Errorf("child fields leaked into the parent: %q", lines[1])
+	}
+}
+
+func TestJsonLogFormat(t *testing.T) {
+	output, restore := captureLogs(t, map[string]string{"LOG_LEVEL": "", "LOG_FORMAT": "JSON"})
+	defer restore()
+
+	Log.With(LogFields{"guild": "guild"}).Error("Unable to save", LogFields{"error": errors.New("redis went away"), "fleet": 3})
+
+	var entry map[string]interface{}
+
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("not json: %q, %v", output.String(), err)
+	}
+
+	if entry["level"] != "error" || entry["msg"] != "Unable to save" || entry["guild"] != "guild" || entry["error"] != "redis went away" || entry["fleet"] != float64(3) {
+		t.Errorf("entry = %v", entry)
+	}
+}
+
+func TestLegacyLogLines(t *testing.T) {
+	output, restore := captureLogs(t, map[string]string{"LOG_LEVEL": "", "LOG_FORMAT": ""})
+	defer restore()
+
+	log.Printf("[WARN] Something old")
+	log.Printf("Plain old line")
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+
+	if len(lines) != 2 || !strings.Contains(lines[0], `level=warn msg="Something old"`) || !strings.Contains(lines[1], `level=info msg="Plain old line"`) {
+		t.Errorf("got %q", lines)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Ids in the test universe. Home to Staging is three jumps through lowsec, or four staying in highsec.
+const (
+	testRegion = 10000001
+
+	testConstellationAlpha = 20000001
+	testConstellationBeta  = 20000002
+
+	testSystemHome    = 30000001
+	testSystemHub     = 30000002
+	testSystemLow     = 30000003
+	testSystemStaging = 30000004
+	testSystemDetour  = 30000005
+	testSystemExtra   = 30000006
+)
+
+// newTestUniverse is a tiny map so nothing has to go to ESI for names, systems or routes
+func newTestUniverse() *Universe {
+	universe := &Universe{
+		Regions:              make(map[int]*UniverseRegion),
+		Constellations:       make(map[int]*UniverseConstellation),
+		Systems:              make(map[int]*UniverseSystem),
+		StationNames:         make(map[int]string),
+		constellationsByName: make(map[string]*UniverseConstellation),
+		systemsByName:        make(map[string]*UniverseSystem),
+	}
+
+	universe.Regions[testRegion] = &UniverseRegion{Id: testRegion, Name: "Test Region"}
+
+	for id, name := range map[int]string{testConstellationAlpha: "Alpha", testConstellationBeta: "Beta"} {
+		constellation := &UniverseConstellation{Id: id, Name: name, RegionId: testRegion, Systems: make([]int, 0)}
+		universe.Constellations[id] = constellation
+		universe.constellationsByName[strings.ToLower(name)] = constellation
+	}
+
+	systems := []struct {
+		id            int
+		constellation int
+		name          string
+		security      float32
+	}{
+		{testSystemHome, testConstellationAlpha, "Home", 0.9},
+		{testSystemHub, testConstellationAlpha, "Hub", 0.6},
+		{testSystemLow, testConstellationAlpha, "Lowpipe", 0.3},
+		{testSystemStaging, testConstellationBeta, "Staging", 0.7},
+		{testSystemDetour, testConstellationBeta, "Detour", 0.5},
+		{testSystemExtra, testConstellationBeta, "Extra", 0.8},
+	}
+
+	for _, s := range systems {
+		system := &UniverseSystem{
+			Id:              s.id,
+			Name:            s.name,
+			ConstellationId: s.constellation,
+			RegionId:        testRegion,
+			SecurityStatus:  s.security,
+			Neighbours:      make([]int, 0),
+			Stations:        make([]int, 0),
+		}
+		universe.Systems[s.id] = system
+		universe.systemsByName[strings.ToLower(s.name)] = system
+		universe.Constellations[s.constellation].Systems = append(universe.Constellations[s.constellation].Systems, s.id)
+	}
+
+	gates := [][2]int{
+		{testSystemHome, testSystemHub},
+		{testSystemHub, testSystemLow},
+		{testSystemLow, testSystemStaging},
+		{testSystemHub, testSystemDetour},
+		{testSystemDetour, testSystemExtra},
+		{testSystemExtra, testSystemStaging},
+	}
+
+	for _, gate := range gates {
+		universe.Systems[gate[0]].Neighbours = append(universe.Systems[gate[0]].Neighbours, gate[1])
+		universe.Systems[gate[1]].Neighbours = append(universe.Systems[gate[1]].Neighbours, gate[0])
+	}
+
+	return universe
+}
+
+// fakeEsi serves whatever incursions the test sets and counts how often it was asked
+type fakeEsi struct {
+	server *httptest.Server
+
+	lock         sync.Mutex
+	incursions   []*EsiIncursion
+	affiliations map[int]*EsiAffiliation
+	fetches      int
+}
+
+func newFakeEsi() *fakeEsi {
+	esi := &fakeEsi{incursions: make([]*EsiIncursion, 0), affiliations: make(map[int]*EsiAffiliation)}
+
+	esi.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		esi.lock.Lock()
+		defer esi.lock.Unlock()
+
+		switch r.URL.Path {
+		case "/latest/incursions":
+			esi.fetches++
+			json.NewEncoder(w).Encode(esi.incursions)
+		case "/latest/characters/affiliation/":
+			var ids []int
+			json.NewDecoder(r.Body).Decode(&ids)
+
+			// Like ESI, characters it doesn't know are left out
+			found := make([]*EsiAffiliation, 0)
+			for _, id := range ids {
+				if affiliation, ok := esi.affiliations[id]; ok {
+					found = append(found, affiliation)
+				}
+			}
+
+			json.NewEncoder(w).Encode(found)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	return esi
+}
+
+func (esi *fakeEsi) Serve(incursions ...*EsiIncursion) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	esi.incursions = incursions
+}
+
+// Affiliate puts the character in the corporation and alliance for affiliation lookups
+func (esi *fakeEsi) Affiliate(characterId, corporationId, allianceId int) {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	esi.affiliations[characterId] = &EsiAffiliation{CharacterId: characterId, CorporationId: corporationId, AllianceId: allianceId}
+}
+
+func (esi *fakeEsi) Fetches() int {
+	esi.lock.Lock()
+	defer esi.lock.Unlock()
+
+	return esi.fetches
+}
+
+func testIncursion(staging, constellation int, state string) *EsiIncursion {
+	return &EsiIncursion{
+		ConstellationId:      constellation,
+		FactionId:            FactionSanshasNation,
+		StagingSolarSystemId: staging,
+		InfestedSolarSystems: []int{staging},
+		Influence:            0.5,
+		State:                state,
+		Type:                 "Incursion",
+	}
+}
+
+// newTestServer is a Server backed by the fake Redis, the test universe and the fake ESI. The returned func
+// puts everything back.
+func newTestServer(t *testing.T) (*Server, *fakeEsi, func()) {
+	client, stopRedis := newTestRedis(t)
+	esi := newFakeEsi()
+
+	previousHostname := EsiHostname
+	EsiHostname = esi.server.URL
+
+	config := &Config{
+		DefaultStagingSystemId:  testSystemHome,
+		SecurityStatusThreshold: 1,
+		DespawnConfirmations:    2,
+		RoutePreference:         string(RouteShortest),
+		RespawnMinHours:         DefaultRespawnMinHours,
+		RespawnMaxHours:         DefaultRespawnMaxHours,
+	}
+
+	server := &Server{
+		Redis:    client,
+		Config:   config,
+		Universe: newTestUniverse(),
+		Thera:    NewTheraFeed(""),
+		Caches:   NewEsiCaches(client),
+		Tracker:  NewIncursionTracker(),
+		Guilds:   NewGuildRegistry(),
+		Events:   NewEventHub(),
+	}
+
+	return server, esi, func() {
+		EsiHostname = previousHostname
+		esi.server.Close()
+		stopRedis()
+	}
+}
+
+// expireIncursions makes the next GetIncursions go back to ESI
+func (server *Server) expireIncursions() {
+	server.Incursions.lock.Lock()
+	defer server.Incursions.lock.Unlock()
+
+	atomic.StoreInt64(&server.Incursions.lastFetch, 0)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The usual Prometheus buckets, requests and tasks both land somewhere in here
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// CounterVec is a counter per set of label values
+type CounterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+// Inc adds one for the label values, given in the same order as the labels
+func (counter *CounterVec) Inc(values ...string) {
+	key := labelKey(counter.Labels, values)
+
+	counter.lock.Lock()
+	counter.values[key]++
+	counter.lock.Unlock()
+}
+
+func (counter *CounterVec) write(buffer *bytes.Buffer) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	writeMetricHeader(buffer, counter.Name, counter.Help, "counter")
+
+	for _, key := range sortedKeys(counter.values) {
+		writeSample(buffer, counter.Name, key, counter.values[key])
+	}
+}
+
+// HistogramVec is a histogram per set of label values
+type HistogramVec struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (vec *HistogramVec) Observe(value float64, values ...string) {
+	key := labelKey(vec.Labels, values)
+
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	h, ok := vec.values[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(vec.Buckets))}
+		vec.values[key] = h
+	}
+
+	for i, bound := range vec.Buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += value
+}
+
+func (vec *HistogramVec) write(buffer *bytes.Buffer) {
+	vec.lock.Lock()
+	defer vec.lock.Unlock()
+
+	writeMetricHeader(buffer, vec.Name, vec.Help, "histogram")
+
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := vec.values[key]
+
+		for i, bound := range vec.Buckets {
+			writeSample(buffer, vec.Name+"_bucket", appendLabel(key, "le", formatFloat(bound)), float64(h.counts[i]))
+		}
+
+		writeSample(buffer, vec.Name+"_bucket", appendLabel(key, "le", "+Inf"), float64(h.count))
+		writeSample(buffer, vec.Name+"_sum", key, h.sum)
+		writeSample(buffer, vec.Name+"_count", key, float64(h.count))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelKey is the rendered label set, a="x",b="y", which is also how samples are told apart
+func labelKey(labels, values []string) string {
+	pairs := make([]string, len(labels))
+
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs[i] = fmt.Sprintf(`%v="%v"`, label, labelEscaper.Replace(value))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func appendLabel(key, label, value string) string {
+	pair := fmt.Sprintf(`%v="%v"`, label, value)
+
+	if len(key) <= 0 {
+		return pair
+	}
+
+	return key + "," + pair
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetricHeader(buffer *bytes.Buffer, name, help, kind string) {
+	buffer.WriteString(fmt.Sprintf("# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind))
+}
+
+func writeSample(buffer *bytes.Buffer, name, labels string, value float64) {
+	if len(labels) > 0 {
+		buffer.WriteString(fmt.Sprintf("%v{%v} %v\n", name, labels, formatFloat(value)))
+	} else {
+		buffer.WriteString(fmt.Sprintf("%v %v\n", name, formatFloat(value)))
+	}
+}
+
+func writeGauge(buffer *bytes.Buffer, name, help string, value float64) {
+	writeMetricHeader(buffer, name, help, "gauge")
+	writeSample(buffer, name, "", value)
+}
+
+func writeCounter(buffer *bytes.Buffer, name, help string, value float64) {
+	writeMetricHeader(buffer, name, help, "counter")
+	writeSample(buffer, name, "", value)
+}
+
+var (
+	esiRequests = NewCounterVec("incursion_bot_esi_requests_total", "ESI requests by endpoint and status code.", "method", "endpoint", "status")
+	esiDuration = NewHistogramVec("incursion_bot_esi_request_duration_seconds", "How long ESI took to answer.", defaultBuckets, "method", "endpoint")
+
+	cacheLookups = NewCounterVec("incursion_bot_cache_lookups_total", "Cache lookups by cache and the tier that answered, or miss.", "cache", "result")
+
+	taskRuns     = NewCounterVec("incursion_bot_task_runs_total", "Scheduled task runs.", "task")
+	taskFailures = NewCounterVec("incursion_bot_task_failures_total", "Scheduled task runs that panicked.", "task")
+	taskDuration = NewHistogramVec("incursion_bot_task_duration_seconds", "How long scheduled tasks took.", defaultBuckets, "task")
+
+	discordSendFailures = NewCounterVec("incursion_bot_discord_send_failures_total", "Messages Discord wouldn't take.", "kind")
+)
+
+// Ids would give every character and system its own series
+var esiIdPattern = regexp.MustCompile(`/[0-9]+`)
+
+// esiEndpoint is the path without ids or the query string, /v1/universe/systems/30000142/ is /v1/universe/systems/{id}/
+func esiEndpoint(path string) string {
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+
+	return esiIdPattern.ReplaceAllString(path, "/{id}")
+}
+
+// observeEsiRequest records a request that started at start. Requests that never got an answer have the status "error".
+func observeEsiRequest(method, path string, start time.Time, resp *http.Response) {
+	status := "error"
+	if resp != nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+
+	endpoint := esiEndpoint(path)
+	duration := time.Since(start)
+
+	esiRequests.Inc(method, endpoint, status)
+	esiDuration.Observe(duration.Seconds(), method, endpoint)
+
+	Log.Debug("ESI request", LogFields{"method": method, "esi_path": path, "status": status, "duration": duration})
+}
+
+var startedAt = time.Now()
+
+// WriteMetrics renders everything in the Prometheus text format
+func (server *Server) WriteMetrics(buffer *bytes.Buffer) {
+	esiRequests.write(buffer)
+	esiDuration.write(buffer)
+	cacheLookups.write(buffer)
+	taskRuns.write(buffer)
+	taskFailures.write(buffer)
+	taskDuration.write(buffer)
+	discordSendFailures.write(buffer)
+
+	writeGauge(buffer, "incursion_bot_guilds", "Guilds the bot is in.", float64(server.Guilds.Count()))
+	writeGauge(buffer, "incursion_bot_active_incursions", "Incursions in the last list from ESI.", float64(server.Incursions.Count()))
+	writeGauge(buffer, "incursion_bot_event_stream_subscribers", "Clients streaming incursion events.", float64(server.Events.Count()))
+	writeGauge(buffer, "incursion_bot_uptime_seconds", "Seconds since the bot started.", time.Since(startedAt).Seconds())
+
+	writeCounter(buffer, "incursion_bot_esi_rejected_responses_total", "Incursion responses from ESI that didn't look like incursions.", float64(atomic.LoadInt64(&IncursionAnomalies.RejectedResponses)))
+	writeCounter(buffer, "incursion_bot_esi_empty_responses_total", "Incursion responses from ESI with no incursions in them.", float64(atomic.LoadInt64(&IncursionAnomalies.EmptyResponses)))
+	writeCounter(buffer, "incursion_bot_suppressed_despawns_total", "Incursions missing from ESI that we didn't call despawned yet.", float64(atomic.LoadInt64(&IncursionAnomalies.SuppressedDespawns)))
+}
+
+// metrics is /metrics. Setting METRICS_TOKEN makes scrapers send it as a bearer token.
+func (server *Server) metrics(c *gin.Context) {
+	if token := os.Getenv("METRICS_TOKEN"); len(token) > 0 {
+		given := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.String(http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+	}
+
+	var buffer bytes.Buffer
+	server.WriteMetrics(&buffer)
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buffer.Bytes())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHistogramVecWrite(t *testing.T) {
+	histogram := NewHistogramVec("test_seconds", "How long things took.", []float64{1, 5}, "task")
+
+	tricky := "a\"b\\c\nd"
+	for _, value := range []float64{0.5, 3, 10} {
+		histogram.Observe(value, tricky)
+	}
+	histogram.Observe(1, "plain")
+
+	var buffer bytes.Buffer
+	histogram.write(&buffer)
+
+	want := `# HELP test_seconds How long things took.
+# TYPE test_seconds histogram
+test_seconds_bucket{task="a\"b\\c\nd",le="1"} 1
+test_seconds_bucket{task="a\"b\\c\nd",le="5"} 2
+test_seconds_bucket{task="a\"b\\c\nd",le="+Inf"} 3
+test_seconds_sum{task="a\"b\\c\nd"} 13.5
+test_seconds_count{task="a\"b\\c\nd"} 3
+test_seconds_bucket{task="plain",le="1"} 1
+test_seconds_bucket{task="plain",le="5"} 1
+test_seconds_bucket{task="plain",le="+Inf"} 1
+test_seconds_sum{task="plain"} 1
+test_seconds_count{task="plain"} 1
+`
+
+	if buffer.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", buffer.String(), want)
+	}
+}
+
+func TestHistogramVecWithoutLabels(t *testing.T) {
+	histogram := NewHistogramVec("test_seconds", "How long things took.", []float64{0.25})
+	histogram.Observe(0.1)
+	histogram.Observe(0.5)
+
+	var buffer bytes.Buffer
+	histogram.write(&buffer)
+
+	for _, line := range []string{`test_seconds_bucket{le="0.25"} 1`, `test_seconds_bucket{le="+Inf"} 2`, "test_seconds_sum 0.6", "test_seconds_count 2"} {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Errorf("missing %q in\n%v", line, buffer.String())
+		}
+	}
+}
+
+func TestCounterVecWrite(t *testing.T) {
+	counter := NewCounterVec("test_total", "Things that happened.", "kind", "status")
+	counter.Inc("x")
+	counter.Inc("a", "200")
+	counter.Inc("a", "200")
+
+	var buffer bytes.Buffer
+	counter.write(&buffer)
+
+	want := `# HELP test_total Things that happened.
+# TYPE test_total counter
+test_total{kind="a",status="200"} 2
+test_total{kind="x",status=""} 1
+`
+
+	if buffer.String() != want {
+		t.Errorf("got\n%v\nwant\n%v", buffer.String(), want)
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	taskDuration.Observe(0.003, "MetricsTest")
+
+	var buffer bytes.Buffer
+	server.WriteMetrics(&buffer)
+	output := buffer.String()
+
+	for _, line := range []string{
+		"# TYPE incursion_bot_task_duration_seconds histogram\n",
+		`incursion_bot_task_duration_seconds_bucket{task="MetricsTest",le="0.005"} 1` + "\n",
+		`incursion_bot_task_duration_seconds_bucket{task="MetricsTest",le="+Inf"} 1` + "\n",
+		"# TYPE incursion_bot_guilds gauge\n",
+		"# TYPE incursion_bot_suppressed_despawns_total counter\n",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("missing %q", line)
+		}
+	}
+
+	// Every metric is declared once
+	types := make(map[string]bool)
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			name := strings.Fields(line)[2]
+
+			if types[name] {
+				t.Errorf("%v is declared twice", name)
+			}
+			types[name] = true
+		}
+	}
+}
+
+func TestEsiEndpoint(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/latest/incursions", "/latest/incursions"},
+		{"/v1/universe/systems/30000142/", "/v1/universe/systems/{id}/"},
+		{"/latest/route/30000142/30002187?flag=secure", "/latest/route/{id}/{id}"},
+	}
+
+	for _, test := range tests {
+		if endpoint := esiEndpoint(test.path); endpoint != test.want {
+			t.Errorf("esiEndpoint(%q) = %q, want %q", test.path, endpoint, test.want)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	SiteVanguard     = "vanguard"
+	SiteAssault      = "assault"
+	SiteHeadquarters = "headquarters"
+)
+
+var siteTypes = []string{SiteVanguard, SiteAssault, SiteHeadquarters}
+
+// SitePayout is what every pilot gets for one site when the fleet is no bigger than MaxPilots.
+// Bigger fleets split the same pool, so each pilot gets MaxPilots/size of it.
+type SitePayout struct {
+	Isk       float64 `json:"isk"`
+	Lp        float64 `json:"lp"`
+	MaxPilots int     `json:"max_pilots"`
+}
+
+type PayoutTable map[string]*SitePayout
+
+// Roughly the Sansha payouts at the time of writing, override them with "payouts" in config.json
+var DefaultPayoutTable = PayoutTable{
+	SiteVanguard:     {Isk: 31500000, Lp: 4200, MaxPilots: 12},
+	SiteAssault:      {Isk: 35700000, Lp: 5000, MaxPilots: 20},
+	SiteHeadquarters: {Isk: 40950000, Lp: 6900, MaxPilots: 40},
+}
+
+// PerPilot is the ISK and LP each pilot gets for one site run with fleetSize pilots
+func (payout *SitePayout) PerPilot(fleetSize int) (float64, float64) {
+	scale := 1.0
+
+	if payout.MaxPilots > 0 && fleetSize > payout.MaxPilots {
+		scale = float64(payout.MaxPilots) / float64(fleetSize)
+	}
+
+	return payout.Isk * scale, payout.Lp * scale
+}
+
+// ParseSiteType takes the names FCs actually use, like vg, as or hq
+func ParseSiteType(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "vg", "vanguard", "vanguards":
+		return SiteVanguard, nil
+	case "as", "assault", "assaults":
+		return SiteAssault, nil
+	case "hq", "headquarters":
+		return SiteHeadquarters, nil
+	}
+
+	return "", fmt.Errorf("unknown site %q, it should be one of vg, as or hq", value)
+}
+
+// SiteLog is one or more completions of the same site by a fleet. The payout is worked out
+// when it is logged so changing the table later doesn't rewrite history.
+type SiteLog struct {
+	FleetId     int       `json:"fleet_id"`
+	Site        string    `json:"site"`
+	Count       int       `json:"count"`
+	Pilots      []string  `json:"pilots"`
+	IskPerPilot float64   `json:"isk_per_pilot"`
+	LpPerPilot  float64   `json:"lp_per_pilot"`
+	LoggedBy    string    `json:"logged_by"`
+	LoggedAt    time.Time `json:"logged_at"`
+}
+
+// PilotPayout is what one pilot earned over some set of site logs
+type PilotPayout struct {
+	UserId string
+	Sites  int
+	Isk    float64
+	Lp     float64
+}
+
+// payoutLock serializes undo against logging
+var payoutLock sync.Mutex
+
+func payoutsKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:payouts", guildId)
+}
+
+// PayoutForSite looks the site up in the configured table, then the defaults
+func (config *Config) PayoutForSite(site string) *SitePayout {
+	if payout, ok := config.Payouts[site]; ok && payout != nil {
+		return payout
+	}
+
+	return DefaultPayoutTable[site]
+}
+
+// GetSiteLogs returns everything logged for the guild, oldest first
+func (server *Server) GetSiteLogs(guildId string) []*SiteLog {
+	logs := make([]*SiteLog, 0)
+
+	for _, raw := range server.Redis.LRange(payoutsKey(guildId), 0, -1).Val() {
+		var siteLog SiteLog
+
+		if err := json.Unmarshal([]byte(raw), &siteLog); err != nil {
+			Log.Warn("Unable to parse site log", LogFields{"guild": guildId, "error": err})
+			continue
+		}
+
+		logs = append(logs, &siteLog)
+	}
+
+	return logs
+}
+
+func (server *Server) SaveSiteLog(guildId string, siteLog *SiteLog) error {
+	bytes, err := json.Marshal(siteLog)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Redis.RPush(payoutsKey(guildId), string(bytes)).Err()
+}
+
+// TotalPayouts adds up what each pilot earned over the logs, biggest earner first
+func TotalPayouts(logs []*SiteLog) []*PilotPayout {
+	totals := make(map[string]*PilotPayout)
+
+	for _, siteLog := range logs {
+		for _, userId := range siteLog.Pilots {
+			total, ok := totals[userId]
+
+			if !ok {
+				total = &PilotPayout{UserId: userId}
+				totals[userId] = total
+			}
+
+			total.Sites += siteLog.Count
+			total.Isk += siteLog.IskPerPilot * float64(siteLog.Count)
+			total.Lp += siteLog.LpPerPilot * float64(siteLog.Count)
+		}
+	}
+
+	payouts := make([]*PilotPayout, 0, len(totals))
+	for _, total := range totals {
+		payouts = append(payouts, total)
+	}
+
+	sort.Slice(payouts, func(i, j int) bool {
+		if payouts[i].Isk == payouts[j].Isk {
+			return payouts[i].UserId < payouts[j].UserId
+		}
+		return payouts[i].Isk > payouts[j].Isk
+	})
+
+	return payouts
+}
+
+// StartOfWeek is midnight UTC on the Monday of the week t is in
+func StartOfWeek(t time.Time) time.Time {
+	t = t.UTC()
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, time.UTC)
+}
+
+// FormatIsk shortens ISK the way players write it, 31.5m or 1.2b
+func FormatIsk(isk float64) string {
+	switch {
+	case isk >= 1e9:
+		return fmt.Sprintf("%.2fb", isk/1e9)
+	case isk >= 1e6:
+		return fmt.Sprintf("%.1fm", isk/1e6)
+	case isk >= 1e3:
+		return fmt.Sprintf("%.0fk", isk/1e3)
+	}
+
+	return fmt.Sprintf("%.0f", isk)
+}
+
+func (server *Server) describePayouts(payouts []*PilotPayout) string {
+	if len(payouts) <= 0 {
+		return "Nothing logged"
+	}
+
+	lines := make([]string, 0, len(payouts))
+	for _, payout := range payouts {
+		lines = append(lines, fmt.Sprintf("%v - %d sites, %v ISK, %.0f LP", server.PilotName(payout.UserId), payout.Sites, FormatIsk(payout.Isk), payout.Lp))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// HandlePayouts is !payouts [@pilot] | fleet <id> | week [weeks ago] | log <fleet id> <vg|as|hq> [count] | undo <fleet id>
+func (server *Server) HandlePayouts(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args := commandArgs(message)
+
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, "Payouts are only tracked in server channels")
+		return
+	}
+
+	if len(args) <= 0 {
+		server.pilotPayouts(guildId, message, message.Author.ID)
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "me":
+		server.pilotPayouts(guildId, message, message.Author.ID)
+	case "fleet":
+		server.fleetPayouts(guildId, message, args[1:])
+	case "week":
+		server.weekPayouts(guildId, message, args[1:])
+	case "log":
+		server.logSites(logger, guildId, message, args[1:])
+	case "undo":
+		server.undoSites(logger, guildId, message, args[1:])
+	default:
+		if userId := ParseMention(args[0]); userId != args[0] {
+			server.pilotPayouts(guildId, message, userId)
+			return
+		}
+
+		server.SendMessage(message.ChannelID, "Usage: !payouts [@pilot] | fleet <id> | week [weeks ago] | log <fleet id> <vg|as|hq> [count] | undo <fleet id>")
+	}
+}
+
+func (server *Server) pilotPayouts(guildId string, message *discordgo.MessageCreate, userId string) {
+	logs := server.GetSiteLogs(guildId)
+	weekStart := StartOfWeek(time.Now())
+
+	thisWeek := make([]*SiteLog, 0)
+	for _, siteLog := range logs {
+		if !siteLog.LoggedAt.Before(weekStart) {
+			thisWeek = append(thisWeek, siteLog)
+		}
+	}
+
+	describe := func(logs []*SiteLog) string {
+		for _, payout := range TotalPayouts(logs) {
+			if payout.UserId == userId {
+				return fmt.Sprintf("%d sites, %v ISK, %.0f LP", payout.Sites, FormatIsk(payout.Isk), payout.Lp)
+			}
+		}
+		return "nothing yet"
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("%v has earned %v this week and %v in total", server.PilotName(userId), describe(thisWeek), describe(logs)))
+}
+
+func (server *Server) fleetPayouts(guildId string, message *discordgo.MessageCreate, args []string) {
+	if len(args) <= 0 {
+		server.SendMessage(message.ChannelID, "Usage: !payouts fleet <id>")
+		return
+	}
+
+	id, err := strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("%q isn't a fleet number", args[0]))
+		return
+	}
+
+	logs := make([]*SiteLog, 0)
+	sites := make(map[string]int)
+
+	for _, siteLog := range server.GetSiteLogs(guildId) {
+		if siteLog.FleetId == id {
+			logs = append(logs, siteLog)
+			sites[siteLog.Site] += siteLog.Count
+		}
+	}
+
+	if len(logs) <= 0 {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Nothing has been logged for fleet #%v", id))
+		return
+	}
+
+	counts := make([]string, 0, len(siteTypes))
+	for _, site := range siteTypes {
+		if sites[site] > 0 {
+			counts = append(counts, fmt.Sprintf("%d %v", sites[site], site))
+		}
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Fleet #%v payouts", id),
+		Description: fmt.Sprintf("Ran %v", strings.Join(counts, ", ")),
+		Timestamp:   logs[len(logs)-1].LoggedAt.Format(time.RFC3339),
+		Color:       0xf1c40f,
+		Fields: []*discordgo.MessageEmbedField{
+			{
+				Name:  "Pilots",
+				Value: truncate(server.describePayouts(TotalPayouts(logs)), 1024),
+			},
+		},
+	}
+
+	server.SendEmbed(message.ChannelID, embed)
+}
+
+func (server *Server) weekPayouts(guildId string, message *discordgo.MessageCreate, args []string) {
+	weeksAgo := 0
+
+	if len(args) > 0 {
+		var err error
+		if weeksAgo, err = strconv.Atoi(args[0]); err != nil || weeksAgo < 0 {
+			server.SendMessage(message.ChannelID, "Usage: !payouts week [weeks ago]")
+			return
+		}
+	}
+
+	start := StartOfWeek(time.Now()).AddDate(0, 0, -7*weeksAgo)
+	end := start.AddDate(0, 0, 7)
+
+	logs := make([]*SiteLog, 0)
+	for _, siteLog := range server.GetSiteLogs(guildId) {
+		if !siteLog.LoggedAt.Before(start) && siteLog.LoggedAt.Before(end) {
+			logs = append(logs, siteLog)
+		}
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       fmt.Sprintf("Payouts for the week of %v", start.Format("2006-01-02")),
+		Description: truncate(server.describePayouts(TotalPayouts(logs)), 2048),
+		Color:       0xf1c40f,
+	}
+
+	server.SendEmbed(message.ChannelID, embed)
+}
+
+// logSites records site completions for everyone signed up to the fleet. Only the FC or an admin can log.
+func (server *Server) logSites(logger *Logger, guildId string, message *discordgo.MessageCreate, args []string) {
+	if len(args) < 2 {
+		server.SendMessage(message.ChannelID, "Usage: !payouts log <fleet id> <vg|as|hq> [count]")
+		return
+	}
+
+	site, err := ParseSiteType(args[1])
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, err.Error())
+		return
+	}
+
+	count := 1
+	if len(args) >= 3 {
+		if count, err = strconv.Atoi(args[2]); err != nil || count <= 0 {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("%q isn't a number of sites", args[2]))
+			return
+		}
+	}
+
+	payout := server.Config.PayoutForSite(site)
+
+	admin := server.IsGuildAdmin(guildId, message.Author.ID)
+
+	server.withFleet(logger, guildId, message, args, func(fleet *Fleet) (bool, string) {
+		if fleet.FcId != message.Author.ID && !admin {
+			return false, "Only the FC or an admin can log sites"
+		}
+
+		if len(fleet.Signups) <= 0 {
+			return false, fmt.Sprintf("Nobody is signed up for fleet #%v", fleet.Id)
+		}
+
+		pilots := make([]string, 0, len(fleet.Signups))
+		for _, signup := range fleet.Signups {
+			pilots = append(pilots, signup.UserId)
+		}
+
+		isk, lp := payout.PerPilot(len(pilots))
+
+		payoutLock.Lock()
+		defer payoutLock.Unlock()
+
+		err := server.SaveSiteLog(guildId, &SiteLog{
+			FleetId:     fleet.Id,
+			Site:        site,
+			Count:       count,
+			Pilots:      pilots,
+			IskPerPilot: isk,
+			LpPerPilot:  lp,
+			LoggedBy:    message.Author.ID,
+			LoggedAt:    time.Now().UTC(),
+		})
+
+		if err != nil {
+			logger.Error("Unable to log sites", LogFields{"guild": guildId, "fleet": fleet.Id, "error": err})
+			return false, fmt.Sprintf("Unable to log sites. Error: %v", err)
+		}
+
+		return false, fmt.Sprintf("Logged %d %v for fleet #%v with %d pilots, %v ISK and %.0f LP each", count, site, fleet.Id, len(pilots), FormatIsk(isk*float64(count)), lp*float64(count))
+	})
+}
+
+// undoSites drops the last thing logged for the fleet
+func (server *Server) undoSites(logger *Logger, guildId string, message *discordgo.MessageCreate, args []string) {
+	admin := server.IsGuildAdmin(guildId, message.Author.ID)
+
+	server.withFleet(logger, guildId, message, args, func(fleet *Fleet) (bool, string) {
+		if fleet.FcId != message.Author.ID && !admin {
+			return false, "Only the FC or an admin can undo sites"
+		}
+
+		payoutLock.Lock()
+		defer payoutLock.Unlock()
+
+		key := payoutsKey(guildId)
+		raw := server.Redis.LRange(key, 0, -1).Val()
+
+		for i := len(raw) - 1; i >= 0; i-- {
+			var siteLog SiteLog
+
+			if err := json.Unmarshal([]byte(raw[i]), &siteLog); err != nil || siteLog.FleetId != fleet.Id {
+				continue
+			}
+
+			// LRem with a negative count removes from the tail, which is the one we just found
+			if err := server.Redis.LRem(key, -1, raw[i]).Err(); err != nil {
+				return false, fmt.Sprintf("Unable to undo. Error: %v", err)
+			}
+
+			return false, fmt.Sprintf("Removed %d %v from fleet #%v", siteLog.Count, siteLog.Site, fleet.Id)
+		}
+
+		return false, fmt.Sprintf("Nothing has been logged for fleet #%v", fleet.Id)
+	})
+}
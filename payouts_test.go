@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPerPilot(t *testing.T) {
+	payout := &SitePayout{Isk: 31500000, Lp: 4200, MaxPilots: 12}
+
+	tests := []struct {
+		fleetSize int
+		isk       float64
+		lp        float64
+	}{
+		{1, 31500000, 4200},
+		{12, 31500000, 4200},
+		{24, 15750000, 2100},
+		{36, 10500000, 1400},
+	}
+
+	for _, test := range tests {
+		isk, lp := payout.PerPilot(test.fleetSize)
+
+		if isk != test.isk || lp != test.lp {
+			t.Errorf("PerPilot(%d) = %v, %v, want %v, %v", test.fleetSize, isk, lp, test.isk, test.lp)
+		}
+	}
+
+	// Without a cap nobody gets scaled down
+	unlimited := &SitePayout{Isk: 1000, Lp: 10}
+	if isk, lp := unlimited.PerPilot(100); isk != 1000 || lp != 10 {
+		t.Errorf("PerPilot without a cap = %v, %v, want 1000, 10", isk, lp)
+	}
+}
+
+func TestTotalPayouts(t *testing.T) {
+	logs := []*SiteLog{
+		{Site: SiteVanguard, Count: 3, Pilots: []string{"a", "b"}, IskPerPilot: 1000, LpPerPilot: 10},
+		{Site: SiteAssault, Count: 1, Pilots: []string{"b", "c"}, IskPerPilot: 500, LpPerPilot: 5},
+		{Site: SiteHeadquarters, Count: 1, Pilots: []string{"c"}, IskPerPilot: 2500, LpPerPilot: 25},
+	}
+
+	want := []PilotPayout{
+		{UserId: "b", Sites: 4, Isk: 3500, Lp: 35},
+		{UserId: "a", Sites: 3, Isk: 3000, Lp: 30},
+		{UserId: "c", Sites: 2, Isk: 3000, Lp: 30},
+	}
+
+	payouts := TotalPayouts(logs)
+
+	if len(payouts) != len(want) {
+		t.Fatalf("got %d payouts, want %d", len(payouts), len(want))
+	}
+
+	for i, payout := range payouts {
+		if *payout != want[i] {
+			t.Errorf("payout %d = %+v, want %+v", i, *payout, want[i])
+		}
+	}
+
+	if payouts := TotalPayouts(nil); len(payouts) != 0 {
+		t.Errorf("TotalPayouts(nil) = %+v, want nothing", payouts)
+	}
+}
+
+func TestStartOfWeek(t *testing.T) {
+	monday := time.Date(2018, 10, 15, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		at   time.Time
+		want time.Time
+	}{
+		{monday, monday},
+		{time.Date(2018, 10, 17, 12, 30, 0, 0, time.UTC), monday},
+		{time.Date(2018, 10, 21, 23, 59, 59, 0, time.UTC), monday},
+		{time.Date(2018, 10, 22, 0, 0, 0, 0, time.UTC), monday.AddDate(0, 0, 7)},
+		// Still Sunday in New York, but already Monday in EVE time
+		{time.Date(2018, 10, 21, 21, 0, 0, 0, time.FixedZone("EDT", -4*60*60)), monday.AddDate(0, 0, 7)},
+		// Across a month and a year
+		{time.Date(2019, 1, 2, 8, 0, 0, 0, time.UTC), time.Date(2018, 12, 31, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		if start := StartOfWeek(test.at); !start.Equal(test.want) {
+			t.Errorf("StartOfWeek(%v) = %v, want %v", test.at, start, test.want)
+		}
+	}
+}
+
+func TestParseSiteType(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		ok    bool
+	}{
+		{"vg", SiteVanguard, true},
+		{"Vanguards", SiteVanguard, true},
+		{"AS", SiteAssault, true},
+		{"hq", SiteHeadquarters, true},
+		{"headquarters", SiteHeadquarters, true},
+		{"mom", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		site, err := ParseSiteType(test.value)
+
+		if site != test.want || (err == nil) != test.ok {
+			t.Errorf("ParseSiteType(%q) = %q, %v, want %q", test.value, site, err, test.want)
+		}
+	}
+}
+
+func TestFormatIsk(t *testing.T) {
+	tests := []struct {
+		isk  float64
+		want string
+	}{
+		{500, "500"},
+		{15000, "15k"},
+		{31500000, "31.5m"},
+		{1234000000, "1.23b"},
+	}
+
+	for _, test := range tests {
+		if formatted := FormatIsk(test.isk); formatted != test.want {
+			t.Errorf("FormatIsk(%v) = %q, want %q", test.isk, formatted, test.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// guildAdminCheck makes sure the message came from an admin of the guild the channel belongs to, telling them off if not
+func (server *Server) guildAdminCheck(logger *Logger, message *discordgo.MessageCreate) (string, bool) {
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		logger.Warn("Unable to find guild for channel", LogFields{"error": err})
+		server.SendMessage(message.ChannelID, fmt.Sprintf("An error occurred! %v, Please contact the maintainer of this bot.", err))
+		return "", false
+	}
+
+	if !server.IsGuildAdmin(guildId, message.Author.ID) {
+		server.SendMessage(message.ChannelID, "Please don't try to change settings if you aren't authorized")
+		return "", false
+	}
+
+	return guildId, true
+}
+
+// IsGuildAdmin is true for admins added with !setadmin and anyone holding one of the guild's admin roles
+func (server *Server) IsGuildAdmin(guildId, userId string) bool {
+	if Exists(server.GetAdminsForGuild(guildId), userId) {
+		return true
+	}
+
+	return server.hasAnyRole(guildId, userId, server.GetGuildSettings(guildId).AdminRoles)
+}
+
+// IsFleetCommander is true for guild admins and anyone holding one of the guild's FC roles
+func (server *Server) IsFleetCommander(guildId, userId string) bool {
+	if server.IsGuildAdmin(guildId, userId) {
+		return true
+	}
+
+	return server.hasAnyRole(guildId, userId, server.GetGuildSettings(guildId).FcRoles)
+}
+
+// guildMember is the member from the state, asking Discord when the state doesn't have them
+func (server *Server) guildMember(guildId, userId string) (*discordgo.Member, error) {
+	if server.Discord == nil {
+		return nil, errors.New("not connected to Discord")
+	}
+
+	member, err := server.Discord.State.Member(guildId, userId)
+
+	if err != nil {
+		member, err = server.Discord.GuildMember(guildId, userId)
+	}
+
+	return member, err
+}
+
+// hasAnyRole checks the member's roles in the guild
+func (server *Server) hasAnyRole(guildId, userId string, roles []string) bool {
+	if len(roles) <= 0 {
+		return false
+	}
+
+	member, err := server.guildMember(guildId, userId)
+
+	if err != nil {
+		return false
+	}
+
+	for _, role := range member.Roles {
+		if Exists(roles, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanManageGuild is true for the guild owner and anyone whose roles let them manage the server, as Discord
+// has them right now
+func (server *Server) CanManageGuild(guildId, userId string) bool {
+	if server.Discord == nil {
+		return false
+	}
+
+	guild, err := server.Discord.State.Guild(guildId)
+
+	if err != nil {
+		var ok bool
+		if guild, ok = server.Guilds.Guild(guildId); !ok {
+			return false
+		}
+	}
+
+	if guild.OwnerID == userId {
+		return true
+	}
+
+	member, err := server.guildMember(guildId, userId)
+
+	if err != nil {
+		return false
+	}
+
+	permissions := 0
+	for _, role := range guild.Roles {
+		// @everyone has the guild's id and applies to every member
+		if role.ID == guild.ID || Exists(member.Roles, role.ID) {
+			permissions |= role.Permissions
+		}
+	}
+
+	return permissions&discordgo.PermissionAdministrator != 0 || permissions&discordgo.PermissionManageServer != 0
+}
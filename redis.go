@@ -1,36 +1,66 @@
-package main
-
-import (
-	"github.com/go-redis/redis"
-	"log"
-	"os"
-)
-
-const localRedisUrl string = "redis://localhost:6379"
-
-func NewRedis() *redis.Client {
-	url := localRedisUrl
-	// TODO: This probably doesn't belong here
-	envRedisUrl := os.Getenv("REDIS_URL")
-
-	if len(envRedisUrl) > 0 {
-		url = envRedisUrl
-	}
-
-	options, err := redis.ParseURL(url)
-
-	if err != nil {
-		log.Panic("Unable to parse error. Error: ", err.Error())
-	}
-
-	// TODO: Lets add some connection pooling here
-	client := redis.NewClient(options)
-
-	pong := client.Ping()
-
-	if pong.Err() != nil {
-		log.Printf("Unable to connect to redis at %s", options.Addr)
-	}
-
-	return client
-}
+package main
+
+import (
+	"github.com/go-redis/redis"
+	"log"
+	"os"
+)
+
+const localRedisUrl string = "redis://localhost:6379"
+
+// watchAttempts is how many times watchKey retries before giving up on a busy key
+const watchAttempts = 5
+
+func NewRedis() *redis.Client {
+	url := localRedisUrl
+	// TODO: This probably doesn't belong here
+	envRedisUrl := os.Getenv("REDIS_URL")
+
+	if len(envRedisUrl) > 0 {
+		url = envRedisUrl
+	}
+
+	options, err := redis.ParseURL(url)
+
+	if err != nil {
+		log.Panic("Unable to parse error. Error: ", err.Error())
+	}
+
+	// TODO: Lets add some connection pooling here
+	client := redis.NewClient(options)
+
+	pong := client.Ping()
+
+	if pong.Err() != nil {
+		Log.Error("Unable to connect to redis", LogFields{"addr": options.Addr, "error": pong.Err()})
+	}
+
+	return client
+}
+
+// watchKey runs update in a WATCH transaction on key, starting again if someone else changes the key first
+func watchKey(client *redis.Client, key string, update func(tx *redis.Tx) error) error {
+	for attempt := 0; attempt < watchAttempts; attempt++ {
+		if err := client.Watch(update, key); err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return redis.TxFailedErr
+}
+
+// takeKey reads a key and deletes it, only the caller whose delete removed it gets the value. Use it for
+// anything that must only be used once.
+func takeKey(client *redis.Client, key string) (string, bool) {
+	value, err := client.Get(key).Result()
+
+	if err != nil {
+		return "", false
+	}
+
+	if client.Del(key).Val() <= 0 {
+		return "", false
+	}
+
+	return value, true
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// fakeRedis is just enough of a Redis server to run the bot against in tests. It speaks RESP on a local
+// socket so the real client, pooling and all, is what gets exercised.
+type fakeRedis struct {
+	listener net.Listener
+
+	lock    sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	lists   map[string][]string
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+
+	// versions counts writes to each key so EXEC can tell if a watched key changed
+	versions map[string]int
+}
+
+// fakeTransaction is one connection's WATCH and MULTI state
+type fakeTransaction struct {
+	watched map[string]int
+	queued  [][]string
+	multi   bool
+}
+
+// readOnlyCommands don't count as a change to a watched key
+var readOnlyCommands = map[string]bool{
+	"PING": true, "SELECT": true, "GET": true, "EXISTS": true, "HGET": true, "HGETALL": true,
+	"HEXISTS": true, "LLEN": true, "LRANGE": true, "SMEMBERS": true, "SISMEMBER": true,
+}
+
+// newTestRedis starts a fake server and returns a client for it. Call the returned func to shut both down.
+func newTestRedis(t *testing.T) (*redis.Client, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatalf("Unable to start fake redis: %v", err)
+	}
+
+	server := &fakeRedis{
+		listener: listener,
+		strings:  make(map[string]string),
+		hashes:   make(map[string]map[string]string),
+		lists:    make(map[string][]string),
+		sets:     make(map[string]map[string]bool),
+		expires:  make(map[string]time.Time),
+		versions: make(map[string]int),
+	}
+
+	go server.serve()
+
+	client := redis.NewClient(&redis.Options{Addr: listener.Addr().String()})
+
+	return client, func() {
+		client.Close()
+		listener.Close()
+	}
+}
+
+func (server *fakeRedis) serve() {
+	for {
+		conn, err := server.listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		go server.handle(conn)
+	}
+}
+
+func (server *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	tx := &fakeTransaction{}
+
+	for {
+		args, err := readCommand(reader)
+
+		if err != nil {
+			return
+		}
+
+		server.lock.Lock()
+		reply := server.transact(tx, args)
+		server.lock.Unlock()
+
+		writer.WriteString(reply)
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("expected an array, got %q", line)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, count)
+
+	for i := range args {
+		header, err := reader.ReadString('\n')
+
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(header[1:]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		value := make([]byte, size+2)
+		if _, err = io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+
+		args[i] = string(value[:size])
+	}
+
+	return args, nil
+}
+
+func respOk() string {
+	return "+OK\r\n"
+}
+
+func respInt(value int) string {
+	return fmt.Sprintf(":%d\r\n", value)
+}
+
+func respBulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%v\r\n", len(value), value)
+}
+
+func respNil() string {
+	return "$-1\r\n"
+}
+
+func respArray(values []string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(values))
+
+	for _, value := range values {
+		reply += respBulk(value)
+	}
+
+	return reply
+}
+
+func respError(message string) string {
+	return "-ERR " + message + "\r\n"
+}
+
+func respBool(value bool) string {
+	if value {
+		return respInt(1)
+	}
+	return respInt(0)
+}
+
+// expire drops key if its TTL has passed, the way Redis does lazily on access
+func (server *fakeRedis) expire(key string) {
+	if at, ok := server.expires[key]; ok && !time.Now().Before(at) {
+		server.delete(key)
+	}
+}
+
+func (server *fakeRedis) delete(key string) bool {
+	_, isString := server.strings[key]
+	_, isHash := server.hashes[key]
+	_, isList := server.lists[key]
+	_, isSet := server.sets[key]
+
+	delete(server.strings, key)
+	delete(server.hashes, key)
+	delete(server.lists, key)
+	delete(server.sets, key)
+	delete(server.expires, key)
+
+	return isString || isHash || isList || isSet
+}
+
+// listIndex turns a possibly negative LRANGE style index into a position in a list of length n
+func listIndex(value string, n int) int {
+	index, _ := strconv.Atoi(value)
+
+	if index < 0 {
+		index += n
+	}
+
+	return index
+}
+
+// transact handles WATCH, MULTI and EXEC for a connection and runs everything else
+func (server *fakeRedis) transact(tx *fakeTransaction, args []string) string {
+	if len(args) <= 0 {
+		return respError("empty command")
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "WATCH":
+		if tx.watched == nil {
+			tx.watched = make(map[string]int)
+		}
+		for _, key := range args[1:] {
+			tx.watched[key] = server.versions[key]
+		}
+		return respOk()
+	case "UNWATCH":
+		tx.watched = nil
+		return respOk()
+	case "MULTI":
+		tx.multi = true
+		tx.queued = nil
+		return respOk()
+	case "DISCARD":
+		*tx = fakeTransaction{}
+		return respOk()
+	case "EXEC":
+		queued, watched := tx.queued, tx.watched
+		*tx = fakeTransaction{}
+
+		for key, version := range watched {
+			if server.versions[key] != version {
+				return "*-1\r\n"
+			}
+		}
+
+		reply := fmt.Sprintf("*%d\r\n", len(queued))
+		for _, command := range queued {
+			reply += server.execute(command)
+		}
+		return reply
+	}
+
+	if tx.multi {
+		tx.queued = append(tx.queued, args)
+		return "+QUEUED\r\n"
+	}
+
+	return server.execute(args)
+}
+
+func (server *fakeRedis) execute(args []string) string {
+	if len(args) <= 0 {
+		return respError("empty command")
+	}
+
+	command := strings.ToUpper(args[0])
+
+	if !readOnlyCommands[command] {
+		keys := args[1:]
+		if command != "DEL" && len(keys) > 1 {
+			keys = keys[:1]
+		}
+		for _, key := range keys {
+			server.versions[key]++
+		}
+	}
+
+	if len(args) > 1 {
+		server.expire(args[1])
+	}
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT", "FLUSHDB":
+		return respOk()
+	case "GET":
+		value, ok := server.strings[args[1]]
+		if !ok {
+			return respNil()
+		}
+		return respBulk(value)
+	case "SET", "SETNX":
+		key := args[1]
+
+		nx := command == "SETNX"
+		var ttl time.Duration
+
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "EX":
+				seconds, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(seconds) * time.Second
+				i++
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+
+		if _, exists := server.strings[key]; exists && nx {
+			if command == "SETNX" {
+				return respInt(0)
+			}
+			return respNil()
+		}
+
+		server.delete(key)
+		server.strings[key] = args[2]
+
+		if ttl > 0 {
+			server.expires[key] = time.Now().Add(ttl)
+		}
+
+		if command == "SETNX" {
+			return respInt(1)
+		}
+		return respOk()
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			server.expire(key)
+			if server.delete(key) {
+				deleted++
+			}
+		}
+		return respInt(deleted)
+	case "EXISTS":
+		found := 0
+		for _, key := range args[1:] {
+			server.expire(key)
+			_, isString := server.strings[key]
+			_, isHash := server.hashes[key]
+			_, isList := server.lists[key]
+			_, isSet := server.sets[key]
+			if isString || isHash || isList || isSet {
+				found++
+			}
+		}
+		return respInt(found)
+	case "INCR":
+		value, _ := strconv.Atoi(server.strings[args[1]])
+		value++
+		server.strings[args[1]] = strconv.Itoa(value)
+		return respInt(value)
+	case "EXPIRE":
+		seconds, _ := strconv.Atoi(args[2])
+		server.expires[args[1]] = time.Now().Add(time.Duration(seconds) * time.Second)
+		return respInt(1)
+	case "HSET":
+		hash, ok := server.hashes[args[1]]
+		if !ok {
+			hash = make(map[string]string)
+			server.hashes[args[1]] = hash
+		}
+
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			if _, exists := hash[args[i]]; !exists {
+				added++
+			}
+			hash[args[i]] = args[i+1]
+		}
+		return respInt(added)
+	case "HGET":
+		value, ok := server.hashes[args[1]][args[2]]
+		if !ok {
+			return respNil()
+		}
+		return respBulk(value)
+	case "HGETALL":
+		hash := server.hashes[args[1]]
+		fields := make([]string, 0, len(hash))
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		values := make([]string, 0, len(hash)*2)
+		for _, field := range fields {
+			values = append(values, field, hash[field])
+		}
+		return respArray(values)
+	case "HDEL":
+		deleted := 0
+		for _, field := range args[2:] {
+			if _, ok := server.hashes[args[1]][field]; ok {
+				delete(server.hashes[args[1]], field)
+				deleted++
+			}
+		}
+		return respInt(deleted)
+	case "HEXISTS":
+		_, ok := server.hashes[args[1]][args[2]]
+		return respBool(ok)
+	case "LPUSH":
+		for _, value := range args[2:] {
+			server.lists[args[1]] = append([]string{value}, server.lists[args[1]]...)
+		}
+		return respInt(len(server.lists[args[1]]))
+	case "RPUSH":
+		server.lists[args[1]] = append(server.lists[args[1]], args[2:]...)
+		return respInt(len(server.lists[args[1]]))
+	case "LLEN":
+		return respInt(len(server.lists[args[1]]))
+	case "LRANGE":
+		list := server.lists[args[1]]
+		start, stop := listIndex(args[2], len(list)), listIndex(args[3], len(list))
+
+		if start < 0 {
+			start = 0
+		}
+		if stop >= len(list) {
+			stop = len(list) - 1
+		}
+		if start > stop {
+			return respArray(nil)
+		}
+		return respArray(list[start : stop+1])
+	case "LTRIM":
+		list := server.lists[args[1]]
+		start, stop := listIndex(args[2], len(list)), listIndex(args[3], len(list))
+
+		if start < 0 {
+			start = 0
+		}
+		if stop >= len(list) {
+			stop = len(list) - 1
+		}
+		if start > stop {
+			delete(server.lists, args[1])
+		} else {
+			server.lists[args[1]] = append([]string(nil), list[start:stop+1]...)
+		}
+		return respOk()
+	case "LREM":
+		count, _ := strconv.Atoi(args[2])
+		kept := make([]string, 0)
+		removed := 0
+
+		for _, value := range server.lists[args[1]] {
+			if value == args[3] && (count == 0 || removed < count) {
+				removed++
+				continue
+			}
+			kept = append(kept, value)
+		}
+
+		server.lists[args[1]] = kept
+		return respInt(removed)
+	case "SADD":
+		set, ok := server.sets[args[1]]
+		if !ok {
+			set = make(map[string]bool)
+			server.sets[args[1]] = set
+		}
+
+		added := 0
+		for _, member := range args[2:] {
+			if !set[member] {
+				set[member] = true
+				added++
+			}
+		}
+		return respInt(added)
+	case "SREM":
+		removed := 0
+		for _, member := range args[2:] {
+			if server.sets[args[1]][member] {
+				delete(server.sets[args[1]], member)
+				removed++
+			}
+		}
+		return respInt(removed)
+	case "SMEMBERS":
+		members := make([]string, 0)
+		for member := range server.sets[args[1]] {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		return respArray(members)
+	case "SISMEMBER":
+		return respBool(server.sets[args[1]][args[2]])
+	}
+
+	return respError("unknown command " + command)
+}
+
+func TestFakeRedisRoundTrip(t *testing.T) {
+	client, stop := newTestRedis(t)
+	defer stop()
+
+	if err := client.Set("key", "value", 0).Err(); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	if value := client.Get("key").Val(); value != "value" {
+		t.Errorf("Get = %q, want value", value)
+	}
+
+	if deleted := client.Del("key").Val(); deleted != 1 {
+		t.Errorf("Del = %d, want 1", deleted)
+	}
+
+	if deleted := client.Del("key").Val(); deleted != 0 {
+		t.Errorf("second Del = %d, want 0", deleted)
+	}
+
+	client.LPush("list", "a")
+	client.LPush("list", "b")
+	if values := client.LRange("list", 0, -1).Val(); strings.Join(values, ",") != "b,a" {
+		t.Errorf("LRange = %v, want [b a]", values)
+	}
+}
+
+func TestFakeRedisWatch(t *testing.T) {
+	client, stop := newTestRedis(t)
+	defer stop()
+
+	update := func(tx *redis.Tx) error {
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set("key", "mine", 0)
+			return nil
+		})
+		return err
+	}
+
+	err := client.Watch(func(tx *redis.Tx) error {
+		client.Set("key", "theirs", 0)
+		return update(tx)
+	}, "key")
+
+	if err != redis.TxFailedErr || client.Get("key").Val() != "theirs" {
+		t.Errorf("changed watched key: Watch = %v, key = %q", err, client.Get("key").Val())
+	}
+
+	if err = client.Watch(update, "key"); err != nil || client.Get("key").Val() != "mine" {
+		t.Errorf("untouched watched key: Watch = %v, key = %q", err, client.Get("key").Val())
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+// A new incursion shows up somewhere between these many hours after one despawns
+const (
+	DefaultRespawnMinHours = 12
+	DefaultRespawnMaxHours = 36
+)
+
+// RespawnWindow is when we expect the incursion that replaces a despawned one
+type RespawnWindow struct {
+	// The despawn event the window comes from, it doubles as a stable id
+	DespawnEventId    int64
+	FactionName       string
+	ConstellationName string
+	RegionName        string
+	DespawnedAt       time.Time
+	Opens             time.Time
+	Closes            time.Time
+}
+
+// EstimateRespawns pairs each despawn with the next spawn of the same faction inside its window, and anything
+// left over is still waiting on its replacement. Events are newest first, the way GetEvents hands them back.
+func EstimateRespawns(events []*IncursionEvent, now time.Time, min, max time.Duration) []*RespawnWindow {
+	pending := make([]*IncursionEvent, 0)
+
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+
+		switch event.Type {
+		case EventDespawned:
+			pending = append(pending, event)
+		case EventSpawned:
+			for j, despawn := range pending {
+				// One that is long overdue respawned while we weren't watching, this spawn isn't its replacement
+				if despawn.FactionId == event.FactionId && event.At.Before(despawn.At.Add(max)) {
+					pending = append(pending[:j], pending[j+1:]...)
+					break
+				}
+			}
+		}
+	}
+
+	windows := make([]*RespawnWindow, 0, len(pending))
+
+	for _, despawn := range pending {
+		window := &RespawnWindow{
+			DespawnEventId:    despawn.Id,
+			FactionName:       despawn.FactionName,
+			ConstellationName: despawn.ConstellationName,
+			RegionName:        despawn.RegionName,
+			DespawnedAt:       despawn.At,
+			Opens:             despawn.At.Add(min),
+			Closes:            despawn.At.Add(max),
+		}
+
+		if window.Closes.Before(now) {
+			continue
+		}
+
+		windows = append(windows, window)
+	}
+
+	return windows
+}
+
+// GetRespawnWindows estimates respawns from the recorded history
+func (server *Server) GetRespawnWindows() []*RespawnWindow {
+	min := time.Duration(server.Config.RespawnMinHours) * time.Hour
+	max := time.Duration(server.Config.RespawnMaxHours) * time.Hour
+
+	return EstimateRespawns(server.GetEvents(0, maxEvents), time.Now().UTC(), min, max)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateRespawns(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	min, max := time.Hour*12, time.Hour*36
+
+	event := func(id int64, eventType EventType, faction int, hoursAgo int) *IncursionEvent {
+		return &IncursionEvent{Id: id, Type: eventType, FactionId: faction, At: now.Add(-time.Duration(hoursAgo) * time.Hour)}
+	}
+
+	tests := []struct {
+		name   string
+		events []*IncursionEvent
+		want   []int64
+	}{
+		{"waiting on a replacement", []*IncursionEvent{event(1, EventDespawned, FactionSanshasNation, 20)}, []int64{1}},
+		{"replaced", []*IncursionEvent{
+			event(2, EventSpawned, FactionSanshasNation, 5),
+			event(1, EventDespawned, FactionSanshasNation, 20),
+		}, []int64{}},
+		{"window has closed", []*IncursionEvent{event(1, EventDespawned, FactionSanshasNation, 40)}, []int64{}},
+		{"another faction doesn't replace it", []*IncursionEvent{
+			event(2, EventSpawned, FactionTriglavian, 5),
+			event(1, EventDespawned, FactionSanshasNation, 20),
+		}, []int64{1}},
+		{"a spawn before the despawn doesn't count", []*IncursionEvent{
+			event(2, EventDespawned, FactionSanshasNation, 10),
+			event(1, EventSpawned, FactionSanshasNation, 30),
+		}, []int64{2}},
+		{"one spawn replaces the oldest despawn", []*IncursionEvent{
+			event(3, EventSpawned, FactionSanshasNation, 5),
+			event(2, EventDespawned, FactionSanshasNation, 10),
+			event(1, EventDespawned, FactionSanshasNation, 20),
+		}, []int64{2}},
+		{"state changes are ignored", []*IncursionEvent{
+			event(2, EventStateChanged, FactionSanshasNation, 5),
+			event(1, EventDespawned, FactionSanshasNation, 20),
+		}, []int64{1}},
+	}
+
+	for _, test := range tests {
+		windows := EstimateRespawns(test.events, now, min, max)
+
+		if len(windows) != len(test.want) {
+			t.Errorf("%v: got %d windows, want %d", test.name, len(windows), len(test.want))
+			continue
+		}
+
+		for i, window := range windows {
+			if window.DespawnEventId != test.want[i] {
+				t.Errorf("%v: window %d is for event %d, want %d", test.name, i, window.DespawnEventId, test.want[i])
+			}
+		}
+	}
+}
+
+func TestEstimateRespawnsWindow(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	despawned := now.Add(-time.Hour * 20)
+
+	windows := EstimateRespawns([]*IncursionEvent{
+		{Id: 1, Type: EventDespawned, FactionName: "Sansha's Nation", ConstellationName: "Alpha", RegionName: "Test Region", At: despawned},
+	}, now, time.Hour*12, time.Hour*36)
+
+	if len(windows) != 1 {
+		t.Fatalf("got %d windows", len(windows))
+	}
+
+	window := windows[0]
+
+	if !window.Opens.Equal(despawned.Add(time.Hour*12)) || !window.Closes.Equal(despawned.Add(time.Hour*36)) {
+		t.Errorf("window is %v to %v", window.Opens, window.Closes)
+	}
+
+	if window.FactionName != "Sansha's Nation" || window.ConstellationName != "Alpha" || window.RegionName != "Test Region" || !window.DespawnedAt.Equal(despawned) {
+		t.Errorf("window = %+v", window)
+	}
+}
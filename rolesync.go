@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// RoleRule gives a Discord role to anyone with a linked character in one of the corporations or alliances
+type RoleRule struct {
+	RoleId       string `json:"role_id"`
+	Corporations []int  `json:"corporations"`
+	Alliances    []int  `json:"alliances"`
+}
+
+type EsiAffiliation struct {
+	CharacterId   int `json:"character_id"`
+	CorporationId int `json:"corporation_id"`
+	AllianceId    int `json:"alliance_id"`
+}
+
+// RoleChange is one role we would add to or take off a member
+type RoleChange struct {
+	UserId string
+	RoleId string
+	Add    bool
+}
+
+// ESI takes at most this many characters per affiliation request
+const maxAffiliationIds = 1000
+
+// roleRulesKey is a hash of role id to RoleRule
+func roleRulesKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:role_rules", guildId)
+}
+
+// roleSyncKey is set when the guild wants the sync to actually change roles
+func roleSyncKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:role_sync", guildId)
+}
+
+// Matches is true if the affiliation is in one of the rule's corporations or alliances
+func (rule *RoleRule) Matches(affiliation *EsiAffiliation) bool {
+	for _, id := range rule.Corporations {
+		if id == affiliation.CorporationId {
+			return true
+		}
+	}
+
+	for _, id := range rule.Alliances {
+		if affiliation.AllianceId > 0 && id == affiliation.AllianceId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (server *Server) GetRoleRules(guildId string) []*RoleRule {
+	rules := make([]*RoleRule, 0)
+
+	for _, raw := range server.Redis.HGetAll(roleRulesKey(guildId)).Val() {
+		var rule RoleRule
+
+		if err := json.Unmarshal([]byte(raw), &rule); err != nil {
+			Log.Warn("Unable to parse role rule", LogFields{"guild": guildId, "error": err})
+			continue
+		}
+
+		rules = append(rules, &rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].RoleId < rules[j].RoleId
+	})
+
+	return rules
+}
+
+func (server *Server) SaveRoleRule(guildId string, rule *RoleRule) error {
+	bytes, err := json.Marshal(rule)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Redis.HSet(roleRulesKey(guildId), rule.RoleId, string(bytes)).Err()
+}
+
+// GetAffiliations looks up the corporation and alliance of every character through public ESI
+func GetAffiliations(characterIds []int) map[int]*EsiAffiliation {
+	affiliations := make(map[int]*EsiAffiliation)
+
+	for start := 0; start < len(characterIds); start += maxAffiliationIds {
+		end := start + maxAffiliationIds
+		if end > len(characterIds) {
+			end = len(characterIds)
+		}
+
+		bytes := postEndpointResult("/latest/characters/affiliation/", characterIds[start:end])
+
+		if bytes == nil {
+			continue
+		}
+
+		var batch []*EsiAffiliation
+		if err := json.Unmarshal(bytes, &batch); err != nil {
+			Log.Warn("Unable to parse affiliations from ESI", LogFields{"error": err})
+			continue
+		}
+
+		for _, affiliation := range batch {
+			affiliations[affiliation.CharacterId] = affiliation
+		}
+	}
+
+	return affiliations
+}
+
+// GetGuildMembers pages through every member of the guild
+func (server *Server) GetGuildMembers(guildId string) ([]*discordgo.Member, error) {
+	members := make([]*discordgo.Member, 0)
+	after := ""
+
+	for {
+		page, err := server.Discord.GuildMembers(guildId, after, 1000)
+
+		if err != nil {
+			return nil, err
+		}
+
+		members = append(members, page...)
+
+		if len(page) < 1000 {
+			return members, nil
+		}
+
+		after = page[len(page)-1].User.ID
+	}
+}
+
+// PlanRoleSync works out the changes for members with linked characters. Members without any are left alone
+// so roles handed out by hand survive.
+func (server *Server) PlanRoleSync(guildId string) ([]*RoleChange, error) {
+	rules := server.GetRoleRules(guildId)
+
+	if len(rules) <= 0 {
+		return make([]*RoleChange, 0), nil
+	}
+
+	members, err := server.GetGuildMembers(guildId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return server.planRoleChanges(rules, members), nil
+}
+
+// planRoleChanges compares the roles members have with the roles their characters' affiliations earn them
+func (server *Server) planRoleChanges(rules []*RoleRule, members []*discordgo.Member) []*RoleChange {
+	characters := make(map[string][]*LinkedCharacter)
+	ids := make([]int, 0)
+
+	for _, member := range members {
+		if member.User == nil || member.User.Bot {
+			continue
+		}
+
+		linked := server.GetLinkedCharacters(member.User.ID)
+
+		if len(linked) <= 0 {
+			continue
+		}
+
+		characters[member.User.ID] = linked
+
+		for _, character := range linked {
+			ids = append(ids, character.Id)
+		}
+	}
+
+	affiliations := GetAffiliations(UniqueInts(ids))
+	changes := make([]*RoleChange, 0)
+
+	for _, member := range members {
+		linked, ok := characters[member.User.ID]
+
+		if !ok {
+			continue
+		}
+
+		for _, rule := range rules {
+			wanted := false
+			// If ESI didn't answer for one of their characters we can't be sure they should lose the role
+			unknown := false
+
+			for _, character := range linked {
+				affiliation, ok := affiliations[character.Id]
+
+				if !ok {
+					unknown = true
+					continue
+				}
+
+				if rule.Matches(affiliation) {
+					wanted = true
+				}
+			}
+
+			has := Exists(member.Roles, rule.RoleId)
+
+			if wanted && !has {
+				changes = append(changes, &RoleChange{UserId: member.User.ID, RoleId: rule.RoleId, Add: true})
+			} else if !wanted && has && !unknown {
+				changes = append(changes, &RoleChange{UserId: member.User.ID, RoleId: rule.RoleId, Add: false})
+			}
+		}
+	}
+
+	return changes
+}
+
+// ApplyRoleChanges makes the changes, carrying on past any Discord refuses
+func (server *Server) ApplyRoleChanges(logger *Logger, guildId string, changes []*RoleChange) int {
+	applied := 0
+
+	for _, change := range changes {
+		var err error
+
+		if change.Add {
+			err = server.Discord.GuildMemberRoleAdd(guildId, change.UserId, change.RoleId)
+		} else {
+			err = server.Discord.GuildMemberRoleRemove(guildId, change.UserId, change.RoleId)
+		}
+
+		if err != nil {
+			logger.Warn("Unable to change role", LogFields{"guild": guildId, "role": change.RoleId, "user": change.UserId, "add": change.Add, "error": err})
+			continue
+		}
+
+		applied++
+	}
+
+	return applied
+}
+
+// syncRoles is the scheduled task, it only touches guilds that have turned enforcement on
+func (server *Server) syncRoles(logger *Logger) {
+	for _, guildId := range server.Guilds.IDs() {
+		if server.Redis.Exists(roleSyncKey(guildId)).Val() == 0 {
+			continue
+		}
+
+		changes, err := server.PlanRoleSync(guildId)
+
+		if err != nil {
+			logger.Error("Unable to plan role sync", LogFields{"guild": guildId, "error": err})
+			continue
+		}
+
+		if len(changes) > 0 {
+			logger.Info("Role sync made changes", LogFields{"guild": guildId, "applied": server.ApplyRoleChanges(logger, guildId, changes), "planned": len(changes)})
+		}
+	}
+}
+
+// findRole takes a role mention, id or name
+func (server *Server) findRole(guildId, value string) (*discordgo.Role, error) {
+	id := strings.TrimSuffix(strings.TrimPrefix(value, "<@&"), ">")
+	roles, err := server.Discord.GuildRoles(guildId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		if role.ID == id || strings.EqualFold(role.Name, value) {
+			return role, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No role called %v", value)
+}
+
+// findEntity resolves a corporation or alliance id or exact name
+func findEntity(kind, value string) (int, error) {
+	if id, err := strconv.Atoi(value); err == nil {
+		return id, nil
+	}
+
+	bytes := postEndpointResult("/latest/universe/ids", []string{value})
+
+	if bytes == nil {
+		return 0, fmt.Errorf("Unable to look up %v", value)
+	}
+
+	var ids struct {
+		Corporations []*EsiName `json:"corporations"`
+		Alliances    []*EsiName `json:"alliances"`
+	}
+
+	if err := json.Unmarshal(bytes, &ids); err != nil {
+		return 0, err
+	}
+
+	found := ids.Corporations
+	if kind == "alliance" {
+		found = ids.Alliances
+	}
+
+	if len(found) <= 0 {
+		return 0, fmt.Errorf("No %v called %v", kind, value)
+	}
+
+	return found[0].Id, nil
+}
+
+func (server *Server) describeRoleChanges(guildId string, changes []*RoleChange) string {
+	if len(changes) <= 0 {
+		return "Everyone already has the right roles"
+	}
+
+	names := make(map[string]string)
+	if roles, err := server.Discord.GuildRoles(guildId); err == nil {
+		for _, role := range roles {
+			names[role.ID] = role.Name
+		}
+	}
+
+	lines := make([]string, 0, len(changes))
+	for _, change := range changes {
+		action := "remove"
+		if change.Add {
+			action = "add"
+		}
+
+		lines = append(lines, fmt.Sprintf("%v %v %v", action, names[change.RoleId], server.PilotName(change.UserId)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// HandleRoleSync is !rolesync [add <role> corp|alliance <id or name> | remove <role> | dryrun | on | off]
+func (server *Server) HandleRoleSync(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	args := commandArgs(message)
+
+	if len(args) <= 0 {
+		server.listRoleRules(guildId, message)
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "add":
+		if len(args) < 4 {
+			server.SendMessage(message.ChannelID, "Usage: !rolesync add <role> corp|alliance <id or name>")
+			return
+		}
+
+		role, err := server.findRole(guildId, args[1])
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, err.Error())
+			return
+		}
+
+		kind := strings.ToLower(args[2])
+		if kind == "corp" || kind == "corporation" {
+			kind = "corporation"
+		} else if kind != "alliance" {
+			server.SendMessage(message.ChannelID, "Roles can be given for a corp or an alliance")
+			return
+		}
+
+		id, err := findEntity(kind, strings.Join(args[3:], " "))
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, err.Error())
+			return
+		}
+
+		rule := &RoleRule{RoleId: role.ID}
+		for _, existing := range server.GetRoleRules(guildId) {
+			if existing.RoleId == role.ID {
+				rule = existing
+			}
+		}
+
+		if kind == "corporation" {
+			rule.Corporations = UniqueInts(append(rule.Corporations, id))
+		} else {
+			rule.Alliances = UniqueInts(append(rule.Alliances, id))
+		}
+
+		if err = server.SaveRoleRule(guildId, rule); err != nil {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to save role rule. Error: %v", err))
+			return
+		}
+
+		server.SendMessage(message.ChannelID, fmt.Sprintf("%v will be given to members of %v %v. Run !rolesync dryrun to see what would change", role.Name, kind, id))
+	case "remove":
+		if len(args) < 2 {
+			server.SendMessage(message.ChannelID, "Usage: !rolesync remove <role>")
+			return
+		}
+
+		role, err := server.findRole(guildId, args[1])
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, err.Error())
+			return
+		}
+
+		server.Redis.HDel(roleRulesKey(guildId), role.ID)
+		server.SendMessage(message.ChannelID, fmt.Sprintf("%v is no longer synced, members keep it until someone takes it off them", role.Name))
+	case "dryrun":
+		changes, err := server.PlanRoleSync(guildId)
+
+		if err != nil {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to work out role changes. Error: %v", err))
+			return
+		}
+
+		for _, chunk := range SplitMessage(server.describeRoleChanges(guildId, changes), maxMessageLength) {
+			server.SendMessage(message.ChannelID, chunk)
+		}
+	case "on":
+		server.Redis.Set(roleSyncKey(guildId), "on", 0)
+		server.SendMessage(message.ChannelID, "Roles will be synced from corp and alliance membership every 30 minutes")
+	case "off":
+		server.Redis.Del(roleSyncKey(guildId))
+		server.SendMessage(message.ChannelID, "Role sync turned off, roles stay as they are")
+	default:
+		server.SendMessage(message.ChannelID, "Usage: !rolesync [add <role> corp|alliance <id or name> | remove <role> | dryrun | on | off]")
+	}
+}
+
+func (server *Server) listRoleRules(guildId string, message *discordgo.MessageCreate) {
+	rules := server.GetRoleRules(guildId)
+
+	if len(rules) <= 0 {
+		server.SendMessage(message.ChannelID, "No roles are synced. Add one with !rolesync add <role> corp|alliance <id or name>")
+		return
+	}
+
+	names := make(map[string]string)
+	if roles, err := server.Discord.GuildRoles(guildId); err == nil {
+		for _, role := range roles {
+			names[role.ID] = role.Name
+		}
+	}
+
+	status := "off, run !rolesync on to enforce"
+	if server.Redis.Exists(roleSyncKey(guildId)).Val() > 0 {
+		status = "on"
+	}
+
+	lines := []string{fmt.Sprintf("Role sync is %v", status)}
+	for _, rule := range rules {
+		lines = append(lines, fmt.Sprintf("%v - corporations %v, alliances %v", names[rule.RoleId], rule.Corporations, rule.Alliances))
+	}
+
+	server.SendMessage(message.ChannelID, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	testCorporation = 98000001
+	testAlliance    = 99000001
+	otherAlliance   = 99000002
+)
+
+func testMember(id string, roles ...string) *discordgo.Member {
+	return &discordgo.Member{User: &discordgo.User{ID: id}, Roles: roles}
+}
+
+func TestPlanRoleSync(t *testing.T) {
+	server, esi, stop := newTestServer(t)
+	defer stop()
+
+	rules := []*RoleRule{
+		{RoleId: "corp-role", Corporations: []int{testCorporation}},
+		{RoleId: "alliance-role", Alliances: []int{testAlliance}},
+	}
+
+	// joining is in the corp, leaving left it but still has both roles, alt has one character in each
+	server.SaveLinkedCharacter("joining", &LinkedCharacter{Id: 1, Name: "Joining"})
+	server.SaveLinkedCharacter("leaving", &LinkedCharacter{Id: 2, Name: "Leaving"})
+	server.SaveLinkedCharacter("alt", &LinkedCharacter{Id: 3, Name: "Main"})
+	server.SaveLinkedCharacter("alt", &LinkedCharacter{Id: 4, Name: "Alt"})
+	server.SaveLinkedCharacter("bot", &LinkedCharacter{Id: 5, Name: "Bot"})
+
+	esi.Affiliate(1, testCorporation, testAlliance)
+	esi.Affiliate(2, 98000002, otherAlliance)
+	esi.Affiliate(3, 98000002, otherAlliance)
+	esi.Affiliate(4, testCorporation, 0)
+	esi.Affiliate(5, testCorporation, testAlliance)
+
+	bot := testMember("bot")
+	bot.User.Bot = true
+
+	members := []*discordgo.Member{
+		testMember("joining"),
+		testMember("leaving", "corp-role", "alliance-role"),
+		testMember("alt", "alliance-role"),
+		// Nothing linked, so roles handed out by hand stay
+		testMember("unlinked", "corp-role"),
+		bot,
+	}
+
+	changes := server.planRoleChanges(rules, members)
+
+	got := make(map[string]bool)
+	for _, change := range changes {
+		got[fmt.Sprintf("%v %v %v", change.UserId, change.RoleId, change.Add)] = true
+	}
+
+	want := []string{
+		"joining corp-role true",
+		"joining alliance-role true",
+		"leaving corp-role false",
+		"leaving alliance-role false",
+		"alt corp-role true",
+		"alt alliance-role false",
+	}
+
+	for _, change := range want {
+		if !got[change] {
+			t.Errorf("missing change %q", change)
+		}
+	}
+
+	if len(changes) != len(want) {
+		t.Errorf("got %d changes, want %d: %v", len(changes), len(want), got)
+	}
+}
+
+func TestPlanRoleSyncKeepsRolesWhenEsiDoesNotKnow(t *testing.T) {
+	server, esi, stop := newTestServer(t)
+	defer stop()
+
+	rules := []*RoleRule{{RoleId: "corp-role", Corporations: []int{testCorporation}}}
+
+	server.SaveLinkedCharacter("member", &LinkedCharacter{Id: 1, Name: "Known"})
+	server.SaveLinkedCharacter("member", &LinkedCharacter{Id: 2, Name: "Unknown"})
+	esi.Affiliate(1, 98000002, 0)
+
+	// One of their characters might still be in the corp, so the role stays
+	if changes := server.planRoleChanges(rules, []*discordgo.Member{testMember("member", "corp-role")}); len(changes) != 0 {
+		t.Errorf("removed a role ESI couldn't confirm: %+v", changes[0])
+	}
+}
+
+func TestPlanRoleSyncWithoutRules(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	// No rules means Discord isn't asked for members at all
+	changes, err := server.PlanRoleSync("guild")
+
+	if err != nil || len(changes) != 0 {
+		t.Errorf("PlanRoleSync = %v, %v", changes, err)
+	}
+}
+
+func TestRoleRuleMatches(t *testing.T) {
+	rule := &RoleRule{Corporations: []int{testCorporation}, Alliances: []int{testAlliance}}
+
+	tests := []struct {
+		affiliation *EsiAffiliation
+		want        bool
+	}{
+		{&EsiAffiliation{CorporationId: testCorporation}, true},
+		{&EsiAffiliation{CorporationId: 98000002, AllianceId: testAlliance}, true},
+		{&EsiAffiliation{CorporationId: 98000002, AllianceId: otherAlliance}, false},
+		{&EsiAffiliation{CorporationId: 98000002}, false},
+	}
+
+	for _, test := range tests {
+		if matches := rule.Matches(test.affiliation); matches != test.want {
+			t.Errorf("Matches(%+v) = %v", test.affiliation, matches)
+		}
+	}
+
+	// A rule for alliance 0 mustn't match everyone outside an alliance
+	if (&RoleRule{Alliances: []int{0}}).Matches(&EsiAffiliation{CorporationId: 98000002}) {
+		t.Error("alliance 0 matched a character without an alliance")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RoutePreference mirrors the flags ESI's /route endpoint takes, plus secure-only which never leaves highsec
+type RoutePreference string
+
+const (
+	RouteShortest   RoutePreference = "shortest"
+	RouteSecure     RoutePreference = "secure"
+	RouteInsecure   RoutePreference = "insecure"
+	RouteSecureOnly RoutePreference = "secure-only"
+
+	// Anything at or above this rounds to 0.5 in game and counts as highsec
+	HighSecThreshold = 0.45
+	// Anything below this rounds to 0.0 and is nullsec
+	LowSecThreshold = 0.05
+
+	// Cost of jumping into the wrong kind of space for the preference. High enough that any detour wins.
+	penaltyJumpCost = 10000
+)
+
+var routePreferences = []string{string(RouteShortest), string(RouteSecure), string(RouteInsecure), string(RouteSecureOnly)}
+
+// RouteOptions are everything that changes which route we pick between two systems
+type RouteOptions struct {
+	Preference RoutePreference
+	Avoid      []int
+}
+
+// ParseRoutePreference accepts the same names ESI uses, with "safest" as an alias for secure
+func ParseRoutePreference(value string) (RoutePreference, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+
+	if value == "safest" {
+		return RouteSecure, nil
+	}
+
+	if !Exists(routePreferences, value) {
+		return "", fmt.Errorf("unknown route preference %q, expected one of %v", value, strings.Join(routePreferences, ", "))
+	}
+
+	return RoutePreference(value), nil
+}
+
+// cacheKey is unique per set of options so different preferences don't stomp on each other
+func (options RouteOptions) cacheKey(src, dst int) string {
+	key := fmt.Sprintf("%v:%v:%v", src, dst, options.preference())
+
+	for _, id := range options.Avoid {
+		key += ":" + strconv.Itoa(id)
+	}
+
+	return key
+}
+
+func (options RouteOptions) preference() RoutePreference {
+	if len(options.Preference) <= 0 {
+		return RouteShortest
+	}
+	return options.Preference
+}
+
+func IsHighSec(security float32) bool {
+	return security >= HighSecThreshold
+}
+
+// JumpCount turns a route (which includes the origin) into a number of jumps, -1 if we have no route
+func JumpCount(route []int) int {
+	if len(route) <= 0 {
+		return -1
+	}
+	return len(route) - 1
+}
+
+// JumpCountText is JumpCount for messages
+func JumpCountText(route []int) string {
+	return JumpsText(JumpCount(route))
+}
+
+// JumpsText shows unknown (negative) jump counts as ?
+func JumpsText(jumps int) string {
+	if jumps < 0 {
+		return "?"
+	}
+	return strconv.Itoa(jumps)
+}
+
+// Route finds a path over the stargate graph from src to dst, including both ends, the same way ESI returns them.
+// Returns nil if there is no route that satisfies the options.
+func (universe *Universe) Route(src, dst int, options RouteOptions) []int {
+	if universe == nil || universe.Systems[src] == nil || universe.Systems[dst] == nil {
+		return nil
+	}
+
+	if src == dst {
+		return []int{src}
+	}
+
+	previous, _ := universe.search(src, dst, options)
+
+	if _, ok := previous[dst]; !ok {
+		return nil
+	}
+
+	// Walk back from the destination
+	route := []int{dst}
+	for system := dst; system != src; {
+		system = previous[system]
+		route = append(route, system)
+	}
+
+	for i, j := 0, len(route)-1; i < j; i, j = i+1, j-1 {
+		route[i], route[j] = route[j], route[i]
+	}
+
+	return route
+}
+
+// Jumps is the number of jumps from src to every system reachable with the options, following the same routes Route would pick
+func (universe *Universe) Jumps(src int, options RouteOptions) map[int]int {
+	if universe == nil || universe.Systems[src] == nil {
+		return make(map[int]int)
+	}
+
+	_, jumps := universe.search(src, 0, options)
+	return jumps
+}
+
+// search runs Dijkstra out from src, stopping early once dst is settled. A dst of 0 searches everything reachable.
+func (universe *Universe) search(src, dst int, options RouteOptions) (map[int]int, map[int]int) {
+	avoid := make(map[int]bool, len(options.Avoid))
+	for _, id := range options.Avoid {
+		// You can always leave where you are and arrive where you're going
+		if id != src && id != dst {
+			avoid[id] = true
+		}
+	}
+
+	preference := options.preference()
+
+	costs := map[int]int{src: 0}
+	jumps := map[int]int{src: 0}
+	previous := make(map[int]int)
+	queue := &routeQueue{{system: src, cost: 0}}
+
+	for queue.Len() > 0 {
+		current := heap.Pop(queue).(routeNode)
+
+		if current.system == dst {
+			break
+		}
+
+		// Stale entry, we already found a cheaper way here
+		if current.cost > costs[current.system] {
+			continue
+		}
+
+		for _, neighbourId := range universe.Systems[current.system].Neighbours {
+			neighbour := universe.Systems[neighbourId]
+
+			if neighbour == nil || avoid[neighbourId] {
+				continue
+			}
+
+			cost := 1
+			highSec := IsHighSec(neighbour.SecurityStatus)
+			if neighbourId != dst {
+				switch {
+				case preference == RouteSecure && !highSec:
+					cost = penaltyJumpCost
+				case preference == RouteInsecure && highSec:
+					cost = penaltyJumpCost
+				case preference == RouteSecureOnly && !highSec:
+					continue
+				}
+			}
+
+			total := current.cost + cost
+			if existing, ok := costs[neighbourId]; ok && existing <= total {
+				continue
+			}
+
+			costs[neighbourId] = total
+			jumps[neighbourId] = jumps[current.system] + 1
+			previous[neighbourId] = current.system
+			heap.Push(queue, routeNode{system: neighbourId, cost: total})
+		}
+	}
+
+	return previous, jumps
+}
+
+// RouteLeavesHighSec is true if any system along the route is low or null
+func (universe *Universe) RouteLeavesHighSec(route []int) bool {
+	for _, id := range route {
+		if system := universe.System(id); system != nil && !IsHighSec(system.SecurityStatus) {
+			return true
+		}
+	}
+	return false
+}
+
+type routeNode struct {
+	system int
+	cost   int
+}
+
+// routeQueue is a min heap on cost for container/heap
+type routeQueue []routeNode
+
+func (queue routeQueue) Len() int            { return len(queue) }
+func (queue routeQueue) Less(i, j int) bool  { return queue[i].cost < queue[j].cost }
+func (queue routeQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *routeQueue) Push(x interface{}) { *queue = append(*queue, x.(routeNode)) }
+
+func (queue *routeQueue) Pop() interface{} {
+	old := *queue
+	node := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return node
+}
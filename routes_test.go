@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	universe := newTestUniverse()
+
+	tests := []struct {
+		name    string
+		src     int
+		dst     int
+		options RouteOptions
+		want    []int
+	}{
+		{"same system", testSystemHome, testSystemHome, RouteOptions{}, []int{testSystemHome}},
+		{"shortest", testSystemHome, testSystemStaging, RouteOptions{}, []int{testSystemHome, testSystemHub, testSystemLow, testSystemStaging}},
+		{"secure detours around lowsec", testSystemHome, testSystemStaging, RouteOptions{Preference: RouteSecure}, []int{testSystemHome, testSystemHub, testSystemDetour, testSystemExtra, testSystemStaging}},
+		{"insecure goes through lowsec", testSystemHome, testSystemStaging, RouteOptions{Preference: RouteInsecure}, []int{testSystemHome, testSystemHub, testSystemLow, testSystemStaging}},
+		{"secure-only", testSystemHome, testSystemStaging, RouteOptions{Preference: RouteSecureOnly}, []int{testSystemHome, testSystemHub, testSystemDetour, testSystemExtra, testSystemStaging}},
+		{"avoid", testSystemHome, testSystemStaging, RouteOptions{Avoid: []int{testSystemLow}}, []int{testSystemHome, testSystemHub, testSystemDetour, testSystemExtra, testSystemStaging}},
+		{"secure-only with no highsec way", testSystemHome, testSystemStaging, RouteOptions{Preference: RouteSecureOnly, Avoid: []int{testSystemDetour}}, nil},
+		{"arriving in lowsec is fine for secure-only", testSystemHub, testSystemLow, RouteOptions{Preference: RouteSecureOnly}, []int{testSystemHub, testSystemLow}},
+		{"avoiding the destination is ignored", testSystemHome, testSystemHub, RouteOptions{Avoid: []int{testSystemHub}}, []int{testSystemHome, testSystemHub}},
+		{"unknown system", testSystemHome, 30009999, RouteOptions{}, nil},
+	}
+
+	for _, test := range tests {
+		route := universe.Route(test.src, test.dst, test.options)
+
+		if fmt.Sprint(route) != fmt.Sprint(test.want) {
+			t.Errorf("%v: Route = %v, want %v", test.name, route, test.want)
+		}
+	}
+}
+
+func TestRouteOnNilUniverse(t *testing.T) {
+	var universe *Universe
+
+	if route := universe.Route(testSystemHome, testSystemStaging, RouteOptions{}); route != nil {
+		t.Errorf("Route = %v, want nil", route)
+	}
+
+	if jumps := universe.Jumps(testSystemHome, RouteOptions{}); len(jumps) != 0 {
+		t.Errorf("Jumps = %v, want none", jumps)
+	}
+}
+
+func TestJumps(t *testing.T) {
+	universe := newTestUniverse()
+
+	shortest := universe.Jumps(testSystemHome, RouteOptions{})
+	if shortest[testSystemStaging] != 3 || shortest[testSystemExtra] != 3 || len(shortest) != 6 {
+		t.Errorf("shortest jumps = %v", shortest)
+	}
+
+	// Jumps follows the route Route picks, not the fewest gates
+	secure := universe.Jumps(testSystemHome, RouteOptions{Preference: RouteSecure})
+	if secure[testSystemStaging] != 4 {
+		t.Errorf("secure jumps to staging = %d, want 4", secure[testSystemStaging])
+	}
+
+	secureOnly := universe.Jumps(testSystemHome, RouteOptions{Preference: RouteSecureOnly})
+	if _, ok := secureOnly[testSystemLow]; ok {
+		t.Errorf("secure-only reached lowsec: %v", secureOnly)
+	}
+}
+
+func TestRouteLeavesHighSec(t *testing.T) {
+	universe := newTestUniverse()
+
+	if !universe.RouteLeavesHighSec([]int{testSystemHome, testSystemHub, testSystemLow}) {
+		t.Error("route through Lowpipe should leave highsec")
+	}
+
+	if universe.RouteLeavesHighSec([]int{testSystemHome, testSystemHub, testSystemDetour}) {
+		t.Error("0.5 is highsec")
+	}
+}
+
+func TestParseRoutePreference(t *testing.T) {
+	tests := []struct {
+		value string
+		want  RoutePreference
+		ok    bool
+	}{
+		{"shortest", RouteShortest, true},
+		{" Secure ", RouteSecure, true},
+		{"safest", RouteSecure, true},
+		{"secure-only", RouteSecureOnly, true},
+		{"fastest", "", false},
+	}
+
+	for _, test := range tests {
+		preference, err := ParseRoutePreference(test.value)
+
+		if (err == nil) != test.ok || preference != test.want {
+			t.Errorf("ParseRoutePreference(%q) = %q, %v", test.value, preference, err)
+		}
+	}
+}
+
+func TestRouteCacheKeys(t *testing.T) {
+	keys := map[string]bool{
+		RouteOptions{}.cacheKey(1, 2):                                         true,
+		RouteOptions{Preference: RouteSecure}.cacheKey(1, 2):                  true,
+		RouteOptions{Avoid: []int{3}}.cacheKey(1, 2):                          true,
+		RouteOptions{Preference: RouteShortest}.cacheKey(2, 1):                true,
+		RouteOptions{Preference: RouteSecure, Avoid: []int{3}}.cacheKey(1, 2): true,
+	}
+
+	if len(keys) != 5 {
+		t.Errorf("options collided on cache keys: %v", keys)
+	}
+
+	if (RouteOptions{}).cacheKey(1, 2) != (RouteOptions{Preference: RouteShortest}).cacheKey(1, 2) {
+		t.Error("no preference should share a key with shortest")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// GuildSettings are the per guild preferences, stored as json in Redis
+type GuildSettings struct {
+	HomeSystemId    int    `json:"home_system_id"`
+	RoutePreference string `json:"route_preference"`
+	Avoid           []int  `json:"avoid"`
+	// Only show incursions run by these factions, everything when empty
+	Factions []int `json:"factions"`
+	// Commands start with this instead of DefaultCommandPrefix
+	Prefix string `json:"prefix"`
+	// Members with any of these roles count as admins, on top of the ones added with !setadmin
+	AdminRoles []string `json:"admin_roles"`
+	// Members with any of these roles can create fleets, admins always can
+	FcRoles []string `json:"fc_roles"`
+	// What routes are described as starting from, home unless we are routing from a pilot's location
+	OriginName string `json:"-"`
+}
+
+const DefaultCommandPrefix = "!"
+
+func guildSettingsKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:settings", guildId)
+}
+
+// DefaultGuildSettings is what a guild gets until an admin changes something. Also used for DMs.
+func (server *Server) DefaultGuildSettings() *GuildSettings {
+	return &GuildSettings{
+		HomeSystemId:    server.Config.DefaultStagingSystemId,
+		RoutePreference: server.Config.RoutePreference,
+		Avoid:           make([]int, 0),
+	}
+}
+
+func (server *Server) GetGuildSettings(guildId string) *GuildSettings {
+	settings := server.DefaultGuildSettings()
+
+	if len(guildId) <= 0 {
+		return settings
+	}
+
+	cmd := server.Redis.Get(guildSettingsKey(guildId))
+
+	if cmd.Err() != nil {
+		return settings
+	}
+
+	if err := json.Unmarshal([]byte(cmd.Val()), settings); err != nil {
+		Log.Warn("Unable to parse settings", LogFields{"guild": guildId, "error": err})
+		return server.DefaultGuildSettings()
+	}
+
+	return settings
+}
+
+func (server *Server) SaveGuildSettings(guildId string, settings *GuildSettings) error {
+	bytes, err := json.Marshal(settings)
+
+	if err != nil {
+		return err
+	}
+
+	if err = server.Redis.Set(guildSettingsKey(guildId), string(bytes), 0).Err(); err != nil {
+		return err
+	}
+
+	server.Guilds.SetPrefix(guildId, settings.CommandPrefix())
+	return nil
+}
+
+// CommandPrefix is what commands in the guild start with, the default for DMs. It's needed for every message the
+// bot can see, so it's kept in memory instead of reading the settings each time.
+func (server *Server) CommandPrefix(guildId string) string {
+	if len(guildId) <= 0 {
+		return DefaultCommandPrefix
+	}
+
+	if prefix, ok := server.Guilds.Prefix(guildId); ok {
+		return prefix
+	}
+
+	prefix := server.GetGuildSettings(guildId).CommandPrefix()
+	server.Guilds.SetPrefix(guildId, prefix)
+	return prefix
+}
+
+// GetGuildSettingsForChannel falls back to the defaults for DMs and channels we don't know
+func (server *Server) GetGuildSettingsForChannel(channelId string) *GuildSettings {
+	guildId, err := server.GetGuildIdForChannel(channelId)
+
+	if err != nil {
+		return server.DefaultGuildSettings()
+	}
+
+	return server.GetGuildSettings(guildId)
+}
+
+// CommandPrefix is what the guild's commands start with
+func (settings *GuildSettings) CommandPrefix() string {
+	if len(settings.Prefix) <= 0 {
+		return DefaultCommandPrefix
+	}
+	return settings.Prefix
+}
+
+func (settings *GuildSettings) RouteOptions() RouteOptions {
+	preference, err := ParseRoutePreference(settings.RoutePreference)
+
+	if err != nil {
+		preference = RouteShortest
+	}
+
+	return RouteOptions{
+		Preference: preference,
+		Avoid:      settings.Avoid,
+	}
+}
+
+// RouteForGuild is the route from the guild's home to the incursion's staging system using their preferences
+func (server *Server) RouteForGuild(settings *GuildSettings, incursion *EsiIncursion) []int {
+	return server.GetRouteWithOptions(settings.HomeSystemId, incursion.StagingSolarSystemId, settings.RouteOptions())
+}
+
+// RouteLeavesHighSec checks every system on the route, using the SDE if we have it
+func (server *Server) RouteLeavesHighSec(route []int) bool {
+	if server.Universe != nil {
+		return server.Universe.RouteLeavesHighSec(route)
+	}
+
+	for _, id := range route {
+		if system := server.GetSystem(id); system != nil && !IsHighSec(system.SecurityStatus) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DescribeRouteForGuild is the "x jumps from home" part of incursion messages
+func (server *Server) DescribeRouteForGuild(settings *GuildSettings, incursion *EsiIncursion) string {
+	route := server.RouteForGuild(settings, incursion)
+	origin := settings.OriginName
+
+	if len(origin) <= 0 {
+		origin = "home"
+	}
+
+	if route == nil {
+		return fmt.Sprintf("no %v route from %v", settings.RouteOptions().preference(), origin)
+	}
+
+	space := "highsec only"
+	if server.RouteLeavesHighSec(route) {
+		space = "through low/null"
+	}
+
+	shortcut := server.DescribeShortcutForGuild(settings, incursion, JumpCount(route))
+
+	return fmt.Sprintf("%v gate jumps from %v (%v, %v)%v", JumpCountText(route), origin, settings.RouteOptions().preference(), space, shortcut)
+}
+
+// FindSystemByName looks in the SDE first, then asks ESI to resolve the name
+func (server *Server) FindSystemByName(name string) *EsiSystem {
+	if system := server.Universe.SystemByName(name); system != nil {
+		return system.EsiSystem()
+	}
+
+	bytes := postEndpointResult("/latest/universe/ids", []string{strings.TrimSpace(name)})
+
+	if bytes == nil {
+		return nil
+	}
+
+	var ids struct {
+		Systems []*EsiName `json:"systems"`
+	}
+
+	if err := json.Unmarshal(bytes, &ids); err != nil || len(ids.Systems) <= 0 {
+		return nil
+	}
+
+	return server.GetSystem(ids.Systems[0].Id)
+}
+
+func (server *Server) SetHome(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(strings.Replace(message.Content, "!sethome", "", -1))
+	system := server.FindSystemByName(name)
+
+	if system == nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Could not find a system called %q", name))
+		return
+	}
+
+	settings := server.GetGuildSettings(guildId)
+	settings.HomeSystemId = system.SystemId
+
+	if err := server.SaveGuildSettings(guildId, settings); err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to set home. Error: %v", err))
+		return
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("Home set to %v", system.Name))
+}
+
+func (server *Server) SetRoutePreference(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	preference, err := ParseRoutePreference(strings.Replace(message.Content, "!setroute", "", -1))
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, err.Error())
+		return
+	}
+
+	settings := server.GetGuildSettings(guildId)
+	settings.RoutePreference = string(preference)
+
+	if err = server.SaveGuildSettings(guildId, settings); err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to set route preference. Error: %v", err))
+		return
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("Routes will now be %v", preference))
+}
+
+func (server *Server) AddAvoid(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	server.changeAvoid(logger, message, "!avoid", true)
+}
+
+func (server *Server) RemoveAvoid(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	server.changeAvoid(logger, message, "!unavoid", false)
+}
+
+func (server *Server) changeAvoid(logger *Logger, message *discordgo.MessageCreate, command string, avoid bool) {
+	guildId, ok := server.guildAdminCheck(logger, message)
+
+	if !ok {
+		return
+	}
+
+	name := strings.TrimSpace(strings.Replace(message.Content, command, "", -1))
+	system := server.FindSystemByName(name)
+
+	if system == nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Could not find a system called %q", name))
+		return
+	}
+
+	settings := server.GetGuildSettings(guildId)
+
+	remaining := make([]int, 0, len(settings.Avoid)+1)
+	for _, id := range settings.Avoid {
+		if id != system.SystemId {
+			remaining = append(remaining, id)
+		}
+	}
+
+	if avoid {
+		remaining = append(remaining, system.SystemId)
+	}
+
+	settings.Avoid = remaining
+
+	if err := server.SaveGuildSettings(guildId, settings); err != nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to update avoid list. Error: %v", err))
+		return
+	}
+
+	if avoid {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Routes will avoid %v", system.Name))
+	} else {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Routes will no longer avoid %v", system.Name))
+	}
+}
+
+func (server *Server) ShowRouteSettings(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	settings := server.GetGuildSettingsForChannel(message.ChannelID)
+
+	home := fmt.Sprint(settings.HomeSystemId)
+	if name := server.GetSystem(settings.HomeSystemId); name != nil {
+		home = name.Name
+	}
+
+	avoided := make([]string, 0, len(settings.Avoid))
+	for _, id := range settings.Avoid {
+		if system := server.GetSystem(id); system != nil {
+			avoided = append(avoided, system.Name)
+		} else {
+			avoided = append(avoided, fmt.Sprint(id))
+		}
+	}
+
+	if len(avoided) <= 0 {
+		avoided = append(avoided, "nothing")
+	}
+
+	server.SendMessage(message.ChannelID, fmt.Sprintf("Home: %v - Route: %v - Avoiding: %v", home, settings.RouteOptions().preference(), strings.Join(avoided, ", ")))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCommandPrefix(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	if prefix := server.CommandPrefix(""); prefix != DefaultCommandPrefix {
+		t.Errorf("DM prefix = %q, want %q", prefix, DefaultCommandPrefix)
+	}
+
+	if prefix := server.CommandPrefix("guild"); prefix != DefaultCommandPrefix {
+		t.Errorf("prefix before any settings = %q, want %q", prefix, DefaultCommandPrefix)
+	}
+
+	settings := server.GetGuildSettings("guild")
+	settings.Prefix = "?"
+
+	if err := server.SaveGuildSettings("guild", settings); err != nil {
+		t.Fatalf("SaveGuildSettings failed: %v", err)
+	}
+
+	if prefix := server.CommandPrefix("guild"); prefix != "?" {
+		t.Errorf("prefix after saving = %q, want ?", prefix)
+	}
+
+	// Once known it isn't read from Redis again
+	server.Redis.Del(guildSettingsKey("guild"))
+
+	if prefix := server.CommandPrefix("guild"); prefix != "?" {
+		t.Errorf("prefix = %q, want the remembered ?", prefix)
+	}
+
+	server.Guilds.Remove("guild")
+
+	if prefix := server.CommandPrefix("guild"); prefix != DefaultCommandPrefix {
+		t.Errorf("prefix after leaving = %q, want %q", prefix, DefaultCommandPrefix)
+	}
+}
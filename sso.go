@@ -0,0 +1,902 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Tranquility's SSO, point these somewhere else in config.json to test against a mock issuer
+const (
+	DefaultSsoAuthorizeUrl = "https://login.eveonline.com/v2/oauth/authorize"
+	DefaultSsoTokenUrl     = "https://login.eveonline.com/v2/oauth/token"
+	DefaultSsoJwksUrl      = "https://login.eveonline.com/oauth/jwks"
+	DefaultSsoIssuer       = "login.eveonline.com"
+)
+
+const (
+	// How long a !link url works for
+	ssoStateTTL = time.Minute * 10
+	// How long the owner of a character has to let someone else link it
+	characterTransferTTL = time.Hour * 24
+
+	// Ties the SSO round trip to the browser that confirmed the link
+	ssoBindingCookie = "sso_binding"
+)
+
+type SsoConfig struct {
+	AuthorizeUrl string `json:"authorize_url"`
+	TokenUrl     string `json:"token_url"`
+	// Where the keys that sign access tokens are published, and who we expect to have issued them
+	JwksUrl string   `json:"jwks_url"`
+	Issuer  string   `json:"issuer"`
+	Scopes  []string `json:"scopes"`
+}
+
+// ssoState is what we remember between sending someone to the SSO and them coming back
+type ssoState struct {
+	UserId string `json:"user_id"`
+	// Shown on the page before the SSO so nobody links a character to an account they don't recognise
+	UserName string `json:"user_name"`
+	Verifier string `json:"verifier"`
+}
+
+// characterTransfer is someone asking for a character that another Discord account holds
+type characterTransfer struct {
+	UserId    string           `json:"user_id"`
+	Character *LinkedCharacter `json:"character"`
+}
+
+// LinkedCharacter is an EVE character a Discord user has proven they own.
+// The refresh token is encrypted with TOKEN_ENCRYPTION_KEY before it gets anywhere near redis.
+type LinkedCharacter struct {
+	Id           int       `json:"id"`
+	Name         string    `json:"name"`
+	RefreshToken string    `json:"refresh_token"`
+	Scopes       string    `json:"scopes"`
+	LinkedAt     time.Time `json:"linked_at"`
+}
+
+type ssoTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// accessToken is a short lived token we got from a refresh, kept in memory until it runs out
+type accessToken struct {
+	Token     string
+	ExpiresAt time.Time
+}
+
+// accessTokens is keyed by character id. refreshLocks keeps one refresh per character in flight without
+// holding up everyone else's, accessTokenLock only guards the two maps.
+var (
+	accessTokenLock sync.Mutex
+	accessTokens    = make(map[int]*accessToken)
+	refreshLocks    = make(map[int]*sync.Mutex)
+)
+
+// refreshLock is the lock held while refreshing the character's token
+func refreshLock(characterId int) *sync.Mutex {
+	accessTokenLock.Lock()
+	defer accessTokenLock.Unlock()
+
+	lock, ok := refreshLocks[characterId]
+
+	if !ok {
+		lock = &sync.Mutex{}
+		refreshLocks[characterId] = lock
+	}
+
+	return lock
+}
+
+// cachedAccessToken is the character's token if it hasn't run out yet
+func cachedAccessToken(characterId int) (string, bool) {
+	accessTokenLock.Lock()
+	defer accessTokenLock.Unlock()
+
+	if cached, ok := accessTokens[characterId]; ok && time.Now().Before(cached.ExpiresAt) {
+		return cached.Token, true
+	}
+
+	return "", false
+}
+
+var (
+	ErrSsoDisabled    = errors.New("EVE SSO isn't set up on this bot")
+	ErrCharacterOwned = errors.New("character is linked to another Discord account")
+)
+
+func ssoStateKey(state string) string {
+	return fmt.Sprintf("bot:sso:state:%v", state)
+}
+
+// ssoBindingKey is the cookie value of the browser that confirmed the link, only one browser gets to
+func ssoBindingKey(state string) string {
+	return fmt.Sprintf("bot:sso:state:%v:binding", state)
+}
+
+// characterTransferKey holds a characterTransfer until the owner releases the character or it runs out
+func characterTransferKey(characterId int) string {
+	return fmt.Sprintf("bot:character:%v:transfer", characterId)
+}
+
+// userCharactersKey is a hash of character id to LinkedCharacter
+func userCharactersKey(userId string) string {
+	return fmt.Sprintf("bot:user:%v:characters", userId)
+}
+
+// userMainKey is the character we show instead of the Discord mention
+func userMainKey(userId string) string {
+	return fmt.Sprintf("bot:user:%v:main", userId)
+}
+
+// characterOwnerKey stops two Discord accounts holding the same character
+func characterOwnerKey(characterId int) string {
+	return fmt.Sprintf("bot:character:%v:owner", characterId)
+}
+
+// applyDefaults fills in the Tranquility endpoints for anything left out
+func (config *SsoConfig) applyDefaults() {
+	if len(config.AuthorizeUrl) <= 0 {
+		config.AuthorizeUrl = DefaultSsoAuthorizeUrl
+	}
+
+	if len(config.TokenUrl) <= 0 {
+		config.TokenUrl = DefaultSsoTokenUrl
+	}
+
+	if len(config.JwksUrl) <= 0 {
+		config.JwksUrl = DefaultSsoJwksUrl
+	}
+
+	if len(config.Issuer) <= 0 {
+		config.Issuer = DefaultSsoIssuer
+	}
+}
+
+// ssoEnabled needs an application to log in with, somewhere to come back to and a key to keep tokens safe
+func ssoEnabled() bool {
+	return len(os.Getenv("EVE_SSO_CLIENT_ID")) > 0 && len(os.Getenv("HOSTED_URL")) > 0 && tokenKey() != nil
+}
+
+func ssoCallbackUrl() string {
+	return strings.TrimSuffix(os.Getenv("HOSTED_URL"), "/") + "/sso/callback"
+}
+
+// tokenKey is TOKEN_ENCRYPTION_KEY as 32 bytes of hex, nil if it isn't usable
+func tokenKey() *[32]byte {
+	raw, err := hex.DecodeString(os.Getenv("TOKEN_ENCRYPTION_KEY"))
+
+	if err != nil || len(raw) != 32 {
+		return nil
+	}
+
+	var key [32]byte
+	copy(key[:], raw)
+	return &key
+}
+
+// EncryptToken seals the token with a fresh nonce, which is kept on the front of the result
+func EncryptToken(key *[32]byte, token string) (string, error) {
+	var nonce [24]byte
+
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return "", err
+	}
+
+	sealed := secretbox.Seal(nonce[:], []byte(token), &nonce, key)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func DecryptToken(key *[32]byte, encrypted string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < 24 {
+		return "", errors.New("encrypted token is too short")
+	}
+
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+
+	token, ok := secretbox.Open(nil, sealed[24:], &nonce, key)
+
+	if !ok {
+		return "", errors.New("unable to decrypt token, has TOKEN_ENCRYPTION_KEY changed?")
+	}
+
+	return string(token), nil
+}
+
+// randomToken is n random bytes in a form that is safe to put in a url
+func randomToken(n int) (string, error) {
+	raw := make([]byte, n)
+
+	if _, err := io.ReadFull(rand.Reader, raw); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// pkceChallenge is the S256 code challenge for the verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// secureCookies is true when we're served over https, so cookies never go out in the clear
+func secureCookies() bool {
+	return strings.HasPrefix(os.Getenv("HOSTED_URL"), "https://")
+}
+
+// StartLink remembers who is linking and returns the url that sends them to the SSO
+func (server *Server) StartLink(user *discordgo.User) (string, error) {
+	if !ssoEnabled() {
+		return "", ErrSsoDisabled
+	}
+
+	state, err := randomToken(24)
+
+	if err != nil {
+		return "", err
+	}
+
+	verifier, err := randomToken(32)
+
+	if err != nil {
+		return "", err
+	}
+
+	bytes, err := json.Marshal(&ssoState{UserId: user.ID, UserName: discordUserName(user), Verifier: verifier})
+
+	if err != nil {
+		return "", err
+	}
+
+	if err = server.Redis.Set(ssoStateKey(state), string(bytes), ssoStateTTL).Err(); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%v/sso/login?state=%v", strings.TrimSuffix(os.Getenv("HOSTED_URL"), "/"), state), nil
+}
+
+// discordUserName is how the pilot appears in Discord, so they can tell it's their account
+func discordUserName(user *discordgo.User) string {
+	if len(user.Username) <= 0 {
+		return user.ID
+	}
+
+	if len(user.Discriminator) <= 0 || user.Discriminator == "0" {
+		return user.Username
+	}
+
+	return fmt.Sprintf("%v#%v", user.Username, user.Discriminator)
+}
+
+// getState looks at the state without using it up
+func (server *Server) getState(state string) (*ssoState, bool) {
+	if len(state) <= 0 {
+		return nil, false
+	}
+
+	cmd := server.Redis.Get(ssoStateKey(state))
+
+	if cmd.Err() != nil {
+		return nil, false
+	}
+
+	var parsed ssoState
+	if err := json.Unmarshal([]byte(cmd.Val()), &parsed); err != nil {
+		return nil, false
+	}
+
+	return &parsed, true
+}
+
+// takeState returns the state once, so a callback can't be replayed
+func (server *Server) takeState(state string) (*ssoState, bool) {
+	raw, ok := takeKey(server.Redis, ssoStateKey(state))
+
+	if !ok {
+		return nil, false
+	}
+
+	var parsed ssoState
+	if err := json.Unmarshal([]byte(raw), &parsed); err != nil {
+		return nil, false
+	}
+
+	return &parsed, true
+}
+
+// requestToken posts a grant to the token endpoint. The secret is optional since PKCE covers public clients.
+func (server *Server) requestToken(form url.Values) (*ssoTokenResponse, error) {
+	form.Set("client_id", os.Getenv("EVE_SSO_CLIENT_ID"))
+
+	request, err := http.NewRequest(http.MethodPost, server.Config.SSO.TokenUrl, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if secret := os.Getenv("EVE_SSO_CLIENT_SECRET"); len(secret) > 0 {
+		request.SetBasicAuth(os.Getenv("EVE_SSO_CLIENT_ID"), secret)
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("SSO token request failed. Status: %v", resp.Status)
+	}
+
+	var token ssoTokenResponse
+	if err = json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// HasScope is true if the character was linked with the scope
+func (character *LinkedCharacter) HasScope(scope string) bool {
+	return Exists(strings.Fields(character.Scopes), scope)
+}
+
+// AccessToken returns a token for calling ESI as the character, refreshing it when it has run out.
+// The SSO can hand back a new refresh token, in which case that one replaces the stored one.
+func (server *Server) AccessToken(userId string, character *LinkedCharacter) (string, error) {
+	key := tokenKey()
+
+	if key == nil {
+		return "", ErrSsoDisabled
+	}
+
+	lock := refreshLock(character.Id)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if cached, ok := cachedAccessToken(character.Id); ok {
+		return cached, nil
+	}
+
+	refreshToken, err := DecryptToken(key, character.RefreshToken)
+
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+
+	token, err := server.requestToken(form)
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(token.RefreshToken) > 0 && token.RefreshToken != refreshToken {
+		if character.RefreshToken, err = EncryptToken(key, token.RefreshToken); err != nil {
+			return "", err
+		}
+
+		if err = server.SaveLinkedCharacter(userId, character); err != nil {
+			Log.Error("Unable to save refreshed token", LogFields{"user": userId, "character": character.Id, "error": err})
+		}
+	}
+
+	// Give ourselves a minute of slack so a token doesn't expire on the way to ESI
+	accessTokenLock.Lock()
+	accessTokens[character.Id] = &accessToken{
+		Token:     token.AccessToken,
+		ExpiresAt: time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute),
+	}
+	accessTokenLock.Unlock()
+
+	return token.AccessToken, nil
+}
+
+// GetLinkedCharacters returns the user's characters in name order
+func (server *Server) GetLinkedCharacters(userId string) []*LinkedCharacter {
+	characters := make([]*LinkedCharacter, 0)
+
+	for _, raw := range server.Redis.HGetAll(userCharactersKey(userId)).Val() {
+		var character LinkedCharacter
+
+		if err := json.Unmarshal([]byte(raw), &character); err != nil {
+			Log.Warn("Unable to parse linked character", LogFields{"user": userId, "error": err})
+			continue
+		}
+
+		characters = append(characters, &character)
+	}
+
+	sort.Slice(characters, func(i, j int) bool {
+		return characters[i].Name < characters[j].Name
+	})
+
+	return characters
+}
+
+func (server *Server) SaveLinkedCharacter(userId string, character *LinkedCharacter) error {
+	bytes, err := json.Marshal(character)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Redis.HSet(userCharactersKey(userId), strconv.Itoa(character.Id), string(bytes)).Err()
+}
+
+// newLinkedCharacter is the character the SSO vouched for, with its refresh token sealed
+func newLinkedCharacter(verified *ssoCharacter, refreshToken string) (*LinkedCharacter, error) {
+	encrypted, err := EncryptToken(tokenKey(), refreshToken)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LinkedCharacter{
+		Id:           verified.CharacterID,
+		Name:         verified.CharacterName,
+		RefreshToken: encrypted,
+		Scopes:       verified.Scopes,
+		LinkedAt:     time.Now().UTC(),
+	}, nil
+}
+
+// LinkCharacter stores the character against the user. If another account holds it, nothing changes and
+// ErrCharacterOwned comes back, the owner has to release it first.
+func (server *Server) LinkCharacter(userId string, character *LinkedCharacter) error {
+	bytes, err := json.Marshal(character)
+
+	if err != nil {
+		return err
+	}
+
+	ownerKey := characterOwnerKey(character.Id)
+	id := strconv.Itoa(character.Id)
+
+	// The owner key and the character are written together, so nobody can see one without the other
+	err = watchKey(server.Redis, ownerKey, func(tx *redis.Tx) error {
+		owner, err := tx.Get(ownerKey).Result()
+
+		if err != nil && err != redis.Nil {
+			return err
+		}
+
+		// Only trust the owner key if the owner still has the character, otherwise it's left over
+		if len(owner) > 0 && owner != userId && tx.HExists(userCharactersKey(owner), id).Val() {
+			return ErrCharacterOwned
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(ownerKey, userId, 0)
+			pipe.HSet(userCharactersKey(userId), id, string(bytes))
+			return nil
+		})
+
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The first character linked becomes the main
+	server.Redis.SetNX(userMainKey(userId), strconv.Itoa(character.Id), 0)
+	return nil
+}
+
+// RequestCharacterTransfer holds on to the character for userId and asks its owner to let it go
+func (server *Server) RequestCharacterTransfer(userId string, character *LinkedCharacter) error {
+	bytes, err := json.Marshal(&characterTransfer{UserId: userId, Character: character})
+
+	if err != nil {
+		return err
+	}
+
+	if err = server.Redis.Set(characterTransferKey(character.Id), string(bytes), characterTransferTTL).Err(); err != nil {
+		return err
+	}
+
+	owner := server.Redis.Get(characterOwnerKey(character.Id)).Val()
+
+	return server.SendDirectMessage(&discordgo.User{ID: owner}, fmt.Sprintf("<@%v> logged in as %v and wants to link it to their Discord account. If you've handed the character over, run !characters release %v within %v. If not, ignore this and change your EVE password.", userId, character.Name, character.Name, characterTransferTTL))
+}
+
+// ReleaseCharacter hands the character to whoever asked for it, false if nobody did
+func (server *Server) ReleaseCharacter(ownerId string, characterId int) (string, bool, error) {
+	raw, ok := takeKey(server.Redis, characterTransferKey(characterId))
+
+	if !ok {
+		return "", false, nil
+	}
+
+	var transfer characterTransfer
+	if err := json.Unmarshal([]byte(raw), &transfer); err != nil || transfer.Character == nil {
+		return "", false, err
+	}
+
+	server.UnlinkCharacter(ownerId, characterId)
+
+	if err := server.LinkCharacter(transfer.UserId, transfer.Character); err != nil {
+		return "", false, err
+	}
+
+	return transfer.UserId, true, nil
+}
+
+func (server *Server) UnlinkCharacter(userId string, characterId int) {
+	id := strconv.Itoa(characterId)
+
+	server.Redis.HDel(userCharactersKey(userId), id)
+
+	accessTokenLock.Lock()
+	delete(accessTokens, characterId)
+	accessTokenLock.Unlock()
+
+	// The character may have moved on to someone else already, only let go of it if it's still ours
+	ownerKey := characterOwnerKey(characterId)
+	err := watchKey(server.Redis, ownerKey, func(tx *redis.Tx) error {
+		if tx.Get(ownerKey).Val() != userId {
+			return nil
+		}
+
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Del(ownerKey)
+			return nil
+		})
+
+		return err
+	})
+
+	if err != nil {
+		Log.Warn("Unable to release character owner", LogFields{"user": userId, "character": characterId, "error": err})
+	}
+
+	if server.Redis.Get(userMainKey(userId)).Val() != id {
+		return
+	}
+
+	server.Redis.Del(userMainKey(userId))
+
+	if remaining := server.GetLinkedCharacters(userId); len(remaining) > 0 {
+		server.Redis.Set(userMainKey(userId), strconv.Itoa(remaining[0].Id), 0)
+	}
+}
+
+// MainCharacter is the character the user picked to be known as, nil if they haven't linked one
+func (server *Server) MainCharacter(userId string) *LinkedCharacter {
+	id := server.Redis.Get(userMainKey(userId)).Val()
+
+	if len(id) <= 0 {
+		return nil
+	}
+
+	raw := server.Redis.HGet(userCharactersKey(userId), id)
+
+	if raw.Err() != nil {
+		return nil
+	}
+
+	var character LinkedCharacter
+	if err := json.Unmarshal([]byte(raw.Val()), &character); err != nil {
+		return nil
+	}
+
+	return &character
+}
+
+// findLinkedCharacter matches the start of a character name, ignoring case
+func findLinkedCharacter(characters []*LinkedCharacter, name string) *LinkedCharacter {
+	name = strings.ToLower(strings.TrimSpace(name))
+
+	if len(name) <= 0 {
+		return nil
+	}
+
+	for _, character := range characters {
+		if strings.ToLower(character.Name) == name {
+			return character
+		}
+	}
+
+	for _, character := range characters {
+		if strings.HasPrefix(strings.ToLower(character.Name), name) {
+			return character
+		}
+	}
+
+	return nil
+}
+
+// setBindingCookie ties the link to this browser, an empty value clears it
+func setBindingCookie(c *gin.Context, value string) {
+	maxAge := int(ssoStateTTL / time.Second)
+	if len(value) <= 0 {
+		maxAge = -1
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     ssoBindingCookie,
+		Value:    value,
+		Path:     "/sso",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secureCookies(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ssoLogin shows which Discord account the character will be linked to before anything happens. The cookie it
+// sets has to come back with the confirmation, so the page can't be skipped by posting to us from elsewhere.
+func (server *Server) ssoLogin(c *gin.Context) {
+	state := c.Query("state")
+	parsed, ok := server.getState(state)
+
+	if !ok {
+		c.String(http.StatusBadRequest, "This link has expired, run !link in Discord again")
+		return
+	}
+
+	binding, err := randomToken(24)
+
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Unable to start linking, please try again")
+		return
+	}
+
+	setBindingCookie(c, binding)
+	c.Header("X-Frame-Options", "DENY")
+
+	renderDashboard(c, "sso_confirm", gin.H{
+		"Title":    "Link an EVE character",
+		"State":    state,
+		"Binding":  binding,
+		"UserName": parsed.UserName,
+	})
+}
+
+// ssoConfirm sends the pilot on to the SSO with a PKCE challenge for the state they were given
+func (server *Server) ssoConfirm(c *gin.Context) {
+	state := c.PostForm("state")
+	parsed, ok := server.getState(state)
+
+	if !ok {
+		c.String(http.StatusBadRequest, "This link has expired, run !link in Discord again")
+		return
+	}
+
+	binding, _ := c.Cookie(ssoBindingCookie)
+
+	if len(binding) <= 0 || subtle.ConstantTimeCompare([]byte(binding), []byte(c.PostForm("binding"))) != 1 {
+		c.String(http.StatusBadRequest, "Please open the link from Discord again and confirm from that page")
+		return
+	}
+
+	// First browser to confirm gets the link, anyone else holding the url is too late
+	if !server.Redis.SetNX(ssoBindingKey(state), binding, ssoStateTTL).Val() {
+		c.String(http.StatusBadRequest, "This link has already been used, run !link in Discord again")
+		return
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("redirect_uri", ssoCallbackUrl())
+	query.Set("client_id", os.Getenv("EVE_SSO_CLIENT_ID"))
+	query.Set("scope", strings.Join(server.Config.SSO.Scopes, " "))
+	query.Set("state", state)
+	query.Set("code_challenge", pkceChallenge(parsed.Verifier))
+	query.Set("code_challenge_method", "S256")
+
+	c.Redirect(http.StatusSeeOther, server.Config.SSO.AuthorizeUrl+"?"+query.Encode())
+}
+
+// ssoCallback swaps the code for tokens and links whichever character logged in, as long as it's the same browser
+// that confirmed the link
+func (server *Server) ssoCallback(c *gin.Context) {
+	state, ok := server.takeState(c.Query("state"))
+
+	if !ok {
+		c.String(http.StatusBadRequest, "This link has expired, run !link in Discord again")
+		return
+	}
+
+	binding, _ := takeKey(server.Redis, ssoBindingKey(c.Query("state")))
+	cookie, _ := c.Cookie(ssoBindingCookie)
+	setBindingCookie(c, "")
+
+	if len(binding) <= 0 || subtle.ConstantTimeCompare([]byte(binding), []byte(cookie)) != 1 {
+		RequestLog(c).Warn("SSO callback from a browser that didn't confirm the link", LogFields{"user": state.UserId})
+		c.String(http.StatusBadRequest, "This login was started in a different browser, run !link in Discord again")
+		return
+	}
+
+	if len(c.Query("code")) <= 0 {
+		c.String(http.StatusBadRequest, "The SSO didn't send a code back, run !link in Discord again")
+		return
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", c.Query("code"))
+	form.Set("code_verifier", state.Verifier)
+	form.Set("redirect_uri", ssoCallbackUrl())
+
+	token, err := server.requestToken(form)
+
+	if err != nil {
+		RequestLog(c).Warn("Unable to exchange SSO code", LogFields{"user": state.UserId, "error": err})
+		c.String(http.StatusBadGateway, "Unable to log in with EVE, please try again")
+		return
+	}
+
+	verified, err := server.verifyToken(token.AccessToken)
+
+	if err != nil {
+		RequestLog(c).Warn("Unable to verify SSO token", LogFields{"user": state.UserId, "error": err})
+		c.String(http.StatusBadGateway, "Unable to log in with EVE, please try again")
+		return
+	}
+
+	character, err := newLinkedCharacter(verified, token.RefreshToken)
+
+	if err == nil {
+		err = server.LinkCharacter(state.UserId, character)
+	}
+
+	if err == ErrCharacterOwned {
+		if err = server.RequestCharacterTransfer(state.UserId, character); err != nil {
+			RequestLog(c).Warn("Unable to ask the owner to release a character", LogFields{"user": state.UserId, "character_id": verified.CharacterID, "error": err})
+		}
+
+		c.String(http.StatusConflict, fmt.Sprintf("%v is linked to another Discord account. We've asked that account to release it, you'll get a DM once they do.", verified.CharacterName))
+		return
+	}
+
+	if err != nil {
+		RequestLog(c).Error("Unable to link character", LogFields{"user": state.UserId, "character_id": verified.CharacterID, "error": err})
+		c.String(http.StatusInternalServerError, "Unable to save your character, please try again")
+		return
+	}
+
+	server.SendDirectMessage(&discordgo.User{ID: state.UserId}, fmt.Sprintf("Linked %v to your Discord account", verified.CharacterName))
+	c.String(http.StatusOK, fmt.Sprintf("Linked %v. You can close this page and head back to Discord.", verified.CharacterName))
+}
+
+// HandleLink DMs a fresh SSO link so nobody else can use it
+func (server *Server) HandleLink(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	link, err := server.StartLink(message.Author)
+
+	if err != nil {
+		logger.Error("Unable to start character link", LogFields{"error": err})
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to link characters. %v", err))
+		return
+	}
+
+	if err = server.SendDirectMessage(message.Author, fmt.Sprintf("Log in with the character you want to link here, the link works for %v. Don't share it, and check the page names your Discord account before you continue: %v", ssoStateTTL, link)); err != nil {
+		server.SendMessage(message.ChannelID, "I couldn't DM you the link. Allow DMs from server members and try again")
+	}
+}
+
+// HandleCharacters is !characters, !characters main <name>, !characters unlink <name> and !characters release <name>
+func (server *Server) HandleCharacters(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args := commandArgs(message)
+	characters := server.GetLinkedCharacters(message.Author.ID)
+
+	if len(args) <= 0 {
+		if len(characters) <= 0 {
+			server.SendMessage(message.ChannelID, "You haven't linked any characters, use !link to add one")
+			return
+		}
+
+		mainCharacter := server.MainCharacter(message.Author.ID)
+		names := make([]string, 0, len(characters))
+
+		for _, character := range characters {
+			if mainCharacter != nil && mainCharacter.Id == character.Id {
+				names = append(names, character.Name+" (main)")
+			} else {
+				names = append(names, character.Name)
+			}
+		}
+
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Linked characters: %v", strings.Join(names, ", ")))
+		return
+	}
+
+	if len(args) < 2 {
+		server.SendMessage(message.ChannelID, "Usage: !characters [main <name> | unlink <name> | release <name>]")
+		return
+	}
+
+	character := findLinkedCharacter(characters, strings.Join(args[1:], " "))
+
+	if character == nil {
+		server.SendMessage(message.ChannelID, fmt.Sprintf("You don't have a character called %v linked", strings.Join(args[1:], " ")))
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "main":
+		server.Redis.Set(userMainKey(message.Author.ID), strconv.Itoa(character.Id), 0)
+		server.SendMessage(message.ChannelID, fmt.Sprintf("You'll show up as %v from now on", character.Name))
+	case "unlink":
+		server.UnlinkCharacter(message.Author.ID, character.Id)
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Unlinked %v", character.Name))
+	case "release":
+		userId, released, err := server.ReleaseCharacter(message.Author.ID, character.Id)
+
+		if err != nil {
+			logger.Error("Unable to release character", LogFields{"character": character.Id, "error": err})
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Unable to release %v. Error: %v", character.Name, err))
+			return
+		}
+
+		if !released {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Nobody has asked to link %v in the last %v", character.Name, characterTransferTTL))
+			return
+		}
+
+		server.SendDirectMessage(&discordgo.User{ID: userId}, fmt.Sprintf("%v has been released to you and is now linked to your Discord account", character.Name))
+		server.SendMessage(message.ChannelID, fmt.Sprintf("Released %v", character.Name))
+	default:
+		server.SendMessage(message.ChannelID, "Usage: !characters [main <name> | unlink <name> | release <name>]")
+	}
+}
+
+// ssoTemplates are added to the dashboard's set so they share its layout
+var ssoTemplates = template.Must(dashboardTemplates.Parse(`
+{{define "sso_confirm"}}{{template "header" .}}
+<p>You're about to link an EVE character to the Discord account <strong>{{.UserName}}</strong>.</p>
+<p>If that isn't your account, close this page. Someone may have sent you their link to get hold of your character.</p>
+<form method="post" action="/sso/login">
+<input type="hidden" name="state" value="{{.State}}">
+<input type="hidden" name="binding" value="{{.Binding}}">
+<button>Continue to EVE Online</button>
+</form>
+{{template "footer" .}}{{end}}
+`))
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTakeKeyOnlyOnce(t *testing.T) {
+	client, stop := newTestRedis(t)
+	defer stop()
+
+	client.Set("once", "value", 0)
+
+	if value, ok := takeKey(client, "once"); !ok || value != "value" {
+		t.Fatalf("takeKey = %q, %v", value, ok)
+	}
+
+	if _, ok := takeKey(client, "once"); ok {
+		t.Error("takeKey handed out the same key twice")
+	}
+}
+
+func TestLinkCharacterKeepsOwner(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	character := &LinkedCharacter{Id: 90000001, Name: "Test Pilot"}
+
+	if err := server.LinkCharacter("owner", character); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.LinkCharacter("someone", character); err != ErrCharacterOwned {
+		t.Fatalf("linking another account's character = %v, want ErrCharacterOwned", err)
+	}
+
+	if owner := server.Redis.Get(characterOwnerKey(character.Id)).Val(); owner != "owner" {
+		t.Errorf("owner changed to %q", owner)
+	}
+
+	// Linking again from the same account just refreshes it
+	if err := server.LinkCharacter("owner", character); err != nil {
+		t.Errorf("relinking = %v", err)
+	}
+}
+
+func TestLinkCharacterTakesStaleOwner(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	// Left over from before the owner's characters were cleared out
+	server.Redis.Set(characterOwnerKey(90000001), "gone", 0)
+
+	if err := server.LinkCharacter("someone", &LinkedCharacter{Id: 90000001, Name: "Test Pilot"}); err != nil {
+		t.Fatalf("LinkCharacter = %v", err)
+	}
+
+	if main := server.MainCharacter("someone"); main == nil || main.Id != 90000001 {
+		t.Errorf("MainCharacter = %+v", main)
+	}
+}
+
+func TestLinkCharacterAtOnce(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	var wait sync.WaitGroup
+	results := make(chan error, 10)
+
+	for i := 0; i < cap(results); i++ {
+		wait.Add(1)
+
+		go func(userId string) {
+			defer wait.Done()
+			results <- server.LinkCharacter(userId, &LinkedCharacter{Id: 90000001, Name: "Test Pilot"})
+		}(fmt.Sprintf("user%v", i))
+	}
+
+	wait.Wait()
+	close(results)
+
+	linked := 0
+	for err := range results {
+		if err == nil {
+			linked++
+		} else if err != ErrCharacterOwned {
+			t.Errorf("LinkCharacter = %v", err)
+		}
+	}
+
+	if linked != 1 {
+		t.Errorf("%v accounts linked the character, want 1", linked)
+	}
+}
+
+func TestUnlinkCharacterKeepsNewOwner(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	character := &LinkedCharacter{Id: 90000001, Name: "Test Pilot"}
+	server.LinkCharacter("owner", character)
+
+	// Someone else picked it up while the old owner's copy was still around
+	server.Redis.Set(characterOwnerKey(character.Id), "someone", 0)
+	server.UnlinkCharacter("owner", character.Id)
+
+	if owner := server.Redis.Get(characterOwnerKey(character.Id)).Val(); owner != "someone" {
+		t.Errorf("owner = %q, want someone", owner)
+	}
+
+	server.UnlinkCharacter("someone", character.Id)
+
+	if server.Redis.Exists(characterOwnerKey(character.Id)).Val() != 0 {
+		t.Error("owner key left behind after the owner unlinked")
+	}
+}
+
+func TestReleaseCharacter(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	character := &LinkedCharacter{Id: 90000001, Name: "Test Pilot"}
+	server.LinkCharacter("owner", character)
+
+	if _, released, _ := server.ReleaseCharacter("owner", character.Id); released {
+		t.Fatal("released a character nobody asked for")
+	}
+
+	bytes, _ := json.Marshal(&characterTransfer{UserId: "someone", Character: character})
+	server.Redis.Set(characterTransferKey(character.Id), string(bytes), characterTransferTTL)
+
+	userId, released, err := server.ReleaseCharacter("owner", character.Id)
+
+	if err != nil || !released || userId != "someone" {
+		t.Fatalf("ReleaseCharacter = %q, %v, %v", userId, released, err)
+	}
+
+	if owner := server.Redis.Get(characterOwnerKey(character.Id)).Val(); owner != "someone" {
+		t.Errorf("owner = %q, want someone", owner)
+	}
+
+	if len(server.GetLinkedCharacters("owner")) != 0 {
+		t.Error("previous owner still has the character")
+	}
+}
+
+func TestSsoLoginBindsBrowser(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	gin.SetMode(gin.TestMode)
+	server.Config.SSO.applyDefaults()
+
+	router := gin.New()
+	router.GET("/sso/login", server.ssoLogin)
+	router.POST("/sso/login", server.ssoConfirm)
+	router.GET("/sso/callback", server.ssoCallback)
+
+	bytes, _ := json.Marshal(&ssoState{UserId: "1", UserName: "pilot#0001", Verifier: "verifier"})
+	server.Redis.Set(ssoStateKey("state"), string(bytes), ssoStateTTL)
+
+	// The page names the Discord account and sets the cookie the confirmation has to match
+	page := httptest.NewRecorder()
+	router.ServeHTTP(page, httptest.NewRequest("GET", "/sso/login?state=state", nil))
+
+	if page.Code != http.StatusOK || !strings.Contains(page.Body.String(), "pilot#0001") {
+		t.Fatalf("login page = %v: %v", page.Code, page.Body.String())
+	}
+
+	cookies := page.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != ssoBindingCookie || !cookies[0].HttpOnly {
+		t.Fatalf("cookies = %+v", cookies)
+	}
+
+	binding := regexp.MustCompile(`name="binding" value="([^"]+)"`).FindStringSubmatch(page.Body.String())
+	if binding == nil || binding[1] != cookies[0].Value {
+		t.Fatalf("form binding %v doesn't match the cookie", binding)
+	}
+
+	confirm := func(cookie string) *httptest.ResponseRecorder {
+		form := url.Values{"state": {"state"}, "binding": {binding[1]}}
+		request := httptest.NewRequest("POST", "/sso/login", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(cookie) > 0 {
+			request.AddCookie(&http.Cookie{Name: ssoBindingCookie, Value: cookie})
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// A form posted from another site doesn't come with the cookie
+	if response := confirm(""); response.Code != http.StatusBadRequest {
+		t.Errorf("confirm without the cookie = %v", response.Code)
+	}
+
+	response := confirm(binding[1])
+	if response.Code != http.StatusSeeOther || !strings.HasPrefix(response.Header().Get("Location"), server.Config.SSO.AuthorizeUrl) {
+		t.Fatalf("confirm = %v %v", response.Code, response.Header().Get("Location"))
+	}
+
+	// Only the first browser gets to confirm
+	if response := confirm(binding[1]); response.Code != http.StatusBadRequest {
+		t.Errorf("second confirm = %v", response.Code)
+	}
+
+	// A callback in a browser that didn't confirm is turned away and uses up the state
+	callback := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/sso/callback?state=state&code=code", nil)
+	request.AddCookie(&http.Cookie{Name: ssoBindingCookie, Value: "someone-else"})
+	router.ServeHTTP(callback, request)
+
+	if callback.Code != http.StatusBadRequest {
+		t.Errorf("callback from another browser = %v", callback.Code)
+	}
+
+	if _, ok := server.getState("state"); ok {
+		t.Error("state survived a rejected callback")
+	}
+}
+
+func TestAccessTokenRefreshesCharactersSeparately(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	previousKey := os.Getenv("TOKEN_ENCRYPTION_KEY")
+	os.Setenv("TOKEN_ENCRYPTION_KEY", strings.Repeat("ab", 32))
+	defer os.Setenv("TOKEN_ENCRYPTION_KEY", previousKey)
+
+	slowStarted := make(chan bool)
+	releaseSlow := make(chan bool)
+	var requests int32
+
+	sso := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		refreshToken := r.PostFormValue("refresh_token")
+
+		if refreshToken == "slow" {
+			slowStarted <- true
+			<-releaseSlow
+		}
+
+		json.NewEncoder(w).Encode(&ssoTokenResponse{AccessToken: "access-" + refreshToken, ExpiresIn: 1200})
+	}))
+	defer sso.Close()
+	server.Config.SSO.TokenUrl = sso.URL
+
+	character := func(id int, refreshToken string) *LinkedCharacter {
+		encrypted, err := EncryptToken(tokenKey(), refreshToken)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &LinkedCharacter{Id: id, Name: refreshToken, RefreshToken: encrypted}
+	}
+
+	slow, fast := character(90000011, "slow"), character(90000012, "fast")
+	slowDone := make(chan string)
+
+	go func() {
+		token, _ := server.AccessToken("someone", slow)
+		slowDone <- token
+	}()
+	<-slowStarted
+
+	fastDone := make(chan string)
+	go func() {
+		token, _ := server.AccessToken("owner", fast)
+		fastDone <- token
+	}()
+
+	select {
+	case token := <-fastDone:
+		if token != "access-fast" {
+			t.Errorf("fast token = %q", token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("one character's refresh held up another's")
+	}
+
+	close(releaseSlow)
+
+	if token := <-slowDone; token != "access-slow" {
+		t.Errorf("slow token = %q", token)
+	}
+
+	// Both are cached now, so asking again doesn't go back to the SSO
+	server.AccessToken("owner", fast)
+	server.AccessToken("someone", slow)
+
+	if count := atomic.LoadInt32(&requests); count != 2 {
+		t.Errorf("SSO asked %v times, want 2", count)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Proxies like to close connections that go quiet
+	streamKeepAlive = time.Second * 30
+
+	// Most events we replay to a client reconnecting with Last-Event-ID
+	maxReplayedEvents = 100
+
+	websocketWriteTimeout = time.Second * 10
+
+	// Streams one API key can have open at once
+	maxStreamsPerKey = 5
+)
+
+// streamCounter is how many streams each API key has open
+type streamCounter struct {
+	lock sync.Mutex
+	open map[string]int
+}
+
+var openStreams = &streamCounter{open: make(map[string]int)}
+
+// Acquire takes one of the key's streams, false when it already has the limit open
+func (counter *streamCounter) Acquire(key string, limit int) bool {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if counter.open[key] >= limit {
+		return false
+	}
+
+	counter.open[key]++
+	return true
+}
+
+func (counter *streamCounter) Release(key string) {
+	counter.lock.Lock()
+	defer counter.lock.Unlock()
+
+	if counter.open[key]--; counter.open[key] <= 0 {
+		delete(counter.open, key)
+	}
+}
+
+// limitStreams holds one of the key's streams for as long as the handler runs
+func (server *Server) limitStreams(c *gin.Context) {
+	key := c.GetString("api_key")
+
+	if !openStreams.Acquire(key, maxStreamsPerKey) {
+		apiError(c, http.StatusTooManyRequests, fmt.Sprintf("This key already has %d streams open", maxStreamsPerKey))
+		return
+	}
+	defer openStreams.Release(key)
+
+	c.Next()
+}
+
+// checkOrigin lets through clients that aren't browsers, our own pages and the origins in api_allowed_origins
+func (server *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if len(origin) <= 0 {
+		return true
+	}
+
+	parsed, err := url.Parse(origin)
+
+	if err != nil {
+		return false
+	}
+
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+
+	for _, allowed := range server.Config.ApiAllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventFilter is ?types=spawned,despawned, or every event when it isn't given
+func eventFilter(c *gin.Context) func(event *IncursionEvent) bool {
+	types := strings.Split(c.Query("types"), ",")
+
+	if len(c.Query("types")) <= 0 {
+		return func(event *IncursionEvent) bool {
+			return true
+		}
+	}
+
+	return func(event *IncursionEvent) bool {
+		return Exists(types, string(event.Type))
+	}
+}
+
+// missedEvents are the events after lastId, oldest first, so a client that dropped can catch up
+func (server *Server) missedEvents(lastId string) []*IncursionEvent {
+	id, err := strconv.ParseInt(lastId, 10, 64)
+
+	if err != nil {
+		return nil
+	}
+
+	recent := server.GetEvents(0, maxReplayedEvents)
+	missed := make([]*IncursionEvent, 0)
+
+	for i := len(recent) - 1; i >= 0; i-- {
+		if recent[i].Id > id {
+			missed = append(missed, recent[i])
+		}
+	}
+
+	return missed
+}
+
+// streamEventsSSE is /api/v1/events/stream, one server-sent event per incursion event named after its type
+func (server *Server) streamEventsSSE(c *gin.Context) {
+	wanted := eventFilter(c)
+	events := server.Events.Subscribe()
+	defer server.Events.Unsubscribe(events)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stop nginx and friends holding on to events
+	c.Header("X-Accel-Buffering", "no")
+
+	send := func(event *IncursionEvent) {
+		c.Render(-1, sse.Event{
+			Id:    strconv.FormatInt(event.Id, 10),
+			Event: string(event.Type),
+			Data:  event,
+		})
+		c.Writer.Flush()
+	}
+
+	lastId := c.GetHeader("Last-Event-ID")
+	if len(lastId) <= 0 {
+		lastId = c.Query("last_event_id")
+	}
+
+	for _, event := range server.missedEvents(lastId) {
+		if wanted(event) {
+			send(event)
+		}
+	}
+
+	c.Render(-1, sse.Event{Event: "ready", Data: gin.H{"subscribers": server.Events.Count()}})
+	c.Writer.Flush()
+
+	clientGone := c.Writer.CloseNotify()
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-clientGone:
+			return
+		case event := <-events:
+			if wanted(event) {
+				send(event)
+			}
+		case <-keepAlive.C:
+			c.Render(-1, sse.Event{Event: "ping", Data: time.Now().UTC().Format(time.RFC3339)})
+			c.Writer.Flush()
+		}
+	}
+}
+
+// streamEventsWebsocket is /api/v1/events/ws, each event is sent as a JSON text message
+func (server *Server) streamEventsWebsocket(c *gin.Context) {
+	upgrader := websocket.Upgrader{CheckOrigin: server.checkOrigin}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+
+	if err != nil {
+		RequestLog(c).Warn("Unable to upgrade event stream to a websocket", LogFields{"error": err})
+		return
+	}
+	defer conn.Close()
+
+	wanted := eventFilter(c)
+	events := server.Events.Subscribe()
+	defer server.Events.Unsubscribe(events)
+
+	// We don't expect anything from the client, but reading is how we find out it went away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(event *IncursionEvent) bool {
+		conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+		return conn.WriteJSON(event) == nil
+	}
+
+	for _, event := range server.missedEvents(c.Query("last_event_id")) {
+		if wanted(event) && !send(event) {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event := <-events:
+			if wanted(event) && !send(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				return
+			}
+		}
+	}
+}
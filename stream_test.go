@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestStreamTickets(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	server.Config.ApiRateLimit = 100
+	server.Redis.HSet(apiKeysKey, hashApiKey("secret"), `{"name":"test"}`)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	api := router.Group("/api/v1", server.requireApiKey)
+	api.POST("/events/tickets", server.apiStreamTicket)
+	api.GET("/events", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString("api_key"))
+	})
+
+	get := func(path string) int {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder.Code
+	}
+
+	// Keys in the query string end up in logs, so they don't work there
+	if code := get("/api/v1/events?api_key=secret"); code != http.StatusUnauthorized {
+		t.Errorf("key in the query string = %v, want 401", code)
+	}
+
+	request := httptest.NewRequest("POST", "/api/v1/events/tickets", nil)
+	request.Header.Set("X-API-Key", "secret")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	var created struct {
+		Ticket string `json:"ticket"`
+	}
+
+	if err := json.Unmarshal(recorder.Body.Bytes(), &created); recorder.Code != http.StatusCreated || err != nil {
+		t.Fatalf("ticket = %v: %v", recorder.Code, recorder.Body.String())
+	}
+
+	if code := get("/api/v1/events?ticket=" + created.Ticket); code != http.StatusOK {
+		t.Errorf("ticket = %v, want 200", code)
+	}
+
+	if code := get("/api/v1/events?ticket=" + created.Ticket); code != http.StatusUnauthorized {
+		t.Errorf("used ticket = %v, want 401", code)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	server, _, stop := newTestServer(t)
+	defer stop()
+
+	server.Config.ApiAllowedOrigins = []string{"https://allowed.example.com/"}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"https://bot.example.com", true},
+		{"https://allowed.example.com", true},
+		{"https://evil.example.com", false},
+		{"https://bot.example.com.evil.example.com", false},
+	}
+
+	for _, test := range tests {
+		request := httptest.NewRequest("GET", "https://bot.example.com/api/v1/events/ws", nil)
+		if len(test.origin) > 0 {
+			request.Header.Set("Origin", test.origin)
+		}
+
+		if ok := server.checkOrigin(request); ok != test.want {
+			t.Errorf("checkOrigin(%q) = %v, want %v", test.origin, ok, test.want)
+		}
+	}
+}
+
+func TestStreamCounter(t *testing.T) {
+	counter := &streamCounter{open: make(map[string]int)}
+
+	for i := 0; i < 2; i++ {
+		if !counter.Acquire("key", 2) {
+			t.Fatalf("stream %d was refused", i+1)
+		}
+	}
+
+	if counter.Acquire("key", 2) {
+		t.Error("a third stream was allowed")
+	}
+
+	if !counter.Acquire("other", 2) {
+		t.Error("another key was refused")
+	}
+
+	counter.Release("key")
+
+	if !counter.Acquire("key", 2) {
+		t.Error("a closed stream wasn't given back")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TheraConnection is a single wormhole from a wormhole hub (Thera, or Turnur) into k-space.
+// The fields match EVE-Scout's public signatures feed.
+type TheraConnection struct {
+	HubSystemId   int       `json:"out_system_id"`
+	HubSystemName string    `json:"out_system_name"`
+	SystemId      int       `json:"in_system_id"`
+	SystemName    string    `json:"in_system_name"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// TheraShortcut is the best way to get somewhere by going through a hub instead of taking the gates
+type TheraShortcut struct {
+	Jumps   int
+	HubName string
+	Entry   TheraConnection
+	Exit    TheraConnection
+}
+
+// TheraFeed keeps the latest known connections. It's refreshed by the scheduler and read by message rendering.
+type TheraFeed struct {
+	Source string
+
+	lock        sync.RWMutex
+	connections []TheraConnection
+}
+
+func NewTheraFeed(source string) *TheraFeed {
+	return &TheraFeed{
+		Source:      source,
+		connections: make([]TheraConnection, 0),
+	}
+}
+
+func (feed *TheraFeed) Enabled() bool {
+	return feed != nil && len(feed.Source) > 0
+}
+
+// Refresh reloads the connections from the configured url or file. On failure we keep what we had.
+func (feed *TheraFeed) Refresh(logger *Logger) {
+	if !feed.Enabled() {
+		return
+	}
+
+	contents, err := readTheraSource(feed.Source)
+
+	if err != nil {
+		logger.Warn("Unable to refresh Thera connections", LogFields{"source": feed.Source, "error": err})
+		return
+	}
+
+	var connections []TheraConnection
+
+	if err = json.Unmarshal(contents, &connections); err != nil {
+		logger.Warn("Malformed Thera connections", LogFields{"source": feed.Source, "error": err})
+		return
+	}
+
+	feed.lock.Lock()
+	feed.connections = connections
+	feed.lock.Unlock()
+
+	logger.Info("Loaded Thera connections", LogFields{"count": len(connections)})
+}
+
+// Connections returns the ones that haven't expired yet
+func (feed *TheraFeed) Connections() []TheraConnection {
+	now := time.Now()
+
+	feed.lock.RLock()
+	defer feed.lock.RUnlock()
+
+	alive := make([]TheraConnection, 0, len(feed.connections))
+	for _, connection := range feed.connections {
+		if connection.ExpiresAt.IsZero() || connection.ExpiresAt.After(now) {
+			alive = append(alive, connection)
+		}
+	}
+
+	return alive
+}
+
+func readTheraSource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	resp, err := http.DefaultClient.Get(source)
+
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Shortcut finds the shortest trip from src to dst that goes in and out of the same hub.
+// Jumps into and out of the hub count as one jump each. Returns nil if there is no way through.
+func (universe *Universe) Shortcut(src, dst int, options RouteOptions, connections []TheraConnection) *TheraShortcut {
+	if universe == nil || len(connections) < 2 {
+		return nil
+	}
+
+	fromSrc := universe.Jumps(src, options)
+	// Gates go both ways, so jumps out from the destination are jumps in to it
+	toDst := universe.Jumps(dst, options)
+
+	var best *TheraShortcut
+
+	for _, entry := range connections {
+		in, ok := fromSrc[entry.SystemId]
+
+		if !ok {
+			continue
+		}
+
+		for _, exit := range connections {
+			if exit.HubSystemId != entry.HubSystemId || exit.SystemId == entry.SystemId {
+				continue
+			}
+
+			out, ok := toDst[exit.SystemId]
+
+			if !ok {
+				continue
+			}
+
+			jumps := in + 2 + out
+
+			if best == nil || jumps < best.Jumps {
+				best = &TheraShortcut{
+					Jumps:   jumps,
+					HubName: entry.HubSystemName,
+					Entry:   entry,
+					Exit:    exit,
+				}
+			}
+		}
+	}
+
+	return best
+}
+
+// DescribeShortcutForGuild is appended to the jump count when a hub beats the gates
+func (server *Server) DescribeShortcutForGuild(settings *GuildSettings, incursion *EsiIncursion, gateJumps int) string {
+	if !server.Thera.Enabled() {
+		return ""
+	}
+
+	shortcut := server.Universe.Shortcut(settings.HomeSystemId, incursion.StagingSolarSystemId, settings.RouteOptions(), server.Thera.Connections())
+
+	if shortcut == nil || (gateJumps >= 0 && shortcut.Jumps >= gateJumps) {
+		return ""
+	}
+
+	return fmt.Sprintf(", or %v via %v through %v -> %v", shortcut.Jumps, shortcut.HubName, shortcut.Entry.SystemName, shortcut.Exit.SystemName)
+}
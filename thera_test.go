@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testSystemThera  = 31000005
+	testSystemTurnur = 30002086
+)
+
+func theraConnection(hub, system int, name string, expiresAt time.Time) TheraConnection {
+	hubName := "Thera"
+	if hub == testSystemTurnur {
+		hubName = "Turnur"
+	}
+
+	return TheraConnection{HubSystemId: hub, HubSystemName: hubName, SystemId: system, SystemName: name, ExpiresAt: expiresAt}
+}
+
+func TestShortcut(t *testing.T) {
+	universe := newTestUniverse()
+	later := time.Now().Add(time.Hour)
+
+	home := theraConnection(testSystemThera, testSystemHome, "Home", later)
+	staging := theraConnection(testSystemThera, testSystemStaging, "Staging", later)
+	hub := theraConnection(testSystemTurnur, testSystemHub, "Hub", later)
+	extra := theraConnection(testSystemTurnur, testSystemExtra, "Extra", later)
+	stagingTurnur := theraConnection(testSystemTurnur, testSystemStaging, "Staging", later)
+
+	tests := []struct {
+		name        string
+		connections []TheraConnection
+		options     RouteOptions
+		jumps       int
+		entry       int
+		exit        int
+	}{
+		{"straight through", []TheraConnection{home, staging}, RouteOptions{}, 2, testSystemHome, testSystemStaging},
+		{"picks the shorter hub", []TheraConnection{hub, extra, home, staging}, RouteOptions{}, 2, testSystemHome, testSystemStaging},
+		{"gates on either side", []TheraConnection{hub, extra}, RouteOptions{}, 4, testSystemHub, testSystemExtra},
+		{"gates on either side, securely", []TheraConnection{hub, stagingTurnur}, RouteOptions{Preference: RouteSecure}, 3, testSystemHub, testSystemStaging},
+		{"entry and exit on different hubs", []TheraConnection{home, stagingTurnur}, RouteOptions{}, -1, 0, 0},
+		{"only one connection", []TheraConnection{home}, RouteOptions{}, -1, 0, 0},
+		{"entry and exit can't be the same hole", []TheraConnection{home, home}, RouteOptions{}, -1, 0, 0},
+		{"hole into a system we don't know", []TheraConnection{theraConnection(testSystemThera, 30009999, "Nowhere", later), staging}, RouteOptions{}, -1, 0, 0},
+	}
+
+	for _, test := range tests {
+		shortcut := universe.Shortcut(testSystemHome, testSystemStaging, test.options, test.connections)
+
+		if test.jumps < 0 {
+			if shortcut != nil {
+				t.Errorf("%v: got %+v, want no shortcut", test.name, shortcut)
+			}
+			continue
+		}
+
+		if shortcut == nil {
+			t.Errorf("%v: got no shortcut", test.name)
+			continue
+		}
+
+		if shortcut.Jumps != test.jumps || shortcut.Entry.SystemId != test.entry || shortcut.Exit.SystemId != test.exit {
+			t.Errorf("%v: got %d jumps through %v -> %v, want %d through %v -> %v", test.name, shortcut.Jumps, shortcut.Entry.SystemId, shortcut.Exit.SystemId, test.jumps, test.entry, test.exit)
+		}
+	}
+
+	var missing *Universe
+	if shortcut := missing.Shortcut(testSystemHome, testSystemStaging, RouteOptions{}, []TheraConnection{home, staging}); shortcut != nil {
+		t.Errorf("got %+v without a universe", shortcut)
+	}
+}
+
+func TestTheraConnectionsExpire(t *testing.T) {
+	now := time.Now()
+
+	feed := NewTheraFeed("unused")
+	feed.connections = []TheraConnection{
+		theraConnection(testSystemThera, testSystemHome, "Home", now.Add(time.Hour)),
+		theraConnection(testSystemThera, testSystemHub, "Hub", now.Add(-time.Minute)),
+		theraConnection(testSystemThera, testSystemStaging, "Staging", time.Time{}),
+	}
+
+	connections := feed.Connections()
+
+	if len(connections) != 2 || connections[0].SystemId != testSystemHome || connections[1].SystemId != testSystemStaging {
+		t.Errorf("Connections = %+v, want Home and Staging", connections)
+	}
+}
+
+func TestTheraRefresh(t *testing.T) {
+	body := fmt.Sprintf(`[
+		{"out_system_id": %d, "out_system_name": "Thera", "in_system_id": %d, "in_system_name": "Home", "expires_at": %q},
+		{"out_system_id": %d, "out_system_name": "Thera", "in_system_id": %d, "in_system_name": "Hub", "expires_at": %q}
+	]`, testSystemThera, testSystemHome, time.Now().Add(time.Hour).Format(time.RFC3339), testSystemThera, testSystemHub, time.Now().Add(-time.Hour).Format(time.RFC3339))
+
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	feed := NewTheraFeed(server.URL)
+	feed.Refresh(Log)
+
+	if connections := feed.Connections(); len(connections) != 1 || connections[0].SystemName != "Home" {
+		t.Fatalf("Connections = %+v, want Home", connections)
+	}
+
+	// A failed refresh keeps what we had
+	failing = true
+	feed.Refresh(Log)
+
+	if connections := feed.Connections(); len(connections) != 1 {
+		t.Errorf("Connections after a failed refresh = %+v, want Home", connections)
+	}
+
+	file, err := ioutil.TempFile("", "thera")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	file.WriteString("not json")
+	file.Close()
+
+	feed.Source = file.Name()
+	feed.Refresh(Log)
+
+	if connections := feed.Connections(); len(connections) != 1 {
+		t.Errorf("Connections after a malformed refresh = %+v, want Home", connections)
+	}
+
+	if err = ioutil.WriteFile(file.Name(), []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	feed.Refresh(Log)
+
+	if connections := feed.Connections(); len(connections) != 0 {
+		t.Errorf("Connections from a file = %+v, want none", connections)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"compress/bzip2"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The Fuzzwork CSV export of the SDE (https://www.fuzzwork.co.uk/dump/latest/) ships one file per table.
+// These are the tables we need, either plain or bzip2'd.
+const (
+	DefaultSdePath = "sde"
+
+	sdeRegionsFile        = "mapRegions.csv"
+	sdeConstellationsFile = "mapConstellations.csv"
+	sdeSystemsFile        = "mapSolarSystems.csv"
+	sdeJumpsFile          = "mapSolarSystemJumps.csv"
+	sdeStationsFile       = "staStations.csv"
+)
+
+type UniverseRegion struct {
+	Id   int
+	Name string
+}
+
+type UniverseConstellation struct {
+	Id       int
+	Name     string
+	RegionId int
+	Systems  []int
+}
+
+type UniverseSystem struct {
+	Id              int
+	Name            string
+	ConstellationId int
+	RegionId        int
+	SecurityStatus  float32
+	SecurityClass   string
+	// Systems connected to this one by a stargate
+	Neighbours []int
+	Stations   []int
+}
+
+// Universe is the static map of New Eden. It's loaded once at startup and never written to after that,
+// so it's safe to read from anywhere.
+type Universe struct {
+	Regions        map[int]*UniverseRegion
+	Constellations map[int]*UniverseConstellation
+	Systems        map[int]*UniverseSystem
+	StationNames   map[int]string
+
+	constellationsByName map[string]*UniverseConstellation
+	systemsByName        map[string]*UniverseSystem
+}
+
+// LoadUniverse imports the map tables from the SDE dump in dir
+func LoadUniverse(dir string) (*Universe, error) {
+	universe := &Universe{
+		Regions:              make(map[int]*UniverseRegion),
+		Constellations:       make(map[int]*UniverseConstellation),
+		Systems:              make(map[int]*UniverseSystem),
+		StationNames:         make(map[int]string),
+		constellationsByName: make(map[string]*UniverseConstellation),
+		systemsByName:        make(map[string]*UniverseSystem),
+	}
+
+	err := readSdeTable(dir, sdeRegionsFile, func(row sdeRow) error {
+		region := &UniverseRegion{
+			Id:   row.Int("regionID"),
+			Name: row.String("regionName"),
+		}
+		universe.Regions[region.Id] = region
+		return row.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = readSdeTable(dir, sdeConstellationsFile, func(row sdeRow) error {
+		constellation := &UniverseConstellation{
+			Id:       row.Int("constellationID"),
+			Name:     row.String("constellationName"),
+			RegionId: row.Int("regionID"),
+			Systems:  make([]int, 0),
+		}
+		universe.Constellations[constellation.Id] = constellation
+		universe.constellationsByName[strings.ToLower(constellation.Name)] = constellation
+		return row.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = readSdeTable(dir, sdeSystemsFile, func(row sdeRow) error {
+		system := &UniverseSystem{
+			Id:              row.Int("solarSystemID"),
+			Name:            row.String("solarSystemName"),
+			ConstellationId: row.Int("constellationID"),
+			RegionId:        row.Int("regionID"),
+			SecurityStatus:  row.Float("security"),
+			SecurityClass:   row.String("securityClass"),
+			Neighbours:      make([]int, 0),
+			Stations:        make([]int, 0),
+		}
+		universe.Systems[system.Id] = system
+		universe.systemsByName[strings.ToLower(system.Name)] = system
+
+		if constellation := universe.Constellations[system.ConstellationId]; constellation != nil {
+			constellation.Systems = append(constellation.Systems, system.Id)
+		}
+		return row.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = readSdeTable(dir, sdeJumpsFile, func(row sdeRow) error {
+		from := universe.Systems[row.Int("fromSolarSystemID")]
+		to := row.Int("toSolarSystemID")
+
+		// Every gate is listed in both directions, so we only need to add one side
+		if from != nil {
+			from.Neighbours = append(from.Neighbours, to)
+		}
+		return row.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Stations are nice to have, plenty of people only grab the map tables
+	err = readSdeTable(dir, sdeStationsFile, func(row sdeRow) error {
+		id := row.Int("stationID")
+		universe.StationNames[id] = row.String("stationName")
+
+		if system := universe.Systems[row.Int("solarSystemID")]; system != nil {
+			system.Stations = append(system.Stations, id)
+		}
+		return row.Err()
+	})
+
+	if err != nil {
+		Log.Warn("Skipping stations from the SDE", LogFields{"error": err})
+	}
+
+	Log.Info("Loaded the SDE", LogFields{"regions": len(universe.Regions), "constellations": len(universe.Constellations), "systems": len(universe.Systems)})
+
+	return universe, nil
+}
+
+func (universe *Universe) System(id int) *UniverseSystem {
+	if universe == nil {
+		return nil
+	}
+	return universe.Systems[id]
+}
+
+func (universe *Universe) Constellation(id int) *UniverseConstellation {
+	if universe == nil {
+		return nil
+	}
+	return universe.Constellations[id]
+}
+
+// SystemByName is case insensitive
+func (universe *Universe) SystemByName(name string) *UniverseSystem {
+	if universe == nil {
+		return nil
+	}
+	return universe.systemsByName[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// ConstellationByName is case insensitive
+func (universe *Universe) ConstellationByName(name string) *UniverseConstellation {
+	if universe == nil {
+		return nil
+	}
+	return universe.constellationsByName[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// Name resolves any region, constellation or system id the same way /universe/names would
+func (universe *Universe) Name(id int) *EsiName {
+	if universe == nil {
+		return nil
+	}
+
+	if system := universe.Systems[id]; system != nil {
+		return &EsiName{Category: "solar_system", Id: id, Name: system.Name}
+	}
+
+	if constellation := universe.Constellations[id]; constellation != nil {
+		return &EsiName{Category: "constellation", Id: id, Name: constellation.Name}
+	}
+
+	if region := universe.Regions[id]; region != nil {
+		return &EsiName{Category: "region", Id: id, Name: region.Name}
+	}
+
+	if station, ok := universe.StationNames[id]; ok {
+		return &EsiName{Category: "station", Id: id, Name: station}
+	}
+
+	return nil
+}
+
+// EsiSystem converts to the same shape we would get from ESI
+func (system *UniverseSystem) EsiSystem() *EsiSystem {
+	return &EsiSystem{
+		ConstellationId: system.ConstellationId,
+		Name:            system.Name,
+		SystemId:        system.Id,
+		SecurityStatus:  system.SecurityStatus,
+		SecurityClass:   system.SecurityClass,
+		Stations:        system.Stations,
+	}
+}
+
+// EsiConstellation converts to the same shape we would get from ESI, with the region name filled in
+func (universe *Universe) EsiConstellation(constellation *UniverseConstellation) *EsiConstellation {
+	esiConstellation := &EsiConstellation{
+		ConstellationId: constellation.Id,
+		Name:            constellation.Name,
+		RegionId:        constellation.RegionId,
+		Systems:         constellation.Systems,
+	}
+
+	if region := universe.Regions[constellation.RegionId]; region != nil {
+		esiConstellation.RegionName = region.Name
+	}
+
+	return esiConstellation
+}
+
+// sdeRow gives access to a csv record by column name. The first bad column is kept in err.
+type sdeRow struct {
+	columns map[string]int
+	record  []string
+	err     error
+}
+
+func (row *sdeRow) String(column string) string {
+	index, ok := row.columns[column]
+
+	if !ok || index >= len(row.record) {
+		if row.err == nil {
+			row.err = fmt.Errorf("missing column %v", column)
+		}
+		return ""
+	}
+
+	return row.record[index]
+}
+
+func (row *sdeRow) Int(column string) int {
+	value, err := strconv.Atoi(row.String(column))
+
+	if err != nil && row.err == nil {
+		row.err = fmt.Errorf("column %v: %v", column, err)
+	}
+
+	return value
+}
+
+func (row *sdeRow) Float(column string) float32 {
+	value, err := strconv.ParseFloat(row.String(column), 32)
+
+	if err != nil && row.err == nil {
+		row.err = fmt.Errorf("column %v: %v", column, err)
+	}
+
+	return float32(value)
+}
+
+func (row *sdeRow) Err() error {
+	return row.err
+}
+
+// openSdeFile opens name in dir, falling back to the bzip2'd version Fuzzwork serves by default
+func openSdeFile(dir, name string) (io.Reader, io.Closer, error) {
+	file, err := os.Open(filepath.Join(dir, name))
+
+	if err == nil {
+		return file, file, nil
+	}
+
+	file, err = os.Open(filepath.Join(dir, name+".bz2"))
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to open %v in %v", name, dir)
+	}
+
+	return bzip2.NewReader(file), file, nil
+}
+
+// readSdeTable calls handle for every row in the table, stopping at the first error
+func readSdeTable(dir, name string, handle func(row sdeRow) error) error {
+	reader, closer, err := openSdeFile(dir, name)
+
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	records := csv.NewReader(reader)
+
+	header, err := records.Read()
+
+	if err != nil {
+		return fmt.Errorf("unable to read header of %v: %v", name, err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, column := range header {
+		columns[column] = i
+	}
+
+	for line := 2; ; line++ {
+		record, err := records.Read()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v line %d: %v", name, line, err)
+		}
+
+		if err = handle(sdeRow{columns: columns, record: record}); err != nil {
+			return fmt.Errorf("%v line %d: %v", name, line, err)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sdeFixture = "testdata/sde"
+
+// copySdeFixture copies the fixture to a temporary directory with some tables replaced, empty contents removes one
+func copySdeFixture(t *testing.T, tables map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "sde")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(sdeFixture)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(filepath.Join(sdeFixture, file.Name()))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if replacement, ok := tables[file.Name()]; ok {
+			contents = []byte(replacement)
+		}
+
+		if len(contents) <= 0 {
+			continue
+		}
+
+		if err = ioutil.WriteFile(filepath.Join(dir, file.Name()), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadUniverse(t *testing.T) {
+	universe, err := LoadUniverse(sdeFixture)
+
+	if err != nil {
+		t.Fatalf("LoadUniverse failed: %v", err)
+	}
+
+	if len(universe.Regions) != 2 || len(universe.Constellations) != 2 || len(universe.Systems) != 3 {
+		t.Fatalf("loaded %d regions, %d constellations and %d systems, want 2, 2 and 3", len(universe.Regions), len(universe.Constellations), len(universe.Systems))
+	}
+
+	jita := universe.SystemByName(" jita ")
+
+	if jita == nil || jita.Id != 30000142 || jita.RegionId != 10000002 || jita.SecurityClass != "B" {
+		t.Fatalf("Jita = %+v", jita)
+	}
+
+	if jita.SecurityStatus < 0.945 || jita.SecurityStatus > 0.946 {
+		t.Errorf("Jita security = %v", jita.SecurityStatus)
+	}
+
+	if len(jita.Neighbours) != 1 || jita.Neighbours[0] != 30000144 {
+		t.Errorf("Jita neighbours = %v, want Perimeter", jita.Neighbours)
+	}
+
+	if len(jita.Stations) != 1 || universe.Name(jita.Stations[0]).Name != "Jita IV - Moon 4 - Caldari Navy Assembly Plant" {
+		t.Errorf("Jita stations = %v", jita.Stations)
+	}
+
+	if kimotoro := universe.ConstellationByName("Kimotoro"); kimotoro == nil || len(kimotoro.Systems) != 2 {
+		t.Errorf("Kimotoro = %+v, want Jita and Perimeter", kimotoro)
+	}
+
+	if constellation := universe.EsiConstellation(universe.Constellation(20000322)); constellation.RegionName != "Domain" {
+		t.Errorf("Throne Worlds is in %q, want Domain", constellation.RegionName)
+	}
+}
+
+func TestLoadUniverseWithoutStations(t *testing.T) {
+	dir, cleanup := copySdeFixture(t, map[string]string{sdeStationsFile: ""})
+	defer cleanup()
+
+	universe, err := LoadUniverse(dir)
+
+	if err != nil {
+		t.Fatalf("stations should be optional, got %v", err)
+	}
+
+	if len(universe.Systems) != 3 || len(universe.StationNames) != 0 {
+		t.Errorf("loaded %d systems and %d stations, want 3 and 0", len(universe.Systems), len(universe.StationNames))
+	}
+}
+
+func TestLoadUniverseRejectsBadTables(t *testing.T) {
+	tests := []struct {
+		name   string
+		tables map[string]string
+		want   string
+	}{
+		{
+			"missing table",
+			map[string]string{sdeSystemsFile: ""},
+			"unable to open mapSolarSystems.csv",
+		},
+		{
+			"missing column",
+			map[string]string{sdeRegionsFile: "regionID,x,y,z\n10000002,0,0,0\n"},
+			"mapRegions.csv line 2: missing column regionName",
+		},
+		{
+			"malformed number",
+			map[string]string{sdeConstellationsFile: "regionID,constellationID,constellationName\n10000002,20000020,Kimotoro\n10000043,twenty,Throne Worlds\n"},
+			"mapConstellations.csv line 3: column constellationID",
+		},
+		{
+			"short row",
+			map[string]string{sdeSystemsFile: "regionID,constellationID,solarSystemID,solarSystemName,security,securityClass\n10000002,20000020,30000142\n"},
+			"mapSolarSystems.csv line 2",
+		},
+	}
+
+	for _, test := range tests {
+		dir, cleanup := copySdeFixture(t, test.tables)
+		_, err := LoadUniverse(dir)
+		cleanup()
+
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%v: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
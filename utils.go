@@ -1,34 +1,42 @@
-package main
-
-import (
-	"time"
-)
-
-// Ints returns a unique subset of the int slice provided.
-func UniqueInts(input []int) []int {
-	u := make([]int, 0, len(input))
-	m := make(map[int]bool)
-
-	for _, val := range input {
-		if _, ok := m[val]; !ok {
-			m[val] = true
-			u = append(u, val)
-		}
-	}
-
-	return u
-}
-
-func Exists(array []string, toSearch string) bool {
-	for _, elem := range array {
-		if elem == toSearch {
-			return true
-		}
-	}
-
-	return false
-}
-
-func GetEpoch() int64 {
-	return time.Now().UTC().Unix()
-}
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Ints returns a unique subset of the int slice provided.
+func UniqueInts(input []int) []int {
+	u := make([]int, 0, len(input))
+	m := make(map[int]bool)
+
+	for _, val := range input {
+		if _, ok := m[val]; !ok {
+			m[val] = true
+			u = append(u, val)
+		}
+	}
+
+	return u
+}
+
+func Exists(array []string, toSearch string) bool {
+	for _, elem := range array {
+		if elem == toSearch {
+			return true
+		}
+	}
+
+	return false
+}
+
+func GetEpoch() int64 {
+	return time.Now().UTC().Unix()
+}
+
+// ParseMention turns <@123> or <@!123> into 123. Plain ids pass straight through.
+func ParseMention(mention string) string {
+	mention = strings.TrimPrefix(strings.TrimSpace(mention), "<@")
+	mention = strings.TrimPrefix(mention, "!")
+	return strings.TrimSuffix(mention, ">")
+}
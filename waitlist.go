@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const DefaultWaitlistTimeoutMinutes = 120
+
+// Ships that go on the logi or booster part of the waitlist, anything else is DPS
+var (
+	logiShips    = []string{"nestor", "guardian", "oneiros", "basilisk", "scimitar", "zarmazd", "loggerhead", "apostle", "minokawa", "lif", "ninazu"}
+	boosterShips = []string{"damnation", "vulture", "claymore", "eos", "bifrost", "pontifex", "stork", "magus", "orca", "porpoise"}
+)
+
+// Hulls with spaces in their names, so !x up can tell where the ship ends and the fit name starts
+var multiWordShips = []string{
+	"apocalypse navy issue", "armageddon navy issue", "dominix navy issue", "megathron navy issue",
+	"raven navy issue", "scorpion navy issue", "tempest fleet issue", "typhoon fleet issue",
+	"rokh navy issue", "maelstrom fleet issue", "hyperion navy issue", "abaddon navy issue",
+}
+
+// Separates the ship from the fit name when the ship isn't one we know
+const shipSeparator = "|"
+
+type WaitlistEntry struct {
+	UserId   string    `json:"user_id"`
+	Ship     string    `json:"ship"`
+	Fit      string    `json:"fit"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+	// Bumped every time they x up, the entry expires from here
+	LastActive time.Time `json:"last_active"`
+}
+
+// Waitlist is one per guild. Entries are in the order people x'd up.
+type Waitlist struct {
+	ChannelId string           `json:"channel_id"`
+	MessageId string           `json:"message_id"`
+	Entries   []*WaitlistEntry `json:"entries"`
+}
+
+// waitlistLock serializes every read-modify-write of waitlists
+var waitlistLock sync.Mutex
+
+func waitlistKey(guildId string) string {
+	return fmt.Sprintf("bot:%v:waitlist", guildId)
+}
+
+// RoleForShip picks the waitlist category from the hull name
+func RoleForShip(ship string) string {
+	ship = strings.ToLower(strings.TrimSpace(ship))
+
+	if Exists(logiShips, ship) {
+		return RoleLogi
+	}
+
+	if Exists(boosterShips, ship) {
+		return RoleBooster
+	}
+
+	return RoleDPS
+}
+
+func (server *Server) GetWaitlist(guildId string) *Waitlist {
+	waitlist := &Waitlist{
+		Entries: make([]*WaitlistEntry, 0),
+	}
+
+	cmd := server.Redis.Get(waitlistKey(guildId))
+
+	if cmd.Err() != nil {
+		return waitlist
+	}
+
+	if err := json.Unmarshal([]byte(cmd.Val()), waitlist); err != nil {
+		Log.Warn("Unable to parse waitlist", LogFields{"guild": guildId, "error": err})
+	}
+
+	return waitlist
+}
+
+func (server *Server) SaveWaitlist(guildId string, waitlist *Waitlist) error {
+	bytes, err := json.Marshal(waitlist)
+
+	if err != nil {
+		return err
+	}
+
+	return server.Redis.Set(waitlistKey(guildId), string(bytes), 0).Err()
+}
+
+// SplitShipAndFit takes the ship off the front of the !x up arguments. A | between them always wins, then the
+// longest known hull name the arguments start with, and otherwise the ship is the first word.
+func SplitShipAndFit(args []string, hulls []string) (string, string) {
+	text := strings.Join(args, " ")
+
+	if index := strings.Index(text, shipSeparator); index >= 0 {
+		return strings.TrimSpace(text[:index]), strings.TrimSpace(text[index+len(shipSeparator):])
+	}
+
+	if len(args) <= 0 {
+		return "", ""
+	}
+
+	words := 1
+
+	for _, hull := range hulls {
+		hullWords := strings.Fields(strings.ToLower(hull))
+
+		if len(hullWords) <= words || len(hullWords) > len(args) {
+			continue
+		}
+
+		if strings.ToLower(strings.Join(args[:len(hullWords)], " ")) == strings.Join(hullWords, " ") {
+			words = len(hullWords)
+		}
+	}
+
+	return strings.Join(args[:words], " "), strings.Join(args[words:], " ")
+}
+
+// knownShips is every hull name !x up should recognise for the guild, including the ones its doctrines fly
+func (server *Server) knownShips(guildId string) []string {
+	ships := append([]string(nil), multiWordShips...)
+
+	for _, fits := range server.GetDoctrineFits(guildId) {
+		for _, fit := range fits {
+			ships = append(ships, fit.Ship)
+		}
+	}
+
+	return ships
+}
+
+// Add puts the user at the back of the list, or updates their ship in place if they are already on it. Either way
+// they count as active again.
+func (waitlist *Waitlist) Add(userId, ship, fit string, now time.Time) *WaitlistEntry {
+	for _, entry := range waitlist.Entries {
+		if entry.UserId == userId {
+			entry.Ship = ship
+			entry.Fit = fit
+			entry.Role = RoleForShip(ship)
+			entry.LastActive = now
+			return entry
+		}
+	}
+
+	entry := &WaitlistEntry{
+		UserId:     userId,
+		Ship:       ship,
+		Fit:        fit,
+		Role:       RoleForShip(ship),
+		JoinedAt:   now,
+		LastActive: now,
+	}
+
+	waitlist.Entries = append(waitlist.Entries, entry)
+	return entry
+}
+
+// Remove takes the user off the list, returning their entry if they were on it
+func (waitlist *Waitlist) Remove(userId string) *WaitlistEntry {
+	for i, entry := range waitlist.Entries {
+		if entry.UserId == userId {
+			waitlist.Entries = append(waitlist.Entries[:i], waitlist.Entries[i+1:]...)
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// Position is where the user is overall and within their role, both starting at 1. Zero if they aren't on the list.
+func (waitlist *Waitlist) Position(userId string) (int, int) {
+	var role string
+
+	for _, entry := range waitlist.Entries {
+		if entry.UserId == userId {
+			role = entry.Role
+		}
+	}
+
+	overall, inRole := 0, 0
+
+	for _, entry := range waitlist.Entries {
+		overall++
+
+		if entry.Role == role {
+			inRole++
+		}
+
+		if entry.UserId == userId {
+			return overall, inRole
+		}
+	}
+
+	return 0, 0
+}
+
+// lastActive falls back to when they joined for entries saved before we tracked activity
+func (entry *WaitlistEntry) lastActive() time.Time {
+	if entry.LastActive.IsZero() {
+		return entry.JoinedAt
+	}
+	return entry.LastActive
+}
+
+// Expire drops everyone that hasn't x'd up for longer than timeout and returns them
+func (waitlist *Waitlist) Expire(now time.Time, timeout time.Duration) []*WaitlistEntry {
+	expired := make([]*WaitlistEntry, 0)
+	remaining := make([]*WaitlistEntry, 0, len(waitlist.Entries))
+
+	for _, entry := range waitlist.Entries {
+		if now.Sub(entry.lastActive()) > timeout {
+			expired = append(expired, entry)
+		} else {
+			remaining = append(remaining, entry)
+		}
+	}
+
+	waitlist.Entries = remaining
+	return expired
+}
+
+func (server *Server) GetWaitlistEmbed(waitlist *Waitlist) *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:       "Waitlist",
+		Description: fmt.Sprintf("%d waiting. X up with `!x up <ship> <fit name>`, leave with `!x down`", len(waitlist.Entries)),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339),
+		Color:       0x9b59b6,
+		Fields:      make([]*discordgo.MessageEmbedField, 0, len(pilotRoles)),
+	}
+
+	now := time.Now().UTC()
+
+	for _, role := range pilotRoles {
+		lines := make([]string, 0)
+
+		for _, entry := range waitlist.Entries {
+			if entry.Role != role {
+				continue
+			}
+
+			lines = append(lines, fmt.Sprintf("%d. %v - %v (%v) - %v", len(lines)+1, server.PilotName(entry.UserId), entry.Ship, entry.Fit, now.Sub(entry.JoinedAt).Truncate(time.Minute)))
+		}
+
+		value := "Nobody waiting"
+		if len(lines) > 0 {
+			value = strings.Join(lines, "\n")
+		}
+
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("%v (%d)", role, len(lines)),
+			Value: truncate(value, 1024),
+		})
+	}
+
+	return embed
+}
+
+// refreshWaitlistMessage edits the live waitlist message, posting a new one if it went missing
+func (server *Server) refreshWaitlistMessage(waitlist *Waitlist) {
+	if len(waitlist.ChannelId) <= 0 {
+		return
+	}
+
+	embed := server.GetWaitlistEmbed(waitlist)
+
+	if len(waitlist.MessageId) > 0 {
+		if _, err := server.Discord.ChannelMessageEditEmbed(waitlist.ChannelId, waitlist.MessageId, embed); err == nil {
+			return
+		}
+	}
+
+	posted, err := server.SendEmbed(waitlist.ChannelId, embed)
+
+	if err != nil {
+		return
+	}
+
+	waitlist.MessageId = posted.ID
+}
+
+// updateWaitlist loads, changes, saves and redraws the guild's waitlist while holding the lock
+func (server *Server) updateWaitlist(logger *Logger, guildId string, update func(waitlist *Waitlist) bool) {
+	waitlistLock.Lock()
+	defer waitlistLock.Unlock()
+
+	waitlist := server.GetWaitlist(guildId)
+
+	if !update(waitlist) {
+		return
+	}
+
+	server.refreshWaitlistMessage(waitlist)
+
+	if err := server.SaveWaitlist(guildId, waitlist); err != nil {
+		logger.Error("Unable to save waitlist", LogFields{"guild": guildId, "error": err})
+	}
+}
+
+// HandleXUp is !x up <ship> <fit name> and !x down
+func (server *Server) HandleXUp(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args := commandArgs(message)
+
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, "Waitlists only work from a server channel")
+		return
+	}
+
+	if len(args) >= 1 && strings.ToLower(args[0]) == "down" {
+		server.updateWaitlist(logger, guildId, func(waitlist *Waitlist) bool {
+			if waitlist.Remove(message.Author.ID) == nil {
+				server.SendMessage(message.ChannelID, "You aren't on the waitlist")
+				return false
+			}
+
+			server.SendMessage(message.ChannelID, fmt.Sprintf("%v left the waitlist", server.PilotName(message.Author.ID)))
+			return true
+		})
+		return
+	}
+
+	usage := "Usage: !x up <ship> <fit name> or !x down. Use !x up <ship> | <fit name> if the ship isn't recognised"
+
+	if len(args) < 3 || strings.ToLower(args[0]) != "up" {
+		server.SendMessage(message.ChannelID, usage)
+		return
+	}
+
+	ship, fit := SplitShipAndFit(args[1:], server.knownShips(guildId))
+
+	if len(ship) <= 0 || len(fit) <= 0 {
+		server.SendMessage(message.ChannelID, usage)
+		return
+	}
+
+	server.updateWaitlist(logger, guildId, func(waitlist *Waitlist) bool {
+		entry := waitlist.Add(message.Author.ID, ship, fit, time.Now().UTC())
+		overall, inRole := waitlist.Position(message.Author.ID)
+
+		server.SendMessage(message.ChannelID, fmt.Sprintf("%v is on the waitlist in a %v as %v. Position %d overall, %d for %v", server.PilotName(message.Author.ID), entry.Ship, entry.Role, overall, inRole, entry.Role))
+		return true
+	})
+}
+
+// HandleWaitlist shows the list, and lets FCs manage it with !waitlist invite|remove|clear|channel
+func (server *Server) HandleWaitlist(logger *Logger, session *discordgo.Session, message *discordgo.MessageCreate) {
+	args := commandArgs(message)
+	guildId, err := server.GetGuildIdForChannel(message.ChannelID)
+
+	if err != nil {
+		server.SendMessage(message.ChannelID, "Waitlists only work from a server channel")
+		return
+	}
+
+	if len(args) <= 0 {
+		server.SendEmbed(message.ChannelID, server.GetWaitlistEmbed(server.GetWaitlist(guildId)))
+		return
+	}
+
+	if !server.IsFleetCommander(guildId, message.Author.ID) {
+		server.SendMessage(message.ChannelID, "Only FCs and admins can manage the waitlist")
+		return
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "invite", "remove":
+		if len(args) < 2 {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Usage: !waitlist %v <@pilot>", args[0]))
+			return
+		}
+
+		userId := ParseMention(args[1])
+		invite := strings.ToLower(args[0]) == "invite"
+
+		var entry *WaitlistEntry
+
+		server.updateWaitlist(logger, guildId, func(waitlist *Waitlist) bool {
+			entry = waitlist.Remove(userId)
+			return entry != nil
+		})
+
+		// Sending can be slow, so it waits until the waitlist is unlocked
+		if entry == nil {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("%v isn't on the waitlist", server.PilotName(userId)))
+			return
+		}
+
+		if invite {
+			server.SendDirectMessage(&discordgo.User{ID: userId}, fmt.Sprintf("You've been invited to fleet in your %v by %v. Accept the invite in game!", entry.Ship, server.PilotName(message.Author.ID)))
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Invited %v (%v, %v)", server.PilotName(userId), entry.Ship, entry.Role))
+		} else {
+			server.SendMessage(message.ChannelID, fmt.Sprintf("Removed %v from the waitlist", server.PilotName(userId)))
+		}
+	case "clear":
+		server.updateWaitlist(logger, guildId, func(waitlist *Waitlist) bool {
+			waitlist.Entries = make([]*WaitlistEntry, 0)
+			server.SendMessage(message.ChannelID, "Waitlist cleared")
+			return true
+		})
+	case "channel":
+		// The live waitlist goes where the command was run
+		server.updateWaitlist(logger, guildId, func(waitlist *Waitlist) bool {
+			waitlist.ChannelId = message.ChannelID
+			waitlist.MessageId = ""
+			return true
+		})
+	default:
+		server.SendMessage(message.ChannelID, "Usage: !waitlist [invite <@pilot> | remove <@pilot> | clear | channel]")
+	}
+}
+
+// expireWaitlists drops pilots that have been waiting too long and tells them about it
+func (server *Server) expireWaitlists(logger *Logger) {
+	timeout := time.Minute * time.Duration(server.Config.WaitlistTimeoutMinutes)
+	now := time.Now().UTC()
+
+	for _, guildId := range server.Guilds.IDs() {
+		var expired []*WaitlistEntry
+
+		server.updateWaitlist(logger, guildId, func(waitlist *Waitlist) bool {
+			expired = waitlist.Expire(now, timeout)
+			return len(expired) > 0
+		})
+
+		// DMs can be slow, so they wait until the waitlist is unlocked
+		for _, entry := range expired {
+			server.SendDirectMessage(&discordgo.User{ID: entry.UserId}, fmt.Sprintf("You've been taken off the waitlist after %v without x'ing up. X up again if you're still around!", timeout))
+		}
+	}
+}
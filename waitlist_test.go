@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitShipAndFit(t *testing.T) {
+	hulls := append([]string{"Vindicator"}, multiWordShips...)
+
+	tests := []struct {
+		args []string
+		ship string
+		fit  string
+	}{
+		{strings.Fields("Vindicator shield dps"), "Vindicator", "shield dps"},
+		{strings.Fields("megathron navy issue armor dps"), "megathron navy issue", "armor dps"},
+		{strings.Fields("Megathron armor dps"), "Megathron", "armor dps"},
+		{strings.Fields("Some New Hull | t2 fit"), "Some New Hull", "t2 fit"},
+		{strings.Fields("Megathron Navy Issue"), "Megathron Navy Issue", ""},
+		{strings.Fields("Megathron Navy"), "Megathron", "Navy"},
+	}
+
+	for _, test := range tests {
+		ship, fit := SplitShipAndFit(test.args, hulls)
+
+		if ship != test.ship || fit != test.fit {
+			t.Errorf("SplitShipAndFit(%q) = %q, %q, want %q, %q", test.args, ship, fit, test.ship, test.fit)
+		}
+	}
+}
+
+func TestWaitlistExpiresOnInactivity(t *testing.T) {
+	joined := time.Date(2018, 6, 1, 18, 0, 0, 0, time.UTC)
+	timeout := time.Hour * 2
+
+	waitlist := &Waitlist{Entries: make([]*WaitlistEntry, 0)}
+	waitlist.Add("active", "Vindicator", "dps", joined)
+	waitlist.Add("idle", "Nestor", "logi", joined)
+
+	// X'ing up again keeps them on the list, and their place in it
+	waitlist.Add("active", "Vindicator", "dps", joined.Add(time.Hour*2))
+
+	expired := waitlist.Expire(joined.Add(time.Hour*3), timeout)
+
+	if len(expired) != 1 || expired[0].UserId != "idle" {
+		t.Fatalf("expired = %+v, want only idle", expired)
+	}
+
+	if overall, _ := waitlist.Position("active"); overall != 1 || !waitlist.Entries[0].JoinedAt.Equal(joined) {
+		t.Errorf("active pilot lost their place, position %d", overall)
+	}
+}
+
+func TestWaitlistExpiresOldEntriesFromJoinTime(t *testing.T) {
+	joined := time.Date(2018, 6, 1, 18, 0, 0, 0, time.UTC)
+
+	// Saved before last active was tracked
+	waitlist := &Waitlist{Entries: []*WaitlistEntry{{UserId: "old", JoinedAt: joined}}}
+
+	if expired := waitlist.Expire(joined.Add(time.Hour*3), time.Hour*2); len(expired) != 1 {
+		t.Errorf("expired = %+v, want the old entry", expired)
+	}
+}